@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// upstreamClient 所有上游请求（镜像仓库和认证服务）共用的客户端，复用连接。
+// main 读取配置后按 upstreamTimeout 重新创建
+var upstreamClient = newUpstreamClient(upstreamTimeout)
+
+// newUpstreamClient 创建上游客户端。timeout 限制建立连接和等待响应头的时间，
+// 不限制读取响应体，大的 blob 可以传输很久
+func newUpstreamClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+	transport.MaxIdleConnsPerHost = 16
+	transport.IdleConnTimeout = 90 * time.Second
+	return &http.Client{Transport: transport, CheckRedirect: checkRedirect}
+}
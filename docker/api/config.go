@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 限流参数，启动时由 loadConfig 从环境变量读取，没有设置时使用这里的默认值
+var (
+	requestLimit    = 5           // REQUEST_LIMIT，每个 IP 每秒的请求数，也是允许的突发请求数
+	blacklistTime   = time.Hour   // BLACKLIST_TIME，超出限制后拒绝该 IP 的时间
+	cleanupInterval = time.Minute // CLEANUP_INTERVAL，清理黑名单和空闲令牌桶的间隔
+	idleTimeout     = time.Minute // IDLE_TIMEOUT，IP 超过该时间没有请求时回收其令牌桶
+
+	// upstreamTimeout UPSTREAM_TIMEOUT，连接上游和等待响应头的超时时间
+	upstreamTimeout = 30 * time.Second
+
+	// shutdownTimeout SHUTDOWN_TIMEOUT，收到 SIGTERM 后等待进行中的请求结束的最长时间
+	shutdownTimeout = 30 * time.Second
+
+	// trustProxy 部署在反向代理后面时设置 TRUST_PROXY=true，按 X-Forwarded-For 或 X-Real-IP 中的客户端地址限流。
+	// 直接对外时不要开启，否则客户端可以伪造这些头绕过限流
+	trustProxy = false
+
+	// followRedirects FOLLOW_REDIRECTS=true 时，上游返回重定向（如 blob 重定向到 CDN）由代理跟随并转发内容，
+	// 客户端只需要能访问代理。默认把重定向原样返回给客户端，blob 内容不经过代理
+	followRedirects = false
+
+	// realmBase AUTH_REALM，返回给客户端的 token 服务地址，为空时根据请求的 Host 生成
+	realmBase = ""
+
+	// redisURL REDIS_URL，例如 redis://:password@redis:6379/0，设置后多个实例通过 Redis 共享计数和黑名单
+	redisURL = ""
+)
+
+// loadConfig 从环境变量读取限流参数并校验，无效时返回错误，成功时打印生效的配置
+func loadConfig() error {
+	var err error
+	if requestLimit, err = envInt("REQUEST_LIMIT", requestLimit); err != nil {
+		return err
+	}
+	if blacklistTime, err = envDuration("BLACKLIST_TIME", blacklistTime); err != nil {
+		return err
+	}
+	if cleanupInterval, err = envDuration("CLEANUP_INTERVAL", cleanupInterval); err != nil {
+		return err
+	}
+	if idleTimeout, err = envDuration("IDLE_TIMEOUT", idleTimeout); err != nil {
+		return err
+	}
+	if upstreamTimeout, err = envDuration("UPSTREAM_TIMEOUT", upstreamTimeout); err != nil {
+		return err
+	}
+	if shutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", shutdownTimeout); err != nil {
+		return err
+	}
+	if trustProxy, err = envBool("TRUST_PROXY", trustProxy); err != nil {
+		return err
+	}
+	if followRedirects, err = envBool("FOLLOW_REDIRECTS", followRedirects); err != nil {
+		return err
+	}
+	realmBase = os.Getenv("AUTH_REALM")
+	redisURL = os.Getenv("REDIS_URL")
+
+	if requestLimit < 1 {
+		return fmt.Errorf("REQUEST_LIMIT must be at least 1")
+	}
+	if blacklistTime < 0 {
+		return fmt.Errorf("BLACKLIST_TIME must not be negative")
+	}
+	if cleanupInterval <= 0 {
+		return fmt.Errorf("CLEANUP_INTERVAL must be positive")
+	}
+	if idleTimeout <= 0 {
+		return fmt.Errorf("IDLE_TIMEOUT must be positive")
+	}
+	if upstreamTimeout <= 0 {
+		return fmt.Errorf("UPSTREAM_TIMEOUT must be positive")
+	}
+	if shutdownTimeout < 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must not be negative")
+	}
+
+	storeName := "memory"
+	if redisURL != "" {
+		storeName = "redis"
+	}
+	log.Printf("Rate limit: %d requests/s per IP, blacklist %v, cleanup every %v, idle timeout %v, trust proxy %v, store %s",
+		requestLimit, blacklistTime, cleanupInterval, idleTimeout, trustProxy, storeName)
+	log.Printf("Upstream: timeout %v, follow redirects %v, shutdown timeout %v", upstreamTimeout, followRedirects, shutdownTimeout)
+	return nil
+}
+
+func envInt(key string, fallback int) (int, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return n, nil
+}
+
+func envDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return d, nil
+}
+
+func envBool(key string, fallback bool) (bool, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return b, nil
+}
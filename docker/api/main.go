@@ -1,40 +1,84 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"jiaoben-/docker/imageref"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 const (
-	hubHost         = "registry-1.docker.io"
-	authURL         = "auth.docker.io"
-	blacklistTime   = time.Hour
-	requestLimit    = 5
-	cleanupInterval = time.Minute
+	hubHost = "registry-1.docker.io"
+	authURL = "auth.docker.io"
 )
 
 var (
-	requestCounts sync.Map
-	blacklist     sync.Map
+	ipLimiters sync.Map // IP -> *ipLimiter
+	blacklist  sync.Map
 )
 
+// ipLimiter 单个 IP 的令牌桶和最近一次请求的时间。令牌以 requestLimit 每秒的速度匀速补充，
+// 不会像按整秒计数那样在两秒交界处放过两倍的请求
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen atomic.Int64
+}
+
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{limiter: rate.NewLimiter(rate.Limit(requestLimit), requestLimit)}
+}
+
 func main() {
-	go cleanupBlacklist() // 启动一个goroutine定期清理黑名单
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	store, err := newLimitStore(redisURL)
+	if err != nil {
+		log.Fatalf("Failed to create rate limit store: %v", err)
+	}
+	limits = store
+	upstreamClient = newUpstreamClient(upstreamTimeout)
+
+	// SIGTERM 时停止接受新请求，等待进行中的传输结束，后台清理也随之停止
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go cleanupBlacklist(ctx)  // 启动一个goroutine定期清理黑名单
+	go cleanupIPLimiters(ctx) // 定期回收空闲 IP 的令牌桶
 	http.HandleFunc("/", rateLimiter(handleRequest))
+
+	ln, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println("Listening on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := serveUntil(ctx, &http.Server{}, ln, shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func cleanupBlacklist() {
+func cleanupBlacklist(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
 	for {
-		time.Sleep(cleanupInterval)
-		now := time.Now()
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
 		blacklist.Range(func(key, value interface{}) bool {
 			if value.(time.Time).Before(now) {
 				blacklist.Delete(key)
@@ -44,49 +88,79 @@ func cleanupBlacklist() {
 	}
 }
 
-func rateLimiter(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ip := r.RemoteAddr
-
-		// 检查黑名单
-		if expireTime, exists := blacklist.Load(ip); exists {
-			if time.Now().Before(expireTime.(time.Time)) {
-				http.Error(w, "IP temporarily blacklisted", http.StatusForbidden)
-				return
-			} else {
-				blacklist.Delete(ip)
-			}
+func cleanupIPLimiters(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			reapIPLimiters(now)
 		}
+	}
+}
 
-		// 获取当前时间的秒级时间戳
-		now := time.Now().Unix()
-
-		// 从请求计数器中获取当前 IP 的请求次数
-		value, _ := requestCounts.LoadOrStore(ip, &sync.Map{})
-		userRequests := value.(*sync.Map)
+// reapIPLimiters 删除最近一次请求早于 now-idleTimeout 的 IP，空闲这么久后令牌桶已经是满的
+func reapIPLimiters(now time.Time) {
+	deadline := now.Add(-idleTimeout).Unix()
+	ipLimiters.Range(func(key, value interface{}) bool {
+		if value.(*ipLimiter).lastSeen.Load() < deadline {
+			ipLimiters.Delete(key)
+		}
+		return true
+	})
+}
 
-		// 获取当前时间戳的请求次数
-		count, _ := userRequests.LoadOrStore(now, new(int))
-		currentCount := count.(*int)
+// clientIP 返回请求的客户端 IP，去掉端口，同一个客户端的不同连接使用同一个令牌桶
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		// 最后一项由最近的代理添加，前面的可能是客户端自己写的
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := net.ParseIP(strings.TrimSpace(parts[len(parts)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
-		// 增加当前时间戳的请求次数
-		*currentCount++
+func rateLimiter(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
 
+		// 限流存储不可用时记录错误并放行，不因此拒绝所有请求
+		ctx := r.Context()
 
-		// 超过阈值时将 IP 加入黑名单
-		if *currentCount > requestLimit {
-			blacklist.Store(ip, time.Now().Add(blacklistTime))
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		// 检查黑名单
+		if blocked, err := limits.Blacklisted(ctx, ip); err != nil {
+			log.Printf("Failed to check blacklist for %s: %v", ip, err)
+		} else if blocked {
+			http.Error(w, "IP temporarily blacklisted", http.StatusForbidden)
 			return
 		}
 
-		// 清理过期的请求计数
-		userRequests.Range(func(key, value interface{}) bool {
-			if key.(int64) < now {
-				userRequests.Delete(key)
+		// 超出限制时将 IP 加入黑名单
+		allowed, err := limits.Allow(ctx, ip)
+		if err != nil {
+			log.Printf("Failed to count request for %s: %v", ip, err)
+			allowed = true
+		}
+		if !allowed {
+			if err := limits.Blacklist(ctx, ip, blacklistTime); err != nil {
+				log.Printf("Failed to blacklist %s: %v", ip, err)
 			}
-			return true
-		})
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
 
 		next(w, r)
 	}
@@ -109,18 +183,35 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 修改请求目标到 Docker Hub
-	proxyURL := &url.URL{
+	proxyRequest(w, r, registryURL(r))
+}
+
+// registryURL 返回 Docker Hub 上的目标地址，nginx 与 library/nginx 指向同一个仓库
+func registryURL(r *http.Request) *url.URL {
+	return &url.URL{
 		Scheme: "https",
 		Host:   hubHost,
-		Path:   r.URL.Path,
+		Path:   imageref.NormalizeV2Path(r.URL.Path),
 	}
-	proxyRequest(w, r, proxyURL)
 }
 
 func handleTokenRequest(w http.ResponseWriter, r *http.Request) {
 	// 构造向认证服务器的请求
-	tokenURL := fmt.Sprintf("https://%s%s", authURL, r.URL.RequestURI())
-	proxyRequest(w, r, mustParseURL(tokenURL))
+	proxyRequest(w, r, tokenURL(r))
+}
+
+// tokenURL 返回认证服务器上的目标地址，scope 中的仓库名与镜像路径使用相同的规范化
+func tokenURL(r *http.Request) *url.URL {
+	query := r.URL.Query()
+	for i, scope := range query["scope"] {
+		query["scope"][i] = imageref.NormalizeScope(scope)
+	}
+	return &url.URL{
+		Scheme:   "https",
+		Host:     authURL,
+		Path:     r.URL.Path,
+		RawQuery: query.Encode(),
+	}
 }
 
 func handlePreflight(w http.ResponseWriter, r *http.Request) {
@@ -140,22 +231,29 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, proxyURL *url.URL) {
 	proxyReq.Header = r.Header
 
 	// 发起请求
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
+	resp, err := upstreamClient.Do(proxyReq)
 	if err != nil {
 		http.Error(w, "Failed to fetch response", http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
-	// 复制响应头和状态码
+	// 复制响应头和状态码，认证地址改为本代理
 	for name, values := range resp.Header {
 		for _, value := range values {
+			if name == "Www-Authenticate" {
+				value = rewriteAuthenticate(value, r)
+			}
 			w.Header().Add(name, value)
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
 
+	// HEAD 只返回响应头，客户端根据 Content-Length 和 Docker-Content-Digest 判断 blob 是否存在
+	if r.Method == http.MethodHead {
+		return
+	}
+
 	// 复制响应体
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
@@ -163,6 +261,19 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, proxyURL *url.URL) {
 	}
 }
 
+// checkRedirect 跟随重定向时不把 Docker Hub 的认证头发给存储服务（它会拒绝带 Authorization 的请求），
+// 不跟随时返回重定向本身
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if !followRedirects {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	req.Header.Del("Authorization")
+	return nil
+}
+
 func mustParseURL(rawurl string) *url.URL {
 	parsedURL, err := url.Parse(rawurl)
 	if err != nil {
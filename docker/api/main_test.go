@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReapIPLimiters 测试空闲 IP 的令牌桶被回收，活跃 IP 的令牌桶保留
+func TestReapIPLimiters(t *testing.T) {
+	handler := rateLimiter(func(w http.ResponseWriter, r *http.Request) {})
+	for _, ip := range []string{"10.0.0.1:1234", "10.0.0.2:1234"} {
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.RemoteAddr = ip
+		handler(httptest.NewRecorder(), req)
+	}
+	defer ipLimiters.Clear()
+
+	// 10.0.0.1 已经空闲超过 idleTimeout
+	value, ok := ipLimiters.Load("10.0.0.1")
+	assert.True(t, ok)
+	value.(*ipLimiter).lastSeen.Store(time.Now().Add(-2 * idleTimeout).Unix())
+
+	reapIPLimiters(time.Now())
+
+	_, ok = ipLimiters.Load("10.0.0.1")
+	assert.False(t, ok)
+	_, ok = ipLimiters.Load("10.0.0.2")
+	assert.True(t, ok)
+}
+
+// TestRateLimiterTokenBucket 测试令牌匀速补充：用完突发额度后，等待一个令牌的时间只能再请求一次，超出时加入黑名单
+func TestRateLimiterTokenBucket(t *testing.T) {
+	defer ipLimiters.Clear()
+	defer blacklist.Clear()
+
+	handler := rateLimiter(func(w http.ResponseWriter, r *http.Request) {})
+	request := func() int {
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.RemoteAddr = "10.0.0.3:1234"
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < requestLimit; i++ {
+		assert.Equal(t, http.StatusOK, request())
+	}
+	time.Sleep(time.Second / time.Duration(requestLimit))
+	assert.Equal(t, http.StatusOK, request())
+	assert.Equal(t, http.StatusTooManyRequests, request())
+	assert.Equal(t, http.StatusForbidden, request())
+}
+
+// TestClientIP 测试限流使用的客户端地址去掉端口，只有信任代理时才使用转发头
+func TestClientIP(t *testing.T) {
+	defer func() { trustProxy = false }()
+	cases := []struct {
+		trust      bool
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{false, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{false, "[2001:db8::1]:443", nil, "2001:db8::1"},
+		{false, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "10.0.0.1"},
+		{true, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{true, "10.0.0.1:1234", map[string]string{"X-Real-IP": "2001:db8::2"}, "2001:db8::2"},
+		{true, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "garbage"}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		trustProxy = c.trust
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.RemoteAddr = c.remoteAddr
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		assert.Equal(t, c.want, clientIP(req), c.remoteAddr)
+	}
+}
+
+// TestRateLimiterIgnoresPort 测试同一客户端的不同连接共享令牌桶
+func TestRateLimiterIgnoresPort(t *testing.T) {
+	defer ipLimiters.Clear()
+	defer blacklist.Clear()
+
+	handler := rateLimiter(func(w http.ResponseWriter, r *http.Request) {})
+	var codes []int
+	for port := 1000; port <= 1000+requestLimit; port++ {
+		req := httptest.NewRequest("GET", "/v2/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.4:%d", port)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, codes[len(codes)-1])
+}
+
+// TestLoadConfig 测试从环境变量读取限流参数，无效的值在启动时报错
+func TestLoadConfig(t *testing.T) {
+	defer func(limit int, blacklist, cleanup, idle time.Duration) {
+		requestLimit, blacklistTime, cleanupInterval, idleTimeout, trustProxy = limit, blacklist, cleanup, idle, false
+	}(requestLimit, blacklistTime, cleanupInterval, idleTimeout)
+
+	t.Setenv("REQUEST_LIMIT", "20")
+	t.Setenv("BLACKLIST_TIME", "5m")
+	t.Setenv("TRUST_PROXY", "true")
+	assert.NoError(t, loadConfig())
+	assert.Equal(t, 20, requestLimit)
+	assert.Equal(t, 5*time.Minute, blacklistTime)
+	assert.Equal(t, time.Minute, cleanupInterval)
+	assert.True(t, trustProxy)
+
+	for key, value := range map[string]string{
+		"REQUEST_LIMIT":    "0",
+		"BLACKLIST_TIME":   "an hour",
+		"CLEANUP_INTERVAL": "0s",
+		"TRUST_PROXY":      "yes please",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			assert.Error(t, loadConfig())
+		})
+	}
+}
+
+// TestRedisStore 测试 Redis 存储的计数和黑名单在多个实例之间共享
+func TestRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	a, err := newLimitStore("redis://" + server.Addr())
+	assert.NoError(t, err)
+	b, err := newLimitStore("redis://" + server.Addr())
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// 两个实例合计不超过 requestLimit
+	for i := 0; i < requestLimit; i++ {
+		store := a
+		if i%2 == 1 {
+			store = b
+		}
+		allowed, err := store.Allow(ctx, "10.0.0.5")
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, err := b.Allow(ctx, "10.0.0.5")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+
+	assert.NoError(t, a.Blacklist(ctx, "10.0.0.5", time.Minute))
+	blocked, err := b.Blacklisted(ctx, "10.0.0.5")
+	assert.NoError(t, err)
+	assert.True(t, blocked)
+
+	server.FastForward(2 * time.Minute)
+	blocked, err = b.Blacklisted(ctx, "10.0.0.5")
+	assert.NoError(t, err)
+	assert.False(t, blocked)
+
+	_, err = newLimitStore("://bad")
+	assert.Error(t, err)
+}
+
+// TestRewriteAuthenticate 测试上游返回的 realm 指向本代理的 /token，service 和 scope 保持不变
+func TestRewriteAuthenticate(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/library/nginx/manifests/latest" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+
+	proxy := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://mirror.example.com"+path, nil)
+		target, _ := url.Parse(upstream.URL + path)
+		rec := httptest.NewRecorder()
+		proxyRequest(rec, req, target)
+		return rec
+	}
+
+	rec := proxy("/v2/library/nginx/manifests/latest")
+	assert.Equal(t, `Bearer realm="http://mirror.example.com/token",service="registry.docker.io",scope="repository:library/nginx:pull"`,
+		rec.Header().Get("Www-Authenticate"))
+
+	// 没有 Www-Authenticate 时不添加
+	rec = proxy("/v2/")
+	assert.Empty(t, rec.Header().Values("Www-Authenticate"))
+
+	realmBase = "https://hub.example.com/"
+	defer func() { realmBase = "" }()
+	rec = proxy("/v2/library/nginx/manifests/latest")
+	assert.Contains(t, rec.Header().Get("Www-Authenticate"), `realm="https://hub.example.com/token"`)
+}
+
+// TestFollowRedirects 测试默认返回重定向；开启后代理跟随 blob 重定向并转发内容，不把认证头发给存储服务
+func TestFollowRedirects(t *testing.T) {
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			http.Error(w, "unexpected Authorization", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("blob"))
+	}))
+	defer storage.Close()
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, storage.URL+"/blob", http.StatusTemporaryRedirect)
+	}))
+	defer registry.Close()
+
+	proxy := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v2/library/nginx/blobs/sha256:abc", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		target, _ := url.Parse(registry.URL + req.URL.Path)
+		rec := httptest.NewRecorder()
+		proxyRequest(rec, req, target)
+		return rec
+	}
+
+	rec := proxy()
+	assert.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	assert.Equal(t, storage.URL+"/blob", rec.Header().Get("Location"))
+
+	followRedirects = true
+	defer func() { followRedirects = false }()
+	rec = proxy()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "blob", rec.Body.String())
+}
+
+// TestUpstreamTimeout 测试上游迟迟不返回响应头时请求超时，不会一直占用连接
+func TestUpstreamTimeout(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	defer func(c *http.Client) { upstreamClient = c }(upstreamClient)
+	upstreamClient = newUpstreamClient(100 * time.Millisecond)
+
+	req := httptest.NewRequest("GET", "/token", nil)
+	target, _ := url.Parse(upstream.URL + "/token")
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	proxyRequest(rec, req, target)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// TestProxyHead 测试 HEAD 请求只转发响应头，保留 Content-Length 和 Docker-Content-Digest
+func TestProxyHead(t *testing.T) {
+	var methods []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Content-Length", "1234")
+		w.Header().Set("Docker-Content-Digest", "sha256:abc")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, _ := url.Parse(upstream.URL + r.URL.Path)
+		proxyRequest(w, r, target)
+	}))
+	defer proxy.Close()
+
+	resp, err := http.Head(proxy.URL + "/v2/library/nginx/blobs/sha256:abc")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(1234), resp.ContentLength)
+	assert.Equal(t, "sha256:abc", resp.Header.Get("Docker-Content-Digest"))
+	assert.Equal(t, []string{http.MethodHead}, methods)
+}
+
+// TestOfficialImageShorthand 测试 nginx 与 library/nginx 转发到相同的上游地址
+func TestOfficialImageShorthand(t *testing.T) {
+	for _, pair := range [][2]string{
+		{"/v2/nginx/manifests/latest", "/v2/library/nginx/manifests/latest"},
+		{"/v2/nginx/blobs/sha256:abc", "/v2/library/nginx/blobs/sha256:abc"},
+		{"/v2/nginx/tags/list", "/v2/library/nginx/tags/list"},
+	} {
+		short := registryURL(httptest.NewRequest("GET", pair[0], nil))
+		full := registryURL(httptest.NewRequest("GET", pair[1], nil))
+		assert.Equal(t, full.String(), short.String())
+		assert.Equal(t, pair[1], short.Path)
+	}
+
+	// 带命名空间的仓库和 /v2/ 探测请求保持不变
+	assert.Equal(t, "/v2/team/app/manifests/v1", registryURL(httptest.NewRequest("GET", "/v2/team/app/manifests/v1", nil)).Path)
+	assert.Equal(t, "/v2/", registryURL(httptest.NewRequest("GET", "/v2/", nil)).Path)
+
+	short := tokenURL(httptest.NewRequest("GET", "/token?service=registry.docker.io&scope=repository:nginx:pull", nil))
+	full := tokenURL(httptest.NewRequest("GET", "/token?service=registry.docker.io&scope=repository:library/nginx:pull", nil))
+	assert.Equal(t, full.String(), short.String())
+	assert.Equal(t, "repository:library/nginx:pull", short.Query().Get("scope"))
+}
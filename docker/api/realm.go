@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// realmPattern 匹配 Www-Authenticate 中的 realm 参数
+var realmPattern = regexp.MustCompile(`realm="[^"]*"`)
+
+// authRealm 返回本代理的 /token 地址。配置了 AUTH_REALM（如 https://mirror.example.com）时使用该地址，
+// 否则根据请求的 Host 生成
+func authRealm(r *http.Request) string {
+	base := strings.TrimSuffix(realmBase, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); trustProxy && (proto == "http" || proto == "https") {
+			scheme = proto
+		}
+		base = scheme + "://" + r.Host
+	}
+	if strings.HasSuffix(base, "/token") {
+		return base
+	}
+	return base + "/token"
+}
+
+// rewriteAuthenticate 将 Docker Hub 返回的 realm（https://auth.docker.io/token）改为本代理的 /token，
+// 客户端获取 token 时也经过代理。service、scope 等其他参数保持不变
+func rewriteAuthenticate(value string, r *http.Request) string {
+	realm := `realm="` + authRealm(r) + `"`
+	return realmPattern.ReplaceAllLiteralString(value, realm)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// limitStore 保存请求计数和黑名单。默认保存在进程内；多个实例部署在负载均衡后面时
+// 使用 Redis 共享，否则每个客户端实际能得到实例数倍的限额，黑名单也只对单个实例生效
+type limitStore interface {
+	// Allow 为 ip 记一次请求，超出 requestLimit 时返回 false
+	Allow(ctx context.Context, ip string) (bool, error)
+	// Blacklisted 返回 ip 是否在黑名单中
+	Blacklisted(ctx context.Context, ip string) (bool, error)
+	// Blacklist 将 ip 加入黑名单，d 时间后自动移除
+	Blacklist(ctx context.Context, ip string, d time.Duration) error
+}
+
+// limits 当前使用的限流存储，main 中根据 REDIS_URL 选择
+var limits limitStore = memoryStore{}
+
+// newLimitStore redisURL 为空时使用进程内存储，否则连接 Redis
+func newLimitStore(redisURL string) (limitStore, error) {
+	if redisURL == "" {
+		return memoryStore{}, nil
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	return &redisStore{client: client, prefix: "docker-api:"}, nil
+}
+
+// memoryStore 进程内的令牌桶和黑名单，保存在 ipLimiters 和 blacklist 中
+type memoryStore struct{}
+
+func (memoryStore) Allow(ctx context.Context, ip string) (bool, error) {
+	value, _ := ipLimiters.LoadOrStore(ip, newIPLimiter())
+	l := value.(*ipLimiter)
+	l.lastSeen.Store(time.Now().Unix())
+	return l.limiter.Allow(), nil
+}
+
+func (memoryStore) Blacklisted(ctx context.Context, ip string) (bool, error) {
+	expireTime, exists := blacklist.Load(ip)
+	if !exists {
+		return false, nil
+	}
+	if time.Now().Before(expireTime.(time.Time)) {
+		return true, nil
+	}
+	blacklist.Delete(ip)
+	return false, nil
+}
+
+func (memoryStore) Blacklist(ctx context.Context, ip string, d time.Duration) error {
+	blacklist.Store(ip, time.Now().Add(d))
+	return nil
+}
+
+// redisStore 在 Redis 中计数。每个 IP 每秒一个计数键（INCR 并设置过期时间），
+// 按滑动窗口估算最近一秒的请求数：上一秒的计数按窗口中剩余的比例计入，
+// 避免整秒计数在两秒交界处放过两倍的请求。黑名单每个 IP 一个键，过期时间即拉黑时长
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func (s *redisStore) Allow(ctx context.Context, ip string) (bool, error) {
+	now := time.Now()
+	sec := now.Unix()
+	current := s.prefix + "count:" + ip + ":" + strconv.FormatInt(sec, 10)
+	previous := s.prefix + "count:" + ip + ":" + strconv.FormatInt(sec-1, 10)
+
+	pipe := s.client.TxPipeline()
+	incr := pipe.Incr(ctx, current)
+	pipe.Expire(ctx, current, 2*time.Second)
+	prev := pipe.Get(ctx, previous)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, err
+	}
+
+	prevCount, err := prev.Int64()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	elapsed := float64(now.Sub(time.Unix(sec, 0))) / float64(time.Second)
+	estimated := float64(prevCount)*(1-elapsed) + float64(incr.Val())
+	return estimated <= float64(requestLimit), nil
+}
+
+func (s *redisStore) Blacklisted(ctx context.Context, ip string) (bool, error) {
+	n, err := s.client.Exists(ctx, s.prefix+"blacklist:"+ip).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *redisStore) Blacklist(ctx context.Context, ip string, d time.Duration) error {
+	if d <= 0 {
+		return nil // 过期时间为 0 时 Redis 不会删除键
+	}
+	return s.client.Set(ctx, s.prefix+"blacklist:"+ip, 1, d).Err()
+}
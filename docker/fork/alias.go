@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"jiaoben-/docker/imageref"
+	"os"
+	"sort"
+	"strings"
+)
+
+// aliasRule 一条以 * 结尾的前缀规则
+type aliasRule struct {
+	prefix string
+	target string
+}
+
+// aliasMap 拉取镜像前把镜像名映射到镜像源，缓存文件仍使用请求的名称。
+// 配置文件（ALIAS_FILE）是一个 JSON 对象，键为请求的镜像名，值为实际拉取的镜像名，例如：
+//
+//	{"nginx": "registry.internal/library/nginx", "library/*": "registry.internal/library/*"}
+//
+// 不带 * 的键精确匹配，按 imageref.Normalize 规范化；以 * 结尾的键匹配前缀，
+// 剩余部分替换值中的 *，值中没有 * 时直接追加。精确匹配优先，其次是最长的前缀
+type aliasMap struct {
+	exact    map[string]string
+	prefixes []aliasRule // 按前缀长度降序
+}
+
+// imageAliases 当前生效的映射，为 nil 时不做映射
+var imageAliases *aliasMap
+
+// loadAliases 读取映射配置文件，path 为空时返回 nil
+func loadAliases(path string) (*aliasMap, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alias file: %v", err)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse alias file %s: %v", path, err)
+	}
+	return newAliasMap(raw)
+}
+
+func newAliasMap(raw map[string]string) (*aliasMap, error) {
+	m := &aliasMap{exact: make(map[string]string)}
+	for name, target := range raw {
+		if name == "" || target == "" {
+			return nil, fmt.Errorf("invalid alias %q -> %q", name, target)
+		}
+		prefix, wildcard := strings.CutSuffix(name, "*")
+		if strings.Contains(prefix, "*") {
+			return nil, fmt.Errorf("invalid alias %q: * is only allowed at the end", name)
+		}
+		if wildcard {
+			m.prefixes = append(m.prefixes, aliasRule{prefix: prefix, target: target})
+		} else {
+			m.exact[imageref.Normalize(name)] = target
+		}
+	}
+	sort.Slice(m.prefixes, func(i, j int) bool {
+		return len(m.prefixes[i].prefix) > len(m.prefixes[j].prefix)
+	})
+	return m, nil
+}
+
+// resolve 返回 name 映射后的镜像名，没有匹配的规则时原样返回
+func (m *aliasMap) resolve(name string) string {
+	if m == nil {
+		return name
+	}
+	if target, ok := m.exact[name]; ok {
+		return target
+	}
+	for _, rule := range m.prefixes {
+		if rest, ok := strings.CutPrefix(name, rule.prefix); ok {
+			if strings.Contains(rule.target, "*") {
+				return strings.Replace(rule.target, "*", rest, 1)
+			}
+			return rule.target + rest
+		}
+	}
+	return name
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dockerHubAuthKey docker 配置文件中 Docker Hub 凭据使用的键
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// registryAuth docker 配置文件 auths 中的一项，auth 为 base64 编码的 username:password
+type registryAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// dockerConfig docker 配置文件（config.json）中与认证有关的部分
+type dockerConfig struct {
+	Auths map[string]registryAuth `json:"auths"`
+}
+
+// registryConfigDir 拉取私有仓库时传给 docker --config 的目录，为空时使用 docker 默认配置
+var registryConfigDir string
+
+// setupRegistryAuth 根据环境变量生成拉取时使用的 docker 配置目录，没有配置凭据时返回空字符串。
+//
+// REGISTRY_AUTH_FILE 指向 docker login 生成的 config.json（可以挂载进来），auths 的键是仓库地址，
+// 每个凭据只用于拉取该仓库的镜像，例如 {"auths": {"registry.example.com": {"auth": "dXNlcjpwYXNz"}}}，
+// 也可以写 username、password。REGISTRY_USERNAME 和 REGISTRY_PASSWORD（密码或访问令牌）
+// 额外添加一个仓库的凭据，仓库由 REGISTRY_HOST 指定，默认为 Docker Hub。
+// 不支持 credsStore 等凭据助手，需要在文件中直接写入凭据
+func setupRegistryAuth() (string, error) {
+	auths, err := loadRegistryAuths(
+		getEnv("REGISTRY_AUTH_FILE", ""),
+		getEnv("REGISTRY_HOST", "docker.io"),
+		getEnv("REGISTRY_USERNAME", ""),
+		getEnv("REGISTRY_PASSWORD", ""),
+	)
+	if err != nil || len(auths) == 0 {
+		return "", err
+	}
+	return writeRegistryConfig(auths)
+}
+
+// loadRegistryAuths 合并配置文件和环境变量中的凭据，同一个仓库以环境变量为准
+func loadRegistryAuths(file, host, username, password string) (map[string]registryAuth, error) {
+	auths := make(map[string]registryAuth)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read registry auth file: %v", err)
+		}
+		var cfg dockerConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse registry auth file %s: %v", file, err)
+		}
+		for registry, auth := range cfg.Auths {
+			if auth.Auth == "" && auth.Username != "" {
+				auth = registryAuth{Auth: encodeAuth(auth.Username, auth.Password), IdentityToken: auth.IdentityToken}
+			}
+			auths[registryAuthKey(registry)] = auth
+		}
+	}
+	if username != "" || password != "" {
+		if username == "" || password == "" {
+			return nil, fmt.Errorf("both REGISTRY_USERNAME and REGISTRY_PASSWORD are required")
+		}
+		auths[registryAuthKey(host)] = registryAuth{Auth: encodeAuth(username, password)}
+	}
+	return auths, nil
+}
+
+// registryAuthKey 把 Docker Hub 的各种写法统一为 docker 使用的键，其他仓库原样返回
+func registryAuthKey(registry string) string {
+	switch registry {
+	case "docker.io", "index.docker.io", "registry-1.docker.io", "https://index.docker.io/v1":
+		return dockerHubAuthKey
+	}
+	return registry
+}
+
+func encodeAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// writeRegistryConfig 把凭据写入新建的临时目录中的 config.json，只有当前用户可读
+func writeRegistryConfig(auths map[string]registryAuth) (string, error) {
+	dir, err := os.MkdirTemp("", "fork-docker-config-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create docker config dir: %v", err)
+	}
+	data, err := json.MarshalIndent(dockerConfig{Auths: auths}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write docker config: %v", err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// codec 冷文件使用的压缩格式，通过扩展名区分，解压时按扩展名选择
+type codec struct {
+	name      string
+	ext       string
+	maxLevel  int                                                  // 压缩级别的上限，1 最快
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error) // level 为 0 时使用默认级别
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = []codec{
+	{
+		name:     "lz4",
+		ext:      ".lz4",
+		maxLevel: 9,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			writer := lz4.NewWriter(w)
+			if level > 0 {
+				// lz4 的级别常量不连续（Level1 为 1<<9），按表对应
+				lz4Level := [...]lz4.CompressionLevel{
+					lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5,
+					lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+				}[level-1]
+				if err := writer.Apply(lz4.CompressionLevelOption(lz4Level)); err != nil {
+					return nil, err
+				}
+			}
+			return writer, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(lz4.NewReader(r)), nil
+		},
+	},
+	{
+		name:     "zstd",
+		ext:      ".zst",
+		maxLevel: 22,
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			encoderLevel := zstd.SpeedDefault
+			if level > 0 {
+				encoderLevel = zstd.EncoderLevelFromZstd(level)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		},
+	},
+}
+
+// compressionCodec 压缩冷文件使用的格式，COMPRESSION_CODEC 配置，lz4（默认）或 zstd。
+// 已有的压缩文件按扩展名解压，修改配置不影响读取
+var compressionCodec = codecs[0]
+
+// compressionLevel 压缩级别，COMPRESSION_LEVEL 配置，lz4 为 1-9，zstd 为 1-22（与 zstd 命令行一致），
+// 0 表示默认级别。只对 compressionCodec 生效，用其他格式压缩时使用默认级别
+var compressionLevel int
+
+// parseCompressionLevel 解析 COMPRESSION_LEVEL，为空或超出 c 支持的范围时返回 0（默认级别）
+func parseCompressionLevel(value string, c codec) int {
+	if value == "" {
+		return 0
+	}
+	level, err := strconv.Atoi(value)
+	if err != nil || level < 1 || level > c.maxLevel {
+		fmt.Printf("Invalid COMPRESSION_LEVEL %q for %s (1-%d), using the default level\n", value, c.name, c.maxLevel)
+		return 0
+	}
+	return level
+}
+
+// levelFor 返回用 c 压缩时的级别
+func levelFor(c codec) int {
+	if c.name != compressionCodec.name {
+		return 0
+	}
+	return compressionLevel
+}
+
+// codecByName 返回名称对应的压缩格式
+func codecByName(name string) (codec, error) {
+	for _, c := range codecs {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return codec{}, fmt.Errorf("unknown compression codec %q", name)
+}
+
+// codecForPath 根据扩展名返回压缩文件的格式
+func codecForPath(path string) (codec, error) {
+	ext := filepath.Ext(path)
+	for _, c := range codecs {
+		if c.ext == ext {
+			return c, nil
+		}
+	}
+	return codec{}, fmt.Errorf("unknown compressed file extension %q", ext)
+}
+
+// trimCodecExt 去掉文件名末尾的压缩扩展名
+func trimCodecExt(fileName string) string {
+	for _, c := range codecs {
+		if trimmed, ok := strings.CutSuffix(fileName, c.ext); ok {
+			return trimmed
+		}
+	}
+	return fileName
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// lifecycleConfig 冷文件压缩和清理的配置
+type lifecycleConfig struct {
+	ColdThreshold    time.Duration
+	CleanUpThreshold time.Duration
+	CheckInterval    time.Duration
+}
+
+// configJSON /config 接口的请求和响应格式，时长使用 time.ParseDuration 的格式，如 "36h"
+type configJSON struct {
+	ColdThreshold    *string `json:"cold_threshold,omitempty"`
+	CleanUpThreshold *string `json:"cleanup_threshold,omitempty"`
+	CheckInterval    *string `json:"check_interval,omitempty"`
+}
+
+// adminToken 访问 /config 所需的 Bearer token，为空时禁用该接口
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+func currentConfig() lifecycleConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return lifecycleConfig{
+		ColdThreshold:    coldThreshold,
+		CleanUpThreshold: cleanUpThreshold,
+		CheckInterval:    checkInterval,
+	}
+}
+
+// requireAdmin 校验 Authorization: Bearer <ADMIN_TOKEN>
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "Admin endpoint disabled", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func getConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeConfig(w, currentConfig())
+}
+
+// patchConfigHandler 修改请求中给出的字段，全部校验通过后才生效，后台循环在下一轮使用新配置
+func patchConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var req configJSON
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	cfg := currentConfig()
+	fields := []struct {
+		name  string
+		value *string
+		dest  *time.Duration
+	}{
+		{"cold_threshold", req.ColdThreshold, &cfg.ColdThreshold},
+		{"cleanup_threshold", req.CleanUpThreshold, &cfg.CleanUpThreshold},
+		{"check_interval", req.CheckInterval, &cfg.CheckInterval},
+	}
+	for _, f := range fields {
+		if f.value == nil {
+			continue
+		}
+		d, err := time.ParseDuration(*f.value)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid %s: %q", f.name, *f.value), http.StatusBadRequest)
+			return
+		}
+		*f.dest = d
+	}
+
+	configMu.Lock()
+	coldThreshold = cfg.ColdThreshold
+	cleanUpThreshold = cfg.CleanUpThreshold
+	checkInterval = cfg.CheckInterval
+	configMu.Unlock()
+
+	select {
+	case configChanged <- struct{}{}:
+	default:
+	}
+
+	fmt.Printf("Config updated: cold=%v cleanup=%v interval=%v\n", cfg.ColdThreshold, cfg.CleanUpThreshold, cfg.CheckInterval)
+	writeConfig(w, cfg)
+}
+
+func writeConfig(w http.ResponseWriter, cfg lifecycleConfig) {
+	cold, cleanUp, interval := cfg.ColdThreshold.String(), cfg.CleanUpThreshold.String(), cfg.CheckInterval.String()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configJSON{
+		ColdThreshold:    &cold,
+		CleanUpThreshold: &cleanUp,
+		CheckInterval:    &interval,
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"jiaoben-/docker/imageref"
+	"net/http"
+	"path/filepath"
+)
+
+// deleteResult DELETE /image 的响应
+type deleteResult struct {
+	Name          string   `json:"name"`
+	Version       string   `json:"version"`
+	Platform      string   `json:"platform,omitempty"`
+	RemovedFiles  []string `json:"removed_files"`
+	DockerRemoved bool     `json:"docker_removed"`
+}
+
+// deleteImageHandler 删除镜像的 tar、所有格式的压缩文件和本地 docker 镜像，
+// 用于立即回收空间或让 latest 等可变标签下次请求时重新拉取。都不存在时返回 404。
+// platform 参数只影响删除的文件，docker 中同一个标签只保存一个平台的镜像
+func deleteImageHandler(w http.ResponseWriter, r *http.Request) {
+	image := r.URL.Query().Get("name")
+	version := r.URL.Query().Get("version")
+	platform := r.URL.Query().Get("platform")
+	if image == "" {
+		http.Error(w, "Please provide image parameter", http.StatusBadRequest)
+		return
+	}
+	image = imageref.Normalize(image)
+	if version == "" {
+		version = "latest"
+	}
+
+	imagePath := getImagePath(image, version, platform)
+	paths := []string{imagePath, digestPath(imagePath)}
+	base := filepath.Join(compressedDir, imageFileName(image, version, platform))
+	for _, c := range codecs {
+		paths = append(paths, base+c.ext)
+	}
+
+	result := deleteResult{Name: image, Version: version, Platform: platform, RemovedFiles: []string{}}
+	lock.Lock()
+	for _, path := range paths {
+		if !fileExists(path) {
+			continue
+		}
+		if err := removeFile(path); err != nil {
+			lock.Unlock()
+			http.Error(w, fmt.Sprintf("Failed to remove %s: %v", filepath.Base(path), err), http.StatusInternalServerError)
+			return
+		}
+		result.RemovedFiles = append(result.RemovedFiles, filepath.Base(path))
+	}
+	err := removeImageFromDocker(image, version)
+	lock.Unlock()
+
+	result.DockerRemoved = err == nil
+	if len(result.RemovedFiles) == 0 && !result.DockerRemoved {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Failed to remove docker image %s:%s: %v\n", image, version, err)
+	}
+	fmt.Printf("Deleted image %s:%s, files: %v\n", image, version, result.RemovedFiles)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
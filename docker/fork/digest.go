@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// digestPath 返回镜像 tar 的摘要文件路径。压缩和解压时摘要文件保留在 imageDir，
+// 解压后的 tar 仍按原来的摘要校验
+func digestPath(imagePath string) string {
+	return imagePath + ".sha256"
+}
+
+// tarPathFor 返回 imageDir 或 compressedDir 中的文件对应的 tar 路径，用于查找摘要文件
+func tarPathFor(fileName string) string {
+	return filepath.Join(imageDir, strings.TrimSuffix(trimCodecExt(fileName), ".tar")+".tar")
+}
+
+// imageDigest 校验 tar 结构并计算整个文件的 sha256，只读一遍文件
+func imageDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	r := io.TeeReader(f, h)
+	if err := validateImageTar(r); err != nil {
+		return "", err
+	}
+	// tar 结束标记之后可能还有填充
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeImageDigest 校验 tar 并把 sha256 写入摘要文件
+func writeImageDigest(imagePath string) (string, error) {
+	digest, err := imageDigest(imagePath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(digestPath(imagePath), []byte(digest+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write digest: %v", err)
+	}
+	return digest, nil
+}
+
+// readImageDigest 返回摘要文件中记录的 sha256，没有摘要文件时返回空字符串
+func readImageDigest(imagePath string) string {
+	data, err := os.ReadFile(digestPath(imagePath))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// verifyImageFile 重新计算 tar 的 sha256 并与摘要文件比较。
+// 之前保存的文件没有摘要文件，校验 tar 结构通过后补写
+func verifyImageFile(imagePath string) error {
+	expected := readImageDigest(imagePath)
+	if expected == "" {
+		_, err := writeImageDigest(imagePath)
+		return err
+	}
+	digest, err := imageDigest(imagePath)
+	if err != nil {
+		return err
+	}
+	if digest != expected {
+		return fmt.Errorf("sha256 mismatch: expected %s, got %s", expected, digest)
+	}
+	return nil
+}
+
+// pullAndVerify 拉取并保存镜像，校验 docker save 的输出并记录摘要，
+// 磁盘写满等原因导致 tar 不完整时删除文件并返回错误
+func pullAndVerify(image, version, platform, imagePath string) error {
+	if err := pullAndSaveImage(image, version, platform, imagePath); err != nil {
+		return err
+	}
+	if _, err := writeImageDigest(imagePath); err != nil {
+		os.Remove(imagePath)
+		os.Remove(digestPath(imagePath))
+		return fmt.Errorf("saved image is invalid: %v", err)
+	}
+	return nil
+}
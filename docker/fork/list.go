@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// imageEntry /list 返回的一个镜像文件，hot 为未压缩的 tar，cold 为压缩后的文件
+type imageEntry struct {
+	Name     string    `json:"name"`
+	Version  string    `json:"version"`
+	Platform string    `json:"platform,omitempty"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	State    string    `json:"state"`
+	Codec    string    `json:"codec,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"` // 未压缩 tar 的摘要
+}
+
+// listImagesHandler 列出 imageDir 和 compressedDir 中的所有镜像文件，按镜像名和版本排序
+func listImagesHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := listImages()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list images: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func listImages() ([]imageEntry, error) {
+	entries := []imageEntry{}
+	hot, err := os.ReadDir(imageDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range hot {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".tar") {
+			continue
+		}
+		if entry, ok := newImageEntry(filepath.Join(imageDir, file.Name()), "hot", ""); ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	cold, err := os.ReadDir(compressedDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range cold {
+		if file.IsDir() {
+			continue
+		}
+		c, err := codecForPath(file.Name())
+		if err != nil {
+			continue
+		}
+		if entry, ok := newImageEntry(filepath.Join(compressedDir, file.Name()), "cold", c.name); ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		if entries[i].Version != entries[j].Version {
+			return entries[i].Version < entries[j].Version
+		}
+		if entries[i].Platform != entries[j].Platform {
+			return entries[i].Platform < entries[j].Platform
+		}
+		return entries[i].State > entries[j].State
+	})
+	return entries, nil
+}
+
+// newImageEntry 读取文件信息，文件在列出后被删除时返回 false
+func newImageEntry(path, state, codecName string) (imageEntry, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return imageEntry{}, false
+	}
+	name, version, platform := parseImageAndVersion(filepath.Base(path))
+	return imageEntry{
+		Name:     name,
+		Version:  version,
+		Platform: platform,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		State:    state,
+		Codec:    codecName,
+		SHA256:   readImageDigest(tarPathFor(filepath.Base(path))),
+	}, true
+}
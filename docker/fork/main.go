@@ -1,42 +1,84 @@
 package main
 
 import (
+	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
+	"jiaoben-/docker/imageref"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/pierrec/lz4/v4"
 )
 
 const (
 	defaultImageDir      = "./images"
 	defaultCompressedDir = "./compressed_images"
 	defaultColdThreshold = 1 * 24 * time.Hour
-	checkInterval        = 24 * time.Hour
-	cleanUpThreshold     = 7 * 24 * time.Hour
+	defaultCheckInterval = 24 * time.Hour
+	defaultCleanUp       = 7 * 24 * time.Hour
 	chunkSize            = 4 * 1024 * 1024 // 4 MB
 )
 
 var (
 	imageDir      string
 	compressedDir string
-	coldThreshold time.Duration
+	dryRun        bool
+	validateTar   bool // 压缩后删除源文件前校验压缩文件中的 tar 结构是否完整，需要读完整个文件
 	lock          sync.Mutex
+
+	// 生命周期配置，可以通过 PATCH /config 在运行时修改，读写需持有 configMu
+	coldThreshold    time.Duration
+	cleanUpThreshold time.Duration
+	checkInterval    time.Duration
+	configMu         sync.RWMutex
+	configChanged    = make(chan struct{}, 1) // 配置修改后唤醒后台循环
+
+	// 便于测试替换的破坏性操作
+	execCommand = exec.Command
+	removeFile  = os.Remove
 )
 
 func init() {
 	imageDir = getEnv("IMAGE_DIR", defaultImageDir)
 	compressedDir = getEnv("COMPRESSED_DIR", defaultCompressedDir)
 	coldThreshold = getEnvDuration("COLD_THRESHOLD", defaultColdThreshold)
+	cleanUpThreshold = getEnvDuration("CLEANUP_THRESHOLD", defaultCleanUp)
+	checkInterval = getEnvDuration("CHECK_INTERVAL", defaultCheckInterval)
+	dryRun = getEnvBool("DRY_RUN", false)
+	validateTar = getEnvBool("VALIDATE_TAR", false)
+
+	aliases, err := loadAliases(getEnv("ALIAS_FILE", ""))
+	if err != nil {
+		fmt.Printf("Failed to load image aliases: %v\n", err)
+		os.Exit(1)
+	}
+	imageAliases = aliases
+
+	c, err := codecByName(getEnv("COMPRESSION_CODEC", "lz4"))
+	if err != nil {
+		fmt.Printf("Invalid COMPRESSION_CODEC: %v\n", err)
+		os.Exit(1)
+	}
+	compressionCodec = c
+	compressionLevel = parseCompressionLevel(getEnv("COMPRESSION_LEVEL", ""), c)
+
+	registryConfigDir, err = setupRegistryAuth()
+	if err != nil {
+		fmt.Printf("Failed to set up registry auth: %v\n", err)
+		os.Exit(1)
+	}
 
-	err := os.MkdirAll(imageDir, os.ModePerm)
+	err = os.MkdirAll(imageDir, os.ModePerm)
 	if err != nil {
 		fmt.Printf("Failed to create image directory: %v\n", err)
 		os.Exit(1)
@@ -50,46 +92,68 @@ func init() {
 }
 
 func main() {
-	r := mux.NewRouter()
-	r.HandleFunc("/get", getImageHandler).Methods("GET")
-	go checkAndCompressColdFiles()
+	go checkAndCompressColdFiles(nil)
 
 	fmt.Println("Starting server on :8080")
-	http.ListenAndServe(":8080", r)
+	http.ListenAndServe(":8080", newRouter())
+}
+
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/get", getImageHandler).Methods("GET")
+	r.HandleFunc("/list", listImagesHandler).Methods("GET")
+	r.HandleFunc("/image", requireAdmin(deleteImageHandler)).Methods("DELETE")
+	r.HandleFunc("/warm", warmHandler).Methods("POST")
+	r.HandleFunc("/warm/{id}", warmStatusHandler).Methods("GET")
+	r.HandleFunc("/config", requireAdmin(getConfigHandler)).Methods("GET")
+	r.HandleFunc("/config", requireAdmin(patchConfigHandler)).Methods("PATCH")
+	return r
 }
 
 func getImageHandler(w http.ResponseWriter, r *http.Request) {
 	image := r.URL.Query().Get("name")
 	version := r.URL.Query().Get("version")
 	needLatest := r.URL.Query().Get("latest")
+	platform := r.URL.Query().Get("platform") // 为空时使用本机平台
 
 	if image == "" {
 		http.Error(w, "Please provide image parameter", http.StatusBadRequest)
 		return
 	}
+	if platform != "" && !platformPattern.MatchString(platform) {
+		http.Error(w, fmt.Sprintf("Invalid platform %q, expected os/arch[/variant]", platform), http.StatusBadRequest)
+		return
+	}
+	// nginx 与 library/nginx 拉取同一个镜像并共用缓存文件
+	image = imageref.Normalize(image)
 
 	if version == "" {
 		version = "latest"
 	}
 
-	imagePath := getImagePath(sanitizeImageName(image), version)
-	compressedPath := getCompressedImagePath(sanitizeImageName(image), version)
+	imagePath := getImagePath(image, version, platform)
+	compressedPath := getCompressedImagePath(image, version, platform)
+	fileName := downloadFileName(image, version, platform)
 
 	lock.Lock()
 	defer lock.Unlock()
 
 	// 如果需要最新镜像，则直接拉取
 	if needLatest == "true" {
-		if err := pullAndSaveImage(image, version, imagePath); err != nil {
+		if err := pullAndVerify(image, version, platform, imagePath); err != nil {
 			http.Error(w, fmt.Sprintf("Failed to pull and save image: %v", err), http.StatusInternalServerError)
 			return
 		}
-		serveFileWithCustomName(w, r, imagePath, fmt.Sprintf("%s_%s.tar", sanitizeImageName(image), version))
+		serveFileWithCustomName(w, r, imagePath, fileName)
 		return
 	}
 
 	// 解压缩文件并返回
 	if fileExists(compressedPath) {
+		if streamDecompress {
+			streamCompressedImage(w, compressedPath, imagePath, fileName)
+			return
+		}
 		if err := decompressImage(compressedPath, imagePath); err != nil {
 			http.Error(w, fmt.Sprintf("Failed to decompress image: %v", err), http.StatusInternalServerError)
 			return
@@ -97,76 +161,149 @@ func getImageHandler(w http.ResponseWriter, r *http.Request) {
 		os.Remove(compressedPath)
 	}
 
+	// 已有的文件按摘要校验，损坏时删除并重新拉取
+	if fileExists(imagePath) {
+		if err := verifyImageFile(imagePath); err != nil {
+			fmt.Printf("Cached image %s is corrupt, pulling again: %v\n", imagePath, err)
+			os.Remove(imagePath)
+			os.Remove(digestPath(imagePath))
+		}
+	}
+
 	// 如果文件不存在，则拉取镜像并保存
 	if !fileExists(imagePath) {
-		if err := pullAndSaveImage(image, version, imagePath); err != nil {
+		if err := pullAndVerify(image, version, platform, imagePath); err != nil {
 			http.Error(w, fmt.Sprintf("Failed to pull and save image: %v", err), http.StatusInternalServerError)
 			return
 		}
 	}
 
-	serveFileWithCustomName(w, r, imagePath, fmt.Sprintf("%s_%s.tar", sanitizeImageName(image), version))
+	serveFileWithCustomName(w, r, imagePath, fileName)
 }
 
-func checkAndCompressColdFiles() {
+// checkAndCompressColdFiles 每隔 checkInterval 清理一次，done 关闭时退出
+func checkAndCompressColdFiles(done <-chan struct{}) {
 	for {
-		files, err := os.ReadDir(imageDir)
-		fmt.Printf("files: %v\n", files)
-		if err != nil {
-			fmt.Printf("Failed to read image directory: %v\n", err)
-			time.Sleep(checkInterval)
-			continue
+		sweepColdFiles()
+		if !waitNextSweep(done) {
+			return
+		}
+	}
+}
+
+// waitNextSweep 等待 checkInterval，配置修改后按新的间隔重新计时；done 关闭时返回 false
+func waitNextSweep(done <-chan struct{}) bool {
+	for {
+		timer := time.NewTimer(currentConfig().CheckInterval)
+		select {
+		case <-done:
+			timer.Stop()
+			return false
+		case <-configChanged:
+			timer.Stop()
+		case <-timer.C:
+			return true
 		}
+	}
+}
 
-		for _, file := range files {
-			filePath := filepath.Join(imageDir, file.Name())
-			if isFileCold(filePath) {
-				imageName, version := parseImageAndVersion(file.Name())
-				compressedPath := getCompressedImagePath(imageName, version)
-				if !fileExists(compressedPath) {
-					lock.Lock()
-					err := compressImage(filePath, compressedPath)
-					lock.Unlock()
-					if err != nil {
-						fmt.Printf("Failed to compress image: %v\n", err)
-					} else {
-						os.Remove(filePath) // 删除原始文件
-					}
-				}
-			}
+// sweepColdFiles 压缩冷文件并删除过期的压缩文件，返回执行（DRY_RUN 时为计划执行）的操作
+func sweepColdFiles() []string {
+	var actions []string
+	act := func(format string, args ...interface{}) bool {
+		action := fmt.Sprintf(format, args...)
+		actions = append(actions, action)
+		if dryRun {
+			fmt.Printf("[DRY_RUN] would %s\n", action)
 		}
+		return !dryRun
+	}
 
-		// 删除超过7天的冷处理文件
-		files, err = os.ReadDir(compressedDir)
-		if err != nil {
-			fmt.Printf("Failed to read compressed directory: %v\n", err)
-			time.Sleep(checkInterval)
+	cfg := currentConfig()
+	files, err := os.ReadDir(imageDir)
+	fmt.Printf("files: %v\n", files)
+	if err != nil {
+		fmt.Printf("Failed to read image directory: %v\n", err)
+		return actions
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".tar") { // 跳过摘要文件
 			continue
 		}
+		filePath := filepath.Join(imageDir, file.Name())
+		if isFileCold(filePath, cfg.ColdThreshold) {
+			compressedPath := filepath.Join(compressedDir, strings.TrimSuffix(file.Name(), ".tar")+compressionCodec.ext)
+			if !fileExists(compressedPath) && act("compress %s to %s", filePath, compressedPath) {
+				lock.Lock()
+				err := compressImage(filePath, compressedPath)
+				if err == nil && validateTar {
+					err = validateCompressedImage(compressedPath)
+				}
+				lock.Unlock()
+				if err != nil {
+					fmt.Printf("Failed to compress image: %v\n", err)
+					removeFile(compressedPath) // 保留原始文件，删除不完整的压缩文件
+				} else {
+					removeFile(filePath) // 删除原始文件
+				}
+			}
+		}
+	}
+
+	// 删除超过7天的冷处理文件
+	files, err = os.ReadDir(compressedDir)
+	if err != nil {
+		fmt.Printf("Failed to read compressed directory: %v\n", err)
+		return actions
+	}
 
-		for _, file := range files {
-			filePath := filepath.Join(compressedDir, file.Name())
-			if isFileExpired(filePath) {
-				os.Remove(filePath)
-				imageName, version := parseImageAndVersion(file.Name())
+	for _, file := range files {
+		filePath := filepath.Join(compressedDir, file.Name())
+		if isFileExpired(filePath, cfg.CleanUpThreshold) {
+			imageName, version, _ := parseImageAndVersion(file.Name())
+			removeExpired := act("remove %s", filePath)
+			removeImage := act("remove docker image %s:%s", imageName, version)
+			if removeExpired && removeImage {
+				removeFile(filePath)
+				if digest := digestPath(tarPathFor(file.Name())); fileExists(digest) {
+					removeFile(digest)
+				}
 				removeImageFromDocker(imageName, version)
 				fmt.Printf("Removed expired file and Docker image: %s\n", filePath)
 			}
 		}
-
-		time.Sleep(checkInterval)
 	}
+
+	return actions
+}
+
+func getImagePath(imageName, version, platform string) string {
+	return filepath.Join(imageDir, imageFileName(imageName, version, platform)+".tar")
 }
 
-func getImagePath(imageName, version string) string {
-	return filepath.Join(imageDir, fmt.Sprintf("%s_%s.tar", sanitizeImageName(imageName), version))
+// getCompressedImagePath 返回已存在的压缩文件（任意格式），不存在时返回使用 compressionCodec 的路径
+func getCompressedImagePath(imageName, version, platform string) string {
+	base := filepath.Join(compressedDir, imageFileName(imageName, version, platform))
+	for _, c := range codecs {
+		if fileExists(base + c.ext) {
+			return base + c.ext
+		}
+	}
+	return base + compressionCodec.ext
 }
 
-func getCompressedImagePath(imageName, version string) string {
-	return filepath.Join(compressedDir, fmt.Sprintf("%s_%s.lz4", sanitizeImageName(imageName), version))
+// imageFileName 返回镜像文件名（不含扩展名）。镜像名、版本和平台分别做 URL 转义，以 @ 连接，
+// 转义后都不包含 @，parseImageAndVersion 可以无歧义地还原。platform 为空（本机平台）时省略
+func imageFileName(imageName, version, platform string) string {
+	name := url.QueryEscape(imageName) + "@" + url.QueryEscape(version)
+	if platform != "" {
+		name += "@" + url.QueryEscape(platform)
+	}
+	return name
 }
 
-func isFileCold(filePath string) bool {
+func isFileCold(filePath string, coldThreshold time.Duration) bool {
 	info, err := os.Stat(filePath)
 	if err != nil {
 		return false
@@ -175,7 +312,7 @@ func isFileCold(filePath string) bool {
 	return time.Since(info.ModTime()) > coldThreshold
 }
 
-func isFileExpired(filePath string) bool {
+func isFileExpired(filePath string, cleanUpThreshold time.Duration) bool {
 	info, err := os.Stat(filePath)
 	if err != nil {
 		return false
@@ -183,12 +320,27 @@ func isFileExpired(filePath string) bool {
 	return time.Since(info.ModTime()) > cleanUpThreshold
 }
 
-func parseImageAndVersion(fileName string) (string, string) {
-	parts := strings.Split(strings.TrimSuffix(fileName, ".lz4"), "_")
+// parseImageAndVersion 从 imageFileName 生成的文件名还原镜像名、版本和平台。
+// 没有 @ 的是旧格式 <镜像名>_<版本>，其中的 _ 无法区分，按最后一个 _ 分割并把其余的 _ 还原为 /
+func parseImageAndVersion(fileName string) (string, string, string) {
+	fileName = strings.TrimSuffix(trimCodecExt(fileName), ".tar")
+	if strings.Contains(fileName, "@") {
+		fields := strings.SplitN(fileName, "@", 3)
+		for i, field := range fields {
+			if unescaped, err := url.QueryUnescape(field); err == nil {
+				fields[i] = unescaped
+			}
+		}
+		if len(fields) == 2 {
+			return fields[0], fields[1], ""
+		}
+		return fields[0], fields[1], fields[2]
+	}
+	parts := strings.Split(fileName, "_")
 	version := parts[len(parts)-1]
 	imageName := strings.Join(parts[:len(parts)-1], "_")
 	imageName = strings.ReplaceAll(imageName, "_", "/")
-	return imageName, version
+	return imageName, version, ""
 }
 
 func fileExists(filePath string) bool {
@@ -196,15 +348,34 @@ func fileExists(filePath string) bool {
 	return !os.IsNotExist(err)
 }
 
-func pullAndSaveImage(image, version, imagePath string) error {
+// pullAndSaveImage 拉取镜像并保存为 tar，仓库不稳定导致的临时失败会重试。
+// 镜像名有映射时从映射的镜像源拉取，再打上请求的名称保存，导入后仍是请求的名称。
+// platform 不为空时拉取指定平台的镜像，如 linux/arm64
+func pullAndSaveImage(image, version, platform, imagePath string) error {
 	fullImageName := fmt.Sprintf("%s:%s", image, version)
-	cmd := exec.Command("docker", "pull", fullImageName)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	sourceImage := imageAliases.resolve(image)
+	sourceName := fmt.Sprintf("%s:%s", sourceImage, version)
+	pullArgs := []string{"pull", sourceName}
+	if platform != "" {
+		pullArgs = []string{"pull", "--platform", platform, sourceName}
+	}
+	if registryConfigDir != "" { // 使用配置的私有仓库凭据
+		pullArgs = append([]string{"--config", registryConfigDir}, pullArgs...)
+	}
+	if output, err := runDocker(pullArgs...); err != nil {
 		return fmt.Errorf("failed to pull image: %s, output: %s", err, output)
 	}
+	if sourceName != fullImageName {
+		if output, err := runDocker("tag", sourceName, fullImageName); err != nil {
+			return fmt.Errorf("failed to tag image: %s, output: %s", err, output)
+		}
+		// 只删除镜像源的标签，镜像仍由请求的名称引用
+		if err := removeImageFromDocker(sourceImage, version); err != nil {
+			fmt.Printf("Failed to untag %s: %v\n", sourceName, err)
+		}
+	}
 
-	cmd = exec.Command("docker", "save", "-o", imagePath, fullImageName)
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := runDocker("save", "-o", imagePath, fullImageName); err != nil {
 		return fmt.Errorf("failed to save image: %s, output: %s", err, output)
 	}
 
@@ -213,7 +384,7 @@ func pullAndSaveImage(image, version, imagePath string) error {
 
 func removeImageFromDocker(image, version string) error {
 	fullImageName := fmt.Sprintf("%s:%s", image, version)
-	cmd := exec.Command("docker", "rmi", fullImageName)
+	cmd := execCommand("docker", "rmi", fullImageName)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to remove image: %s, output: %s", err, output)
 	}
@@ -221,7 +392,12 @@ func removeImageFromDocker(image, version string) error {
 	return nil
 }
 
+// compressImage 按 destPath 的扩展名选择压缩格式
 func compressImage(srcPath, destPath string) error {
+	c, err := codecForPath(destPath)
+	if err != nil {
+		return err
+	}
 	srcFile, err := os.Open(srcPath)
 	if err != nil {
 		return err
@@ -234,7 +410,10 @@ func compressImage(srcPath, destPath string) error {
 	}
 	defer destFile.Close()
 
-	writer := lz4.NewWriter(destFile)
+	writer, err := c.newWriter(destFile, levelFor(c))
+	if err != nil {
+		return err
+	}
 	defer writer.Close()
 
 	buf := make([]byte, chunkSize)
@@ -255,7 +434,12 @@ func compressImage(srcPath, destPath string) error {
 	return nil
 }
 
+// decompressImage 按 srcPath 的扩展名选择解压格式
 func decompressImage(srcPath, destPath string) error {
+	c, err := codecForPath(srcPath)
+	if err != nil {
+		return err
+	}
 	srcFile, err := os.Open(srcPath)
 	if err != nil {
 		return err
@@ -268,7 +452,11 @@ func decompressImage(srcPath, destPath string) error {
 	}
 	defer destFile.Close()
 
-	reader := lz4.NewReader(srcFile)
+	reader, err := c.newReader(srcFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
 
 	buf := make([]byte, chunkSize)
 	for {
@@ -288,6 +476,50 @@ func decompressImage(srcPath, destPath string) error {
 	return nil
 }
 
+// validateCompressedImage 解压并校验压缩后的镜像文件
+func validateCompressedImage(path string) error {
+	c, err := codecForPath(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader, err := c.newReader(f)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return validateImageTar(reader)
+}
+
+// validateImageTar 读完所有 tar 条目，确认没有被截断且包含 manifest.json 或 index.json
+func validateImageTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	hasManifest := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar: %v", err)
+		}
+		if hdr.Name == "manifest.json" || hdr.Name == "index.json" {
+			hasManifest = true
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("invalid tar entry %s: %v", hdr.Name, err)
+		}
+	}
+	if !hasManifest {
+		return errors.New("invalid tar: missing manifest.json")
+	}
+	return nil
+}
+
 func serveFileWithCustomName(w http.ResponseWriter, r *http.Request, filePath, fileName string) {
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
 	w.Header().Set("Content-Type", "application/octet-stream")
@@ -314,6 +546,41 @@ func getEnvDuration(key string, fallback time.Duration) time.Duration {
 	return duration
 }
 
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return fallback
+	}
+	return n
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
+// platformPattern 合法的平台参数，如 linux/amd64、linux/arm64/v8
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// downloadFileName 生成下载时的文件名，缓存文件名使用 imageFileName
+func downloadFileName(imageName, version, platform string) string {
+	if platform == "" {
+		return fmt.Sprintf("%s_%s.tar", sanitizeImageName(imageName), version)
+	}
+	return fmt.Sprintf("%s_%s_%s.tar", sanitizeImageName(imageName), version, sanitizeImageName(platform))
+}
+
 func sanitizeImageName(imageName string) string {
 	return strings.ReplaceAll(imageName, "/", "_")
 }
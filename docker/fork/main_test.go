@@ -0,0 +1,800 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupTestDirs 使用临时目录作为镜像目录和压缩目录
+func setupTestDirs(t *testing.T) {
+	oldImageDir, oldCompressedDir := imageDir, compressedDir
+	imageDir = filepath.Join(t.TempDir(), "images")
+	compressedDir = filepath.Join(t.TempDir(), "compressed")
+	assert.NoError(t, os.MkdirAll(imageDir, os.ModePerm))
+	assert.NoError(t, os.MkdirAll(compressedDir, os.ModePerm))
+	t.Cleanup(func() { imageDir, compressedDir = oldImageDir, oldCompressedDir })
+}
+
+// createAgedFile 创建一个修改时间为 age 之前的文件
+func createAgedFile(t *testing.T, path string, age time.Duration) {
+	assert.NoError(t, os.WriteFile(path, []byte("content"), 0644))
+	old := time.Now().Add(-age)
+	assert.NoError(t, os.Chtimes(path, old, old))
+}
+
+// stubCommands 记录执行的命令和删除的文件，不做实际操作
+func stubCommands(t *testing.T) (commands *[][]string, removed *[]string) {
+	commands, removed = &[][]string{}, &[]string{}
+	oldExec, oldRemove := execCommand, removeFile
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		*commands = append(*commands, append([]string{name}, args...))
+		return exec.Command("true")
+	}
+	removeFile = func(path string) error {
+		*removed = append(*removed, path)
+		return os.Remove(path)
+	}
+	t.Cleanup(func() { execCommand, removeFile = oldExec, oldRemove })
+	return commands, removed
+}
+
+// stubSave 让 docker save 把 content 写到输出文件，需要在 stubCommands 之后调用
+func stubSave(t *testing.T, content []byte) {
+	stubbed := execCommand
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		if args[0] == "save" {
+			assert.NoError(t, os.WriteFile(args[2], content, 0644))
+		}
+		return stubbed(name, args...)
+	}
+}
+
+// TestSweepColdFilesDryRun 测试 DRY_RUN 下只记录计划操作而不删除
+func TestSweepColdFilesDryRun(t *testing.T) {
+	setupTestDirs(t)
+	commands, removed := stubCommands(t)
+	dryRun = true
+	defer func() { dryRun = false }()
+
+	coldPath := filepath.Join(imageDir, "nginx_latest.tar")
+	expiredPath := filepath.Join(compressedDir, "redis_7.lz4")
+	createAgedFile(t, coldPath, 2*coldThreshold)
+	createAgedFile(t, expiredPath, 2*cleanUpThreshold)
+
+	actions := sweepColdFiles()
+
+	assert.Equal(t, []string{
+		"compress " + coldPath + " to " + filepath.Join(compressedDir, "nginx_latest.lz4"),
+		"remove " + expiredPath,
+		"remove docker image redis:7",
+	}, actions)
+	assert.Empty(t, *commands)
+	assert.Empty(t, *removed)
+	assert.FileExists(t, coldPath)
+	assert.FileExists(t, expiredPath)
+	assert.NoFileExists(t, filepath.Join(compressedDir, "nginx_latest.lz4"))
+}
+
+// TestSweepColdFiles 测试正常模式下执行压缩和删除
+func TestSweepColdFiles(t *testing.T) {
+	setupTestDirs(t)
+	commands, removed := stubCommands(t)
+
+	coldPath := filepath.Join(imageDir, "nginx_latest.tar")
+	expiredPath := filepath.Join(compressedDir, "redis_7.lz4")
+	createAgedFile(t, coldPath, 2*coldThreshold)
+	createAgedFile(t, expiredPath, 2*cleanUpThreshold)
+
+	sweepColdFiles()
+
+	assert.Equal(t, [][]string{{"docker", "rmi", "redis:7"}}, *commands)
+	assert.Equal(t, []string{coldPath, expiredPath}, *removed)
+	assert.FileExists(t, filepath.Join(compressedDir, "nginx_latest.lz4"))
+}
+
+// buildImageTar 构造一个类似 docker save 输出的 tar
+func buildImageTar(t testing.TB) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	files := []struct{ name, body string }{
+		{"layer/layer.tar", string(bytes.Repeat([]byte("x"), 4096))},
+		{"manifest.json", `[{"Config":"config.json","Layers":["layer/layer.tar"]}]`},
+	}
+	for _, f := range files {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body))}))
+		_, err := tw.Write([]byte(f.body))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+// TestValidateImageTar 测试完整的 tar 通过校验，截断或缺少 manifest 的 tar 校验失败
+func TestValidateImageTar(t *testing.T) {
+	image := buildImageTar(t)
+	assert.NoError(t, validateImageTar(bytes.NewReader(image)))
+
+	// 在第一个条目中间截断
+	assert.Error(t, validateImageTar(bytes.NewReader(image[:2048])))
+	// 在条目边界截断，manifest.json 丢失
+	assert.Error(t, validateImageTar(bytes.NewReader(image[:512+4096])))
+	assert.Error(t, validateImageTar(bytes.NewReader([]byte("content"))))
+}
+
+// TestSweepColdFilesValidateTar 测试压缩结果校验失败时保留原始文件
+func TestSweepColdFilesValidateTar(t *testing.T) {
+	setupTestDirs(t)
+	_, removed := stubCommands(t)
+	validateTar = true
+	defer func() { validateTar = false }()
+
+	image := buildImageTar(t)
+	validPath := filepath.Join(imageDir, "nginx_latest.tar")
+	truncatedPath := filepath.Join(imageDir, "redis_7.tar")
+	assert.NoError(t, os.WriteFile(validPath, image, 0644))
+	assert.NoError(t, os.WriteFile(truncatedPath, image[:2048], 0644))
+	old := time.Now().Add(-2 * coldThreshold)
+	assert.NoError(t, os.Chtimes(validPath, old, old))
+	assert.NoError(t, os.Chtimes(truncatedPath, old, old))
+
+	sweepColdFiles()
+
+	assert.Contains(t, *removed, validPath)
+	assert.FileExists(t, filepath.Join(compressedDir, "nginx_latest.lz4"))
+	assert.FileExists(t, truncatedPath)
+	assert.NoFileExists(t, filepath.Join(compressedDir, "redis_7.lz4"))
+}
+
+// setConfigForTest 设置生命周期配置和管理 token，测试结束后恢复
+func setConfigForTest(t *testing.T, cfg lifecycleConfig, token string) {
+	old, oldToken := currentConfig(), adminToken
+	configMu.Lock()
+	coldThreshold, cleanUpThreshold, checkInterval = cfg.ColdThreshold, cfg.CleanUpThreshold, cfg.CheckInterval
+	configMu.Unlock()
+	adminToken = token
+	t.Cleanup(func() {
+		configMu.Lock()
+		coldThreshold, cleanUpThreshold, checkInterval = old.ColdThreshold, old.CleanUpThreshold, old.CheckInterval
+		configMu.Unlock()
+		adminToken = oldToken
+	})
+}
+
+// patchConfig 以管理员身份调用 PATCH /config
+func patchConfig(token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PATCH", "/config", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	requireAdmin(patchConfigHandler)(rec, req)
+	return rec
+}
+
+// TestPatchConfigValidation 测试认证和时长校验
+func TestPatchConfigValidation(t *testing.T) {
+	setConfigForTest(t, lifecycleConfig{time.Hour, 2 * time.Hour, time.Hour}, "secret")
+
+	assert.Equal(t, http.StatusUnauthorized, patchConfig("", `{"cold_threshold":"1h"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, patchConfig("wrong", `{"cold_threshold":"1h"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patchConfig("secret", `{"cold_threshold":"soon"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patchConfig("secret", `{"check_interval":"-1h"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, patchConfig("secret", `{"cold":"1h"}`).Code)
+	// 部分字段无效时整个请求不生效
+	assert.Equal(t, http.StatusBadRequest, patchConfig("secret", `{"cold_threshold":"3h","check_interval":"0s"}`).Code)
+	assert.Equal(t, time.Hour, currentConfig().ColdThreshold)
+
+	rec := patchConfig("secret", `{"cleanup_threshold":"36h"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"cold_threshold":"1h0m0s","cleanup_threshold":"36h0m0s","check_interval":"1h0m0s"}`, rec.Body.String())
+
+	adminToken = ""
+	assert.Equal(t, http.StatusForbidden, patchConfig("", `{"cold_threshold":"1h"}`).Code)
+}
+
+// TestPatchConfigAppliesToLoop 测试后台循环使用修改后的冷文件阈值
+func TestPatchConfigAppliesToLoop(t *testing.T) {
+	setupTestDirs(t)
+	stubCommands(t)
+	setConfigForTest(t, lifecycleConfig{24 * time.Hour, 7 * 24 * time.Hour, time.Hour}, "secret")
+
+	coldPath := filepath.Join(imageDir, "nginx_latest.tar")
+	compressedPath := filepath.Join(compressedDir, "nginx_latest.lz4")
+	createAgedFile(t, coldPath, 2*time.Hour)
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		checkAndCompressColdFiles(done)
+	}()
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	rec := patchConfig("secret", `{"cold_threshold":"1h","check_interval":"10ms"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Eventually(t, func() bool { return fileExists(compressedPath) }, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestGetImageOfficialShorthand 测试 nginx 与 library/nginx 拉取相同的镜像并保存到同一个文件
+func TestGetImageOfficialShorthand(t *testing.T) {
+	setupTestDirs(t)
+	commands, _ := stubCommands(t)
+
+	for _, name := range []string{"nginx", "library/nginx", "docker.io/nginx"} {
+		req := httptest.NewRequest("GET", "/get?name="+name, nil)
+		getImageHandler(httptest.NewRecorder(), req)
+	}
+
+	imagePath := getImagePath("library/nginx", "latest", "")
+	var want [][]string
+	for i := 0; i < 3; i++ {
+		want = append(want,
+			[]string{"docker", "pull", "library/nginx:latest"},
+			[]string{"docker", "save", "-o", imagePath, "library/nginx:latest"})
+	}
+	assert.Equal(t, want, *commands)
+}
+
+// TestPullRetry 测试临时性失败重试后成功，永久性失败不重试
+func TestPullRetry(t *testing.T) {
+	setupTestDirs(t)
+	oldExec, oldBackoff := execCommand, pullBackoff
+	pullBackoff = time.Millisecond
+	t.Cleanup(func() { execCommand, pullBackoff = oldExec, oldBackoff })
+
+	// fail 返回一个输出 message 后失败的命令
+	fail := func(message string) *exec.Cmd {
+		return exec.Command("sh", "-c", "echo \"$0\" >&2; exit 1", message)
+	}
+
+	var pulls int
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		if args[0] == "pull" {
+			pulls++
+			if pulls <= 2 {
+				return fail("Error response from daemon: Get \"https://registry-1.docker.io/v2/\": net/http: TLS handshake timeout")
+			}
+		}
+		return exec.Command("true")
+	}
+	assert.NoError(t, pullAndSaveImage("library/nginx", "latest", "", getImagePath("library/nginx", "latest", "")))
+	assert.Equal(t, 3, pulls)
+
+	pulls = 0
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		pulls++
+		return fail("Error response from daemon: manifest for library/nginx:nope not found: manifest unknown")
+	}
+	err := pullAndSaveImage("library/nginx", "nope", "", getImagePath("library/nginx", "nope", ""))
+	assert.ErrorContains(t, err, "manifest unknown")
+	assert.Equal(t, 1, pulls)
+
+	// 输出中的镜像 ID 包含 502 也不当成仓库 5xx 重试
+	pulls = 0
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		pulls++
+		return fail("Error response from daemon: failed to register layer: sha256:9c502e1f7a: invalid tar header")
+	}
+	assert.Error(t, pullAndSaveImage("library/nginx", "latest", "", getImagePath("library/nginx", "latest", "")))
+	assert.Equal(t, 1, pulls)
+	assert.True(t, isRetryablePullError([]byte("received unexpected HTTP status: 502 Bad Gateway")))
+	assert.True(t, isRetryablePullError([]byte("unexpected status code 503")))
+
+	// 临时性失败超过重试次数后返回错误
+	pulls = 0
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		pulls++
+		return fail("toomanyrequests: You have reached your pull rate limit")
+	}
+	assert.Error(t, pullAndSaveImage("library/nginx", "latest", "", getImagePath("library/nginx", "latest", "")))
+	assert.Equal(t, pullAttempts, pulls)
+}
+
+// TestImageAlias 测试映射的镜像名从映射的镜像源拉取，但缓存在请求的名称下
+func TestImageAlias(t *testing.T) {
+	setupTestDirs(t)
+	commands, _ := stubCommands(t)
+
+	aliasFile := filepath.Join(t.TempDir(), "aliases.json")
+	assert.NoError(t, os.WriteFile(aliasFile, []byte(`{
+		"nginx": "registry.internal/library/nginx",
+		"library/*": "mirror.internal/hub/*",
+		"team/*": "registry.internal/team/"
+	}`), 0644))
+	aliases, err := loadAliases(aliasFile)
+	assert.NoError(t, err)
+	imageAliases = aliases
+	defer func() { imageAliases = nil }()
+
+	assert.Equal(t, "registry.internal/library/nginx", aliases.resolve("library/nginx"))
+	assert.Equal(t, "mirror.internal/hub/redis", aliases.resolve("library/redis"))
+	assert.Equal(t, "registry.internal/team/app", aliases.resolve("team/app"))
+	assert.Equal(t, "other/app", aliases.resolve("other/app"))
+
+	req := httptest.NewRequest("GET", "/get?name=nginx&version=1.25", nil)
+	getImageHandler(httptest.NewRecorder(), req)
+
+	imagePath := getImagePath("library/nginx", "1.25", "")
+	assert.Equal(t, [][]string{
+		{"docker", "pull", "registry.internal/library/nginx:1.25"},
+		{"docker", "tag", "registry.internal/library/nginx:1.25", "library/nginx:1.25"},
+		{"docker", "rmi", "registry.internal/library/nginx:1.25"},
+		{"docker", "save", "-o", imagePath, "library/nginx:1.25"},
+	}, *commands)
+
+	_, err = newAliasMap(map[string]string{"a*b": "c"})
+	assert.Error(t, err)
+}
+
+// TestWarmImages 测试 POST /warm 在后台拉取镜像，GET /warm/{id} 返回每个镜像的状态
+func TestWarmImages(t *testing.T) {
+	setupTestDirs(t)
+	commands, _ := stubCommands(t)
+	stubSave(t, buildImageTar(t))
+	assert.NoError(t, os.WriteFile(getImagePath("library/redis", "7", ""), []byte("content"), 0644))
+	router := newRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/warm", strings.NewReader(`[{"name": "nginx", "version": "1.25"}, {"name": "redis", "version": "7"}]`)))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	var job warmJob
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.NotEmpty(t, job.ID)
+	assert.Equal(t, "/warm/"+job.ID, rec.Header().Get("Location"))
+
+	assert.Eventually(t, func() bool {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/warm/"+job.ID, nil))
+		job = warmJob{}
+		return rec.Code == http.StatusOK && json.Unmarshal(rec.Body.Bytes(), &job) == nil && job.Status == warmDone
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, job.Finished)
+	assert.Equal(t, []warmImage{
+		{Name: "library/nginx", Version: "1.25", Status: warmDone},
+		{Name: "library/redis", Version: "7", Status: warmCached},
+	}, job.Images)
+	assert.Equal(t, [][]string{
+		{"docker", "pull", "library/nginx:1.25"},
+		{"docker", "save", "-o", getImagePath("library/nginx", "1.25", ""), "library/nginx:1.25"},
+	}, *commands)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/warm/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	for _, body := range []string{`[]`, `[{"version": "1"}]`, `{`} {
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/warm", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+}
+
+// TestParseImageAndVersion 测试镜像名、版本和平台中的 _、/、. 和端口号都能从文件名还原
+func TestParseImageAndVersion(t *testing.T) {
+	for _, c := range []struct{ image, version, platform string }{
+		{"library/my_app", "1_2", ""},
+		{"my_org/my_app", "1.2.3", ""},
+		{"registry.example.com:5000/team/app", "v1.0-rc_1", ""},
+		{"library/nginx", "latest", "linux/arm64/v8"},
+	} {
+		for _, path := range []string{getImagePath(c.image, c.version, c.platform), getCompressedImagePath(c.image, c.version, c.platform)} {
+			image, version, platform := parseImageAndVersion(filepath.Base(path))
+			assert.Equal(t, c.image, image, path)
+			assert.Equal(t, c.version, version, path)
+			assert.Equal(t, c.platform, platform, path)
+		}
+	}
+	assert.NotEqual(t, getImagePath("my_app", "1", ""), getImagePath("my/app", "1", ""))
+
+	// 旧格式的文件名按最后一个 _ 分割
+	image, version, platform := parseImageAndVersion("library_nginx_1.25.lz4")
+	assert.Equal(t, "library/nginx", image)
+	assert.Equal(t, "1.25", version)
+	assert.Empty(t, platform)
+}
+
+// TestSweepColdFilesUnderscore 测试名称带 _ 的镜像过期时删除正确的 docker 镜像
+func TestSweepColdFilesUnderscore(t *testing.T) {
+	setupTestDirs(t)
+	commands, _ := stubCommands(t)
+
+	coldPath := getImagePath("my_org/my_app", "1_2", "")
+	expiredPath := getCompressedImagePath("library/my_db", "2.0", "")
+	createAgedFile(t, coldPath, 2*coldThreshold)
+	createAgedFile(t, expiredPath, 2*cleanUpThreshold)
+
+	sweepColdFiles()
+
+	assert.Equal(t, [][]string{{"docker", "rmi", "library/my_db:2.0"}}, *commands)
+	assert.FileExists(t, getCompressedImagePath("my_org/my_app", "1_2", ""))
+}
+
+// TestCompressionCodecs 测试每种格式压缩后都能按扩展名解压，并通过 tar 校验
+func TestCompressionCodecs(t *testing.T) {
+	setupTestDirs(t)
+	image := buildImageTar(t)
+	srcPath := filepath.Join(imageDir, "src.tar")
+	assert.NoError(t, os.WriteFile(srcPath, image, 0644))
+
+	for _, c := range codecs {
+		compressedPath := filepath.Join(compressedDir, "image"+c.ext)
+		assert.NoError(t, compressImage(srcPath, compressedPath), c.name)
+		assert.NoError(t, validateCompressedImage(compressedPath), c.name)
+
+		destPath := filepath.Join(imageDir, c.name+".tar")
+		assert.NoError(t, decompressImage(compressedPath, destPath), c.name)
+		data, err := os.ReadFile(destPath)
+		assert.NoError(t, err)
+		assert.Equal(t, image, data, c.name)
+	}
+	assert.Error(t, compressImage(srcPath, filepath.Join(compressedDir, "image.gz")))
+	_, err := codecByName("gzip")
+	assert.Error(t, err)
+}
+
+// TestGetImageZstd 测试默认格式为 lz4 时仍能读取之前用 zstd 压缩的文件
+func TestGetImageZstd(t *testing.T) {
+	setupTestDirs(t)
+	commands, _ := stubCommands(t)
+	srcPath := filepath.Join(t.TempDir(), "src.tar")
+	assert.NoError(t, os.WriteFile(srcPath, buildImageTar(t), 0644))
+	base := filepath.Join(compressedDir, imageFileName("library/nginx", "1.25", ""))
+	assert.NoError(t, compressImage(srcPath, base+".zst"))
+	assert.Equal(t, base+".zst", getCompressedImagePath("library/nginx", "1.25", ""))
+
+	rec := httptest.NewRecorder()
+	getImageHandler(rec, httptest.NewRequest("GET", "/get?name=nginx&version=1.25", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, buildImageTar(t), rec.Body.Bytes())
+	assert.Empty(t, *commands)
+	assert.NoFileExists(t, base+".zst")
+	assert.Equal(t, base+".lz4", getCompressedImagePath("library/nginx", "1.25", ""))
+}
+
+// BenchmarkCompressImage 比较各压缩格式在镜像 tar 上的压缩率和吞吐量
+func BenchmarkCompressImage(b *testing.B) {
+	dir := b.TempDir()
+	// 一半可压缩的文本、一半随机数据，近似镜像层中文本文件和二进制文件的混合
+	var layer bytes.Buffer
+	rng := rand.New(rand.NewSource(1))
+	for layer.Len() < 16*1024*1024 {
+		fmt.Fprintf(&layer, "line %d: /usr/lib/x86_64-linux-gnu/libexample.so.%d\n", layer.Len(), rng.Intn(100))
+		random := make([]byte, 64)
+		rng.Read(random)
+		layer.Write(random)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NoError(b, tw.WriteHeader(&tar.Header{Name: "layer/layer.tar", Mode: 0644, Size: int64(layer.Len())}))
+	_, err := tw.Write(layer.Bytes())
+	assert.NoError(b, err)
+	assert.NoError(b, tw.Close())
+	srcPath := filepath.Join(dir, "image.tar")
+	assert.NoError(b, os.WriteFile(srcPath, buf.Bytes(), 0644))
+
+	for _, c := range codecs {
+		b.Run(c.name, func(b *testing.B) {
+			destPath := filepath.Join(dir, "image"+c.ext)
+			b.SetBytes(int64(buf.Len()))
+			for i := 0; i < b.N; i++ {
+				if err := compressImage(srcPath, destPath); err != nil {
+					b.Fatal(err)
+				}
+			}
+			info, err := os.Stat(destPath)
+			assert.NoError(b, err)
+			b.ReportMetric(float64(buf.Len())/float64(info.Size()), "ratio")
+		})
+	}
+}
+
+// TestListImages 测试 /list 返回未压缩和压缩的镜像及其大小和状态
+func TestListImages(t *testing.T) {
+	setupTestDirs(t)
+	assert.NoError(t, os.WriteFile(getImagePath("my_org/my_app", "1_2", ""), []byte("content"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(compressedDir, imageFileName("library/nginx", "1.25", "")+".zst"), []byte("zst"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(compressedDir, "redis_7.lz4"), []byte("lz4"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(imageDir, "notes.txt"), []byte("ignored"), 0644))
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/list", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var entries []imageEntry
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	for i := range entries {
+		assert.False(t, entries[i].ModTime.IsZero())
+		entries[i].ModTime = time.Time{}
+	}
+	assert.Equal(t, []imageEntry{
+		{Name: "library/nginx", Version: "1.25", Size: 3, State: "cold", Codec: "zstd"},
+		{Name: "my_org/my_app", Version: "1_2", Size: 7, State: "hot"},
+		{Name: "redis", Version: "7", Size: 3, State: "cold", Codec: "lz4"},
+	}, entries)
+}
+
+// TestDeleteImage 测试删除镜像文件和 docker 镜像，都不存在时返回 404
+func TestDeleteImage(t *testing.T) {
+	setupTestDirs(t)
+	commands, removed := stubCommands(t)
+	setConfigForTest(t, currentConfig(), "secret")
+	router := newRouter()
+	deleteImage := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/image?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	imagePath := getImagePath("library/nginx", "latest", "")
+	compressedPath := filepath.Join(compressedDir, imageFileName("library/nginx", "latest", "")+".zst")
+	assert.NoError(t, os.WriteFile(imagePath, []byte("content"), 0644))
+	assert.NoError(t, os.WriteFile(compressedPath, []byte("content"), 0644))
+
+	rec := deleteImage("name=nginx")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var result deleteResult
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, deleteResult{
+		Name:          "library/nginx",
+		Version:       "latest",
+		RemovedFiles:  []string{filepath.Base(imagePath), filepath.Base(compressedPath)},
+		DockerRemoved: true,
+	}, result)
+	assert.Equal(t, []string{imagePath, compressedPath}, *removed)
+	assert.Equal(t, [][]string{{"docker", "rmi", "library/nginx:latest"}}, *commands)
+	assert.NoFileExists(t, imagePath)
+	assert.NoFileExists(t, compressedPath)
+
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		return exec.Command("false")
+	}
+	assert.Equal(t, http.StatusNotFound, deleteImage("name=nginx").Code)
+	assert.Equal(t, http.StatusBadRequest, deleteImage("version=1").Code)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("DELETE", "/image?name=nginx", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+// TestImageDigest 测试保存后记录摘要，服务前发现文件损坏时删除并重新拉取
+func TestImageDigest(t *testing.T) {
+	setupTestDirs(t)
+	commands, _ := stubCommands(t)
+	image := buildImageTar(t)
+	stubSave(t, image)
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		getImageHandler(rec, httptest.NewRequest("GET", "/get?name=nginx", nil))
+		return rec
+	}
+
+	rec := get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	imagePath := getImagePath("library/nginx", "latest", "")
+	sum := sha256.Sum256(image)
+	digest := hex.EncodeToString(sum[:])
+	assert.Equal(t, digest, readImageDigest(imagePath))
+	assert.Len(t, *commands, 2)
+
+	// 摘要一致时直接返回缓存
+	assert.Equal(t, http.StatusOK, get().Code)
+	assert.Len(t, *commands, 2)
+
+	// 文件被截断后重新拉取
+	assert.NoError(t, os.WriteFile(imagePath, image[:2048], 0644))
+	rec = get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, image, rec.Body.Bytes())
+	assert.Len(t, *commands, 4)
+
+	// docker save 输出不完整时返回错误并删除文件
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		if args[0] == "save" {
+			assert.NoError(t, os.WriteFile(args[2], image[:2048], 0644))
+		}
+		return exec.Command("true")
+	}
+	rec = httptest.NewRecorder()
+	getImageHandler(rec, httptest.NewRequest("GET", "/get?name=redis", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.NoFileExists(t, getImagePath("library/redis", "latest", ""))
+	assert.NoFileExists(t, digestPath(getImagePath("library/redis", "latest", "")))
+
+	entries, err := listImages()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, digest, entries[0].SHA256)
+}
+
+// failingWriter 模拟客户端在传输中途断开
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.Body.Len()+len(p) > w.limit {
+		return 0, errors.New("client disconnected")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+// TestStreamCompressedImage 测试边解压边返回，保留解压后的缓存；客户端断开时不留下临时文件
+func TestStreamCompressedImage(t *testing.T) {
+	setupTestDirs(t)
+	stubCommands(t)
+	image := buildImageTar(t)
+	srcPath := filepath.Join(t.TempDir(), "src.tar")
+	assert.NoError(t, os.WriteFile(srcPath, image, 0644))
+	imagePath := getImagePath("library/nginx", "latest", "")
+	compressedPath := getCompressedImagePath("library/nginx", "latest", "")
+	compress := func() {
+		assert.NoError(t, compressImage(srcPath, compressedPath))
+	}
+	get := func(w http.ResponseWriter) {
+		getImageHandler(w, httptest.NewRequest("GET", "/get?name=nginx", nil))
+	}
+
+	// 客户端断开：压缩文件保留，没有临时文件
+	compress()
+	get(&failingWriter{httptest.NewRecorder(), 1024})
+	assert.FileExists(t, compressedPath)
+	assert.NoFileExists(t, imagePath)
+	files, err := os.ReadDir(imageDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// 不保留解压结果时只返回数据
+	keepDecompressed = false
+	rec := httptest.NewRecorder()
+	get(rec)
+	keepDecompressed = true
+	assert.Equal(t, image, rec.Body.Bytes())
+	assert.Equal(t, `attachment; filename="library_nginx_latest.tar"`, rec.Header().Get("Content-Disposition"))
+	assert.FileExists(t, compressedPath)
+	assert.NoFileExists(t, imagePath)
+
+	rec = httptest.NewRecorder()
+	get(rec)
+	assert.Equal(t, image, rec.Body.Bytes())
+	assert.NoFileExists(t, compressedPath)
+	data, err := os.ReadFile(imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, image, data)
+}
+
+// TestRegistryAuth 测试合并配置文件和环境变量中的凭据，配置凭据后拉取时使用 --config
+func TestRegistryAuth(t *testing.T) {
+	setupTestDirs(t)
+	commands, _ := stubCommands(t)
+
+	authFile := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(authFile, []byte(`{"auths": {
+		"registry.example.com": {"auth": "dXNlcjpwYXNz"},
+		"docker.io": {"username": "hub", "password": "old"},
+		"ghcr.io": {"username": "me", "password": "ghp_token"}
+	}}`), 0644))
+	auths, err := loadRegistryAuths(authFile, "index.docker.io", "hub", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]registryAuth{
+		"registry.example.com": {Auth: "dXNlcjpwYXNz"},
+		"ghcr.io":              {Auth: encodeAuth("me", "ghp_token")},
+		dockerHubAuthKey:       {Auth: encodeAuth("hub", "secret")},
+	}, auths)
+
+	_, err = loadRegistryAuths("", "docker.io", "hub", "")
+	assert.Error(t, err)
+	auths, err = loadRegistryAuths("", "docker.io", "", "")
+	assert.NoError(t, err)
+	assert.Empty(t, auths)
+
+	dir, err := writeRegistryConfig(map[string]registryAuth{"ghcr.io": {Auth: encodeAuth("me", "ghp_token")}})
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	info, err := os.Stat(filepath.Join(dir, "config.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	registryConfigDir = dir
+	defer func() { registryConfigDir = "" }()
+	imagePath := getImagePath("ghcr.io/me/app", "1.0", "")
+	assert.NoError(t, pullAndSaveImage("ghcr.io/me/app", "1.0", "", imagePath))
+	assert.Equal(t, [][]string{
+		{"docker", "--config", dir, "pull", "ghcr.io/me/app:1.0"},
+		{"docker", "save", "-o", imagePath, "ghcr.io/me/app:1.0"},
+	}, *commands)
+}
+
+// TestGetImagePlatform 测试指定平台时拉取该平台的镜像，不同平台的缓存文件互不影响
+func TestGetImagePlatform(t *testing.T) {
+	setupTestDirs(t)
+	commands, _ := stubCommands(t)
+	stubSave(t, buildImageTar(t))
+
+	for _, query := range []string{"name=nginx&platform=linux/arm64", "name=nginx"} {
+		rec := httptest.NewRecorder()
+		getImageHandler(rec, httptest.NewRequest("GET", "/get?"+query, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, query)
+	}
+	armPath := getImagePath("library/nginx", "latest", "linux/arm64")
+	hostPath := getImagePath("library/nginx", "latest", "")
+	assert.Equal(t, [][]string{
+		{"docker", "pull", "--platform", "linux/arm64", "library/nginx:latest"},
+		{"docker", "save", "-o", armPath, "library/nginx:latest"},
+		{"docker", "pull", "library/nginx:latest"},
+		{"docker", "save", "-o", hostPath, "library/nginx:latest"},
+	}, *commands)
+	assert.FileExists(t, armPath)
+	assert.FileExists(t, hostPath)
+
+	rec := httptest.NewRecorder()
+	getImageHandler(rec, httptest.NewRequest("GET", "/get?name=nginx&platform=linux/arm64", nil))
+	assert.Equal(t, `attachment; filename="library_nginx_latest_linux_arm64.tar"`, rec.Header().Get("Content-Disposition"))
+	assert.Len(t, *commands, 4)
+
+	rec = httptest.NewRecorder()
+	getImageHandler(rec, httptest.NewRequest("GET", "/get?name=nginx&platform=--help", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// TestCompressionLevel 测试压缩级别的校验，以及各格式在最高级别压缩后能正常解压
+func TestCompressionLevel(t *testing.T) {
+	setupTestDirs(t)
+	lz4Codec, zstdCodec := codecs[0], codecs[1]
+	assert.Equal(t, 0, parseCompressionLevel("", lz4Codec))
+	assert.Equal(t, 9, parseCompressionLevel("9", lz4Codec))
+	assert.Equal(t, 0, parseCompressionLevel("10", lz4Codec))
+	assert.Equal(t, 19, parseCompressionLevel("19", zstdCodec))
+	assert.Equal(t, 0, parseCompressionLevel("0", zstdCodec))
+	assert.Equal(t, 0, parseCompressionLevel("max", zstdCodec))
+
+	image := buildImageTar(t)
+	srcPath := filepath.Join(imageDir, "src.tar")
+	assert.NoError(t, os.WriteFile(srcPath, image, 0644))
+	oldCodec, oldLevel := compressionCodec, compressionLevel
+	defer func() { compressionCodec, compressionLevel = oldCodec, oldLevel }()
+	for _, c := range codecs {
+		compressionCodec, compressionLevel = c, c.maxLevel
+		assert.Equal(t, c.maxLevel, levelFor(c))
+		compressedPath := filepath.Join(compressedDir, "image"+c.ext)
+		assert.NoError(t, compressImage(srcPath, compressedPath), c.name)
+		assert.NoError(t, validateCompressedImage(compressedPath), c.name)
+	}
+	assert.Equal(t, 0, levelFor(lz4Codec))
+
+	// 每个级别都能创建压缩器并压缩
+	for _, c := range codecs {
+		for level := 1; level <= c.maxLevel; level++ {
+			var buf bytes.Buffer
+			w, err := c.newWriter(&buf, level)
+			if !assert.NoError(t, err, "%s level %d", c.name, level) {
+				continue
+			}
+			_, err = w.Write(image)
+			assert.NoError(t, err, "%s level %d", c.name, level)
+			assert.NoError(t, w.Close(), "%s level %d", c.name, level)
+			assert.NotZero(t, buf.Len(), "%s level %d", c.name, level)
+		}
+	}
+}
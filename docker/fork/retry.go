@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// pullAttempts docker pull/save 最多执行的次数，PULL_ATTEMPTS 配置
+	pullAttempts = getEnvInt("PULL_ATTEMPTS", 3)
+	// pullBackoff 第一次重试前的等待时间，之后每次翻倍，PULL_BACKOFF 配置
+	pullBackoff = getEnvDuration("PULL_BACKOFF", 2*time.Second)
+)
+
+// permanentPullErrors 重试也不会成功的错误：镜像或标签不存在、认证失败、镜像名无效
+var permanentPullErrors = []string{
+	"manifest unknown",
+	"not found",
+	"unauthorized",
+	"authentication required",
+	"denied",
+	"invalid reference format",
+	"no space left on device",
+}
+
+// transientPullErrors 网络问题、超时、仓库 5xx 和限流，稍后重试可能成功
+var transientPullErrors = []string{
+	"timeout",
+	"timed out",
+	"connection reset",
+	"connection refused",
+	"unexpected eof",
+	"temporary failure",
+	"toomanyrequests",
+	"too many requests",
+	"rate limit",
+	"internal server error",
+	"bad gateway",
+	"service unavailable",
+	"gateway timeout",
+}
+
+// transientStatusPattern 仓库返回的 5xx 状态码，只匹配 status 之后的状态码，
+// 避免镜像 ID、摘要中恰好包含的 502 等数字被当成临时性错误
+var transientStatusPattern = regexp.MustCompile(`\bstatus(?: code)?:? 50[0234]\b`)
+
+// isRetryablePullError 根据 docker 命令的输出判断失败是否值得重试，无法识别的错误不重试
+func isRetryablePullError(output []byte) bool {
+	text := strings.ToLower(string(output))
+	for _, pattern := range permanentPullErrors {
+		if strings.Contains(text, pattern) {
+			return false
+		}
+	}
+	for _, pattern := range transientPullErrors {
+		if strings.Contains(text, pattern) {
+			return true
+		}
+	}
+	return transientStatusPattern.MatchString(text)
+}
+
+// runDocker 执行 docker 命令并返回合并的输出，临时性错误按指数退避重试，最多 pullAttempts 次
+func runDocker(args ...string) ([]byte, error) {
+	delay := pullBackoff
+	for attempt := 1; ; attempt++ {
+		output, err := execCommand("docker", args...).CombinedOutput()
+		if err == nil {
+			return output, nil
+		}
+		if attempt >= pullAttempts || !isRetryablePullError(output) {
+			return output, err
+		}
+		fmt.Printf("docker %s failed (attempt %d/%d), retrying in %v: %s\n", strings.Join(args, " "), attempt, pullAttempts, delay, strings.TrimSpace(string(output)))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
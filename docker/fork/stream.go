@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// streamDecompress 请求压缩的镜像时边解压边返回，不先写完整的 tar，STREAM_DECOMPRESS 配置
+	streamDecompress = getEnvBool("STREAM_DECOMPRESS", true)
+	// keepDecompressed 边解压边返回时同时写一份 tar 作为缓存并删除压缩文件，KEEP_DECOMPRESSED 配置
+	keepDecompressed = getEnvBool("KEEP_DECOMPRESSED", true)
+)
+
+// streamCompressedImage 把压缩文件解压后直接写入响应。keepDecompressed 时同时写入临时文件，
+// 完整写完且摘要一致后才重命名为 imagePath；客户端断开或解压失败时删除临时文件，保留压缩文件
+func streamCompressedImage(w http.ResponseWriter, compressedPath, imagePath, fileName string) {
+	c, err := codecForPath(compressedPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decompress image: %v", err), http.StatusInternalServerError)
+		return
+	}
+	srcFile, err := os.Open(compressedPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decompress image: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer srcFile.Close()
+	reader, err := c.newReader(srcFile)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decompress image: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	var dst io.Writer = w
+	var tmpFile *os.File
+	h := sha256.New()
+	if keepDecompressed {
+		tmpFile, err = os.CreateTemp(imageDir, filepath.Base(imagePath)+".*.part")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create image file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name()) // 重命名成功后不存在
+		}()
+		dst = io.MultiWriter(w, tmpFile, h)
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.CopyBuffer(dst, reader, make([]byte, chunkSize)); err != nil {
+		fmt.Printf("Streaming %s aborted: %v\n", compressedPath, err)
+		return
+	}
+	if tmpFile == nil {
+		return
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		fmt.Printf("Failed to write %s: %v\n", tmpFile.Name(), err)
+		return
+	}
+	if expected := readImageDigest(imagePath); expected != "" && expected != hex.EncodeToString(h.Sum(nil)) {
+		fmt.Printf("Decompressed %s does not match its sha256, keeping the compressed file\n", compressedPath)
+		return
+	}
+	if err := os.Rename(tmpFile.Name(), imagePath); err != nil {
+		fmt.Printf("Failed to save decompressed image: %v\n", err)
+		return
+	}
+	os.Remove(compressedPath)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"jiaoben-/docker/imageref"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// warmJobTTL 预热任务结束后保留状态的时间，过期的任务在创建新任务时清理
+const warmJobTTL = time.Hour
+
+// 预热任务和镜像的状态
+const (
+	warmPending = "pending"
+	warmRunning = "running"
+	warmDone    = "done"
+	warmCached  = "cached"
+	warmFailed  = "failed"
+)
+
+// warmImage 预热任务中的一个镜像，请求和响应共用
+type warmImage struct {
+	Name     string `json:"name"`
+	Version  string `json:"version,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// warmJob 一次 POST /warm 创建的后台任务，字段读写需持有 mu
+type warmJob struct {
+	mu       sync.Mutex
+	ID       string      `json:"id"`
+	Status   string      `json:"status"`
+	Total    int         `json:"total"`
+	Finished int         `json:"finished"`
+	Failed   int         `json:"failed"`
+	Images   []warmImage `json:"images"`
+	ended    time.Time
+}
+
+var (
+	warmJobs   = make(map[string]*warmJob)
+	warmJobsMu sync.Mutex
+)
+
+// warmHandler 接收 [{"name": "nginx", "version": "1.25"}, ...]，在后台依次拉取并保存，
+// 立即返回 202 和任务 ID，通过 GET /warm/{id} 查询进度
+func warmHandler(w http.ResponseWriter, r *http.Request) {
+	var images []warmImage
+	if err := json.NewDecoder(r.Body).Decode(&images); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(images) == 0 {
+		http.Error(w, "Please provide at least one image", http.StatusBadRequest)
+		return
+	}
+	for i := range images {
+		if images[i].Name == "" {
+			http.Error(w, fmt.Sprintf("Image %d has no name", i), http.StatusBadRequest)
+			return
+		}
+		if images[i].Platform != "" && !platformPattern.MatchString(images[i].Platform) {
+			http.Error(w, fmt.Sprintf("Image %d has an invalid platform %q", i, images[i].Platform), http.StatusBadRequest)
+			return
+		}
+		images[i].Name = imageref.Normalize(images[i].Name)
+		if images[i].Version == "" {
+			images[i].Version = "latest"
+		}
+		images[i].Status = warmPending
+		images[i].Error = ""
+	}
+
+	job := &warmJob{ID: newJobID(), Status: warmPending, Total: len(images), Images: images}
+	warmJobsMu.Lock()
+	for id, old := range warmJobs {
+		old.mu.Lock()
+		expired := !old.ended.IsZero() && time.Since(old.ended) > warmJobTTL
+		old.mu.Unlock()
+		if expired {
+			delete(warmJobs, id)
+		}
+	}
+	warmJobs[job.ID] = job
+	warmJobsMu.Unlock()
+
+	go job.run()
+
+	w.Header().Set("Location", "/warm/"+job.ID)
+	writeWarmJob(w, http.StatusAccepted, job)
+}
+
+// warmStatusHandler 返回预热任务的进度和每个镜像的状态
+func warmStatusHandler(w http.ResponseWriter, r *http.Request) {
+	warmJobsMu.Lock()
+	job, ok := warmJobs[mux.Vars(r)["id"]]
+	warmJobsMu.Unlock()
+	if !ok {
+		http.Error(w, "Warm job not found", http.StatusNotFound)
+		return
+	}
+	writeWarmJob(w, http.StatusOK, job)
+}
+
+func writeWarmJob(w http.ResponseWriter, status int, job *warmJob) {
+	job.mu.Lock()
+	data, err := json.Marshal(job)
+	job.mu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode job: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// run 依次预热每个镜像，与 /get 共用 lock，不会同时拉取同一个镜像
+func (job *warmJob) run() {
+	job.setStatus(warmRunning)
+	for i := range job.Images {
+		job.mu.Lock()
+		image, version, platform := job.Images[i].Name, job.Images[i].Version, job.Images[i].Platform
+		job.Images[i].Status = warmRunning
+		job.mu.Unlock()
+
+		cached, err := warmImageFile(image, version, platform)
+
+		job.mu.Lock()
+		switch {
+		case err != nil:
+			fmt.Printf("Failed to warm %s:%s: %v\n", image, version, err)
+			job.Images[i].Status = warmFailed
+			job.Images[i].Error = err.Error()
+			job.Failed++
+		case cached:
+			job.Images[i].Status = warmCached
+		default:
+			job.Images[i].Status = warmDone
+		}
+		job.Finished++
+		job.mu.Unlock()
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Status = warmDone
+	if job.Failed > 0 {
+		job.Status = warmFailed
+	}
+	job.ended = time.Now()
+}
+
+func (job *warmJob) setStatus(status string) {
+	job.mu.Lock()
+	job.Status = status
+	job.mu.Unlock()
+}
+
+// warmImageFile 镜像文件或压缩文件已存在时返回 true，否则拉取并保存
+func warmImageFile(image, version, platform string) (bool, error) {
+	imagePath := getImagePath(image, version, platform)
+	compressedPath := getCompressedImagePath(image, version, platform)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if fileExists(imagePath) || fileExists(compressedPath) {
+		return true, nil
+	}
+	return false, pullAndVerify(image, version, platform, imagePath)
+}
+
+// newJobID 生成 16 个十六进制字符的随机任务 ID
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,54 @@
+package imageref
+
+import "strings"
+
+// hubPrefixes Docker Hub 的仓库地址前缀，去掉后与省略地址的写法等价
+var hubPrefixes = []string{"docker.io/", "index.docker.io/", "registry-1.docker.io/"}
+
+// Normalize 把 Docker Hub 上的仓库名规范化为 namespace/name 形式：
+// 去掉 docker.io/ 等前缀，只有一段的官方镜像补上 library/，
+// 例如 nginx、docker.io/nginx 和 library/nginx 都得到 library/nginx。
+// 已包含命名空间或其他仓库地址的名称原样返回
+func Normalize(name string) string {
+	for _, prefix := range hubPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			name = strings.TrimPrefix(name, prefix)
+			break
+		}
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return name
+	}
+	return "library/" + name
+}
+
+// v2Endpoints 仓库名之后的 Registry API 路径段
+var v2Endpoints = []string{"/manifests/", "/blobs/", "/tags/"}
+
+// NormalizeV2Path 规范化 /v2/<name>/manifests|blobs|tags/... 路径中的仓库名，
+// 其他路径原样返回
+func NormalizeV2Path(path string) string {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return path
+	}
+	for _, endpoint := range v2Endpoints {
+		if i := strings.Index(rest, endpoint); i > 0 {
+			return "/v2/" + Normalize(rest[:i]) + rest[i:]
+		}
+	}
+	return path
+}
+
+// NormalizeScope 规范化 token 请求中 repository:<name>:<actions> 形式的 scope
+func NormalizeScope(scope string) string {
+	kind, rest, ok := strings.Cut(scope, ":")
+	if !ok || kind != "repository" {
+		return scope
+	}
+	i := strings.LastIndex(rest, ":")
+	if i <= 0 {
+		return scope
+	}
+	return kind + ":" + Normalize(rest[:i]) + rest[i:]
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// maxIdleConnsPerHost 每个镜像保持的空闲连接数，UPSTREAM_MAX_IDLE_PER_HOST 配置
+var maxIdleConnsPerHost = int(getEnvInt64("UPSTREAM_MAX_IDLE_PER_HOST", 16))
+
+// upstreamClient 所有上游请求共用的客户端，复用连接，避免每个请求都重新握手。
+// 单个请求的超时由 upstreamTimeout 通过 context 控制
+var upstreamClient = newUpstreamClient()
+
+func newUpstreamClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 0 // 不限制总数，按 MaxIdleConnsPerHost 限制
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// cacheMaxBytes 缓存目录的最大总大小（字节），超过时按最近访问时间淘汰条目，0 表示不限制。
+	// CACHE_MAX_BYTES 配置
+	cacheMaxBytes = getEnvInt64("CACHE_MAX_BYTES", 0)
+	// cacheSweepInterval 检查缓存大小的间隔，CACHE_SWEEP_INTERVAL 配置
+	cacheSweepInterval = getEnvDuration("CACHE_SWEEP_INTERVAL", 10*time.Minute)
+)
+
+// lastAccess 本进程内各缓存键最近一次命中的时间，没有记录时使用文件的修改时间
+var (
+	accessMu   sync.Mutex
+	lastAccess = make(map[string]time.Time)
+)
+
+// touchCacheEntry 记录缓存条目被访问
+func touchCacheEntry(cacheFilePath string) {
+	accessMu.Lock()
+	lastAccess[extractHashFromURL(cacheFilePath)] = time.Now()
+	accessMu.Unlock()
+}
+
+// evictCandidate 一个可以淘汰的完整缓存条目
+type evictCandidate struct {
+	key      string
+	size     int64
+	lastUsed time.Time
+	refs     []string // 引用该条目的仓库
+}
+
+// evictCache 缓存目录总大小超过 maxBytes 时，删除完整的条目（数据或分片、记录、响应头和引用文件），
+// 直到不超过 maxBytes。引用的仓库少的条目先淘汰，引用数相同时按最近访问时间从旧到新。
+// 被多个仓库引用的条目每次淘汰只移除一个仓库的引用，最后一个引用移除时才删除条目。
+// 正在下载和未完成的条目计入总大小但不删除。返回删除的缓存键
+func evictCache(maxBytes int64) ([]string, error) {
+	entries, err := scanCacheDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	var candidates []evictCandidate
+	for key, e := range entries {
+		files := append([]string{e.data, e.record, e.meta, e.refs}, e.temps...)
+		for _, part := range e.parts {
+			files = append(files, part)
+		}
+		c := evictCandidate{key: key}
+		for _, file := range files {
+			if file == "" {
+				continue
+			}
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			c.size += info.Size()
+			if info.ModTime().After(c.lastUsed) {
+				c.lastUsed = info.ModTime()
+			}
+		}
+		total += c.size
+		if (e.data != "" || e.record != "") && len(e.temps) == 0 && !inFlight(key) {
+			refsMu.Lock()
+			c.refs, err = readCacheRefs(filepath.Join(cacheDir, key+".dat"))
+			refsMu.Unlock()
+			if err != nil {
+				log.Printf("Failed to read refs of cache entry %s: %v", key, err)
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	if total <= maxBytes {
+		return nil, nil
+	}
+
+	accessMu.Lock()
+	for i := range candidates {
+		if t, ok := lastAccess[candidates[i].key]; ok && t.After(candidates[i].lastUsed) {
+			candidates[i].lastUsed = t
+		}
+	}
+	accessMu.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		if len(candidates[i].refs) != len(candidates[j].refs) {
+			return len(candidates[i].refs) < len(candidates[j].refs)
+		}
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+
+	var evicted []string
+	for _, c := range candidates {
+		if total <= maxBytes {
+			break
+		}
+		cacheFilePath := filepath.Join(cacheDir, c.key+".dat")
+		if len(c.refs) > 0 {
+			remaining, err := releaseRepoRef(cacheFilePath, c.refs[0])
+			if err != nil {
+				return evicted, err
+			}
+			if remaining > 0 {
+				continue // 其他仓库仍然引用，条目保留
+			}
+		} else {
+			refsMu.Lock()
+			err := removeCacheEntry(cacheFilePath)
+			refsMu.Unlock()
+			if err != nil {
+				return evicted, err
+			}
+		}
+		accessMu.Lock()
+		delete(lastAccess, c.key)
+		accessMu.Unlock()
+		total -= c.size
+		evicted = append(evicted, c.key)
+	}
+	return evicted, nil
+}
+
+// inFlight 返回 key 是否正在从上游下载
+func inFlight(key string) bool {
+	flightsMu.Lock()
+	defer flightsMu.Unlock()
+	_, ok := flights[key]
+	return ok
+}
+
+// startCacheEvictor 启动后台 goroutine，每隔 interval 把缓存目录淘汰到 maxBytes 以内，ctx 取消后停止
+func startCacheEvictor(ctx context.Context, interval time.Duration, maxBytes int64) {
+	if maxBytes <= 0 || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			evicted, err := evictCache(maxBytes)
+			if err != nil {
+				log.Printf("Failed to evict cache entries: %v", err)
+			}
+			if len(evicted) > 0 {
+				log.Printf("Evicted %d cache entries: %v", len(evicted), evicted)
+			}
+		}
+	}()
+}
@@ -0,0 +1,33 @@
+package main
+
+import "sync"
+
+// blobFlight 一次正在进行的上游 blob 下载
+type blobFlight struct {
+	done chan struct{}
+}
+
+// flights 按缓存键记录正在进行的下载，同一个 blob 的并发请求只有一个访问上游
+var (
+	flightsMu sync.Mutex
+	flights   = make(map[string]*blobFlight)
+)
+
+// joinFlight 加入 key 对应的下载。没有正在进行的下载时调用方成为 leader，
+// 返回的 finish 必须在下载结束（无论成败）后调用；否则返回在 leader 结束时关闭的通道
+func joinFlight(key string) (wait <-chan struct{}, finish func()) {
+	flightsMu.Lock()
+	defer flightsMu.Unlock()
+
+	if flight, ok := flights[key]; ok {
+		return flight.done, nil
+	}
+	flight := &blobFlight{done: make(chan struct{})}
+	flights[key] = flight
+	return nil, func() {
+		flightsMu.Lock()
+		delete(flights, key)
+		flightsMu.Unlock()
+		close(flight.done)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheckInterval 探测死亡镜像的间隔，HEALTH_CHECK_INTERVAL 配置（如 30s），0 表示不探测，
+// 所有镜像都死亡时退回到全部恢复
+var healthCheckInterval = getEnvDuration("HEALTH_CHECK_INTERVAL", 30*time.Second)
+
+// healthCheckTimeout 单次探测的超时时间
+const healthCheckTimeout = 5 * time.Second
+
+// healthChecker 后台探测死亡镜像的 goroutine
+type healthChecker struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartHealthChecks 启动后台 goroutine，每隔 interval 向死亡的URL发送 HEAD /v2/，
+// 返回 200 或 401 时清除死亡标记，正常的URL不探测。
+// 启动后所有URL都死亡时 Get 直接返回空字符串，不再全部恢复。重复调用会先停止之前的探测
+func (um *URLManager) StartHealthChecks(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	um.StopHealthChecks()
+
+	hc := &healthChecker{stop: make(chan struct{}), done: make(chan struct{})}
+	um.mu.Lock()
+	um.health = hc
+	um.mu.Unlock()
+
+	go func() {
+		defer close(hc.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hc.stop:
+				return
+			case <-ticker.C:
+				um.checkDead()
+			}
+		}
+	}()
+}
+
+// StopHealthChecks 停止后台探测并等待正在进行的探测结束
+func (um *URLManager) StopHealthChecks() {
+	um.mu.Lock()
+	hc := um.health
+	um.health = nil
+	um.mu.Unlock()
+	if hc == nil {
+		return
+	}
+	close(hc.stop)
+	<-hc.done
+}
+
+// healthChecking 返回是否正在后台探测，调用方需持有 um.mu
+func (um *URLManager) healthChecking() bool {
+	return um.health != nil
+}
+
+// checkDead 并发探测所有死亡的URL，等待删除的URL除外
+func (um *URLManager) checkDead() {
+	um.mu.RLock()
+	var dead []string
+	for _, urlInfo := range um.urls {
+		urlInfo.mu.Lock()
+		if urlInfo.Dead && !urlInfo.removed {
+			dead = append(dead, urlInfo.URL)
+		}
+		urlInfo.mu.Unlock()
+	}
+	um.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, url := range dead {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			if probeMirror(url) {
+				log.Printf("Mirror %s is healthy again", url)
+				um.markAlive(url)
+			}
+		}(url)
+	}
+	wg.Wait()
+}
+
+// markAlive 清除URL的死亡标记
+func (um *URLManager) markAlive(url string) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	for _, urlInfo := range um.urls {
+		if urlInfo.URL == url {
+			urlInfo.mu.Lock()
+			if !urlInfo.removed {
+				urlInfo.Dead = false
+			}
+			urlInfo.mu.Unlock()
+			break
+		}
+	}
+}
+
+// healthClient 探测使用的客户端，与上游请求共用连接池，不跟随重定向
+var healthClient = &http.Client{
+	Transport: upstreamClient.Transport,
+	Timeout:   healthCheckTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// probeMirror 向镜像发送 HEAD /v2/，返回 200 或 401（需要认证）时认为镜像可用
+func probeMirror(url string) bool {
+	resp, err := healthClient.Head(strings.TrimSuffix(url, "/") + "/v2/")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusUnauthorized
+}
@@ -1,21 +1,28 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -26,68 +33,123 @@ type URLInfo struct {
 	Load         int
 	ResponseTime float64 // 响应时间，以秒为单位
 	Weight       float64 // 动态权重
+	successCount int64   // 成功完成的请求数
+	failCount    int64   // 失败（被标记死亡）的请求数
+	removed      bool    // 已调用 RemoveURL，负载归零后从列表中删除
 	mu           sync.Mutex
 }
 
+// URLStat 是某个URL在某一时刻的统计快照
+type URLStat struct {
+	Pool         string  `json:"pool,omitempty"` // 所属镜像池，由 mirrorStats 填写
+	URL          string  `json:"url"`
+	Dead         bool    `json:"dead"`
+	Load         int     `json:"load"`
+	ResponseTime float64 `json:"response_time"`
+	Weight       float64 `json:"weight"`
+	SuccessCount int64   `json:"success_count"`
+	FailCount    int64   `json:"fail_count"`
+}
+
 // URLManager 管理URL的CRUD操作和负载均衡
 type URLManager struct {
-	urls []*URLInfo
-	mu   sync.RWMutex
-	rand *rand.Rand
+	urls   []*URLInfo
+	mu     sync.RWMutex
+	rand   *rand.Rand
+	randMu sync.Mutex // rand.Rand 不是并发安全的，Get 只持有读锁
+	rrNext uint64     // RoundRobin 下次开始的位置
+	health *healthChecker
+
+	// Strategy 选择URL的算法，应在开始使用前设置
+	Strategy Strategy
+
+	stateFile string              // 保存权重的文件
+	saved     map[string]urlState // 从文件恢复的状态，AddURL 时使用
+	saveMu    sync.Mutex          // 串行化 Save，后开始的保存总是最后写入
 }
 
+// minWeight 权重下限，避免内容长度为 0 或未知时权重为 0、负数或 NaN 导致 URL 永远不会被选中
+const minWeight = 0.01
+
 // NewURLManager 初始化一个URLManager
 func NewURLManager() *URLManager {
 	return &URLManager{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
 }
 
-// AddURL 添加一个新的URL，初始权重为1
+// AddURL 添加一个新的URL，初始权重为1，有保存的状态时使用保存的权重和响应时间
 func (um *URLManager) AddURL(url string) {
 	um.mu.Lock()
 	defer um.mu.Unlock()
-	um.urls = append(um.urls, &URLInfo{URL: url, Weight: 1})
+	urlInfo := &URLInfo{URL: url, Weight: 1}
+	if state, ok := um.saved[url]; ok {
+		urlInfo.Weight = math.Max(state.Weight, minWeight)
+		urlInfo.ResponseTime = state.ResponseTime
+	}
+	um.urls = append(um.urls, urlInfo)
 }
 
-// Get 获取一个可用的URL，使用动态加权最少连接法
+// RemoveURL 删除一个URL，返回是否找到。仍有请求在使用的URL先标记为死亡，
+// 不再被 Get 选中，等负载归零后再从列表中删除
+func (um *URLManager) RemoveURL(url string) bool {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	for i, urlInfo := range um.urls {
+		if urlInfo.URL != url {
+			continue
+		}
+		urlInfo.mu.Lock()
+		defer urlInfo.mu.Unlock()
+		if urlInfo.removed {
+			return false
+		}
+		urlInfo.removed = true
+		urlInfo.Dead = true
+		if urlInfo.Load == 0 {
+			um.urls = append(um.urls[:i:i], um.urls[i+1:]...)
+		}
+		return true
+	}
+	return false
+}
+
+// purge 删除已调用 RemoveURL 且负载归零的 urlInfo
+func (um *URLManager) purge(target *URLInfo) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	for i, urlInfo := range um.urls {
+		if urlInfo == target {
+			um.urls = append(um.urls[:i:i], um.urls[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get 获取一个可用的URL，按 Strategy 选择，默认使用动态加权最少连接法
 func (um *URLManager) Get() string {
 	for {
 		um.mu.RLock()
-		n := len(um.urls)
-		if n == 0 {
+		if len(um.urls) == 0 {
 			um.mu.RUnlock()
 			return ""
 		}
 
-		var selectedURL *URLInfo
-		minLoadRatio := math.MaxFloat64
-		startIndex := um.rand.Intn(n) // 引入随机偏移量
-
-		for i := 0; i < n; i++ {
-			urlInfo := um.urls[(startIndex+i)%n]
-			urlInfo.mu.Lock()
-			if !urlInfo.Dead {
-				loadRatio := float64(urlInfo.Load) / urlInfo.Weight
-				if loadRatio < minLoadRatio {
-					if selectedURL != nil {
-						selectedURL.mu.Unlock()
-					}
-					selectedURL = urlInfo
-					minLoadRatio = loadRatio
-				} else {
-					urlInfo.mu.Unlock()
-				}
-			} else {
-				urlInfo.mu.Unlock()
-			}
-		}
-
+		selectedURL, live := um.pick()
 		if selectedURL != nil {
+			selectedURL.mu.Lock()
 			selectedURL.Load++
 			selectedURL.mu.Unlock()
 			um.mu.RUnlock()
 			return selectedURL.URL
 		}
 
+		// 剩下的都是等待删除的URL，或由后台探测负责恢复
+		if live == 0 || um.healthChecking() {
+			um.mu.RUnlock()
+			return ""
+		}
+
 		// 如果所有URL都标记为死亡，尝试恢复它们
 		um.mu.RUnlock()
 		um.resume()
@@ -96,8 +158,14 @@ func (um *URLManager) Get() string {
 
 // Done 标记URL已完成使用，并记录响应时间和内容长度
 func (um *URLManager) Done(url string, responseTime float64, contentLength int64) {
+	var done *URLInfo
 	um.mu.RLock()
-	defer um.mu.RUnlock()
+	defer func() {
+		um.mu.RUnlock()
+		if done != nil {
+			um.purge(done)
+		}
+	}()
 
 	for _, urlInfo := range um.urls {
 		if urlInfo.URL == url {
@@ -105,6 +173,7 @@ func (um *URLManager) Done(url string, responseTime float64, contentLength int64
 			if urlInfo.Load > 0 {
 				urlInfo.Load--
 			}
+			urlInfo.successCount++
 			// 动态调整权重，考虑响应时间和内容长度
 			beta := 0.7 // 权重因子，增加负载的影响
 			k := 1e6    // 初始调节单位不同带来的影响
@@ -116,6 +185,39 @@ func (um *URLManager) Done(url string, responseTime float64, contentLength int64
 			}
 
 			urlInfo.Weight = beta*float64(urlInfo.Load) + (1-beta)*(float64(contentLength)/responseTime/k)
+			if !(urlInfo.Weight >= minWeight) { // 同时处理 NaN
+				urlInfo.Weight = minWeight
+			}
+			urlInfo.ResponseTime = responseTime
+			if urlInfo.removed && urlInfo.Load == 0 {
+				done = urlInfo
+			}
+			urlInfo.mu.Unlock()
+			break
+		}
+	}
+}
+
+// release 释放URL的负载但不更新统计和权重，用于客户端中途取消的请求
+func (um *URLManager) release(url string) {
+	var done *URLInfo
+	um.mu.RLock()
+	defer func() {
+		um.mu.RUnlock()
+		if done != nil {
+			um.purge(done)
+		}
+	}()
+
+	for _, urlInfo := range um.urls {
+		if urlInfo.URL == url {
+			urlInfo.mu.Lock()
+			if urlInfo.Load > 0 {
+				urlInfo.Load--
+			}
+			if urlInfo.removed && urlInfo.Load == 0 {
+				done = urlInfo
+			}
 			urlInfo.mu.Unlock()
 			break
 		}
@@ -124,27 +226,61 @@ func (um *URLManager) Done(url string, responseTime float64, contentLength int64
 
 // MarkDead 标记URL为死亡状态
 func (um *URLManager) MarkDead(url string) {
+	var dead *URLInfo
 	um.mu.RLock()
-	defer um.mu.RUnlock()
+	defer func() {
+		um.mu.RUnlock()
+		if dead != nil {
+			um.purge(dead)
+		}
+	}()
 
 	for _, urlInfo := range um.urls {
 		if urlInfo.URL == url {
 			urlInfo.mu.Lock()
 			urlInfo.Dead = true
 			urlInfo.Load = 0
+			urlInfo.failCount++
+			if urlInfo.removed {
+				dead = urlInfo
+			}
 			urlInfo.mu.Unlock()
 			break
 		}
 	}
 }
 
-// resume 恢复所有标记为死亡的URL
+// Stats 返回所有URL的统计快照
+func (um *URLManager) Stats() []URLStat {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	stats := make([]URLStat, 0, len(um.urls))
+	for _, urlInfo := range um.urls {
+		urlInfo.mu.Lock()
+		stats = append(stats, URLStat{
+			URL:          urlInfo.URL,
+			Dead:         urlInfo.Dead,
+			Load:         urlInfo.Load,
+			ResponseTime: urlInfo.ResponseTime,
+			Weight:       urlInfo.Weight,
+			SuccessCount: urlInfo.successCount,
+			FailCount:    urlInfo.failCount,
+		})
+		urlInfo.mu.Unlock()
+	}
+	return stats
+}
+
+// resume 恢复所有标记为死亡的URL，等待删除的URL除外
 func (um *URLManager) resume() {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 	for _, urlInfo := range um.urls {
 		urlInfo.mu.Lock()
-		urlInfo.Dead = false
+		if !urlInfo.removed {
+			urlInfo.Dead = false
+		}
 		urlInfo.mu.Unlock()
 	}
 }
@@ -153,11 +289,44 @@ const (
 	bufSize  = 64 * 1024 // 64 KB
 	cacheDir = "cache"   // 缓存目录
 )
-const chunkSize = 100 * 1024 * 1024 // 100MB
-var glourls URLManager
+
+// chunkSize 缓存分片大小，长度未知或超过该值的响应按此大小拆分
+var chunkSize int64 = 100 * 1024 * 1024 // 100MB
+var glourls = NewURLManager()
+
+// maxCacheEntrySize 单个缓存条目的最大总大小（字节），超过时放弃缓存但继续向客户端转发，0 表示不限制
+var maxCacheEntrySize = getEnvInt64("MAX_CACHE_ENTRY_SIZE", 10*1024*1024*1024)
+
+// maxConcurrentPerIP 单个客户端 IP 同时进行的请求数上限，超过时返回 429，0 表示不限制
+var maxConcurrentPerIP = getEnvInt64("MAX_CONCURRENT_PER_IP", 8)
+
+// maxUpstreamAttempts 单个请求最多尝试的上游次数（包括换用其他镜像），UPSTREAM_ATTEMPTS 配置
+var maxUpstreamAttempts = int(getEnvInt64("UPSTREAM_ATTEMPTS", 6))
+
+// strictVerify 为 true 时缓存未命中的 blob 会先完整下载并校验 sha256，校验失败返回错误而不是转发给客户端
+var strictVerify = os.Getenv("STRICT_VERIFY") == "true"
 
 func main() {
-	glourls = *NewURLManager()
+	verifyCache := flag.Bool("verify-cache", false, "校验缓存目录中的条目后退出")
+	repair := flag.Bool("repair", false, "与 -verify-cache 一起使用，删除损坏或不完整的缓存条目")
+	flag.StringVar(&realmBase, "realm", realmBase, "token 服务地址，如 https://proxy.example.com，默认根据请求的 Host 生成")
+	flag.Parse()
+	if *verifyCache {
+		os.Exit(runVerifyCache(cacheDir, *repair))
+	}
+
+	um, err := NewURLManagerFromFile(weightsFile)
+	if err != nil {
+		log.Printf("Failed to restore URL weights: %v", err)
+	}
+	glourls = um
+	if name := os.Getenv("STRATEGY"); name != "" {
+		strategy, err := ParseStrategy(name)
+		if err != nil {
+			log.Fatalf("Invalid STRATEGY: %v", err)
+		}
+		glourls.Strategy = strategy
+	}
 	glourls.AddURL("https://yanyu.icu")
 	glourls.AddURL("https://hub.rat.dev")
 	glourls.AddURL("https://docker.anyhub.us.kg")
@@ -169,12 +338,41 @@ func main() {
 	glourls.AddURL("https://docker.jsdelivr.fyi")
 	glourls.AddURL("https://dockercf.jsdelivr.fyi")
 	glourls.AddURL("https://dockertest.jsdelivr.fyi")
+	if router, err = loadRoutes(routesFile, glourls); err != nil {
+		log.Fatalf("Failed to load routes: %v", err)
+	}
 
 	os.MkdirAll("logs", 0755)
 	os.MkdirAll("cache", 0755)
-	http.HandleFunc("/", handleRequest)
+	http.HandleFunc("/stats", handleStats)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/", limitConcurrency(handleRequest))
+	// SIGTERM 时停止接受新请求，等待进行中的传输结束后再退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	glourls.StartHealthChecks(healthCheckInterval)
+	router.StartHealthChecks(healthCheckInterval)
+	startCacheEvictor(ctx, cacheSweepInterval, cacheMaxBytes)
+	glourls.saveEvery(ctx, weightsSaveInterval)
+	router.saveEvery(ctx, weightsSaveInterval)
+
+	ln, err := net.Listen("tcp", ":23000")
+	if err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println("Listening on :23000")
-	log.Fatal(http.ListenAndServe(":23000", nil))
+	err = serveUntil(ctx, &http.Server{}, ln, shutdownTimeout)
+	glourls.StopHealthChecks()
+	router.StopHealthChecks()
+	if err := glourls.Save(); err != nil {
+		log.Printf("Failed to save URL weights: %v", err)
+	}
+	if err := router.Save(); err != nil {
+		log.Printf("Failed to save URL weights: %v", err)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func handleRequest(w http.ResponseWriter, r *http.Request) {
@@ -188,9 +386,72 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 镜像层已经是压缩格式，只对清单等其他响应启用 gzip
+	if gzipResponses && r.Method != http.MethodHead && !shouldCache(r.URL.Path) && acceptsGzip(r) {
+		gw := newGzipResponseWriter(w)
+		defer gw.Close()
+		w = gw
+	}
+
 	proxyRequest(w, r)
 }
 
+// handleStats 以 JSON 输出所有镜像池中各镜像的统计信息
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(mirrorStats()); err != nil {
+		log.Printf("Failed to encode stats: %v", err)
+	}
+}
+
+// activeRequests 各客户端 IP 正在进行的请求数，归零时删除
+var (
+	activeMu       sync.Mutex
+	activeRequests = make(map[string]int64)
+)
+
+// clientIP 返回请求的客户端 IP，去掉端口
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquireSlot 为 ip 占用一个并发名额，已达上限时返回 false
+func acquireSlot(ip string) bool {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if maxConcurrentPerIP > 0 && activeRequests[ip] >= maxConcurrentPerIP {
+		return false
+	}
+	activeRequests[ip]++
+	return true
+}
+
+// releaseSlot 释放 ip 的一个并发名额
+func releaseSlot(ip string) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if activeRequests[ip]--; activeRequests[ip] <= 0 {
+		delete(activeRequests, ip)
+	}
+}
+
+// limitConcurrency 限制单个客户端 IP 同时进行的请求数，避免一个客户端占满上游带宽
+func limitConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !acquireSlot(ip) {
+			http.Error(w, "Too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		defer releaseSlot(ip)
+		next(w, r)
+	}
+}
+
 func handlePreflight(w http.ResponseWriter, r *http.Request) {
 	// 设置预检请求响应头
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, TRACE, DELETE, HEAD, OPTIONS")
@@ -198,61 +459,162 @@ func handlePreflight(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func serveFromCache(w http.ResponseWriter, cacheFilePath string) bool {
+// serveFromCache 从缓存返回 blob，拆分的缓存按记录文件拼接所有分片。
+// 支持 Range 请求，按请求的区间返回 206；缓存不存在或不完整时不写入任何内容并返回 false
+func serveFromCache(w http.ResponseWriter, r *http.Request, cacheFilePath string) bool {
+	paths := []string{cacheFilePath}
 	recordFilePath := getRecordFilePath(cacheFilePath)
-	if _, err := os.Stat(recordFilePath); os.IsNotExist(err) {
-		// 处理未拆分的文件
-		cacheFile, err := os.Open(cacheFilePath)
-		if err != nil {
-			// log.Printf("Failed to open cache file: %v", err)
-			return false
-		}
-		defer cacheFile.Close()
-
-		w.Header().Set("Content-Type", "application/octet-stream") // 设置合适的 MIME 类型
-		io.Copy(w, cacheFile)
-		return true
-	} else {
+	if _, err := os.Stat(recordFilePath); err == nil {
 		// 处理拆分的文件
 		recordFile, err := os.Open(recordFilePath)
 		if err != nil {
 			log.Printf("Failed to open record file: %v", err)
 			return false
 		}
-		defer recordFile.Close()
-
 		var partCount int
 		var totalSize int64
 		fmt.Fscanf(recordFile, "Parts: %d\nTotalSize: %d\n", &partCount, &totalSize)
+		recordFile.Close()
 
+		paths = paths[:0]
 		for part := 0; part < partCount; part++ {
-			partFilePath := getCacheFilePathWithPart(cacheFilePath, part)
-			cacheFile, err := os.Open(partFilePath)
-			if err != nil {
-				log.Printf("Failed to open cache file part %d: %v", part, err)
-				return false
-			}
-			defer cacheFile.Close()
+			paths = append(paths, getCacheFilePathWithPart(cacheFilePath, part))
+		}
+	}
 
-			_, err = io.Copy(w, cacheFile)
-			if err != nil {
-				log.Printf("Failed to copy cache file part %d: %v", part, err)
-				return false
-			}
+	content, err := openParts(paths)
+	if err != nil {
+		if !os.IsNotExist(err) || len(paths) > 1 {
+			log.Printf("Failed to open cache file: %v", err)
 		}
-		return true
+		return false
+	}
+	defer content.Close()
+
+	meta := readCacheMeta(cacheFilePath)
+	if err := verifyCachedContent(cacheFilePath, content, &meta); err != nil {
+		// 损坏的缓存不返回给客户端，删除后由调用方重新从上游获取
+		log.Printf("Dropping corrupt cache entry %s: %v", cacheFilePath, err)
+		refsMu.Lock()
+		removeCacheEntry(cacheFilePath)
+		refsMu.Unlock()
+		return false
+	}
+
+	setCacheHeaders(w, meta)
+	http.ServeContent(w, r, "", time.Time{}, content)
+	return true
+}
+
+// verifyCachedContent 返回缓存内容之前校验 sha256。meta 中记录过相同大小的校验结果时直接信任，
+// 否则（如旧版本写入的缓存）完整计算一次，一致时记录到 meta 中，之后命中不再计算
+func verifyCachedContent(cacheFilePath string, content *partsReader, meta *cacheMeta) error {
+	digest := extractHashFromURL(cacheFilePath)
+	if !sha256KeyRe.MatchString(digest) || (meta.Verified && meta.Size == content.size) {
+		return nil
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, content); err != nil {
+		return fmt.Errorf("failed to read cache content: %v", err)
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if sum := fmt.Sprintf("%x", hasher.Sum(nil)); !strings.EqualFold(sum, digest) {
+		return fmt.Errorf("digest mismatch: want %s, got %s", digest, sum)
+	}
+	meta.Verified, meta.Size = true, content.size
+	if err := saveCacheMeta(cacheFilePath, *meta); err != nil {
+		log.Printf("Failed to record cache verification: %v", err)
+	}
+	return nil
+}
+
+// cacheMeta 缓存文件旁保存的上游响应头和校验结果
+type cacheMeta struct {
+	ContentType         string `json:"content_type,omitempty"`
+	DockerContentDigest string `json:"docker_content_digest,omitempty"`
+	Verified            bool   `json:"verified,omitempty"` // 内容已通过 sha256 校验
+	Size                int64  `json:"size,omitempty"`     // 校验时的内容大小
+}
+
+// writeCacheMeta 保存上游响应中需要在命中缓存时重放的响应头，
+// verifiedSize 为提交时已校验的内容大小
+func writeCacheMeta(cacheFilePath string, header http.Header, verifiedSize int64) error {
+	return saveCacheMeta(cacheFilePath, cacheMeta{
+		ContentType:         header.Get("Content-Type"),
+		DockerContentDigest: header.Get("Docker-Content-Digest"),
+		Verified:            true,
+		Size:                verifiedSize,
+	})
+}
+
+func saveCacheMeta(cacheFilePath string, meta cacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(getMetaFilePath(cacheFilePath), data)
+}
+
+// readCacheMeta 读取缓存的元数据，没有元数据文件时返回空值
+func readCacheMeta(cacheFilePath string) cacheMeta {
+	var meta cacheMeta
+	if data, err := os.ReadFile(getMetaFilePath(cacheFilePath)); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	return meta
+}
+
+// setCacheHeaders 重放缓存的响应头，旧缓存没有元数据时使用 application/octet-stream
+func setCacheHeaders(w http.ResponseWriter, meta cacheMeta) {
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", meta.ContentType)
+	if meta.DockerContentDigest != "" {
+		w.Header().Set("Docker-Content-Digest", meta.DockerContentDigest)
 	}
 }
 
 func proxyRequest(w http.ResponseWriter, r *http.Request) {
+	// 同一个请求的所有日志和重试共用一个请求 ID，并通过响应头返回给客户端
+	reqID := newRequestID()
+	w.Header().Set(requestIDHeader, reqID)
 	// 创建日志文件
 	logFileName := createLogFileName(r.URL.Path)
 	cacheFilePath := getCacheFilePath(r.URL.Path)
 	// 如果请求路径是缓存路径，则尝试从缓存中读取
+	serveCached := func() bool {
+		if !serveFromCache(w, r, cacheFilePath) {
+			return false
+		}
+		touchCacheEntry(cacheFilePath)
+		if _, err := addCacheRef(cacheFilePath, r.URL.Path); err != nil {
+			log.Printf("[%s] Failed to record cache reference: %v", reqID, err)
+		}
+		return true
+	}
 	if shouldCache(r.URL.Path) {
-		if serveFromCache(w, cacheFilePath) {
+		if serveCached() {
 			return
 		}
+		// 同一个 blob 只有一个请求访问上游，其他请求等它写完缓存后从缓存返回；
+		// 缓存只在校验通过后才提交，leader 失败时不会读到不完整的文件，此时各自访问上游
+		wait, finish := joinFlight(extractHashFromURL(r.URL.Path))
+		if finish != nil {
+			defer finish()
+		} else {
+			select {
+			case <-wait:
+			case <-r.Context().Done():
+				return
+			}
+			if serveCached() {
+				return
+			}
+			log.Printf("[%s] Shared fetch of %s produced no cache entry, fetching upstream", reqID, r.URL.Path)
+		}
 	}
 	f, err := os.OpenFile(logFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -260,15 +622,16 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer f.Close()
-	tickets := 0
-	for {
-		defer func() { tickets++ }()
-		if tickets >= 6 {
+	// 按路径前缀选择镜像池，转发给上游时去掉前缀
+	pool, upstreamPath := routeRequest(r.URL.Path)
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && attempt > maxUpstreamAttempts { // 至少尝试一次
+			log.Printf("[%s] Giving up on %s after %d upstream attempts", reqID, r.URL.Path, maxUpstreamAttempts)
+			http.Error(w, "All upstream attempts failed", http.StatusBadGateway)
 			return
 		}
 
-		defer f.Close()
-		logger := log.New(f, "", log.LstdFlags)
+		logger := newAttemptLogger(f, reqID, attempt)
 		logger.Println("request header print------------------------------------------------")
 		for name, values := range r.Header {
 			for _, value := range values {
@@ -276,52 +639,96 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		// 获取动态负载均衡的URL
-		targetURL := glourls.Get()
+		targetURL := pool.Get()
 		if targetURL == "" {
+			logger.Println("No available URLs")
 			http.Error(w, "No available URLs", http.StatusServiceUnavailable)
 			return
 		}
+		logger.Printf("Trying %s", targetURL)
 		// 修改请求目标
 		proxyURL, err := url.Parse(targetURL)
 		if err != nil {
 			http.Error(w, "Failed to parse target URL", http.StatusInternalServerError)
 			return
 		}
-		proxyURL.Path = r.URL.Path
+		proxyURL.Path = upstreamPath
 		proxyURL.RawQuery = r.URL.RawQuery // 保留原始查询参数
-		// 创建新请求
-		proxyReq, err := http.NewRequest(r.Method, proxyURL.String(), r.Body)
+		// 创建新请求，上游超过 upstreamTimeout 没有响应或没有发送数据时取消
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		idle := newIdleTimer(upstreamTimeout, cancel)
+		defer idle.stop()
+		proxyReq, err := http.NewRequestWithContext(ctx, r.Method, proxyURL.String(), r.Body)
 		if err != nil {
 			http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
 			return
 		}
-		proxyReq.Header = r.Header
+		proxyReq.Header = r.Header.Clone()
+		proxyReq.Header.Set(requestIDHeader, reqID)
 
 		startTime := time.Now()
 		// 发起请求
-		client := &http.Client{}
-		resp, err := client.Do(proxyReq)
+		resp, err := upstreamClient.Do(proxyReq)
 		responseTime := time.Since(startTime).Seconds()
 		if err != nil {
-			fmt.Printf("err2222: %v\n", err)
-			// glourls.MarkDead(proxyURL.Scheme+proxyReq()) // 标记URL为死亡状态
-			continue // 尝试使用下一个URL
+			fmt.Printf("[%s attempt=%d] err2222: %v\n", reqID, attempt, err)
+			if r.Context().Err() != nil {
+				logger.Printf("Client went away: %v", err)
+				pool.release(targetURL)
+				return
+			}
+			if idle.expired() {
+				logger.Printf("Upstream %s timed out after %v", targetURL, upstreamTimeout)
+			} else {
+				logger.Printf("Upstream %s failed: %v", targetURL, err)
+			}
+			pool.MarkDead(targetURL) // 标记URL为死亡状态，释放占用的负载
+			continue                 // 尝试使用下一个URL
 		}
-		fmt.Printf("%v resp.StatusCode: %v\n", targetURL, resp.StatusCode)
+		idle.progress()
+		resp.Body = idleBody{resp.Body, idle}
+		fmt.Printf("[%s attempt=%d] %v resp.StatusCode: %v\n", reqID, attempt, targetURL, resp.StatusCode)
+		logger.Printf("Upstream %s returned %d", targetURL, resp.StatusCode)
 		defer resp.Body.Close()
 
-		glourls.Done(proxyURL.String(), responseTime, resp.ContentLength) // 更新URL的负载信息
+		if resp.StatusCode >= http.StatusInternalServerError {
+			// 只有连接错误和 5xx 说明镜像不可用；404 等是对请求本身的正常应答，直接返回给客户端
+			logger.Printf("Marking %s dead, retrying with next mirror", targetURL)
+			pool.MarkDead(targetURL) // 标记URL为死亡状态，释放占用的负载
+			continue                 // 尝试使用下一个URL
+		}
+
+		pool.Done(targetURL, responseTime, resp.ContentLength) // 更新URL的负载信息
 
-		if resp.StatusCode == http.StatusNotFound {
-			glourls.MarkDead(proxyURL.String()) // 标记URL为死亡状态
-			continue                            // 尝试使用下一个URL
+		// 严格校验模式下先完整下载并校验摘要，通过后再从缓存返回。HEAD 没有响应体，直接转发
+		if strictVerify && r.Method == http.MethodGet && shouldCache(proxyURL.Path) && resp.StatusCode == http.StatusOK {
+			size, err := fetchVerified(resp.Body, cacheFilePath, extractHashFromURL(proxyURL.Path))
+			if err != nil {
+				logger.Printf("Strict verification failed: %v", err)
+				http.Error(w, "Upstream blob failed digest verification", http.StatusBadGateway)
+				return
+			}
+			if err := writeCacheMeta(cacheFilePath, resp.Header, size); err != nil {
+				logger.Printf("Failed to write cache metadata: %v", err)
+			}
+			if _, err := addCacheRef(cacheFilePath, r.URL.Path); err != nil {
+				logger.Printf("Failed to record cache reference: %v", err)
+			}
+			if !serveFromCache(w, r, cacheFilePath) {
+				http.Error(w, "Failed to serve verified blob", http.StatusInternalServerError)
+			}
+			return
 		}
 
 		// 复制响应头和状态码
 		for name, values := range resp.Header {
+			if name == requestIDHeader {
+				continue // 保留本代理生成的请求 ID
+			}
 			for _, value := range values {
 				if name == "Www-Authenticate" {
-					w.Header().Add(name, `Bearer realm="http://192.168.xx.xx:23000/token",service="registry.docker.io"`)
+					w.Header().Add(name, authenticateHeader(r))
 				} else {
 					w.Header().Add(name, value)
 				}
@@ -330,53 +737,28 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) {
 		}
 		w.WriteHeader(resp.StatusCode)
 
-		// 复制并打印响应体
-		var builder strings.Builder
+		// 复制响应体，日志只记录开头的一部分，避免大文件占用内存
+		var body bodySample
 		buf := make([]byte, bufSize)
-		var cacheFile *os.File
-		part := 0
-		totalReadSize := int64(0)
-		split := resp.ContentLength > 100*1024*1024 // 检查是否需要拆分文件
+		// 只缓存完整的 GET 响应，HEAD 和错误响应不会留下缓存条目或附属文件
+		var cw *cacheWriter
+		if r.Method == http.MethodGet && resp.StatusCode == http.StatusOK && shouldCache(proxyURL.Path) {
+			cw = newCacheWriter(cacheFilePath, extractHashFromURL(proxyURL.Path), resp.ContentLength)
+		}
 		for {
 			n, err := resp.Body.Read(buf)
 			if n > 0 {
-				builder.Write(buf[:n])
-				if shouldCache(proxyURL.Path) {
-					if split {
-						// 处理拆分文件
-						if cacheFile == nil || totalReadSize+int64(n) > chunkSize { // 超过100MB创建新文件
-							if cacheFile != nil {
-								totalReadSize = 0
-								cacheFile.Close()
-							}
-							cacheFilePath = getCacheFilePathWithPart(proxyURL.Path, part)
-							cacheFile, err = os.Create(cacheFilePath)
-							if err != nil {
-								logger.Printf("Failed to create cache file: %v", err)
-								return
-							}
-							part++
-						}
-						cacheFile.Write(buf[:n]) // 将响应写入缓存文件
-						totalReadSize += int64(n)
-					} else {
-						// 处理未拆分文件
-						if cacheFile == nil {
-							cacheFile, err = os.Create(cacheFilePath)
-							if err != nil {
-								logger.Printf("Failed to create cache file: %v", err)
-								return
-							}
-							defer cacheFile.Close()
-						}
-						cacheFile.Write(buf[:n])
+				body.Write(buf[:n])
+				if cw != nil {
+					if err := cw.Write(buf[:n]); err != nil {
+						logger.Printf("Abandoning cache entry %s: %v", cacheFilePath, err)
 					}
 				}
 				_, writeErr := w.Write(buf[:n])
 				if writeErr != nil {
 					logger.Printf("Failed to write response body: %v", writeErr)
-					if shouldCache(proxyURL.Path) {
-						os.Remove(cacheFilePath)
+					if cw != nil {
+						cw.abandon()
 					}
 					return
 				}
@@ -386,31 +768,27 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) {
 			}
 			if err != nil {
 				logger.Printf("Failed to read response body: %v", err)
-				if shouldCache(proxyURL.Path) {
-					os.Remove(cacheFilePath)
+				if idle.expired() {
+					logger.Printf("Upstream %s stalled for %v, marking dead", targetURL, upstreamTimeout)
+					pool.MarkDead(targetURL)
+				}
+				if cw != nil {
+					cw.abandon()
 				}
 				return
 			}
 		}
-		body := builder.String()
-		if shouldCache(proxyURL.Path) {
-			if split {
-				if cacheFile != nil {
-					cacheFile.Close()
+		if cw != nil {
+			if err := cw.Close(); err != nil {
+				logger.Printf("Failed to finish cache entry %s: %v", cacheFilePath, err)
+			} else if !cw.abandoned {
+				if err := writeCacheMeta(cacheFilePath, resp.Header, cw.total); err != nil {
+					logger.Printf("Failed to write cache metadata: %v", err)
 				}
-				// 创建记录文件
-				recordFilePath := getRecordFilePath(proxyURL.Path)
-				recordFile, err := os.Create(recordFilePath)
-				if err != nil {
-					logger.Printf("Failed to create record file: %v", err)
-					return
+				if _, err := addCacheRef(cacheFilePath, r.URL.Path); err != nil {
+					logger.Printf("Failed to record cache reference: %v", err)
 				}
-				defer recordFile.Close()
-				record := fmt.Sprintf("Parts: %d\nTotalSize: %d\n", part, totalReadSize)
-				recordFile.Write([]byte(record))
 			}
-
-			go checkCacheFileSize(cacheFilePath, resp.Header.Get("Content-Length"), logger)
 		}
 
 		logger.Println("response header print------------------------------------------------")
@@ -420,20 +798,69 @@ func proxyRequest(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		logger.Printf("body: %v", body)
+		// 按单行记录，多行的响应体也带有请求 ID
+		logger.Printf("body: %s", body.String())
 		return // 成功处理后退出循环
 	}
 }
 
+// maxLoggedBody 日志中记录的响应体最大字节数
+const maxLoggedBody = 4 * 1024
+
+// bodySample 保存响应体的前 maxLoggedBody 字节和总字节数
+type bodySample struct {
+	head  []byte
+	total int64
+}
+
+func (b *bodySample) Write(p []byte) {
+	if room := maxLoggedBody - len(b.head); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		b.head = append(b.head, p[:room]...)
+	}
+	b.total += int64(len(p))
+}
+
+func (b *bodySample) String() string {
+	if b.total > int64(len(b.head)) {
+		return fmt.Sprintf("%q... (%d bytes total)", b.head, b.total)
+	}
+	return fmt.Sprintf("%q (%d bytes)", b.head, b.total)
+}
+
 func shouldCache(urlPath string) bool {
 	return strings.Contains(urlPath, "/blobs/sha256:")
 }
 
+// maxLogNameLen 日志文件名中路径部分的最大长度，超过时截断并附加哈希
+const maxLogNameLen = 80
+
+// logSeq 日志文件序号，保证同一秒内的并发请求不会写入同一个文件
+var logSeq uint64
+
 func createLogFileName(urlPath string) string {
-	// 使用当前时间和 URL 路径创建唯一的日志文件名
+	// 使用当前时间、请求序号和 URL 路径创建唯一的日志文件名
 	timestamp := time.Now().Format("20060102_150405")
-	escapedPath := strings.ReplaceAll(urlPath, "/", "_")
-	return fmt.Sprintf("logs/%s_%s.log", timestamp, escapedPath)
+	seq := atomic.AddUint64(&logSeq, 1)
+	return fmt.Sprintf("logs/%s_%d_%s.log", timestamp, seq, sanitizeLogName(urlPath))
+}
+
+// sanitizeLogName 只保留字母、数字、'.'、'-'、'_'，过长的路径截断后附加哈希
+func sanitizeLogName(urlPath string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, urlPath)
+	if len(safe) > maxLogNameLen {
+		sum := sha256.Sum256([]byte(urlPath))
+		safe = fmt.Sprintf("%s_%x", safe[:maxLogNameLen-17], sum[:8])
+	}
+	return safe
 }
 
 func getCacheFilePath(urlPath string) string {
@@ -451,103 +878,274 @@ func getRecordFilePath(urlPath string) string {
 	return filepath.Join(cacheDir, fmt.Sprintf("%s_record.txt", hash))
 }
 
+func getMetaFilePath(urlPath string) string {
+	hash := extractHashFromURL(urlPath)
+	return filepath.Join(cacheDir, fmt.Sprintf("%s_meta.json", hash))
+}
+
+// digestRe 匹配路径中的 sha256 摘要
+var digestRe = regexp.MustCompile(`sha256:([a-fA-F0-9]{64})`)
+
+// extractHashFromURL 返回缓存键：路径中有 sha256 摘要时使用小写的摘要，与仓库无关，
+// 不同仓库中相同的 blob 共用一个缓存条目；
+// 传入的是缓存文件路径（cache/<key>.dat）时取回其中的键；
+// 其他路径使用完整路径的哈希，避免不同仓库中同名的末段路径共用一个缓存文件
 func extractHashFromURL(urlPath string) string {
-	re := regexp.MustCompile(`sha256:([a-fA-F0-9]+)`)
-	matches := re.FindStringSubmatch(urlPath)
+	matches := digestRe.FindStringSubmatch(urlPath)
 	if len(matches) > 1 {
-		return matches[1]
+		return strings.ToLower(matches[1])
+	}
+	if filepath.Dir(urlPath) == cacheDir {
+		return strings.TrimSuffix(filepath.Base(urlPath), ".dat")
 	}
-	parts := strings.Split(urlPath, "/")
-	return parts[len(parts)-1]
+	sum := sha256.Sum256([]byte(urlPath))
+	return fmt.Sprintf("path_%x", sum[:16])
 }
 
-func checkCacheFileSize(url string, contentLengthStr string, logger *log.Logger) {
-	if contentLengthStr != "" {
-		contentLength, err := strconv.ParseInt(contentLengthStr, 10, 64)
-		if err == nil {
-			fmt.Printf("contentLength: %v\n", contentLength)
+// fetchVerified 将 body 写入临时文件并同时计算 sha256，与 digest 一致时才提交到缓存，返回内容大小
+func fetchVerified(body io.Reader, cacheFilePath, digest string) (int64, error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(cacheFilePath), filepath.Base(cacheFilePath)+".tmp*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temp cache file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
 
-			cacheFilePath := getCacheFilePath(url)
-			recordFilePath := getRecordFilePath(cacheFilePath)
-			if _, err := os.Stat(recordFilePath); os.IsNotExist(err) {
-				// 处理未拆分的文件
-				cacheFile, err := os.Open(cacheFilePath)
-				if err != nil {
-					log.Printf("Failed to open cache file: %v", err)
-					return
-				}
-				defer cacheFile.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(tmpFile, io.TeeReader(body, hasher))
+	tmpFile.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read upstream body: %v", err)
+	}
 
-				buf, err := io.ReadAll(cacheFile)
-				if err != nil {
-					log.Printf("Failed to read cache file: %v", err)
-					return
-				}
+	sum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if !strings.EqualFold(sum, digest) {
+		return 0, fmt.Errorf("digest mismatch: want %s, got %s", digest, sum)
+	}
 
-				sha, err := calculateSHA256(strings.NewReader(string(buf)))
-				if err != nil {
-					log.Printf("Failed to calculate SHA256: %v", err)
-					return
-				}
+	return size, commitCacheFile(tmpPath, cacheFilePath, size)
+}
 
-				shas := fmt.Sprintf("%x", sha)
-				if shas != extractHashFromURL(url) {
-					os.Remove(cacheFilePath)
-				}
-			} else {
-				// 处理拆分的文件
-				recordFile, err := os.Open(recordFilePath)
-				if err != nil {
-					log.Printf("Failed to open record file: %v", err)
-					return
-				}
-				defer recordFile.Close()
-
-				var partCount int
-				var totalSize int64
-				fmt.Fscanf(recordFile, "Parts: %d\nTotalSize: %d\n", &partCount, &totalSize)
-				reader := bytes.Buffer{}
-
-				for part := 0; part < partCount; part++ {
-					partFilePath := getCacheFilePathWithPart(cacheFilePath, part)
-					cacheFile, err := os.Open(partFilePath)
-					if err != nil {
-						log.Printf("Failed to open cache file part %d: %v", part, err)
-						return
-					}
-					defer cacheFile.Close()
+// commitCacheFile 将已校验的临时文件放入缓存，超过 chunkSize 时按缓存格式拆分并写入记录文件。
+// 分片同样先写入临时文件再重命名，记录文件最后写入，之前的中断不会留下可被命中的条目
+func commitCacheFile(tmpPath, cacheFilePath string, size int64) error {
+	if size <= chunkSize {
+		return os.Rename(tmpPath, cacheFilePath)
+	}
 
-					content, err := io.ReadAll(cacheFile)
-					if err != nil {
-						log.Printf("Failed to read cache file part %d: %v", part, err)
-						return
-					}
+	src, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
 
-					reader.Write(content)
-				}
+	part := 0
+	for written := int64(0); written < size; part++ {
+		partPath := getCacheFilePathWithPart(cacheFilePath, part)
+		partFile, err := os.CreateTemp(filepath.Dir(partPath), filepath.Base(partPath)+".tmp*")
+		if err != nil {
+			return err
+		}
+		n, err := io.CopyN(partFile, src, chunkSize)
+		partFile.Close()
+		written += n
+		if err != nil && err != io.EOF {
+			os.Remove(partFile.Name())
+			return err
+		}
+		if err := os.Rename(partFile.Name(), partPath); err != nil {
+			os.Remove(partFile.Name())
+			return err
+		}
+	}
 
-				sha, err := calculateSHA256(&reader)
-				if err != nil {
-					log.Printf("Failed to calculate SHA256: %v", err)
-					return
-				}
+	record := fmt.Sprintf("Parts: %d\nTotalSize: %d\n", part, size)
+	return writeFileAtomic(getRecordFilePath(cacheFilePath), []byte(record))
+}
 
-				shas := fmt.Sprintf("%x", sha)
-				if shas != extractHashFromURL(url) {
-					for part := 0; part < partCount; part++ {
-						partFilePath := getCacheFilePathWithPart(cacheFilePath, part)
-						os.Remove(partFilePath)
-					}
-					os.Remove(recordFilePath)
-				}
+// writeFileAtomic 先写入临时文件再重命名，中断时不会留下半个文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// cacheWriter 将上游响应写入缓存，写入的同时计算 sha256。长度未知或超过 chunkSize 时
+// 按 chunkSize 滚动写入分片。所有文件先写入临时文件，结束时摘要一致才重命名到缓存位置，
+// 拆分时最后写入记录文件；不一致、出错或总大小超过 maxCacheEntrySize 时放弃缓存并删除临时文件。
+// 进程崩溃只会留下临时文件，不会被当作完整的缓存返回
+type cacheWriter struct {
+	cacheFilePath string
+	digest        string
+	split         bool
+	hasher        hash.Hash
+	file          *os.File
+	tmpPaths      []string // 每个分片（未拆分时为整个文件）的临时文件
+	committed     int      // 已重命名到缓存位置的文件数
+	partSize      int64    // 当前分片已写入的大小
+	total         int64    // 已写入的总大小
+	abandoned     bool
+}
+
+func newCacheWriter(cacheFilePath, digest string, contentLength int64) *cacheWriter {
+	return &cacheWriter{
+		cacheFilePath: cacheFilePath,
+		digest:        digest,
+		split:         contentLength < 0 || contentLength > chunkSize,
+		hasher:        sha256.New(),
+	}
+}
+
+// Write 写入一段数据，出错或超过大小限制时放弃缓存并返回原因，之后的写入直接忽略
+func (cw *cacheWriter) Write(p []byte) error {
+	if cw.abandoned {
+		return nil
+	}
+	if maxCacheEntrySize > 0 && cw.total+int64(len(p)) > maxCacheEntrySize {
+		cw.abandon()
+		return fmt.Errorf("exceeds max cache entry size %d", maxCacheEntrySize)
+	}
+	cw.hasher.Write(p)
+
+	for len(p) > 0 {
+		if cw.file == nil || (cw.split && cw.partSize == chunkSize) {
+			if err := cw.nextFile(); err != nil {
+				cw.abandon()
+				return err
 			}
 		}
+		n := len(p)
+		if cw.split && int64(n) > chunkSize-cw.partSize {
+			n = int(chunkSize - cw.partSize)
+		}
+		if _, err := cw.file.Write(p[:n]); err != nil {
+			cw.abandon()
+			return err
+		}
+		cw.partSize += int64(n)
+		cw.total += int64(n)
+		p = p[n:]
 	}
+	return nil
 }
-func calculateSHA256(reader io.Reader) ([]byte, error) {
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, reader); err != nil {
-		return nil, fmt.Errorf("could not copy file contents to hasher: %v", err)
+
+// finalPath 返回第 i 个文件提交后的路径
+func (cw *cacheWriter) finalPath(i int) string {
+	if !cw.split {
+		return cw.cacheFilePath
+	}
+	return getCacheFilePathWithPart(cw.cacheFilePath, i)
+}
+
+// nextFile 关闭当前文件并为下一个分片创建临时文件
+func (cw *cacheWriter) nextFile() error {
+	if cw.file != nil {
+		cw.file.Close()
+	}
+	path := cw.finalPath(len(cw.tmpPaths))
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	cw.file = file
+	cw.tmpPaths = append(cw.tmpPaths, file.Name())
+	cw.partSize = 0
+	return nil
+}
+
+// Close 关闭缓存文件并校验摘要，一致时把临时文件重命名到缓存位置，拆分时再写入记录文件
+func (cw *cacheWriter) Close() error {
+	if cw.abandoned || cw.file == nil {
+		return nil
+	}
+	if err := cw.file.Close(); err != nil {
+		cw.abandon()
+		return err
+	}
+	cw.file = nil
+
+	if sum := fmt.Sprintf("%x", cw.hasher.Sum(nil)); !strings.EqualFold(sum, cw.digest) {
+		cw.abandon()
+		return fmt.Errorf("digest mismatch: want %s, got %s", cw.digest, sum)
+	}
+	for i, tmpPath := range cw.tmpPaths {
+		if err := os.Rename(tmpPath, cw.finalPath(i)); err != nil {
+			cw.abandon()
+			return err
+		}
+		cw.committed++
+	}
+	if !cw.split {
+		return nil
+	}
+
+	record := fmt.Sprintf("Parts: %d\nTotalSize: %d\n", len(cw.tmpPaths), cw.total)
+	if err := writeFileAtomic(getRecordFilePath(cw.cacheFilePath), []byte(record)); err != nil {
+		cw.abandon()
+		return err
+	}
+	return nil
+}
+
+// abandon 放弃缓存，删除临时文件和提交失败前已重命名的分片
+func (cw *cacheWriter) abandon() {
+	if cw.abandoned {
+		return
+	}
+	cw.abandoned = true
+	if cw.file != nil {
+		cw.file.Close()
+		cw.file = nil
+	}
+	for i, tmpPath := range cw.tmpPaths {
+		if i < cw.committed {
+			os.Remove(cw.finalPath(i))
+		} else {
+			os.Remove(tmpPath)
+		}
+	}
+}
+
+func getEnv(key, fallback string) string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	return value
+}
+
+func getEnvInt64(key string, fallback int64) int64 {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback
 	}
-	return hasher.Sum(nil), nil
+	return d
 }
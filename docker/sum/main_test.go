@@ -0,0 +1,1549 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCreateLogFileNameSafe 测试日志文件名只包含安全字符且长度受限
+func TestCreateLogFileNameSafe(t *testing.T) {
+	safe := regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	paths := []string{
+		"/v2/library/nginx/blobs/sha256:abc",
+		"/v2/x/manifests/latest?a=b&c=d",
+		"/token?scope=repository:library/nginx:pull",
+		"/" + strings.Repeat("very-long-segment/", 50),
+	}
+	for _, p := range paths {
+		name := createLogFileName(p)
+		assert.Equal(t, "logs", filepath.Dir(name))
+		base := filepath.Base(name)
+		assert.Regexp(t, safe, base, p)
+		assert.LessOrEqual(t, len(base), 128, p)
+	}
+
+	// 截断后不同的长路径不能得到相同的名字
+	long := "/" + strings.Repeat("a", 200)
+	assert.NotEqual(t, sanitizeLogName(long+"1"), sanitizeLogName(long+"2"))
+}
+
+// TestCreateLogFileNameUnique 测试并发请求同一路径时文件名不冲突
+func TestCreateLogFileNameUnique(t *testing.T) {
+	const n = 200
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	names := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := createLogFileName("/v2/library/nginx/blobs/sha256:abc")
+			mu.Lock()
+			names[name] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, names, n)
+}
+
+// findStat 按URL查找统计快照
+func findStat(stats []URLStat, url string) URLStat {
+	for _, stat := range stats {
+		if stat.URL == url {
+			return stat
+		}
+	}
+	return URLStat{}
+}
+
+// TestURLManagerCounters 测试成功和失败计数
+func TestURLManagerCounters(t *testing.T) {
+	um := NewURLManager()
+	um.AddURL("https://a.example")
+	um.AddURL("https://b.example")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			um.Done("https://a.example", 0.1, 1024)
+		}()
+		go func() {
+			defer wg.Done()
+			um.MarkDead("https://b.example")
+		}()
+	}
+	wg.Wait()
+	um.Done("https://b.example", 0.1, 1024)
+
+	stats := um.Stats()
+	assert.Len(t, stats, 2)
+	a := findStat(stats, "https://a.example")
+	assert.Equal(t, int64(10), a.SuccessCount)
+	assert.Equal(t, int64(0), a.FailCount)
+	b := findStat(stats, "https://b.example")
+	assert.Equal(t, int64(1), b.SuccessCount)
+	assert.Equal(t, int64(10), b.FailCount)
+	assert.True(t, b.Dead)
+}
+
+// setupProxyTest 切换到临时工作目录并使用 upstream 作为唯一镜像
+func setupProxyTest(t *testing.T, upstream http.Handler) *httptest.Server {
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	assert.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+	assert.NoError(t, os.MkdirAll("logs", 0755))
+	assert.NoError(t, os.MkdirAll(cacheDir, 0755))
+
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	glourls = NewURLManager()
+	glourls.AddURL(server.URL)
+	return server
+}
+
+// blobPath 返回内容对应的 blob 请求路径
+func blobPath(content []byte) string {
+	return fmt.Sprintf("/v2/library/test/blobs/sha256:%x", sha256.Sum256(content))
+}
+
+// TestStrictVerifyMismatch 测试严格模式下摘要不匹配时返回错误且不缓存
+func TestStrictVerifyMismatch(t *testing.T) {
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("corrupted content"))
+	}))
+	strictVerify = true
+	defer func() { strictVerify = false }()
+
+	path := blobPath([]byte("expected content"))
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "corrupted content")
+	assert.NoFileExists(t, getCacheFilePath(path))
+}
+
+// TestStrictVerifyMatch 测试严格模式下摘要匹配时返回内容并写入缓存
+func TestStrictVerifyMatch(t *testing.T) {
+	content := []byte("expected content")
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	strictVerify = true
+	defer func() { strictVerify = false }()
+
+	path := blobPath(content)
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.FileExists(t, getCacheFilePath(path))
+}
+
+// TestStrictVerifyHead 测试严格模式下 HEAD 请求直接转发响应头，不校验空的响应体
+func TestStrictVerifyHead(t *testing.T) {
+	content := []byte("expected content")
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	strictVerify = true
+	defer func() { strictVerify = false }()
+
+	path := blobPath(content)
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("HEAD", path, nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Body.Bytes())
+	assert.NoFileExists(t, getCacheFilePath(path))
+}
+
+// TestHeadNotCached 测试 HEAD 请求不创建缓存条目，也不留下响应头和引用文件
+func TestHeadNotCached(t *testing.T) {
+	content := []byte("blob content")
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("HEAD", blobPath(content), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	entries, err := os.ReadDir(cacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// TestNotFoundCountedAsSuccess 测试镜像返回 404 时计为成功的请求，不计为失败，镜像仍在轮换中
+func TestNotFoundCountedAsSuccess(t *testing.T) {
+	setupProxyTest(t, http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	stats := glourls.Stats()
+	assert.Len(t, stats, 1)
+	assert.Positive(t, stats[0].SuccessCount)
+	assert.Zero(t, stats[0].FailCount)
+	assert.False(t, stats[0].Dead)
+}
+
+// TestNotFoundKeepsMirror 测试镜像返回 404 时原样返回给客户端且不标记死亡，
+// 开启健康检查时之后的请求仍能使用该镜像
+func TestNotFoundKeepsMirror(t *testing.T) {
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	glourls.StartHealthChecks(time.Hour)
+	defer glourls.StopHealthChecks()
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"ok":true}`, rec.Body.String())
+}
+
+// TestStreamVerifyMatch 测试非严格模式下边转发边校验，摘要匹配时提交缓存并在之后命中
+func TestStreamVerifyMatch(t *testing.T) {
+	content := []byte("expected content")
+	upstreamCalls := 0
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Write(content)
+	}))
+
+	path := blobPath(content)
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.FileExists(t, getCacheFilePath(path))
+
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, 1, upstreamCalls)
+	assert.Equal(t, content, rec.Body.Bytes())
+
+	// 提交后不留下临时文件
+	report, err := VerifyCache(cacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Defects)
+}
+
+// TestStreamVerifyMismatch 测试非严格模式下摘要不匹配时客户端仍收到响应，但临时文件被删除且不缓存
+func TestStreamVerifyMismatch(t *testing.T) {
+	content := []byte(strings.Repeat("corrupted content", 20))
+	upstreamCalls := 0
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Write(content)
+	}))
+	defer func(old int64) { chunkSize = old }(chunkSize)
+
+	for _, size := range []int64{1024, 100} { // 未拆分和拆分两种写入方式
+		chunkSize = size
+		path := blobPath([]byte("expected content"))
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, content, rec.Body.Bytes())
+
+		entries, err := os.ReadDir(cacheDir)
+		assert.NoError(t, err)
+		assert.Empty(t, entries, "chunk size %d", size)
+	}
+	assert.Equal(t, 2, upstreamCalls)
+}
+
+// TestCacheUnknownLengthSplit 测试长度未知的响应按 chunkSize 拆分缓存
+func TestCacheUnknownLengthSplit(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 25))
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 分多次写入并刷新，响应使用 chunked 编码，长度未知
+		for i := 0; i < len(content); i += 50 {
+			w.Write(content[i : i+50])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer func(old int64) { chunkSize = old }(chunkSize)
+	chunkSize = 100
+
+	path := blobPath(content)
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, content, rec.Body.Bytes())
+
+	cacheFilePath := getCacheFilePath(path)
+	record, err := os.ReadFile(getRecordFilePath(cacheFilePath))
+	assert.NoError(t, err)
+	assert.Equal(t, "Parts: 3\nTotalSize: 250\n", string(record))
+	for part, size := range []int64{100, 100, 50} {
+		info, err := os.Stat(getCacheFilePathWithPart(cacheFilePath, part))
+		assert.NoError(t, err)
+		assert.Equal(t, size, info.Size())
+	}
+
+	// 拆分后的缓存可以完整读回
+	rec = httptest.NewRecorder()
+	assert.True(t, serveFromCache(rec, httptest.NewRequest("GET", path, nil), cacheFilePath))
+	assert.Equal(t, content, rec.Body.Bytes())
+}
+
+// TestCacheEntryTooLarge 测试超过最大缓存大小时放弃缓存，但客户端仍收到完整响应
+func TestCacheEntryTooLarge(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 25))
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < len(content); i += 50 {
+			w.Write(content[i : i+50])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer func(old int64) { chunkSize = old }(chunkSize)
+	defer func(old int64) { maxCacheEntrySize = old }(maxCacheEntrySize)
+	chunkSize = 100
+	maxCacheEntrySize = 200
+
+	path := blobPath(content)
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.Bytes())
+
+	entries, err := os.ReadDir(cacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// TestCacheKeyNamespace 测试末段相同但仓库不同的路径使用不同的缓存文件
+func TestCacheKeyNamespace(t *testing.T) {
+	a := getCacheFilePath("/v2/team-a/app/blobs/latest")
+	b := getCacheFilePath("/v2/team-b/app/blobs/latest")
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, cacheDir, filepath.Dir(a))
+
+	// 摘要路径仍以摘要为键，与仓库无关
+	digest := strings.Repeat("ab", 32)
+	assert.Equal(t, getCacheFilePath("/v2/team-a/app/blobs/sha256:"+digest), getCacheFilePath("/v2/team-b/app/blobs/sha256:"+digest))
+	assert.Equal(t, filepath.Join(cacheDir, digest+".dat"), getCacheFilePath("/v2/x/blobs/sha256:"+digest))
+
+	// 由缓存文件路径推导的分片和记录文件与由请求路径推导的一致
+	path := "/v2/team-a/app/blobs/latest"
+	assert.Equal(t, getRecordFilePath(path), getRecordFilePath(getCacheFilePath(path)))
+	assert.Equal(t, getCacheFilePathWithPart(path, 1), getCacheFilePathWithPart(getCacheFilePath(path), 1))
+}
+
+// newTestManager 创建包含给定URL的URLManager
+func newTestManager(urls ...string) *URLManager {
+	um := NewURLManager()
+	for _, u := range urls {
+		um.AddURL(u)
+	}
+	return um
+}
+
+// TestURLManagerGetEmpty 测试没有URL时返回空字符串
+func TestURLManagerGetEmpty(t *testing.T) {
+	assert.Equal(t, "", NewURLManager().Get())
+}
+
+// TestURLManagerDistributionByWeight 测试并发请求按权重分配
+func TestURLManagerDistributionByWeight(t *testing.T) {
+	um := newTestManager("https://a.example", "https://b.example")
+	um.urls[0].Weight = 1
+	um.urls[1].Weight = 3
+
+	// 请求一直未完成，负载按权重累积
+	counts := map[string]int{}
+	for i := 0; i < 400; i++ {
+		counts[um.Get()]++
+	}
+	assert.InDelta(t, 100, counts["https://a.example"], 2)
+	assert.InDelta(t, 300, counts["https://b.example"], 2)
+}
+
+// TestURLManagerDeadAndResume 测试跳过死亡的URL，全部死亡时恢复
+func TestURLManagerDeadAndResume(t *testing.T) {
+	um := newTestManager("https://a.example", "https://b.example")
+	um.MarkDead("https://a.example")
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "https://b.example", um.Get())
+	}
+
+	um.MarkDead("https://b.example")
+	assert.NotEmpty(t, um.Get())
+	for _, stat := range um.Stats() {
+		assert.False(t, stat.Dead, stat.URL)
+	}
+}
+
+// TestURLManagerRemoveURL 测试删除的URL不再被选中，仍在使用的URL等负载归零后才从列表中删除
+func TestURLManagerRemoveURL(t *testing.T) {
+	um := newTestManager("https://a.example", "https://b.example", "https://c.example")
+	assert.True(t, um.RemoveURL("https://b.example"))
+	assert.False(t, um.RemoveURL("https://b.example"))
+	assert.False(t, um.RemoveURL("https://x.example"))
+	assert.Len(t, um.Stats(), 2)
+	for i := 0; i < 100; i++ {
+		u := um.Get()
+		assert.NotEqual(t, "https://b.example", u)
+		um.Done(u, 0.1, 1024)
+	}
+
+	// 正在使用的URL先标记为死亡，请求完成后删除
+	um = newTestManager("https://a.example")
+	assert.Equal(t, "https://a.example", um.Get())
+	assert.True(t, um.RemoveURL("https://a.example"))
+	assert.Len(t, um.Stats(), 1)
+	assert.Equal(t, "", um.Get())
+	um.Done("https://a.example", 0.1, 1024)
+	assert.Empty(t, um.Stats())
+}
+
+// TestURLManagerHealthChecks 测试后台探测只恢复返回 200/401 的死亡镜像，探测期间全部死亡时 Get 不再恢复
+func TestURLManagerHealthChecks(t *testing.T) {
+	var probes sync.Map
+	newMirror := func(status int) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			probes.Store(r.Host, r.Method+" "+r.URL.Path)
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+	healthy, auth, down := newMirror(http.StatusOK), newMirror(http.StatusUnauthorized), newMirror(http.StatusBadGateway)
+	alive := newMirror(http.StatusOK)
+
+	um := newTestManager(healthy, auth, down, alive)
+	for _, u := range []string{healthy, auth, down, alive} {
+		um.MarkDead(u)
+	}
+	um.StartHealthChecks(time.Hour)
+	defer um.StopHealthChecks()
+	assert.Equal(t, "", um.Get())
+
+	um.markAlive(alive)
+	um.checkDead()
+	dead := map[string]bool{}
+	for _, stat := range um.Stats() {
+		dead[stat.URL] = stat.Dead
+	}
+	assert.Equal(t, map[string]bool{healthy: false, auth: false, down: true, alive: false}, dead)
+
+	host := strings.TrimPrefix(healthy, "http://")
+	method, _ := probes.Load(host)
+	assert.Equal(t, "HEAD /v2/", method)
+	_, probed := probes.Load(strings.TrimPrefix(alive, "http://"))
+	assert.False(t, probed, "healthy URLs should be skipped")
+
+	// 停止后恢复原来的行为
+	um.StopHealthChecks()
+	um.MarkDead(healthy)
+	um.MarkDead(auth)
+	um.MarkDead(alive)
+	assert.NotEmpty(t, um.Get())
+}
+
+// TestURLManagerZeroWeight 测试内容长度为 0 或未知时URL仍然可以被选中
+func TestURLManagerZeroWeight(t *testing.T) {
+	um := newTestManager("https://a.example")
+	for _, contentLength := range []int64{0, -1} {
+		assert.Equal(t, "https://a.example", um.Get())
+		um.Done("https://a.example", 0, contentLength)
+
+		done := make(chan string)
+		go func() { done <- um.Get() }()
+		select {
+		case u := <-done:
+			assert.Equal(t, "https://a.example", u)
+		case <-time.After(time.Second):
+			t.Fatalf("Get did not return after content length %d", contentLength)
+		}
+		um.Done("https://a.example", 0.1, 1024)
+	}
+}
+
+// TestURLManagerConcurrent 测试并发调用不会死锁，负载最终归零（配合 -race 运行）
+func TestURLManagerConcurrent(t *testing.T) {
+	urls := []string{"https://a.example", "https://b.example", "https://c.example", "https://d.example"}
+	um := newTestManager(urls...)
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					u := um.Get()
+					switch {
+					case j%17 == 0:
+						um.MarkDead(u)
+					default:
+						um.Done(u, 0.05, int64(1024*(j+1)))
+					}
+					if i == 0 && j == 50 {
+						um.AddURL("https://e.example")
+					}
+					_ = um.Stats()
+				}
+			}(i)
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock: concurrent URLManager calls did not finish")
+	}
+
+	for _, stat := range um.Stats() {
+		assert.Equal(t, 0, stat.Load, stat.URL)
+	}
+}
+
+// TestProxyUpdatesURLStats 测试代理完成请求后能找到对应的URL并更新统计，
+// 之前传入的是附加了请求路径的URL，Done 找不到URL，负载永远不会减少
+func TestProxyUpdatesURLStats(t *testing.T) {
+	server := setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	stat := findStat(glourls.Stats(), server.URL)
+	assert.Equal(t, int64(1), stat.SuccessCount)
+	assert.Equal(t, 0, stat.Load)
+}
+
+// TestCacheReplaysContentType 测试命中缓存时返回上游的 Content-Type 和 Docker-Content-Digest
+func TestCacheReplaysContentType(t *testing.T) {
+	const contentType = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	content := []byte("layer content")
+	path := blobPath(content)
+	digest := "sha256:" + extractHashFromURL(path)
+	upstreamCalls := 0
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write(content)
+	}))
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, contentType, rec.Header().Get("Content-Type"))
+
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, 1, upstreamCalls)
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.Equal(t, contentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, digest, rec.Header().Get("Docker-Content-Digest"))
+
+	// 没有元数据的旧缓存使用默认类型
+	assert.NoError(t, os.Remove(getMetaFilePath(getCacheFilePath(path))))
+	rec = httptest.NewRecorder()
+	assert.True(t, serveFromCache(rec, httptest.NewRequest("GET", path, nil), getCacheFilePath(path)))
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+	assert.Empty(t, rec.Header().Get("Docker-Content-Digest"))
+}
+
+// TestVerifyCache 测试损坏的缓存目录中各类问题被正确归类，修复后只保留完好的条目
+func TestVerifyCache(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	key := func(content string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	}
+
+	// 完好的单文件和拆分条目
+	good, split := key("good"), key("hello world")
+	write(good+".dat", "good")
+	write(good+"_meta.json", "{}")
+	write(split+"_part_0.dat", "hello ")
+	write(split+"_part_1.dat", "world")
+	write(split+"_record.txt", "Parts: 2\nTotalSize: 11\n")
+	write("path_0123.dat", "not content-addressed")
+
+	// 内容与文件名不一致
+	corrupt := key("original")
+	write(corrupt+".dat", "tampered")
+	// 记录文件指向缺失的分片
+	dangling := key("dangling")
+	write(dangling+"_part_0.dat", "dang")
+	write(dangling+"_record.txt", "Parts: 2\nTotalSize: 8\n")
+	// 没有记录文件的分片
+	orphan := key("orphan")
+	write(orphan+"_part_0.dat", "orph")
+	// 分片总大小与记录不一致
+	short := key("short")
+	write(short+"_part_0.dat", "sh")
+	write(short+"_record.txt", "Parts: 1\nTotalSize: 5\n")
+	// 没有数据的响应头文件和中断写入的临时文件
+	meta := key("meta")
+	write(meta+"_meta.json", "{}")
+	temp := key("temp")
+	write(temp+".dat.tmp123", "partial")
+
+	report, err := VerifyCache(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, report.Entries)
+	assert.Equal(t, 2, report.Verified)
+
+	kinds := make(map[string]string)
+	for _, defect := range report.Defects {
+		kinds[defect.Key] = defect.Kind
+	}
+	assert.Equal(t, map[string]string{
+		corrupt:  defectHashMismatch,
+		dangling: defectMissingPart,
+		orphan:   defectOrphanPart,
+		short:    defectSizeMismatch,
+		meta:     defectOrphanMeta,
+		temp:     defectStaleTemp,
+	}, kinds)
+
+	_, err = report.Repair()
+	assert.NoError(t, err)
+
+	report, err = VerifyCache(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Defects)
+	assert.Equal(t, 3, report.Entries)
+	assert.Equal(t, 2, report.Verified)
+	_, err = os.Stat(filepath.Join(dir, good+"_meta.json"))
+	assert.NoError(t, err)
+}
+
+// TestGzipResponses 测试接受 gzip 的客户端获取的清单被压缩，镜像层原样返回
+func TestGzipResponses(t *testing.T) {
+	manifest := `{"schemaVersion":2,"layers":[]}`
+	layer := []byte("already compressed layer")
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			w.Header().Set("Content-Type", "application/vnd.docker.image.rootfs.diff.tar.gzip")
+			w.Write(layer)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+		w.Write([]byte(manifest))
+	}))
+
+	req := httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handleRequest(rec, req)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Content-Length"))
+	zr, err := gzip.NewReader(rec.Body)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, manifest, string(body))
+
+	// 不接受 gzip 的客户端得到原始内容
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, manifest, rec.Body.String())
+
+	// 镜像层即使客户端接受 gzip 也不压缩，首次转发和命中缓存都一样
+	path := blobPath(layer)
+	for i := 0; i < 2; i++ {
+		req = httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec = httptest.NewRecorder()
+		handleRequest(rec, req)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"))
+		assert.Equal(t, layer, rec.Body.Bytes())
+	}
+}
+
+// TestLimitConcurrency 测试同一 IP 超过并发上限的请求被拒绝，完成的请求释放名额
+func TestLimitConcurrency(t *testing.T) {
+	old := maxConcurrentPerIP
+	maxConcurrentPerIP = 3
+	defer func() { maxConcurrentPerIP = old }()
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := limitConcurrency(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+	})
+	request := func(ip, target string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = ip
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			assert.Equal(t, http.StatusOK, request(fmt.Sprintf("10.0.0.1:%d", port), "/v2/?block=1"))
+		}(1000 + i)
+		<-entered
+	}
+
+	// 同一 IP 的第 4 个并发请求被拒绝，其他 IP 不受影响
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.1:2000", "/v2/"))
+	assert.Equal(t, http.StatusOK, request("10.0.0.2:2000", "/v2/"))
+
+	// 请求完成后名额被释放
+	close(release)
+	wg.Wait()
+	assert.Equal(t, http.StatusOK, request("10.0.0.1:2001", "/v2/"))
+	assert.Empty(t, activeRequests)
+}
+
+// TestRequestIDAcrossRetries 测试同一个请求在不同镜像上重试时日志共用一个请求 ID，
+// 并标注第几次尝试，响应头和转发给上游的请求头都带有该 ID
+func TestRequestIDAcrossRetries(t *testing.T) {
+	var hits int32
+	var upstreamIDs []string
+	var mu sync.Mutex
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamIDs = append(upstreamIDs, r.Header.Get("X-Request-Id"))
+		mu.Unlock()
+		// 第一次请求的镜像返回 502，迫使代理切换到另一个镜像
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("{\n  \"ok\": true\n}"))
+	})
+	setupProxyTest(t, upstream)
+	second := httptest.NewServer(upstream)
+	defer second.Close()
+	glourls.AddURL(second.URL)
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	id := rec.Header().Get("X-Request-Id")
+	assert.Regexp(t, `^[0-9a-f]{16}$`, id)
+	assert.Equal(t, []string{id, id}, upstreamIDs)
+
+	files, err := filepath.Glob("logs/*.log")
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	content, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	attempts := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		m := regexp.MustCompile(`\[([0-9a-f]+) attempt=(\d+)\] `).FindStringSubmatch(line)
+		if assert.NotNil(t, m, line) {
+			assert.Equal(t, id, m[1], line)
+			attempts[m[2]] = true
+		}
+	}
+	assert.Equal(t, map[string]bool{"1": true, "2": true}, attempts)
+
+	// 另一个请求使用不同的 ID
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	assert.NotEqual(t, id, rec.Header().Get("X-Request-Id"))
+}
+
+// TestCacheSharedAcrossRepositories 测试不同仓库中相同摘要的 blob 共用一个缓存文件，
+// 只有所有仓库的引用都移除后才删除缓存
+func TestCacheSharedAcrossRepositories(t *testing.T) {
+	content := []byte("shared layer")
+	var hits int32
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write(content)
+	}))
+
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+	pathA := "/v2/team-a/app/blobs/sha256:" + digest
+	pathB := "/v2/team-b/base/blobs/sha256:" + strings.ToUpper(digest)
+	for _, path := range []string{pathA, pathB} {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, content, rec.Body.Bytes())
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	dataFiles, err := filepath.Glob(filepath.Join(cacheDir, "*.dat"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(cacheDir, digest+".dat")}, dataFiles)
+
+	cacheFilePath := getCacheFilePath(pathA)
+	refs, err := readCacheRefs(cacheFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team-a/app", "team-b/base"}, refs)
+
+	// 移除一个仓库的引用后缓存仍然保留
+	remaining, err := releaseCacheRef(cacheFilePath, pathA)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, remaining)
+	assert.FileExists(t, cacheFilePath)
+
+	remaining, err = releaseCacheRef(cacheFilePath, pathB)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, remaining)
+	entries, err := os.ReadDir(cacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// TestLargeBodyLogTruncated 测试大响应体完整转发，日志只记录开头部分和总字节数
+func TestLargeBodyLogTruncated(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1MB
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	assert.Equal(t, content, rec.Body.Bytes())
+
+	files, err := filepath.Glob("logs/*.log")
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	info, err := os.Stat(files[0])
+	assert.NoError(t, err)
+	assert.Less(t, info.Size(), int64(16*1024))
+	logged, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(logged), fmt.Sprintf("... (%d bytes total)", len(content)))
+}
+
+// TestSingleFlightBlob 测试同一个 blob 的并发请求只访问上游一次，其他请求从缓存返回
+func TestSingleFlightBlob(t *testing.T) {
+	content := []byte(strings.Repeat("layer content", 100))
+	release := make(chan struct{})
+	var upstreamCalls int32
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		<-release
+		w.Write(content)
+	}))
+
+	const clients = 10
+	path := blobPath(content)
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, clients)
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handleRequest(rec, httptest.NewRequest("GET", path, nil))
+		}(recs[i])
+	}
+	// leader 阻塞在上游时给其他请求留出时间，没有合并的请求会在这期间访问上游
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&upstreamCalls) == 1 }, 5*time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstreamCalls))
+	for _, rec := range recs {
+		assert.Equal(t, content, rec.Body.Bytes())
+	}
+}
+
+// TestSingleFlightLeaderFails 测试 leader 下载中断时其他请求不读取不完整的缓存，而是各自访问上游
+func TestSingleFlightLeaderFails(t *testing.T) {
+	content := []byte(strings.Repeat("layer content", 100))
+	release := make(chan struct{})
+	var upstreamCalls int32
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&upstreamCalls, 1) > 1 {
+			w.Write(content)
+			return
+		}
+		<-release
+		// 声明完整长度，只写入一半后断开连接
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+
+	const clients = 4
+	path := blobPath(content)
+	leader := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleRequest(leader, httptest.NewRequest("GET", path, nil))
+	}()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&upstreamCalls) == 1 }, 5*time.Second, time.Millisecond)
+
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, clients-1)
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handleRequest(rec, httptest.NewRequest("GET", path, nil))
+		}(recs[i])
+	}
+	// leader 阻塞在上游时给其他请求留出时间，没有合并的请求会在这期间访问上游
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&upstreamCalls) == 1 }, 5*time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-done
+	wg.Wait()
+
+	assert.NotEqual(t, content, leader.Body.Bytes())
+	for _, rec := range recs {
+		assert.Equal(t, content, rec.Body.Bytes())
+	}
+	assert.Equal(t, int32(clients), atomic.LoadInt32(&upstreamCalls))
+}
+
+// TestAuthenticateRealm 测试 realm 使用配置的地址，未配置时根据请求的 Host 生成
+func TestAuthenticateRealm(t *testing.T) {
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Www-Authenticate", `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer func(old string) { realmBase = old }(realmBase)
+
+	realmBase = ""
+	req := httptest.NewRequest("GET", "/v2/", nil)
+	req.Host = "mirror.lan:23000"
+	rec := httptest.NewRecorder()
+	handleRequest(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, `Bearer realm="http://mirror.lan:23000/token",service="registry.docker.io"`, rec.Header().Get("Www-Authenticate"))
+
+	req = httptest.NewRequest("GET", "/v2/", nil)
+	req.Host = "mirror.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	assert.Equal(t, "https://mirror.example.com/token", authRealm(req))
+
+	realmBase = "https://proxy.example.com/"
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/", nil))
+	assert.Equal(t, `Bearer realm="https://proxy.example.com/token",service="registry.docker.io"`, rec.Header().Get("Www-Authenticate"))
+}
+
+// TestEvictCache 测试超过大小上限时先淘汰最久未访问的条目，包括分片、记录和响应头文件
+func TestEvictCache(t *testing.T) {
+	setupProxyTest(t, http.NotFoundHandler())
+	defer func(old int64) { chunkSize = old }(chunkSize)
+	chunkSize = 100
+
+	// commit 写入一个缓存条目，修改时间为 age 之前
+	commit := func(content []byte, age time.Duration) string {
+		path := blobPath(content)
+		cw := newCacheWriter(getCacheFilePath(path), extractHashFromURL(path), int64(len(content)))
+		assert.NoError(t, cw.Write(content))
+		assert.NoError(t, cw.Close())
+		assert.NoError(t, writeCacheMeta(getCacheFilePath(path), http.Header{}, int64(len(content))))
+		old := time.Now().Add(-age)
+		files, _ := filepath.Glob(filepath.Join(cacheDir, extractHashFromURL(path)+"*"))
+		for _, file := range files {
+			assert.NoError(t, os.Chtimes(file, old, old))
+		}
+		return extractHashFromURL(path)
+	}
+	oldest := commit(bytes.Repeat([]byte("a"), 250), 3*time.Hour) // 拆分为 3 个分片
+	hit := commit(bytes.Repeat([]byte("b"), 80), 2*time.Hour)
+	recent := commit(bytes.Repeat([]byte("c"), 80), time.Hour)
+	touchCacheEntry(filepath.Join(cacheDir, hit+".dat"))
+
+	// 没有超过上限时不删除
+	evicted, err := evictCache(1 << 20)
+	assert.NoError(t, err)
+	assert.Empty(t, evicted)
+
+	evicted, err = evictCache(150)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{oldest, recent}, evicted)
+	remaining, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+	assert.NoError(t, err)
+	for _, file := range remaining {
+		assert.Contains(t, filepath.Base(file), hit)
+	}
+	assert.FileExists(t, filepath.Join(cacheDir, hit+".dat"))
+}
+
+// TestEvictCacheSharedRefs 测试被多个仓库引用的条目最后淘汰，每次淘汰只移除一个引用，
+// 最后一个引用移除时才删除
+func TestEvictCacheSharedRefs(t *testing.T) {
+	setupProxyTest(t, http.NotFoundHandler())
+
+	// commit 写入一个缓存条目并记录引用它的仓库，修改时间为 age 之前
+	commit := func(content []byte, age time.Duration, repos ...string) string {
+		path := blobPath(content)
+		cacheFilePath := getCacheFilePath(path)
+		cw := newCacheWriter(cacheFilePath, extractHashFromURL(path), int64(len(content)))
+		assert.NoError(t, cw.Write(content))
+		assert.NoError(t, cw.Close())
+		for _, repo := range repos {
+			_, err := addCacheRef(cacheFilePath, "/v2/"+repo+"/blobs/sha256:"+extractHashFromURL(path))
+			assert.NoError(t, err)
+		}
+		old := time.Now().Add(-age)
+		files, _ := filepath.Glob(filepath.Join(cacheDir, extractHashFromURL(path)+"*"))
+		for _, file := range files {
+			assert.NoError(t, os.Chtimes(file, old, old))
+		}
+		return extractHashFromURL(path)
+	}
+	shared := commit(bytes.Repeat([]byte("s"), 100), 2*time.Hour, "team-a/app", "team-b/base")
+	single := commit(bytes.Repeat([]byte("u"), 100), time.Hour, "team-a/app")
+
+	// 共享的条目虽然更久未访问，仍先淘汰只有一个引用的条目
+	evicted, err := evictCache(150)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{single}, evicted)
+	assert.FileExists(t, filepath.Join(cacheDir, shared+".dat"))
+
+	// 仍然超过上限时移除一个引用，条目保留给另一个仓库
+	evicted, err = evictCache(0)
+	assert.NoError(t, err)
+	assert.Empty(t, evicted)
+	refs, err := readCacheRefs(filepath.Join(cacheDir, shared+".dat"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team-b/base"}, refs)
+
+	evicted, err = evictCache(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{shared}, evicted)
+	entries, err := os.ReadDir(cacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// TestServeFromCacheRange 测试单文件和拆分缓存按 Range 返回 206，跨分片的区间拼接正确
+func TestServeFromCacheRange(t *testing.T) {
+	setupProxyTest(t, http.NotFoundHandler())
+	defer func(old int64) { chunkSize = old }(chunkSize)
+	chunkSize = 100
+
+	for _, size := range []int{80, 250} { // 单文件和 3 个分片
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte('a' + i%26)
+		}
+		path := blobPath(content)
+		cw := newCacheWriter(getCacheFilePath(path), extractHashFromURL(path), int64(size))
+		assert.NoError(t, cw.Write(content))
+		assert.NoError(t, cw.Close())
+
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, content, rec.Body.Bytes())
+
+		for _, rng := range [][2]int{{0, 9}, {50, 79}, {size - 30, size - 1}, {95, 205}} {
+			if rng[1] >= size {
+				continue
+			}
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rng[0], rng[1]))
+			rec := httptest.NewRecorder()
+			handleRequest(rec, req)
+			assert.Equal(t, http.StatusPartialContent, rec.Code)
+			assert.Equal(t, fmt.Sprintf("bytes %d-%d/%d", rng[0], rng[1], size), rec.Header().Get("Content-Range"))
+			assert.Equal(t, content[rng[0]:rng[1]+1], rec.Body.Bytes(), "size %d range %v", size, rng)
+		}
+
+		// 从某个位置到结尾
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Range", "bytes=120-")
+		rec = httptest.NewRecorder()
+		handleRequest(rec, req)
+		if size > 120 {
+			assert.Equal(t, http.StatusPartialContent, rec.Code)
+			assert.Equal(t, content[120:], rec.Body.Bytes())
+		} else {
+			assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+		}
+	}
+}
+
+// TestUpstreamTimeout 测试上游不返回响应头时超时并换用下一个镜像，响应体停止发送时中止请求，
+// 两种情况下超时的镜像都被标记为死亡且不再占用负载
+func TestUpstreamTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	slow := setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	}))
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	t.Cleanup(fast.Close)
+	// 发送一部分响应体后停止
+	stalling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-stall
+	}))
+	t.Cleanup(stalling.Close)
+	t.Cleanup(func() { close(stall) }) // 先放行阻塞的处理函数，服务器才能关闭
+	defer func(old time.Duration) { upstreamTimeout = old }(upstreamTimeout)
+	upstreamTimeout = 100 * time.Millisecond
+
+	glourls.AddURL(fast.URL)
+	glourls.MarkDead(fast.URL) // 先选中慢的镜像
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `{"ok":true}`, rec.Body.String())
+	// 两个镜像都死亡后被恢复，用失败计数确认慢的镜像被标记过死亡
+	stat := findStat(glourls.Stats(), slow.URL)
+	assert.GreaterOrEqual(t, stat.FailCount, int64(1))
+	assert.Equal(t, 0, stat.Load)
+
+	glourls = NewURLManager()
+	glourls.AddURL(stalling.URL)
+	done := make(chan struct{})
+	rec = httptest.NewRecorder()
+	go func() {
+		defer close(done)
+		handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not time out on a stalled body")
+	}
+	assert.Equal(t, "partial", rec.Body.String())
+	stat = findStat(glourls.Stats(), stalling.URL)
+	assert.True(t, stat.Dead)
+	assert.Equal(t, 0, stat.Load)
+}
+
+// TestUpstreamConnectionReuse 测试连续的上游请求复用同一个连接
+func TestUpstreamConnectionReuse(t *testing.T) {
+	var conns int32
+	setupProxyTest(t, http.NotFoundHandler())
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	glourls = NewURLManager()
+	glourls.AddURL(server.URL)
+
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/latest", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
+
+// TestURLManagerPersistWeights 测试权重和响应时间保存后恢复，死亡标记和负载不保存
+func TestURLManagerPersistWeights(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "weights.json")
+	um, err := NewURLManagerFromFile(path)
+	assert.NoError(t, err)
+	um.AddURL("https://a.example")
+	um.AddURL("https://b.example")
+	um.Get()
+	um.Done("https://a.example", 0.5, 10*1024*1024)
+	um.Get()
+	um.MarkDead("https://b.example")
+	before := findStat(um.Stats(), "https://a.example")
+	assert.NoError(t, um.Save())
+
+	restored, err := NewURLManagerFromFile(path)
+	assert.NoError(t, err)
+	restored.AddURL("https://a.example")
+	restored.AddURL("https://b.example")
+	restored.AddURL("https://c.example")
+	a := findStat(restored.Stats(), "https://a.example")
+	assert.Equal(t, before.Weight, a.Weight)
+	assert.Equal(t, 0.5, a.ResponseTime)
+	assert.Equal(t, 0, a.Load)
+	b := findStat(restored.Stats(), "https://b.example")
+	assert.False(t, b.Dead)
+	assert.Equal(t, 0, b.Load)
+	assert.Equal(t, float64(1), findStat(restored.Stats(), "https://c.example").Weight)
+
+	assert.NoError(t, os.WriteFile(path, []byte("not json"), 0644))
+	_, err = NewURLManagerFromFile(path)
+	assert.Error(t, err)
+}
+
+// TestURLManagerConcurrentSave 测试并发保存权重都成功，不留下临时文件
+func TestURLManagerConcurrentSave(t *testing.T) {
+	dir := t.TempDir()
+	um, err := NewURLManagerFromFile(filepath.Join(dir, "weights.json"))
+	assert.NoError(t, err)
+	um.AddURL("https://a.example")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, um.Save())
+		}()
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "weights.json", entries[0].Name())
+}
+
+// TestRouterPersistWeights 测试前缀镜像池的权重保存到单独的文件，重新加载路由后恢复
+func TestRouterPersistWeights(t *testing.T) {
+	dir := t.TempDir()
+	routesFile := filepath.Join(dir, "routes.json")
+	assert.NoError(t, os.WriteFile(routesFile, []byte(`{"/ghcr": ["https://ghcr.example"]}`), 0644))
+	weightsFile := filepath.Join(dir, "weights.json")
+	assert.Equal(t, filepath.Join(dir, "weights.ghcr.json"), routeWeightsFile(weightsFile, "/ghcr"))
+	assert.Equal(t, "", routeWeightsFile("", "/ghcr"))
+
+	def, err := NewURLManagerFromFile(weightsFile)
+	assert.NoError(t, err)
+	rt, err := loadRoutes(routesFile, def)
+	assert.NoError(t, err)
+	url, pool, _ := rt.Get("/ghcr/v2/owner/app/manifests/latest")
+	pool.Done(url, 0.5, 10*1024*1024)
+	before := findStat(pool.Stats(), url)
+	assert.NoError(t, rt.Save())
+
+	rt, err = loadRoutes(routesFile, def)
+	assert.NoError(t, err)
+	_, pool, _ = rt.Get("/ghcr/v2/owner/app/manifests/latest")
+	restored := findStat(pool.Stats(), url)
+	assert.Equal(t, before.Weight, restored.Weight)
+	assert.Equal(t, 0.5, restored.ResponseTime)
+}
+
+// TestStatsAndMetrics 测试 /stats 输出 JSON 快照，/metrics 输出 Prometheus 文本格式，
+// 都包含路由配置中前缀镜像池的镜像
+func TestStatsAndMetrics(t *testing.T) {
+	glourls = newTestManager("https://a.example", `https://b.example/"x"`)
+	glourls.Get()
+	glourls.MarkDead(`https://b.example/"x"`)
+	router = NewRouter(glourls)
+	router.AddRoute("/ghcr", newTestManager("https://ghcr.example"))
+	defer func() { router = nil }()
+
+	rec := httptest.NewRecorder()
+	handleStats(rec, httptest.NewRequest("GET", "/stats", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var stats []URLStat
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Len(t, stats, 3)
+	assert.True(t, findStat(stats, `https://b.example/"x"`).Dead)
+	assert.Equal(t, defaultPoolName, findStat(stats, "https://a.example").Pool)
+	assert.Equal(t, "/ghcr", findStat(stats, "https://ghcr.example").Pool)
+
+	rec = httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE mirror_load gauge\n")
+	assert.Contains(t, body, "# TYPE mirror_fail_total counter\n")
+	assert.Contains(t, body, `mirror_dead{pool="default",url="https://a.example"} 0`+"\n")
+	assert.Contains(t, body, `mirror_dead{pool="default",url="https://b.example/\"x\""} 1`+"\n")
+	assert.Contains(t, body, `mirror_fail_total{pool="default",url="https://b.example/\"x\""} 1`+"\n")
+	assert.Contains(t, body, `mirror_weight{pool="default",url="https://a.example"} 1`+"\n")
+	assert.Contains(t, body, `mirror_dead{pool="/ghcr",url="https://ghcr.example"} 0`+"\n")
+}
+
+// TestServeFromCacheVerifies 测试没有校验记录的缓存先校验再返回，损坏时删除并重新从上游获取，
+// 校验通过后记录结果，之后命中不再计算
+func TestServeFromCacheVerifies(t *testing.T) {
+	content := []byte("layer content")
+	upstreamCalls := 0
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Write(content)
+	}))
+	path := blobPath(content)
+	cacheFilePath := getCacheFilePath(path)
+
+	// 旧版本写入的损坏缓存：大小相同但内容不同，没有校验记录
+	assert.NoError(t, os.WriteFile(cacheFilePath, []byte("LAYER CONTENT"), 0644))
+	rec := httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.Equal(t, 1, upstreamCalls)
+	data, err := os.ReadFile(cacheFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int64(len(content)), readCacheMeta(cacheFilePath).Size)
+
+	// 旧版本写入的完好缓存：校验一次后记录结果
+	assert.NoError(t, os.Remove(getMetaFilePath(cacheFilePath)))
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.Equal(t, 1, upstreamCalls)
+	assert.True(t, readCacheMeta(cacheFilePath).Verified)
+
+	// 大小变化说明内容在校验后被改动，需要重新校验
+	assert.NoError(t, os.WriteFile(cacheFilePath, []byte("truncated"), 0644))
+	rec = httptest.NewRecorder()
+	handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, content, rec.Body.Bytes())
+	assert.Equal(t, 2, upstreamCalls)
+}
+
+// TestMaxUpstreamAttempts 测试所有镜像都失败时最多尝试 maxUpstreamAttempts 次后返回 502
+func TestMaxUpstreamAttempts(t *testing.T) {
+	var calls int32
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer func(old int) { maxUpstreamAttempts = old }(maxUpstreamAttempts)
+	maxUpstreamAttempts = 3
+
+	done := make(chan struct{})
+	rec := httptest.NewRecorder()
+	go func() {
+		defer close(done)
+		handleRequest(rec, httptest.NewRequest("GET", "/v2/library/nginx/manifests/missing", nil))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy kept retrying past the attempt limit")
+	}
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+// TestCacheWriteAtomic 测试下载过程中只有临时文件，缓存不会被命中；完成后临时文件全部重命名，
+// 中断时临时文件被删除
+func TestCacheWriteAtomic(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 25))
+	release := make(chan struct{})
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content[:150])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(content[150:])
+	}))
+	defer func(old int64) { chunkSize = old }(chunkSize)
+	chunkSize = 100
+
+	path := blobPath(content)
+	cacheFilePath := getCacheFilePath(path)
+	done := make(chan struct{})
+	rec := httptest.NewRecorder()
+	go func() {
+		defer close(done)
+		handleRequest(rec, httptest.NewRequest("GET", path, nil))
+	}()
+
+	// 第一个分片写满后仍是临时文件
+	assert.Eventually(t, func() bool {
+		temps, _ := filepath.Glob(filepath.Join(cacheDir, "*.tmp*"))
+		return len(temps) == 2
+	}, 5*time.Second, time.Millisecond)
+	parts, err := filepath.Glob(filepath.Join(cacheDir, "*_part_*.dat"))
+	assert.NoError(t, err)
+	assert.Empty(t, parts)
+	assert.False(t, serveFromCache(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil), cacheFilePath))
+	report, err := VerifyCache(cacheDir)
+	assert.NoError(t, err)
+	for _, defect := range report.Defects {
+		assert.Equal(t, defectStaleTemp, defect.Kind)
+		assert.Equal(t, extractHashFromURL(path), defect.Key)
+	}
+
+	close(release)
+	<-done
+	assert.Equal(t, content, rec.Body.Bytes())
+	temps, err := filepath.Glob(filepath.Join(cacheDir, "*.tmp*"))
+	assert.NoError(t, err)
+	assert.Empty(t, temps)
+	report, err = VerifyCache(cacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Defects)
+	assert.Equal(t, 1, report.Verified)
+
+	// 中断的写入不留下任何文件
+	cw := newCacheWriter(getCacheFilePath(blobPath([]byte("other"))), extractHashFromURL(blobPath([]byte("other"))), -1)
+	assert.NoError(t, cw.Write(content))
+	cw.abandon()
+	entries, err := os.ReadDir(cacheDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 6) // 之前条目的 3 个分片、记录、响应头和引用文件
+}
+
+// TestURLManagerStrategies 测试轮询按顺序选择并跳过死亡的URL，加权随机按权重分配
+func TestURLManagerStrategies(t *testing.T) {
+	um := NewURLManagerWithStrategy(RoundRobin)
+	for _, u := range []string{"https://a.example", "https://b.example", "https://c.example"} {
+		um.AddURL(u)
+	}
+	um.MarkDead("https://b.example")
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, um.Get())
+	}
+	assert.Equal(t, []string{"https://a.example", "https://c.example", "https://c.example", "https://a.example"}, got)
+
+	um = NewURLManagerWithStrategy(WeightedRandom)
+	um.AddURL("https://a.example")
+	um.AddURL("https://b.example")
+	um.urls[0].Weight = 1
+	um.urls[1].Weight = 3
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		u := um.Get()
+		counts[u]++
+		um.Done(u, 0.1, 1024) // Done 会重新计算权重，恢复测试设置的权重
+		um.urls[0].Weight, um.urls[1].Weight = 1, 3
+	}
+	assert.InDelta(t, 1000, counts["https://a.example"], 150)
+	assert.InDelta(t, 3000, counts["https://b.example"], 150)
+
+	for _, s := range []Strategy{LeastConn, RoundRobin, WeightedRandom} {
+		parsed, err := ParseStrategy(s.String())
+		assert.NoError(t, err)
+		assert.Equal(t, s, parsed)
+	}
+	_, err := ParseStrategy("fastest")
+	assert.Error(t, err)
+}
+
+// TestRouterPrefix 测试按路径前缀选择镜像池并去掉前缀转发，未匹配的路径使用默认镜像池
+func TestRouterPrefix(t *testing.T) {
+	setupProxyTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hub " + r.URL.Path))
+	}))
+	ghcr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ghcr " + r.URL.Path))
+	}))
+	defer ghcr.Close()
+
+	routes, err := json.Marshal(map[string][]string{"/ghcr": {ghcr.URL}})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile("routes.json", routes, 0644))
+	router, err = loadRoutes("routes.json", glourls)
+	assert.NoError(t, err)
+	defer func() { router = nil }()
+
+	for path, want := range map[string]string{
+		"/ghcr/v2/owner/app/manifests/latest": "ghcr /v2/owner/app/manifests/latest",
+		"/v2/library/nginx/manifests/latest":  "hub /v2/library/nginx/manifests/latest",
+		"/ghcrx/v2/owner/app/manifests/1":     "hub /ghcrx/v2/owner/app/manifests/1",
+	} {
+		rec := httptest.NewRecorder()
+		proxyRequest(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, want, rec.Body.String(), path)
+	}
+
+	url, pool, upstreamPath := router.Get("/ghcr/v2/owner/app/blobs/sha256:abc")
+	assert.Equal(t, ghcr.URL, url)
+	assert.NotSame(t, glourls, pool)
+	assert.Equal(t, "/v2/owner/app/blobs/sha256:abc", upstreamPath)
+	pool.release(url)
+}
+
+// TestServeUntilDrains 测试关闭时等待进行中的请求完成，超时后强制关闭
+func TestServeUntilDrains(t *testing.T) {
+	// serve 启动服务并发出一个请求，请求到达后取消 ctx，release 关闭后请求才返回
+	serve := func(timeout time.Duration, release chan struct{}) (chan error, chan *http.Response) {
+		started := make(chan struct{})
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("done"))
+		})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- serveUntil(ctx, &http.Server{Handler: handler}, ln, timeout) }()
+		responses := make(chan *http.Response, 1)
+		go func() {
+			resp, _ := http.Get("http://" + ln.Addr().String())
+			responses <- resp
+		}()
+		<-started
+		cancel()
+		return served, responses
+	}
+
+	// 请求在超时前完成
+	release := make(chan struct{})
+	served, responses := serve(5*time.Second, release)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	resp := <-responses
+	if assert.NotNil(t, resp) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "done", string(body))
+	}
+	assert.NoError(t, <-served)
+
+	// 请求一直不结束时超时返回错误，连接被强制关闭
+	release = make(chan struct{})
+	defer close(release)
+	served, responses = serve(100*time.Millisecond, release)
+	assert.ErrorIs(t, <-served, context.DeadlineExceeded)
+	assert.Nil(t, <-responses)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// labelEscaper 转义 Prometheus 标签值中的反斜杠、双引号和换行
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// mirrorMetric 一项镜像指标
+type mirrorMetric struct {
+	name  string
+	kind  string // gauge 或 counter
+	help  string
+	value func(URLStat) float64
+}
+
+var mirrorMetrics = []mirrorMetric{
+	{"mirror_load", "gauge", "Requests currently in flight to the mirror.", func(s URLStat) float64 { return float64(s.Load) }},
+	{"mirror_weight", "gauge", "Dynamic load-balancing weight of the mirror.", func(s URLStat) float64 { return s.Weight }},
+	{"mirror_response_time_seconds", "gauge", "Response time of the last completed request.", func(s URLStat) float64 { return s.ResponseTime }},
+	{"mirror_dead", "gauge", "Whether the mirror is marked dead (1) or alive (0).", func(s URLStat) float64 {
+		if s.Dead {
+			return 1
+		}
+		return 0
+	}},
+	{"mirror_success_total", "counter", "Requests completed by the mirror.", func(s URLStat) float64 { return float64(s.SuccessCount) }},
+	{"mirror_fail_total", "counter", "Times the mirror was marked dead.", func(s URLStat) float64 { return float64(s.FailCount) }},
+}
+
+// defaultPoolName 默认镜像池在统计中的名称，前缀镜像池使用其路径前缀
+const defaultPoolName = "default"
+
+// mirrorStats 返回默认镜像池和路由配置中各前缀镜像池所有镜像的统计快照
+func mirrorStats() []URLStat {
+	stats := poolStats(glourls, defaultPoolName)
+	if router != nil {
+		for _, r := range router.routes {
+			stats = append(stats, poolStats(r.pool, r.prefix)...)
+		}
+	}
+	return stats
+}
+
+// poolStats 返回镜像池的统计快照，并填写镜像池名称
+func poolStats(pool *URLManager, name string) []URLStat {
+	stats := pool.Stats()
+	for i := range stats {
+		stats[i].Pool = name
+	}
+	return stats
+}
+
+// handleMetrics 以 Prometheus 文本格式输出所有镜像池中各镜像的统计信息
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := mirrorStats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range mirrorMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, stat := range stats {
+			fmt.Fprintf(w, "%s{pool=\"%s\",url=\"%s\"} %g\n", m.name, labelEscaper.Replace(stat.Pool), labelEscaper.Replace(stat.URL), m.value(stat))
+		}
+	}
+}
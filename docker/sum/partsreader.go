@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// partsReader 把按顺序排列的分片文件当作一个文件读取，支持 Seek，
+// 用于按 Range 返回拆分缓存的任意区间
+type partsReader struct {
+	files   []*os.File
+	offsets []int64 // 每个分片在整个文件中的起始偏移
+	size    int64
+	pos     int64
+}
+
+// openParts 打开所有分片，任何一个分片无法打开时关闭已打开的文件并返回错误
+func openParts(paths []string) (*partsReader, error) {
+	pr := &partsReader{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			pr.Close()
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			pr.Close()
+			return nil, err
+		}
+		pr.files = append(pr.files, f)
+		pr.offsets = append(pr.offsets, pr.size)
+		pr.size += info.Size()
+	}
+	return pr, nil
+}
+
+func (pr *partsReader) Read(p []byte) (int, error) {
+	if pr.pos >= pr.size {
+		return 0, io.EOF
+	}
+	// 找到 pos 所在的分片
+	i := len(pr.offsets) - 1
+	for i > 0 && pr.offsets[i] > pr.pos {
+		i--
+	}
+	n, err := pr.files[i].ReadAt(p, pr.pos-pr.offsets[i])
+	pr.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil // 当前分片读完，下次读取下一个分片
+	}
+	if err == io.EOF && pr.pos < pr.size {
+		err = io.ErrUnexpectedEOF // 分片在打开后被截断
+	}
+	return n, err
+}
+
+func (pr *partsReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pr.pos
+	case io.SeekEnd:
+		offset += pr.size
+	default:
+		return 0, errors.New("partsReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("partsReader.Seek: negative position")
+	}
+	pr.pos = offset
+	return offset, nil
+}
+
+func (pr *partsReader) Close() error {
+	for _, f := range pr.files {
+		f.Close()
+	}
+	return nil
+}
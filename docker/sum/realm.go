@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// realmBase 返回给客户端的 token 服务地址（如 https://proxy.example.com），
+// 由 -realm 参数或 AUTH_REALM 环境变量配置，为空时根据请求的 Host 生成
+var realmBase = getEnv("AUTH_REALM", "")
+
+// authRealm 返回 Www-Authenticate 中的 realm，即本代理的 /token 地址
+func authRealm(r *http.Request) string {
+	base := strings.TrimSuffix(realmBase, "/")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		base = scheme + "://" + r.Host
+	}
+	if strings.HasSuffix(base, "/token") {
+		return base
+	}
+	return base + "/token"
+}
+
+// authenticateHeader 生成指向本代理的 Www-Authenticate 响应头
+func authenticateHeader(r *http.Request) string {
+	return fmt.Sprintf(`Bearer realm="%s",service="registry.docker.io"`, authRealm(r))
+}
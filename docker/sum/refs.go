@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// refsMu 保护所有缓存条目的引用文件
+var refsMu sync.Mutex
+
+// getRefsFilePath 返回缓存条目的引用文件路径，记录引用该条目的仓库
+func getRefsFilePath(urlPath string) string {
+	hash := extractHashFromURL(urlPath)
+	return filepath.Join(cacheDir, fmt.Sprintf("%s_refs.json", hash))
+}
+
+// repositoryOf 返回请求路径中的仓库部分，如 /v2/library/nginx/blobs/sha256:... 返回 library/nginx
+func repositoryOf(urlPath string) string {
+	repo := strings.TrimPrefix(urlPath, "/v2/")
+	if i := strings.Index(repo, "/blobs/"); i >= 0 {
+		return repo[:i]
+	}
+	return repo
+}
+
+// readCacheRefs 读取缓存条目的引用列表，没有引用文件时返回空列表
+func readCacheRefs(cacheFilePath string) ([]string, error) {
+	data, err := os.ReadFile(getRefsFilePath(cacheFilePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return nil, fmt.Errorf("invalid refs file: %v", err)
+	}
+	return refs, nil
+}
+
+// writeCacheRefs 保存引用列表，先写临时文件再重命名，中断时不会留下半个文件
+func writeCacheRefs(cacheFilePath string, refs []string) error {
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return err
+	}
+	path := getRefsFilePath(cacheFilePath)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// addCacheRef 记录 urlPath 所在的仓库引用了缓存条目，返回引用该条目的仓库数。
+// 同一个摘要的 blob 在不同仓库中共用一个缓存条目
+func addCacheRef(cacheFilePath, urlPath string) (int, error) {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+
+	refs, err := readCacheRefs(cacheFilePath)
+	if err != nil {
+		return 0, err
+	}
+	repo := repositoryOf(urlPath)
+	i := sort.SearchStrings(refs, repo)
+	if i < len(refs) && refs[i] == repo {
+		return len(refs), nil
+	}
+	refs = append(refs, "")
+	copy(refs[i+1:], refs[i:])
+	refs[i] = repo
+	return len(refs), writeCacheRefs(cacheFilePath, refs)
+}
+
+// releaseCacheRef 移除 urlPath 所在仓库对缓存条目的引用，没有其他仓库引用时删除整个条目。
+// 返回剩余的引用数
+func releaseCacheRef(cacheFilePath, urlPath string) (int, error) {
+	return releaseRepoRef(cacheFilePath, repositoryOf(urlPath))
+}
+
+// releaseRepoRef 移除仓库 repo 对缓存条目的引用，没有其他仓库引用时删除整个条目。
+// 返回剩余的引用数
+func releaseRepoRef(cacheFilePath, repo string) (int, error) {
+	refsMu.Lock()
+	defer refsMu.Unlock()
+
+	refs, err := readCacheRefs(cacheFilePath)
+	if err != nil {
+		return 0, err
+	}
+	i := sort.SearchStrings(refs, repo)
+	if i < len(refs) && refs[i] == repo {
+		refs = append(refs[:i], refs[i+1:]...)
+	}
+	if len(refs) > 0 {
+		return len(refs), writeCacheRefs(cacheFilePath, refs)
+	}
+	return 0, removeCacheEntry(cacheFilePath)
+}
+
+// removeCacheEntry 删除缓存条目的数据、分片、记录、响应头和引用文件
+func removeCacheEntry(cacheFilePath string) error {
+	files := []string{getCacheFilePath(cacheFilePath), getRecordFilePath(cacheFilePath), getMetaFilePath(cacheFilePath), getRefsFilePath(cacheFilePath)}
+	parts, err := filepath.Glob(filepath.Join(cacheDir, extractHashFromURL(cacheFilePath)+"_part_*.dat"))
+	if err != nil {
+		return err
+	}
+	for _, file := range append(files, parts...) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// requestIDHeader 返回给客户端并转发给上游的请求 ID 头
+const requestIDHeader = "X-Request-Id"
+
+// requestIDSeq 随机数不可用时的后备序号
+var requestIDSeq uint64
+
+// newRequestID 生成 16 位十六进制的请求 ID，用于关联同一个请求在不同镜像上的重试日志
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d-%d", os.Getpid(), atomic.AddUint64(&requestIDSeq, 1))
+	}
+	return hex.EncodeToString(b)
+}
+
+// newAttemptLogger 返回每行都带有请求 ID 和第几次尝试的日志
+func newAttemptLogger(f *os.File, reqID string, attempt int) *log.Logger {
+	return log.New(f, fmt.Sprintf("[%s attempt=%d] ", reqID, attempt), log.LstdFlags|log.Lmsgprefix)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// routesFile 按路径前缀分配镜像池的配置文件，ROUTES_FILE 配置，为空时所有请求使用默认镜像池
+var routesFile = os.Getenv("ROUTES_FILE")
+
+// router 启动时根据 routesFile 创建，为 nil 时所有请求使用 glourls
+var router *Router
+
+// routeRequest 返回请求路径对应的镜像池和转发给上游的路径
+func routeRequest(path string) (*URLManager, string) {
+	if router == nil {
+		return glourls, path
+	}
+	return router.Pool(path)
+}
+
+// route 一个路径前缀对应的镜像池
+type route struct {
+	prefix string
+	pool   *URLManager
+}
+
+// Router 按请求路径的前缀选择镜像池，如 /ghcr/v2/... 使用 ghcr.io 的镜像，
+// 转发给上游时去掉前缀；没有匹配的前缀时使用默认镜像池，路径不变
+type Router struct {
+	routes      []route // 按前缀长度降序
+	defaultPool *URLManager
+}
+
+// NewRouter 创建一个Router，defaultPool 处理没有匹配前缀的请求
+func NewRouter(defaultPool *URLManager) *Router {
+	return &Router{defaultPool: defaultPool}
+}
+
+// AddRoute 让以 prefix 开头的请求使用 pool，prefix 按路径段匹配，如 /ghcr 不匹配 /ghcrx
+func (rt *Router) AddRoute(prefix string, pool *URLManager) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	rt.routes = append(rt.routes, route{prefix: prefix, pool: pool})
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return len(rt.routes[i].prefix) > len(rt.routes[j].prefix)
+	})
+}
+
+// Pool 返回 path 对应的镜像池和转发给上游的路径，最长的前缀优先
+func (rt *Router) Pool(path string) (*URLManager, string) {
+	for _, r := range rt.routes {
+		rest, ok := strings.CutPrefix(path, r.prefix)
+		if ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+			if rest == "" {
+				rest = "/"
+			}
+			return r.pool, rest
+		}
+	}
+	return rt.defaultPool, path
+}
+
+// Get 返回 path 对应镜像池中的一个URL、该镜像池和转发给上游的路径，
+// 之后的 Done、MarkDead 需要调用在返回的镜像池上
+func (rt *Router) Get(path string) (string, *URLManager, string) {
+	pool, upstreamPath := rt.Pool(path)
+	return pool.Get(), pool, upstreamPath
+}
+
+// pools 返回除默认镜像池外的所有镜像池
+func (rt *Router) pools() []*URLManager {
+	pools := make([]*URLManager, 0, len(rt.routes))
+	for _, r := range rt.routes {
+		pools = append(pools, r.pool)
+	}
+	return pools
+}
+
+// StartHealthChecks 为所有前缀的镜像池启动健康检查，默认镜像池由调用方单独管理
+func (rt *Router) StartHealthChecks(interval time.Duration) {
+	for _, pool := range rt.pools() {
+		pool.StartHealthChecks(interval)
+	}
+}
+
+// StopHealthChecks 停止所有前缀镜像池的健康检查
+func (rt *Router) StopHealthChecks() {
+	for _, pool := range rt.pools() {
+		pool.StopHealthChecks()
+	}
+}
+
+// Save 保存所有前缀镜像池的权重，返回第一个错误
+func (rt *Router) Save() error {
+	var firstErr error
+	for _, pool := range rt.pools() {
+		if err := pool.Save(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// saveEvery 每隔 interval 保存一次所有前缀镜像池的权重，ctx 取消后停止
+func (rt *Router) saveEvery(ctx context.Context, interval time.Duration) {
+	for _, pool := range rt.pools() {
+		pool.saveEvery(ctx, interval)
+	}
+}
+
+// loadRoutes 读取路由配置文件，文件是一个 JSON 对象，键为路径前缀，值为镜像地址列表，例如：
+//
+//	{"/ghcr": ["https://ghcr.mirror.example"], "/quay": ["https://quay.mirror.example"]}
+//
+// 默认镜像池保存权重时，各前缀镜像池的权重保存在 routeWeightsFile 对应的文件中。
+// path 为空时返回只有默认镜像池的Router
+func loadRoutes(path string, defaultPool *URLManager) (*Router, error) {
+	rt := NewRouter(defaultPool)
+	if path == "" {
+		return rt, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rt, fmt.Errorf("failed to read routes file: %v", err)
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return rt, fmt.Errorf("failed to parse routes file %s: %v", path, err)
+	}
+	for prefix, urls := range raw {
+		if strings.Trim(prefix, "/") == "" || len(urls) == 0 {
+			return rt, fmt.Errorf("invalid route %q", prefix)
+		}
+		pool, err := NewURLManagerFromFile(routeWeightsFile(defaultPool.stateFile, prefix))
+		if err != nil {
+			log.Printf("Failed to restore URL weights for route %s: %v", prefix, err)
+		}
+		pool.Strategy = defaultPool.Strategy
+		for _, url := range urls {
+			pool.AddURL(url)
+		}
+		rt.AddRoute(prefix, pool)
+	}
+	return rt, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+)
+
+// Strategy URLManager 选择URL的算法
+type Strategy int
+
+const (
+	// LeastConn 动态加权最少连接：选择负载与权重之比最小的URL，默认算法
+	LeastConn Strategy = iota
+	// RoundRobin 按顺序轮流选择存活的URL，不考虑权重和负载
+	RoundRobin
+	// WeightedRandom 按权重随机选择存活的URL
+	WeightedRandom
+)
+
+var strategyNames = map[Strategy]string{
+	LeastConn:      "least-conn",
+	RoundRobin:     "round-robin",
+	WeightedRandom: "weighted-random",
+}
+
+func (s Strategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy 按名称（least-conn、round-robin、weighted-random）返回选择算法
+func ParseStrategy(name string) (Strategy, error) {
+	for s, n := range strategyNames {
+		if strings.EqualFold(name, n) {
+			return s, nil
+		}
+	}
+	return LeastConn, fmt.Errorf("unknown strategy %q", name)
+}
+
+// NewURLManagerWithStrategy 初始化一个使用指定选择算法的URLManager
+func NewURLManagerWithStrategy(strategy Strategy) *URLManager {
+	um := NewURLManager()
+	um.Strategy = strategy
+	return um
+}
+
+// pick 按选择算法从存活的URL中选出一个，没有存活的URL时返回 nil。
+// live 为未被删除的URL数量。调用方需持有 um.mu 的读锁，
+// 每次只持有一个 urlInfo 的锁，避免并发调用互相等待
+func (um *URLManager) pick() (selected *URLInfo, live int) {
+	n := len(um.urls)
+	um.randMu.Lock()
+	startIndex := um.rand.Intn(n) // 引入随机偏移量
+	um.randMu.Unlock()
+	if um.Strategy == RoundRobin {
+		startIndex = int(atomic.AddUint64(&um.rrNext, 1)-1) % n
+	}
+
+	minLoadRatio := math.MaxFloat64
+	var alive []*URLInfo
+	var weights []float64
+	var totalWeight float64
+	for i := 0; i < n; i++ {
+		urlInfo := um.urls[(startIndex+i)%n]
+		urlInfo.mu.Lock()
+		dead := urlInfo.Dead
+		if !urlInfo.removed {
+			live++
+		}
+		weight := urlInfo.Weight
+		loadRatio := float64(urlInfo.Load) / weight
+		urlInfo.mu.Unlock()
+		if dead {
+			continue
+		}
+
+		switch um.Strategy {
+		case RoundRobin:
+			// 从上次之后的位置开始，第一个存活的URL
+			if selected == nil {
+				selected = urlInfo
+			}
+		case WeightedRandom:
+			alive = append(alive, urlInfo)
+			weights = append(weights, weight)
+			totalWeight += weight
+		default:
+			if loadRatio < minLoadRatio {
+				selected = urlInfo
+				minLoadRatio = loadRatio
+			}
+		}
+	}
+
+	if um.Strategy == WeightedRandom && len(alive) > 0 {
+		um.randMu.Lock()
+		r := um.rand.Float64() * totalWeight
+		um.randMu.Unlock()
+		selected = alive[len(alive)-1]
+		for i, weight := range weights {
+			if r < weight {
+				selected = alive[i]
+				break
+			}
+			r -= weight
+		}
+	}
+	return selected, live
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamTimeout 等待上游响应头的超时时间，也是读取响应体时的空闲超时：
+// 超过该时间没有收到任何数据就取消请求，不限制大文件的总下载时间。
+// UPSTREAM_TIMEOUT 配置（如 30s），0 表示不限制
+var upstreamTimeout = getEnvDuration("UPSTREAM_TIMEOUT", 30*time.Second)
+
+// idleTimer 超过 timeout 没有进展时调用 cancel
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+func newIdleTimer(timeout time.Duration, cancel func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			t.fired.Store(true)
+			cancel()
+		})
+	}
+	return t
+}
+
+// progress 收到数据后重新计时
+func (t *idleTimer) progress() {
+	if t.timer != nil && !t.fired.Load() {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// expired 返回请求是否因超时被取消
+func (t *idleTimer) expired() bool {
+	return t.fired.Load()
+}
+
+// idleBody 上游响应体，每次读到数据时重新计时
+type idleBody struct {
+	io.ReadCloser
+	idle *idleTimer
+}
+
+func (b idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.idle.progress()
+	}
+	return n, err
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 缓存缺陷类型
+const (
+	defectHashMismatch = "hash_mismatch" // 内容的 sha256 与文件名不一致
+	defectSizeMismatch = "size_mismatch" // 分片总大小与记录文件不一致
+	defectMissingPart  = "missing_part"  // 记录文件指向的分片不存在
+	defectOrphanPart   = "orphan_part"   // 没有记录文件或超出记录范围的分片
+	defectBadRecord    = "bad_record"    // 记录文件无法解析
+	defectOrphanMeta   = "orphan_meta"   // 没有对应数据的响应头或引用文件
+	defectStaleTemp    = "stale_temp"    // 中断写入遗留的临时文件
+)
+
+var (
+	partFileRe   = regexp.MustCompile(`^(.+)_part_(\d+)\.dat$`)
+	recordFileRe = regexp.MustCompile(`^(.+)_record\.txt$`)
+	metaFileRe   = regexp.MustCompile(`^(.+)_meta\.json$`)
+	refsFileRe   = regexp.MustCompile(`^(.+)_refs\.json$`)
+	tempFileRe   = regexp.MustCompile(`^(.+?)(?:_part_\d+\.dat|\.dat|_record\.txt|_meta\.json|_refs\.json)\.tmp.*$`)
+	dataFileRe   = regexp.MustCompile(`^(.+)\.dat$`)
+	sha256KeyRe  = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
+)
+
+// CacheDefect 缓存目录中的一处问题，Files 为修复时需要删除的文件
+type CacheDefect struct {
+	Key    string   `json:"key"`
+	Kind   string   `json:"kind"`
+	Detail string   `json:"detail"`
+	Files  []string `json:"files"`
+}
+
+// CacheReport 缓存目录的检查结果
+type CacheReport struct {
+	Entries  int           `json:"entries"`  // 检查的缓存键数量
+	Verified int           `json:"verified"` // 通过 sha256 校验的条目数量
+	Defects  []CacheDefect `json:"defects"`
+}
+
+// cacheEntryFiles 同一个缓存键下的所有文件
+type cacheEntryFiles struct {
+	data   string
+	record string
+	meta   string
+	refs   string
+	parts  map[int]string
+	temps  []string
+}
+
+// VerifyCache 扫描缓存目录，流式校验每个条目的 sha256 并找出孤立的分片、
+// 指向缺失分片的记录文件和遗留的临时文件。只报告不修改，删除由 Repair 完成。
+// 应在代理停止时运行，否则正在写入的条目可能被误报
+func VerifyCache(dir string) (CacheReport, error) {
+	var report CacheReport
+
+	entries, err := scanCacheDir(dir)
+	if err != nil {
+		return report, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		report.Entries++
+		defects, verified, err := verifyCacheEntry(key, entries[key])
+		if err != nil {
+			return report, err
+		}
+		report.Defects = append(report.Defects, defects...)
+		if verified {
+			report.Verified++
+		}
+	}
+	return report, nil
+}
+
+// scanCacheDir 按缓存键归类缓存目录中的文件
+func scanCacheDir(dir string) (map[string]*cacheEntryFiles, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache dir: %v", err)
+	}
+
+	entries := make(map[string]*cacheEntryFiles)
+	entry := func(key string) *cacheEntryFiles {
+		e, ok := entries[key]
+		if !ok {
+			e = &cacheEntryFiles{parts: make(map[int]string)}
+			entries[key] = e
+		}
+		return e
+	}
+	for _, de := range dirEntries {
+		if de.IsDir() {
+			continue
+		}
+		name := de.Name()
+		path := filepath.Join(dir, name)
+		if m := partFileRe.FindStringSubmatch(name); m != nil {
+			part, err := strconv.Atoi(m[2])
+			if err != nil {
+				continue
+			}
+			entry(m[1]).parts[part] = path
+		} else if m := recordFileRe.FindStringSubmatch(name); m != nil {
+			entry(m[1]).record = path
+		} else if m := metaFileRe.FindStringSubmatch(name); m != nil {
+			entry(m[1]).meta = path
+		} else if m := refsFileRe.FindStringSubmatch(name); m != nil {
+			entry(m[1]).refs = path
+		} else if m := tempFileRe.FindStringSubmatch(name); m != nil {
+			e := entry(m[1])
+			e.temps = append(e.temps, path)
+		} else if m := dataFileRe.FindStringSubmatch(name); m != nil {
+			entry(m[1]).data = path
+		}
+	}
+	return entries, nil
+}
+
+// verifyCacheEntry 检查一个缓存键下的文件，verified 表示内容通过了 sha256 校验
+func verifyCacheEntry(key string, e *cacheEntryFiles) (defects []CacheDefect, verified bool, err error) {
+	for _, temp := range e.temps {
+		defects = append(defects, CacheDefect{Key: key, Kind: defectStaleTemp, Detail: "leftover temp file", Files: []string{temp}})
+	}
+
+	// all 删除整个条目时需要删除的文件
+	all := func() []string {
+		var files []string
+		for _, f := range []string{e.data, e.record, e.meta, e.refs} {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+		for _, part := range sortedParts(e.parts) {
+			files = append(files, e.parts[part])
+		}
+		return files
+	}
+	checkHash := func(paths []string) (bool, error) {
+		if !sha256KeyRe.MatchString(key) {
+			return false, nil
+		}
+		sum, err := hashFiles(paths)
+		if err != nil {
+			return false, err
+		}
+		if !strings.EqualFold(sum, key) {
+			defects = append(defects, CacheDefect{Key: key, Kind: defectHashMismatch, Detail: "content sha256 " + sum, Files: all()})
+			return false, nil
+		}
+		return true, nil
+	}
+
+	switch {
+	case e.record != "":
+		var partCount int
+		var totalSize int64
+		record, err := os.ReadFile(e.record)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read record file: %v", err)
+		}
+		if _, err := fmt.Sscanf(string(record), "Parts: %d\nTotalSize: %d\n", &partCount, &totalSize); err != nil || partCount <= 0 {
+			defects = append(defects, CacheDefect{Key: key, Kind: defectBadRecord, Detail: "unparseable record file", Files: all()})
+			return defects, false, nil
+		}
+
+		var missing []int
+		var paths []string
+		var size int64
+		for part := 0; part < partCount; part++ {
+			path, ok := e.parts[part]
+			if !ok {
+				missing = append(missing, part)
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to stat cache part: %v", err)
+			}
+			paths = append(paths, path)
+			size += info.Size()
+		}
+		for _, part := range sortedParts(e.parts) {
+			if part >= partCount {
+				defects = append(defects, CacheDefect{Key: key, Kind: defectOrphanPart, Detail: fmt.Sprintf("part %d beyond record", part), Files: []string{e.parts[part]}})
+			}
+		}
+		if len(missing) > 0 {
+			defects = append(defects, CacheDefect{Key: key, Kind: defectMissingPart, Detail: fmt.Sprintf("missing parts %v", missing), Files: all()})
+			return defects, false, nil
+		}
+		if size != totalSize {
+			defects = append(defects, CacheDefect{Key: key, Kind: defectSizeMismatch, Detail: fmt.Sprintf("record says %d bytes, parts hold %d", totalSize, size), Files: all()})
+			return defects, false, nil
+		}
+		verified, err = checkHash(paths)
+		if err != nil {
+			return nil, false, err
+		}
+
+	case len(e.parts) > 0:
+		// 没有记录文件的分片属于未完成的写入
+		defects = append(defects, CacheDefect{Key: key, Kind: defectOrphanPart, Detail: "parts without record file", Files: all()})
+		return defects, false, nil
+
+	case e.data != "":
+		verified, err = checkHash([]string{e.data})
+		if err != nil {
+			return nil, false, err
+		}
+
+	case e.meta != "" || e.refs != "":
+		defects = append(defects, CacheDefect{Key: key, Kind: defectOrphanMeta, Detail: "meta file without data", Files: all()})
+	}
+	return defects, verified, nil
+}
+
+// sortedParts 返回按编号排序的分片号
+func sortedParts(parts map[int]string) []int {
+	nums := make([]int, 0, len(parts))
+	for part := range parts {
+		nums = append(nums, part)
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// hashFiles 依次读取文件计算 sha256，不把内容整体读入内存
+func hashFiles(paths []string) (string, error) {
+	hasher := sha256.New()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to open cache file: %v", err)
+		}
+		_, err = io.Copy(hasher, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read cache file: %v", err)
+		}
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// Repair 删除报告中所有有问题的文件，返回删除的文件列表
+func (r CacheReport) Repair() ([]string, error) {
+	var removed []string
+	seen := make(map[string]bool)
+	for _, defect := range r.Defects {
+		for _, file := range defect.Files {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return removed, fmt.Errorf("failed to remove %s: %v", file, err)
+			}
+			removed = append(removed, file)
+		}
+	}
+	return removed, nil
+}
+
+// runVerifyCache 执行 -verify-cache 命令，以 JSON 输出报告，发现问题且未修复时返回非零退出码
+func runVerifyCache(dir string, repair bool) int {
+	report, err := VerifyCache(dir)
+	if err != nil {
+		log.Printf("Failed to verify cache: %v", err)
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+
+	if len(report.Defects) == 0 {
+		return 0
+	}
+	if !repair {
+		return 1
+	}
+	removed, err := report.Repair()
+	for _, file := range removed {
+		fmt.Printf("removed %s\n", file)
+	}
+	if err != nil {
+		log.Printf("Failed to repair cache: %v", err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// weightsFile 保存镜像权重的文件，重启后从中恢复，WEIGHTS_FILE 配置，为空时不保存
+	weightsFile = getEnv("WEIGHTS_FILE", "weights.json")
+	// weightsSaveInterval 保存权重的间隔，WEIGHTS_SAVE_INTERVAL 配置
+	weightsSaveInterval = getEnvDuration("WEIGHTS_SAVE_INTERVAL", time.Minute)
+)
+
+// urlState 持久化的镜像状态。死亡标记和负载是临时状态，不保存
+type urlState struct {
+	URL          string  `json:"url"`
+	Weight       float64 `json:"weight"`
+	ResponseTime float64 `json:"response_time"`
+}
+
+// NewURLManagerFromFile 创建一个URLManager，之后 AddURL 添加的URL使用 path 中保存的权重和响应时间。
+// 文件不存在时与 NewURLManager 相同；Save 把当前状态写回 path
+func NewURLManagerFromFile(path string) (*URLManager, error) {
+	um := NewURLManager()
+	um.stateFile = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return um, nil
+	}
+	if err != nil {
+		return um, fmt.Errorf("failed to read weights file: %v", err)
+	}
+	var states []urlState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return um, fmt.Errorf("failed to parse weights file %s: %v", path, err)
+	}
+	um.saved = make(map[string]urlState, len(states))
+	for _, state := range states {
+		um.saved[state.URL] = state
+	}
+	return um, nil
+}
+
+// Save 把所有URL的权重和响应时间写入 NewURLManagerFromFile 指定的文件，
+// 先写临时文件再重命名，中断时不会留下半个文件。并发调用依次执行
+func (um *URLManager) Save() error {
+	if um.stateFile == "" {
+		return nil
+	}
+	um.saveMu.Lock()
+	defer um.saveMu.Unlock()
+
+	um.mu.RLock()
+	states := make([]urlState, 0, len(um.urls))
+	for _, urlInfo := range um.urls {
+		urlInfo.mu.Lock()
+		states = append(states, urlState{URL: urlInfo.URL, Weight: urlInfo.Weight, ResponseTime: urlInfo.ResponseTime})
+		urlInfo.mu.Unlock()
+	}
+	um.mu.RUnlock()
+
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(um.stateFile, data)
+}
+
+// routeWeightsFile 返回前缀镜像池保存权重的文件，在 path 的扩展名前加上前缀，
+// 如 weights.json 和 /ghcr 对应 weights.ghcr.json。path 为空时不保存，返回空字符串
+func routeWeightsFile(path, prefix string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	name := strings.ReplaceAll(strings.Trim(prefix, "/"), "/", "_")
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// saveEvery 每隔 interval 保存一次权重，ctx 取消后停止
+func (um *URLManager) saveEvery(ctx context.Context, interval time.Duration) {
+	if um.stateFile == "" || interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := um.Save(); err != nil {
+				log.Printf("Failed to save URL weights: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// checkpoint 记录直接写入输出文件时各字节区间的完成情况，保存在输出文件旁。
+// ETag 和 Length 用于在续传前确认源文件没有变化
+type checkpoint struct {
+	ETag      string `json:"etag"`
+	Length    int64  `json:"length"`
+	ChunkSize int64  `json:"chunk_size"`
+	Done      []bool `json:"done"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// checkpointPath 返回输出文件对应的检查点路径
+func checkpointPath(filename string) string {
+	return filename + ".checkpoint"
+}
+
+// newCheckpoint 创建一个所有区间都未完成的检查点
+func newCheckpoint(filename string, info remoteFile, chunkSize int64) *checkpoint {
+	total := int((info.length + chunkSize - 1) / chunkSize)
+	return &checkpoint{
+		ETag:      info.etag,
+		Length:    info.length,
+		ChunkSize: chunkSize,
+		Done:      make([]bool, total),
+		path:      checkpointPath(filename),
+	}
+}
+
+// loadCheckpoint 读取已有的检查点，源文件的 ETag 或长度发生变化、
+// 源文件没有 ETag 或检查点损坏时返回新的检查点，resumed 为 false
+func loadCheckpoint(filename string, info remoteFile, chunkSize int64) (cp *checkpoint, resumed bool) {
+	fresh := newCheckpoint(filename, info, chunkSize)
+	if info.etag == "" {
+		return fresh, false
+	}
+
+	data, err := os.ReadFile(fresh.path)
+	if err != nil {
+		return fresh, false
+	}
+	var saved checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fresh, false
+	}
+	if saved.ETag != info.etag || saved.Length != info.length ||
+		saved.ChunkSize != chunkSize || len(saved.Done) != len(fresh.Done) {
+		return fresh, false
+	}
+
+	fresh.Done = saved.Done
+	return fresh, true
+}
+
+// remaining 返回未完成的区间数
+func (cp *checkpoint) remaining() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	n := 0
+	for _, done := range cp.Done {
+		if !done {
+			n++
+		}
+	}
+	return n
+}
+
+// markDone 标记区间 i 已完成并持久化
+func (cp *checkpoint) markDone(i int) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Done[i] = true
+	return cp.saveLocked()
+}
+
+// save 持久化检查点
+func (cp *checkpoint) save() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.saveLocked()
+}
+
+// saveLocked 先写临时文件再重命名，避免中断时留下半个检查点
+func (cp *checkpoint) saveLocked() error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, cp.path); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %v", err)
+	}
+	return nil
+}
+
+// remove 删除检查点文件
+func (cp *checkpoint) remove() {
+	os.Remove(cp.path)
+}
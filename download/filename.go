@@ -0,0 +1,53 @@
+package main
+
+import (
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// defaultOutputName 响应头和 URL 中都没有可用的文件名时使用
+const defaultOutputName = "download"
+
+// isOutputDir 输出路径以 / 结尾时表示目录，文件名由服务器决定
+func isOutputDir(output string) bool {
+	return strings.HasSuffix(output, "/")
+}
+
+// outputName 返回保存文件使用的名称：优先使用 Content-Disposition 中的文件名，
+// 其次是 URL 路径的最后一段
+func outputName(disposition, rawURL string) string {
+	if disposition != "" {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			// filename* 由 mime 解码后也放在 filename 中
+			if name := sanitizeFileName(params["filename"]); name != "" {
+				return name
+			}
+		}
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		if name := sanitizeFileName(path.Base(u.Path)); name != "" {
+			return name
+		}
+	}
+	return defaultOutputName
+}
+
+// sanitizeFileName 只保留文件名本身，去掉目录部分，防止服务器给出的名称写到输出目录之外。
+// 无法使用时返回空字符串
+func sanitizeFileName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = path.Base(strings.TrimSpace(name))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	switch name {
+	case "", ".", "..", "/":
+		return ""
+	}
+	return name
+}
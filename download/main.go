@@ -1,197 +1,488 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"jiaoben-/s3/model"
+	"jiaoben-/util/pool"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-// downloadChunk 下载文件的一个分片
-func downloadChunk(url string, headers map[string]string, start, end int64, chunkNum int, filename string, wg *sync.WaitGroup, errChan chan error) {
-	defer wg.Done()
+// errRangeIgnored 服务器对 Range 请求返回了 200 和整个文件，不能分片下载
+var errRangeIgnored = errors.New("server ignored the Range header")
 
-	// 创建请求
-	req, err := http.NewRequest("GET", url, nil)
+// objectStore 下载结果的远端存储，S3Client 实现了该接口
+type objectStore interface {
+	UploadReader(key string, r io.Reader, partSize int64) error
+}
+
+// store 非空时下载完成后上传，不在本地保留最终文件
+var store objectStore
+
+// storePartSize 流式上传时每个分片的大小
+const storePartSize = 10 * 1024 * 1024
+
+// downloadOptions 分片下载的参数，不同的服务器适合不同的设置
+type downloadOptions struct {
+	chunkSize   int64 // 每个 Range 请求的字节数
+	concurrency int   // 单个文件同时进行的 Range 请求数
+
+	// progress 可选，下载过程中按间隔回调已下载的字节数和总长度（未知时为 -1）
+	progress func(downloaded, total int64)
+}
+
+// defaultOptions 命令行和任务都没有指定时使用的参数
+var defaultOptions = downloadOptions{chunkSize: 10 * 1024 * 1024, concurrency: 8}
+
+const (
+	// minChunkSize 区间太小时请求数过多，反而更慢
+	minChunkSize = 64 * 1024
+	// maxChunks 单个文件最多划分的区间数，文件很大时自动增大区间，检查点也不会过大
+	maxChunks = 10000
+)
+
+// validate 检查参数是否有效
+func (o downloadOptions) validate() error {
+	if o.chunkSize < minChunkSize {
+		return fmt.Errorf("chunk size must be at least %d bytes", minChunkSize)
+	}
+	if o.concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	return nil
+}
+
+// chunkSizeFor 返回长度为 length 的文件使用的区间大小，区间数不超过 maxChunks
+func (o downloadOptions) chunkSizeFor(length int64) int64 {
+	if length > o.chunkSize*maxChunks {
+		return (length + maxChunks - 1) / maxChunks
+	}
+	return o.chunkSize
+}
+
+// remoteFile 源文件的长度和 ETag，length 为 -1 表示服务器没有返回长度
+type remoteFile struct {
+	length      int64
+	etag        string
+	disposition string // Content-Disposition，用于确定文件名
+}
+
+// statRemote 通过 HEAD 请求获取源文件的长度和 ETag
+func statRemote(ctx context.Context, url string, headers map[string]string) (remoteFile, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
-		errChan <- fmt.Errorf("failed to create request: %v", err)
-		return
+		return remoteFile{}, err
 	}
 
-	// 设置请求头
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
-	// 发送请求
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		errChan <- fmt.Errorf("failed to download chunk %d: %v", chunkNum, err)
-		return
+		return remoteFile{}, err
 	}
 	defer resp.Body.Close()
 
-	// 检查响应状态码
-	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
-		errChan <- fmt.Errorf("failed to download chunk %d: status code %d", chunkNum, resp.StatusCode)
-		return
+	if resp.StatusCode != http.StatusOK {
+		return remoteFile{}, fmt.Errorf("status code %d", resp.StatusCode)
 	}
 
-	// 创建目标文件
-	out, err := os.Create(fmt.Sprintf("%s_chunk_%d", filename, chunkNum))
-	if err != nil {
-		errChan <- fmt.Errorf("failed to create chunk file %d: %v", chunkNum, err)
-		return
+	// 没有 Content-Length（如分块传输）时长度未知，由调用方改为不分片下载
+	length := int64(-1)
+	if lengthStr := resp.Header.Get("Content-Length"); lengthStr != "" {
+		length, err = strconv.ParseInt(lengthStr, 10, 64)
+		if err != nil || length < 0 {
+			return remoteFile{}, fmt.Errorf("invalid Content-Length %q", lengthStr)
+		}
 	}
-	defer out.Close()
 
-	// 将响应数据写入文件
-	_, err = io.Copy(out, resp.Body)
+	return remoteFile{length: length, etag: resp.Header.Get("ETag"), disposition: resp.Header.Get("Content-Disposition")}, nil
+}
+
+// downloadStream 不分片地用一个请求下载整个文件，用于长度未知的源文件
+func downloadStream(ctx context.Context, url string, headers map[string]string, filename string, check fileCheck, opts downloadOptions) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		errChan <- fmt.Errorf("failed to write chunk file %d: %v", chunkNum, err)
-		return
+		return fmt.Errorf("failed to create request: %v", err)
 	}
 
-}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
 
-// mergeChunks 合并所有分片
-func mergeChunks(filename string, totalChunks int) error {
-	out, err := os.Create(filename)
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+		return fmt.Errorf("failed to download file: %v", err)
 	}
-	defer out.Close()
+	defer resp.Body.Close()
 
-	for i := 0; i < totalChunks; i++ {
-		chunkFile, err := os.Open(fmt.Sprintf("%s_chunk_%d", filename, i))
-		if err != nil {
-			return fmt.Errorf("failed to open chunk file %d: %v", i, err)
-		}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download file: status code %d", resp.StatusCode)
+	}
+	r := throttle(ctx, resp.Body)
+	if p := newProgress(opts.progress, check.length, 0); p != nil {
+		r = io.TeeReader(r, p)
+	}
+	return saveReader(filename, r, check)
+}
 
-		_, err = io.Copy(out, chunkFile)
-		chunkFile.Close()
-		if err != nil {
-			return fmt.Errorf("failed to copy chunk file %d: %v", i, err)
+// saveReader 将 r 的全部内容保存为 filename，配置了 store 时直接上传。
+// 本地先写入 .part 文件，完整写入且通过校验后再重命名
+func saveReader(filename string, r io.Reader, check fileCheck) error {
+	d := newDigestWriter()
+	r = io.TeeReader(r, d)
+	if store != nil {
+		key := filepath.Base(filename)
+		if err := store.UploadReader(key, r, storePartSize); err != nil {
+			return fmt.Errorf("failed to upload file: %v", err)
 		}
-
-		// 删除分片文件
-		os.Remove(fmt.Sprintf("%s_chunk_%d", filename, i))
+		// 边下载边上传，只能在上传后发现内容不对
+		if err := check.verify(d); err != nil {
+			return fmt.Errorf("uploaded %s is invalid: %v", key, err)
+		}
+		return nil
 	}
 
+	partPath := filename + ".part"
+	out, err := os.Create(partPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(partPath)
+		return fmt.Errorf("failed to write output file: %v", err)
+	}
+	if err := check.verify(d); err != nil {
+		out.Close()
+		os.Remove(partPath)
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(partPath)
+		return fmt.Errorf("failed to close output file: %v", err)
+	}
+	if err := os.Rename(partPath, filename); err != nil {
+		return fmt.Errorf("failed to rename output file: %v", err)
+	}
 	return nil
 }
 
-// getContentLength 获取文件总长度
-func getContentLength(url string, headers map[string]string) (int64, error) {
-	req, err := http.NewRequest("HEAD", url, nil)
+// downloadRangeAt 下载 [start, end] 区间并写入 out 的对应偏移。
+// etag 非空时通过 If-Range 要求源文件未变化，否则服务器会返回整个文件，此时报错。
+// 返回 200 时（源文件变化或服务器不支持 Range）返回 errRangeIgnored
+func downloadRangeAt(ctx context.Context, url string, headers map[string]string, etag string, start, end int64, out io.WriterAt) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("failed to create request: %v", err)
 	}
 
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		req.Header.Set("If-Range", etag)
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("status code %d", resp.StatusCode)
+	if resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("source may have changed: %w", errRangeIgnored)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("status code %d, source may have changed", resp.StatusCode)
+	}
+	if got := resp.Header.Get("ETag"); etag != "" && got != "" && got != etag {
+		return fmt.Errorf("etag changed from %s to %s", etag, got)
 	}
 
-	lengthStr := resp.Header.Get("Content-Length")
-	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	n, err := io.Copy(io.NewOffsetWriter(out, start), throttle(ctx, resp.Body))
 	if err != nil {
-		return 0, err
+		return err
 	}
-
-	return length, nil
+	if n != end-start+1 {
+		return fmt.Errorf("short read: got %d of %d bytes", n, end-start+1)
+	}
+	return nil
 }
 
-// downloadFile 下载整个文件
-func downloadFile(url string, headers map[string]string, filename string) error {
-	// 获取文件总长度
-	contentLength, err := getContentLength(url, headers)
+// downloadFileAt 将各区间直接写入输出文件的对应偏移，进度记录在检查点中。
+// 中断后重新运行时只下载未完成的区间；源文件的 ETag 或长度变化时从头开始。
+// ctx 取消或任一区间失败时中止其余区间的请求；源文件没有 ETag 时无法续传，失败后删除已下载的数据
+func downloadFileAt(ctx context.Context, url string, headers map[string]string, filename string, info remoteFile, opts downloadOptions) (err error) {
+	partPath := filename + ".part"
+	chunkSize := opts.chunkSizeFor(info.length)
+	if info.etag == "" {
+		defer func() {
+			if err != nil {
+				os.Remove(partPath)
+				os.Remove(checkpointPath(filename))
+			}
+		}()
+	}
+	cp, resumed := loadCheckpoint(filename, info, chunkSize)
+
+	// 续传时分片文件必须存在且长度正确，否则从头开始
+	if resumed {
+		if fi, err := os.Stat(partPath); err != nil || fi.Size() != info.length {
+			cp, resumed = newCheckpoint(filename, info, chunkSize), false
+		}
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if !resumed {
+		flag |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(partPath, flag, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to get content length: %v", err)
+		return fmt.Errorf("failed to open output file: %v", err)
 	}
+	defer out.Close()
 
-	const chunkSize = 10 * 1024 * 1024 // 1MB
-	totalChunks := int(contentLength / chunkSize)
-	if contentLength%chunkSize != 0 {
-		totalChunks++
+	if resumed {
+		fmt.Printf("Resuming %s: %d of %d ranges left\n", filename, cp.remaining(), len(cp.Done))
+	} else {
+		if err := out.Truncate(info.length); err != nil {
+			return fmt.Errorf("failed to allocate output file: %v", err)
+		}
+		if err := cp.save(); err != nil {
+			return err
+		}
 	}
 
-	var wg sync.WaitGroup
-	errChan := make(chan error, totalChunks)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	for i := 0; i < totalChunks; i++ {
-		wg.Add(1)
+	var tasks []func() error
+	var p *progress      // 各区间共享同一个进度，任务开始执行前创建
+	var downloaded int64 // 续传时已完成的字节数
+	for i, done := range cp.Done {
+		i := i
 		start := int64(i) * chunkSize
 		end := start + chunkSize - 1
-		if end > contentLength-1 {
-			end = contentLength - 1
+		if end > info.length-1 {
+			end = info.length - 1
+		}
+		if done {
+			downloaded += end - start + 1
+			continue
 		}
 
-		go downloadChunk(url, headers, start, end, i, filename, &wg, errChan)
+		tasks = append(tasks, func() error {
+			var dst io.WriterAt = out
+			var pw *progressWriterAt
+			if p != nil {
+				pw = &progressWriterAt{w: out, p: p}
+				dst = pw
+			}
+			err := withRetry(ctx, chunkAttempts, func() error {
+				if pw != nil {
+					pw.reset()
+				}
+				return downloadRangeAt(ctx, url, headers, info.etag, start, end, dst)
+			})
+			if err != nil {
+				cancel() // 中止其他进行中的区间
+				return fmt.Errorf("failed to download range %d: %w", i, err)
+			}
+			return cp.markDone(i)
+		})
+	}
+
+	p = newProgress(opts.progress, info.length, downloaded)
+
+	// 区间比并发数少时（如小文件只有一个区间）不需要多余的协程
+	workers := opts.concurrency
+	if workers > len(tasks) {
+		workers = len(tasks)
+	}
+	if err := pool.RunSlice(ctx, workers, tasks); err != nil {
+		return fmt.Errorf("download error: %w", err)
 	}
 
-	wg.Wait()
-	close(errChan)
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %v", err)
+	}
+	if err := os.Rename(partPath, filename); err != nil {
+		return fmt.Errorf("failed to rename output file: %v", err)
+	}
+	cp.remove()
+	return nil
+}
 
-	for err := range errChan {
-		if err != nil {
-			return fmt.Errorf("download error: %v", err)
-		}
+// downloadFile 按 opts 分片下载整个文件，ctx 取消时中止所有请求。下载结果的长度必须与 HEAD 返回的一致，
+// expectedSHA256 非空时同时校验 sha256，不一致时删除文件并返回错误。
+// filename 以 / 结尾时保存到该目录，文件名取自 Content-Disposition 或 URL
+func downloadFile(ctx context.Context, url string, headers map[string]string, filename string, expectedSHA256 string, opts downloadOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
 	}
 
-	err = mergeChunks(filename, totalChunks)
+	// 获取文件总长度
+	info, err := statRemote(ctx, url, headers)
 	if err != nil {
-		return fmt.Errorf("failed to merge chunks: %v", err)
+		return fmt.Errorf("failed to get content length: %v", err)
+	}
+	if isOutputDir(filename) {
+		filename = filepath.Join(filename, outputName(info.disposition, url))
+		fmt.Printf("Saving %s as %s\n", url, filename)
+	}
+	contentLength := info.length
+	check := fileCheck{length: contentLength, sha256: expectedSHA256}
+
+	switch {
+	case contentLength == 0:
+		// 空文件直接创建，不需要分片
+		return saveReader(filename, strings.NewReader(""), check)
+	case contentLength < 0:
+		// 长度未知时无法划分区间，改为单个请求流式下载
+		return downloadStream(ctx, url, headers, filename, check, opts)
+	}
+
+	// 各区间直接写入输出文件的对应偏移，支持断点续传
+	if store == nil {
+		err = downloadFileAt(ctx, url, headers, filename, info, opts)
+		if err == nil {
+			err = verifyFile(filename, check)
+		}
+	} else {
+		err = downloadToStore(ctx, url, headers, filename, info, opts, check)
+	}
+	if errors.Is(err, errRangeIgnored) {
+		// 已写入的数据不可信，丢弃后用一个请求重新下载整个文件
+		fmt.Printf("Range requests not honored for %s, falling back to a single stream\n", url)
+		os.Remove(filename + ".part")
+		os.Remove(checkpointPath(filename))
+		return downloadStream(ctx, url, headers, filename, check, opts)
+	}
+	return err
+}
+
+// downloadToStore 先直接写入本地文件，完整下载并通过校验后上传到 store 并删除本地文件。
+// 源文件有 ETag 时失败后保留进度用于续传
+func downloadToStore(ctx context.Context, url string, headers map[string]string, filename string, info remoteFile, opts downloadOptions, check fileCheck) error {
+	if err := downloadFileAt(ctx, url, headers, filename, info, opts); err != nil {
+		return err
+	}
+	defer os.Remove(filename)
+	if err := verifyFile(filename, check); err != nil {
+		return err
 	}
 
-	fmt.Println("11")
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open downloaded file: %v", err)
+	}
+	defer f.Close()
+	if err := store.UploadReader(filepath.Base(filename), f, storePartSize); err != nil {
+		return fmt.Errorf("failed to upload file: %v", err)
+	}
 	return nil
 }
 
-// readDir 读取目录中的文件并发送到channel
-func readDir(dir string, urlChan chan string) {
-	defer close(urlChan)
+// readDir 读取目录中的任务文件并发送到channel，旧格式的文件名由 legacy 转换为任务
+func readDir(dir string, legacy func(name string) task, tasks chan<- task) {
+	defer close(tasks)
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		panic(err)
 	}
 
 	for _, file := range files {
-		f, err := os.Open(path.Join(dir, file.Name()))
-		if err != nil {
-			panic(err)
-		}
-		defer f.Close()
-
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			urlChan <- scanner.Text()
+		if file.IsDir() {
+			continue
 		}
-		if err := scanner.Err(); err != nil {
+		err := readTaskFile(path.Join(dir, file.Name()), legacy, func(t task) { tasks <- t })
+		if err != nil {
 			fmt.Printf("Failed to read file: %v\n", err)
 		}
 	}
 }
 
+// workerPause 每个下载线程处理完一个文件后的间隔
+var workerPause = time.Second
+
+// runWorkers 启动 workers 个线程依次处理 items 中的任务。ctx 取消后不再开始新的任务，
+// 进行中的任务继续处理完，剩余的任务只计数不处理
+func runWorkers[T any](ctx context.Context, workers int, items <-chan T, process func(item T) error) (completed, failed, remaining int64) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				if ctx.Err() != nil {
+					atomic.AddInt64(&remaining, 1)
+					continue
+				}
+
+				if err := process(item); err != nil {
+					fmt.Println(err)
+					atomic.AddInt64(&failed, 1)
+				} else {
+					atomic.AddInt64(&completed, 1)
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(workerPause):
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	return completed, failed, remaining
+}
+
 func main() {
+	workers := flag.Int("workers", 16, "number of files to download concurrently")
+	flag.IntVar(&chunkAttempts, "retries", chunkAttempts, "attempts per chunk before the download fails")
+	flag.Int64Var(&defaultOptions.chunkSize, "chunk-size", defaultOptions.chunkSize, "bytes per range request")
+	flag.IntVar(&defaultOptions.concurrency, "concurrency", defaultOptions.concurrency, "number of concurrent range requests per file")
+	showProgress := flag.Bool("progress", false, "print the progress of each file periodically")
+	maxRate := flag.Int64("max-rate", 0, "aggregate download limit across all files in bytes per second, 0 for unlimited")
+	flag.Parse()
+	if *workers < 1 {
+		fmt.Println("-workers must be at least 1")
+		os.Exit(2)
+	}
+	if chunkAttempts < 1 {
+		fmt.Println("-retries must be at least 1")
+		os.Exit(2)
+	}
+	if err := defaultOptions.validate(); err != nil {
+		fmt.Printf("Invalid options: %v\n", err)
+		os.Exit(2)
+	}
+	if *maxRate < 0 {
+		fmt.Println("-max-rate must not be negative")
+		os.Exit(2)
+	}
+	limiter = newLimiter(*maxRate)
+
 	// 定义请求头
 	headers := map[string]string{
 		"Accept":                    "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7",
@@ -206,47 +497,87 @@ func main() {
 		"User-Agent":                "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
 	}
 
-	// 读取包含URL的文件目录
-	FileDir := "task"
-	filenames := make(chan string)
+	// 配置了 S3_BUCKET 时合并结果直接上传到 S3。使用临时凭证时通过 S3_SESSION_TOKEN 传入会话令牌，
+	// 自签名证书的 MinIO 可设置 S3_INSECURE_SKIP_VERIFY=true
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		var opts []model.ClientOption
+		if token := os.Getenv("S3_SESSION_TOKEN"); token != "" {
+			opts = append(opts, model.WithSessionToken(token))
+		}
+		if os.Getenv("S3_INSECURE_SKIP_VERIFY") == "true" {
+			opts = append(opts, model.WithInsecureSkipVerify())
+		}
+		client, err := model.NewS3Client(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), os.Getenv("S3_REGION"), os.Getenv("S3_ENDPOINT"), bucket, opts...)
+		if err != nil {
+			fmt.Printf("Failed to create S3 client: %v\n", err)
+			return
+		}
+		store = client
+	}
 
-	// 启动一个goroutine读取URL文件
-	go readDir(FileDir, filenames)
+	// 第一次 Ctrl-C 停止调度新文件并等待进行中的下载结束，再次 Ctrl-C 取消进行中的下载
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	downloadCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	go func() {
+		<-ctx.Done()
+		stop()
+		fmt.Println("Interrupted, waiting for in-flight downloads (press Ctrl-C again to abort)...")
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sig:
+		case <-downloadCtx.Done():
+			return
+		}
+		signal.Stop(sig) // 恢复默认的信号处理，第三次 Ctrl-C 立即退出
+		fmt.Println("Aborting in-flight downloads...")
+		abort()
+	}()
 
-	var wg sync.WaitGroup
+	// 读取任务文件目录。旧格式的任务文件每行一个文件名，使用固定的地址模板和请求头
+	FileDir := "task"
+	tasks := make(chan task)
+	legacy := func(filename string) task {
+		return task{
+			URL:     "http://down.shuyy8.cc/zip/" + filename + ".zip",
+			Output:  path.Join("download", filename, filename+".zip"),
+			Headers: headers,
+		}
+	}
 
-	// 启动多个下载线程
-	for i := 0; i < 16; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for filename := range filenames {
-				// 处理文件名
-				filename = strings.TrimSpace(filename)
-				if filename == "" {
-					continue
-				}
+	// 启动一个goroutine读取任务文件
+	go readDir(FileDir, legacy, tasks)
 
-				url := "http://down.shuyy8.cc/zip/" + filename + ".zip"
-				toDir := path.Join("download", filename)
-				if err := os.MkdirAll(toDir, 0755); err != nil {
-					fmt.Printf("Failed to create directory %s: %v\n", toDir, err)
-					continue
-				}
-				tofile := path.Join(toDir, filename+".zip")
+	// 启动多个下载线程
+	completed, failed, remaining := runWorkers(ctx, *workers, tasks, func(t task) error {
+		toDir := filepath.Dir(t.Output)
+		if err := os.MkdirAll(toDir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %v", toDir, err)
+		}
 
-				// 下载文件
-				err := downloadFile(url, headers, tofile)
-				if err != nil {
-					fmt.Printf("Failed to download %s: %v\n", url, err)
+		// 下载文件
+		opts := t.options(defaultOptions)
+		if *showProgress {
+			opts.progress = func(downloaded, total int64) {
+				if total > 0 {
+					fmt.Printf("%s: %.1f%% (%d/%d bytes)\n", t.Output, float64(downloaded)*100/float64(total), downloaded, total)
+				} else {
+					fmt.Printf("%s: %d bytes\n", t.Output, downloaded)
 				}
-
-				time.Sleep(time.Second)
 			}
-		}()
-	}
+		}
+		if err := downloadFile(downloadCtx, t.URL, t.Headers, t.Output, t.SHA256, opts); err != nil {
+			return fmt.Errorf("failed to download %s: %v", t.URL, err)
+		}
+		return nil
+	})
 
-	wg.Wait()
-	fmt.Println("All downloads completed.")
+	if ctx.Err() != nil {
+		fmt.Printf("Stopped: %d completed, %d failed, %d remaining.\n", completed, failed, remaining)
+		return
+	}
+	fmt.Printf("All downloads completed: %d completed, %d failed.\n", completed, failed)
 
 }
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubStore 记录上传内容的对象存储
+type stubStore struct {
+	key  string
+	data []byte
+}
+
+func (s *stubStore) UploadReader(key string, r io.Reader, partSize int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.key = key
+	s.data = data
+	return nil
+}
+
+// newTestServer 创建支持 Range 的测试文件服务
+func newTestServer(content []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.zip", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+// TestDownloadFileToStore 测试下载结果上传到对象存储
+func TestDownloadFileToStore(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server := newTestServer(content)
+	defer server.Close()
+
+	stub := &stubStore{}
+	store = stub
+	defer func() { store = nil }()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	err := downloadFile(context.Background(), server.URL, nil, filename, "", defaultOptions)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "file.zip", stub.key)
+	assert.Equal(t, content, stub.data)
+
+	// 本地不保留最终文件、未完成的文件和检查点
+	matches, err := filepath.Glob(filename + "*")
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+// etagServer 带 ETag 的测试文件服务，记录收到的 Range 请求
+type etagServer struct {
+	*httptest.Server
+	content []byte
+
+	mu     sync.Mutex
+	etag   string
+	ranges []string
+}
+
+func newETagServer(content []byte, etag string) *etagServer {
+	s := &etagServer{content: content, etag: etag}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		w.Header().Set("ETag", s.etag)
+		if rng := r.Header.Get("Range"); rng != "" {
+			s.ranges = append(s.ranges, rng)
+		}
+		s.mu.Unlock()
+		http.ServeContent(w, r, "file.zip", time.Time{}, bytes.NewReader(s.content))
+	}))
+	return s
+}
+
+// testOptions 测试使用 100 字节的区间，便于构造多个区间
+var testOptions = downloadOptions{chunkSize: 100, concurrency: 8}
+
+// writePartial 模拟中断的下载：写入检查点并填充已完成的区间
+func writePartial(t *testing.T, filename string, info remoteFile, chunkSize int64, fill []byte, done ...int) {
+	cp := newCheckpoint(filename, info, chunkSize)
+	part := make([]byte, info.length)
+	for _, i := range done {
+		cp.Done[i] = true
+		start := int64(i) * chunkSize
+		copy(part[start:start+chunkSize], fill[start:])
+	}
+	assert.NoError(t, cp.save())
+	assert.NoError(t, os.WriteFile(filename+".part", part, 0644))
+}
+
+// TestDownloadFileAtResume 测试续传时只下载未完成的区间
+func TestDownloadFileAtResume(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := newETagServer(content, `"v1"`)
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	info := remoteFile{length: int64(len(content)), etag: `"v1"`}
+	writePartial(t, filename, info, 100, content, 0, 1, 2, 5)
+
+	err := downloadFileAt(context.Background(), server.URL, nil, filename, info, testOptions)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Len(t, server.ranges, 6)
+	assert.NotContains(t, server.ranges, "bytes=0-99")
+
+	// 完成后不保留检查点和分片文件
+	_, err = os.Stat(checkpointPath(filename))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filename + ".part")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestDownloadFileAtSourceChanged 测试源文件 ETag 变化后从头下载
+func TestDownloadFileAtSourceChanged(t *testing.T) {
+	stale := []byte(strings.Repeat("x", 1000))
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := newETagServer(content, `"v1"`)
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	writePartial(t, filename, remoteFile{length: 1000, etag: `"v1"`}, 100, stale, 0, 1, 2, 5)
+
+	// 中断期间源文件被替换
+	server.mu.Lock()
+	server.etag = `"v2"`
+	server.mu.Unlock()
+
+	info, err := statRemote(context.Background(), server.URL, nil)
+	assert.NoError(t, err)
+	err = downloadFileAt(context.Background(), server.URL, nil, filename, info, testOptions)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Len(t, server.ranges, 10)
+}
+
+// TestDownloadRangeAtChangedMidway 测试下载过程中源文件变化时报错而不是写入错误的数据
+func TestDownloadRangeAtChangedMidway(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := newETagServer(content, `"v2"`)
+	defer server.Close()
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "file.zip"))
+	assert.NoError(t, err)
+	defer out.Close()
+
+	err = downloadRangeAt(context.Background(), server.URL, nil, `"v1"`, 0, 99, out)
+	assert.Error(t, err)
+}
+
+// TestRunWorkersCancel 测试取消后不再开始新的文件，剩余文件被计数
+func TestRunWorkersCancel(t *testing.T) {
+	workerPause = 0
+	defer func() { workerPause = time.Second }()
+
+	filenames := make(chan string)
+	go func() {
+		defer close(filenames)
+		for _, name := range []string{"a", "b", "c", "d"} {
+			filenames <- name
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var started []string
+	completed, failed, remaining := runWorkers(ctx, 1, filenames, func(filename string) error {
+		started = append(started, filename)
+		cancel() // 处理第一个文件时收到中断，进行中的文件继续完成
+		return nil
+	})
+
+	assert.Equal(t, []string{"a"}, started)
+	assert.Equal(t, int64(1), completed)
+	assert.Equal(t, int64(0), failed)
+	assert.Equal(t, int64(3), remaining)
+}
+
+// TestDownloadFileToStoreCleanup 测试源文件没有 ETag、无法续传时，下载失败后删除已下载的数据
+func TestDownloadFileToStoreCleanup(t *testing.T) {
+	retryDelay = 0
+	defer func() { retryDelay = time.Second }()
+	content := bytes.Repeat([]byte("x"), 25*1024*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 第二个分片失败
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=10485760-") {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, "file.zip", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	store = &stubStore{}
+	defer func() { store = nil }()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	err := downloadFile(context.Background(), server.URL, nil, filename, "", defaultOptions)
+	assert.Error(t, err)
+
+	matches, err := filepath.Glob(filename + "*")
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+// TestReadTaskFileJSONL 测试 JSONL 任务文件中各条目使用自己的地址、输出路径和请求头
+func TestReadTaskFileJSONL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tasks.jsonl")
+	content := `{"url":"https://a.example.com/one.zip","output":"out/one.zip","headers":{"Authorization":"Bearer one"}}
+
+{"url":"http://b.example.org/two.bin","output":"out/two.bin","headers":{"Cookie":"k=v","Referer":"http://b.example.org/"},"sha256":"` + strings.Repeat("ab", 32) + `"}
+{"url":"http://c.example.org/missing-output"}
+`
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	var tasks []task
+	err := readTaskFile(path, func(name string) task {
+		t.Errorf("legacy format used for %s", name)
+		return task{}
+	}, func(tk task) { tasks = append(tasks, tk) })
+	assert.NoError(t, err)
+
+	assert.Equal(t, []task{
+		{URL: "https://a.example.com/one.zip", Output: "out/one.zip", Headers: map[string]string{"Authorization": "Bearer one"}},
+		{URL: "http://b.example.org/two.bin", Output: "out/two.bin", Headers: map[string]string{"Cookie": "k=v", "Referer": "http://b.example.org/"}, SHA256: strings.Repeat("ab", 32)},
+	}, tasks)
+
+	// 其他扩展名按旧格式每行一个文件名
+	legacyPath := filepath.Join(dir, "names.txt")
+	assert.NoError(t, os.WriteFile(legacyPath, []byte("a\n\n b \n"), 0644))
+	var names []string
+	err = readTaskFile(legacyPath, func(name string) task { return task{URL: name} }, func(tk task) { names = append(names, tk.URL) })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, names)
+}
+
+// TestDownloadFileZeroLength 测试空文件直接创建，不发送 Range 请求
+func TestDownloadFileZeroLength(t *testing.T) {
+	server := newETagServer(nil, `"empty"`)
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "empty.zip")
+	assert.NoError(t, downloadFile(context.Background(), server.URL, nil, filename, "", defaultOptions))
+
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	assert.Empty(t, server.ranges)
+	_, err = os.Stat(checkpointPath(filename))
+	assert.True(t, os.IsNotExist(err))
+
+	// 上传到对象存储时同样得到一个空对象
+	stub := &stubStore{}
+	store = stub
+	defer func() { store = nil }()
+	assert.NoError(t, downloadFile(context.Background(), server.URL, nil, filepath.Join(t.TempDir(), "empty.zip"), "", defaultOptions))
+	assert.Equal(t, "empty.zip", stub.key)
+	assert.Empty(t, stub.data)
+}
+
+// TestDownloadFileUnknownLength 测试服务器不返回 Content-Length 时改为单个请求流式下载
+func TestDownloadFileUnknownLength(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "" {
+			ranges = append(ranges, rng)
+		}
+		if r.Method == "HEAD" {
+			return
+		}
+		// 先刷新一部分数据，强制使用分块传输
+		w.Write(content[:100])
+		w.(http.Flusher).Flush()
+		w.Write(content[100:])
+	}))
+	defer server.Close()
+
+	info, err := statRemote(context.Background(), server.URL, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), info.length)
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	assert.NoError(t, downloadFile(context.Background(), server.URL, nil, filename, "", defaultOptions))
+
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Empty(t, ranges)
+	_, err = os.Stat(filename + ".part")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestDownloadToStoreResume 测试上传到对象存储时同样直接写入单个文件，失败后重新运行只下载未完成的区间
+func TestDownloadToStoreResume(t *testing.T) {
+	retryDelay = 0
+	defer func() { retryDelay = time.Second }()
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := newETagServer(content, `"v1"`)
+	defer server.Close()
+	failing := true
+	inner := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		fail := failing && r.Header.Get("Range") == "bytes=300-399"
+		server.mu.Unlock()
+		if fail {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+
+	stub := &stubStore{}
+	store = stub
+	defer func() { store = nil }()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	info := remoteFile{length: int64(len(content)), etag: `"v1"`}
+	assert.Error(t, downloadToStore(context.Background(), server.URL, nil, filename, info, testOptions, fileCheck{length: info.length}))
+	assert.Nil(t, stub.data)
+	assert.FileExists(t, checkpointPath(filename))
+	matches, err := filepath.Glob(filename + "*")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{filename + ".part", checkpointPath(filename)}, matches)
+
+	// 失败的区间会中止其他进行中的区间，重新运行时只请求检查点中未完成的区间
+	cp, resumed := loadCheckpoint(filename, info, testOptions.chunkSize)
+	assert.True(t, resumed)
+	var pending []string
+	for i, done := range cp.Done {
+		if !done {
+			pending = append(pending, fmt.Sprintf("bytes=%d-%d", i*100, i*100+99))
+		}
+	}
+	assert.Contains(t, pending, "bytes=300-399")
+
+	server.mu.Lock()
+	failing = false
+	server.ranges = nil
+	server.mu.Unlock()
+	assert.NoError(t, downloadToStore(context.Background(), server.URL, nil, filename, info, testOptions, fileCheck{length: info.length}))
+	assert.Equal(t, content, stub.data)
+	assert.Subset(t, pending, server.ranges)
+	assert.Subset(t, server.ranges, pending)
+
+	matches, err = filepath.Glob(filename + "*")
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+// TestDownloadRetry 测试失败的区间重新请求同一个 Range，用完次数后才报错
+func TestDownloadRetry(t *testing.T) {
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = time.Second }()
+
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := newETagServer(content, `"v1"`)
+	defer server.Close()
+	failures := 2
+	inner := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		fail := failures > 0 && r.Header.Get("Range") == "bytes=300-399"
+		if fail {
+			failures--
+			server.ranges = append(server.ranges, r.Header.Get("Range"))
+		}
+		server.mu.Unlock()
+		if fail {
+			// 传输到一半断开，已写入的字节在重试时会被覆盖
+			w.Header().Set("Content-Range", "bytes 300-399/1000")
+			w.Header().Set("Content-Length", "100")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[300:350])
+			w.(http.Flusher).Flush()
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+
+	// 失败的尝试不计入进度
+	progressInterval = 0
+	defer func() { progressInterval = 500 * time.Millisecond }()
+	opts := testOptions
+	var last int64
+	opts.progress = func(downloaded, total int64) { last = downloaded }
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	info := remoteFile{length: int64(len(content)), etag: `"v1"`}
+	assert.NoError(t, downloadFileAt(context.Background(), server.URL, nil, filename, info, opts))
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int64(len(content)), last)
+	var retried int
+	for _, rng := range server.ranges {
+		if rng == "bytes=300-399" {
+			retried++
+		}
+	}
+	assert.Equal(t, 3, retried)
+
+	// 失败次数超过 -retries 时报错
+	chunkAttempts = 2
+	defer func() { chunkAttempts = 5 }()
+	failures = 2
+	filename = filepath.Join(t.TempDir(), "file.zip")
+	assert.Error(t, downloadFileAt(context.Background(), server.URL, nil, filename, info, testOptions))
+}
+
+// TestDownloadFileRangeIgnored 测试服务器忽略 Range 返回 200 时改为单个请求下载整个文件
+func TestDownloadFileRangeIgnored(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	var mu sync.Mutex
+	var gets int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			gets++
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == "HEAD" {
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	for _, toStore := range []bool{false, true} {
+		stub := &stubStore{}
+		if toStore {
+			store = stub
+		}
+		filename := filepath.Join(t.TempDir(), "file.zip")
+		assert.NoError(t, downloadFile(context.Background(), server.URL, nil, filename, "", defaultOptions))
+		store = nil
+
+		if toStore {
+			assert.Equal(t, content, stub.data)
+		} else {
+			data, err := os.ReadFile(filename)
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+		}
+		matches, err := filepath.Glob(filename + "?*")
+		assert.NoError(t, err)
+		assert.Empty(t, matches, "no chunk, part or checkpoint files left")
+	}
+	assert.Equal(t, 4, gets) // 每次一个被忽略的 Range 请求和一个完整下载
+}
+
+// TestDownloadFileCancel 测试取消 ctx 后中止所有区间的请求，并删除无法续传的临时文件
+func TestDownloadFileCancel(t *testing.T) {
+	var requests sync.WaitGroup
+	requests.Add(defaultOptions.concurrency)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(100*1024*1024))
+			return
+		}
+		requests.Done()
+		<-r.Context().Done() // 直到请求被取消都不返回数据
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		requests.Wait()
+		cancel()
+	}()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	done := make(chan error, 1)
+	go func() { done <- downloadFile(ctx, server.URL, nil, filename, "", defaultOptions) }()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("download was not aborted")
+	}
+
+	matches, err := filepath.Glob(filename + "*")
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+// TestDownloadFileChecksum 测试下载结果的 sha256 与期望值不一致时返回错误并删除文件
+func TestDownloadFileChecksum(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := newTestServer(content)
+	defer server.Close()
+	sum := sha256.Sum256(content)
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	assert.NoError(t, downloadFile(context.Background(), server.URL, nil, filename, hex.EncodeToString(sum[:]), defaultOptions))
+	assert.FileExists(t, filename)
+
+	err := downloadFile(context.Background(), server.URL, nil, filename, strings.Repeat("ab", 32), defaultOptions)
+	assert.ErrorContains(t, err, "checksum mismatch")
+	assert.NoFileExists(t, filename)
+}
+
+// TestDownloadFileTruncated 测试单个请求下载时内容比 HEAD 返回的长度短，返回错误且不保留文件
+func TestDownloadFileTruncated(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			return
+		}
+		// 忽略 Range，也不返回 Content-Length，连接正常结束但少了最后 100 字节
+		w.(http.Flusher).Flush()
+		w.Write(content[:900])
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	err := downloadFile(context.Background(), server.URL, nil, filename, "", defaultOptions)
+	assert.ErrorContains(t, err, "size mismatch")
+
+	matches, err := filepath.Glob(filename + "*")
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+// TestDownloadOptions 测试分片参数的校验、任务覆盖和区间数上限
+func TestDownloadOptions(t *testing.T) {
+	assert.NoError(t, defaultOptions.validate())
+	assert.Error(t, downloadOptions{chunkSize: 1024, concurrency: 8}.validate())
+	assert.Error(t, downloadOptions{chunkSize: minChunkSize, concurrency: 0}.validate())
+	assert.Error(t, downloadFile(context.Background(), "http://127.0.0.1:0", nil, "file.zip", "", downloadOptions{}))
+
+	opts := task{ChunkSize: 1 << 20}.options(defaultOptions)
+	assert.Equal(t, downloadOptions{chunkSize: 1 << 20, concurrency: defaultOptions.concurrency}, opts)
+	assert.Equal(t, defaultOptions, task{}.options(defaultOptions))
+	assert.Error(t, task{URL: "u", Output: "o", ChunkSize: 1}.validate())
+	assert.Error(t, task{URL: "u", Output: "o", Concurrency: -1}.validate())
+
+	// 小文件只有一个区间，大文件的区间数不超过 maxChunks
+	assert.Equal(t, defaultOptions.chunkSize, defaultOptions.chunkSizeFor(5*1024*1024))
+	length := defaultOptions.chunkSize*maxChunks*3 + 1
+	size := defaultOptions.chunkSizeFor(length)
+	assert.LessOrEqual(t, (length+size-1)/size, int64(maxChunks))
+}
+
+// TestDownloadFileAtConcurrency 测试同时进行的 Range 请求数不超过 concurrency
+func TestDownloadFileAtConcurrency(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	var running, peak int32
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		http.ServeContent(w, r, "file.zip", time.Time{}, bytes.NewReader(content))
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	info := remoteFile{length: int64(len(content))}
+	assert.NoError(t, downloadFileAt(context.Background(), server.URL, nil, filename, info, downloadOptions{chunkSize: 100, concurrency: 2}))
+	got, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.LessOrEqual(t, peak, int32(2))
+}
+
+// TestDownloadThrottle 测试所有区间共享同一个限速器，总速率不超过限制
+func TestDownloadThrottle(t *testing.T) {
+	assert.Nil(t, newLimiter(0))
+	assert.Equal(t, 100, newLimiter(100).Burst())
+
+	limiter = newLimiter(1000)
+	defer func() { limiter = nil }()
+
+	content := []byte(strings.Repeat("0123456789", 150))
+	server := newTestServer(content)
+	defer server.Close()
+
+	// 开始时可以突发 1000 字节，剩下的 500 字节至少要等待 0.5 秒
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	info := remoteFile{length: int64(len(content))}
+	start := time.Now()
+	assert.NoError(t, downloadFileAt(context.Background(), server.URL, nil, filename, info, testOptions))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	got, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+// TestDownloadProgress 测试所有区间的进度累加到同一个计数器，续传时从已完成的字节数开始
+func TestDownloadProgress(t *testing.T) {
+	progressInterval = 0
+	defer func() { progressInterval = 500 * time.Millisecond }()
+
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := newETagServer(content, `"v1"`)
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "file.zip")
+	info := remoteFile{length: int64(len(content)), etag: `"v1"`}
+	writePartial(t, filename, info, 100, content, 0, 1, 2)
+
+	var reports []int64
+	opts := testOptions
+	opts.progress = func(downloaded, total int64) {
+		assert.Equal(t, info.length, total)
+		reports = append(reports, downloaded)
+	}
+	assert.NoError(t, downloadFileAt(context.Background(), server.URL, nil, filename, info, opts))
+
+	assert.NotEmpty(t, reports)
+	assert.Greater(t, reports[0], int64(300))
+	assert.IsNonDecreasing(t, reports)
+	assert.Equal(t, info.length, reports[len(reports)-1])
+}
+
+// TestOutputName 测试从 Content-Disposition 和 URL 确定文件名，并去掉目录部分
+func TestOutputName(t *testing.T) {
+	cases := []struct {
+		disposition, url, want string
+	}{
+		{`attachment; filename="book.zip"`, "http://example.org/get?id=1", "book.zip"},
+		{`attachment; filename*=UTF-8''%E4%B9%A6.zip`, "http://example.org/get", "书.zip"},
+		{`attachment; filename="../../etc/passwd"`, "http://example.org/get", "passwd"},
+		{`attachment; filename="..\..\evil.exe"`, "http://example.org/get", "evil.exe"},
+		{`attachment; filename=".."`, "http://example.org/files/a%20b.zip", "a b.zip"},
+		{"", "http://example.org/files/book.zip?token=1", "book.zip"},
+		{"", "http://example.org/", defaultOutputName},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, outputName(c.disposition, c.url), c.disposition)
+	}
+}
+
+// TestDownloadFileToDir 测试输出路径为目录时使用服务器给出的文件名
+func TestDownloadFileToDir(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../real.zip"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, downloadFile(context.Background(), server.URL+"/get", nil, dir+"/", "", defaultOptions))
+	got, err := os.ReadFile(filepath.Join(dir, "real.zip"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval 两次进度回调之间的最短间隔，下载完成时总会回调一次
+var progressInterval = 500 * time.Millisecond
+
+// progress 统计同一个文件所有区间已下载的字节数，并按间隔调用回调。
+// 回调在下载的协程中执行，但不会被同时调用
+type progress struct {
+	downloaded atomic.Int64
+	total      int64 // -1 表示长度未知
+	report     func(downloaded, total int64)
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// newProgress 创建进度统计，downloaded 为续传时已完成的字节数。report 为 nil 时返回 nil
+func newProgress(report func(downloaded, total int64), total, downloaded int64) *progress {
+	if report == nil {
+		return nil
+	}
+	p := &progress{total: total, report: report}
+	p.downloaded.Store(downloaded)
+	return p
+}
+
+// add 累加已下载的字节数，距上次回调超过 progressInterval 或下载完成时回调
+func (p *progress) add(n int) {
+	downloaded := p.downloaded.Add(int64(n))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if downloaded != p.total && time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+	p.report(p.downloaded.Load(), p.total)
+}
+
+// Write 只统计字节数，用于 io.TeeReader
+func (p *progress) Write(b []byte) (int, error) {
+	p.add(len(b))
+	return len(b), nil
+}
+
+// progressWriterAt 写入 w 的同时统计字节数。每个区间使用自己的 progressWriterAt，
+// 重试时通过 reset 撤销失败的尝试已统计的字节数
+type progressWriterAt struct {
+	w       io.WriterAt
+	p       *progress
+	written int64
+}
+
+func (pw *progressWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := pw.w.WriteAt(b, off)
+	pw.written += int64(n)
+	pw.p.add(n)
+	return n, err
+}
+
+// reset 撤销已统计的字节数，区间重新下载前调用
+func (pw *progressWriterAt) reset() {
+	pw.p.downloaded.Add(-pw.written)
+	pw.written = 0
+}
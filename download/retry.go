@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// chunkAttempts 每个区间最多请求的次数，-retries 配置
+var chunkAttempts = 5
+
+// retryDelay 第一次重试前的等待时间，之后每次翻倍，最长 maxRetryDelay
+var retryDelay = time.Second
+
+const maxRetryDelay = 30 * time.Second
+
+// withRetry 调用 fn 直到成功、返回不值得重试的错误或用完 attempts 次，返回最后一次的错误。
+// 两次尝试之间按指数退避等待，ctx 取消时立即返回
+func withRetry(ctx context.Context, attempts int, fn func() error) error {
+	delay := retryDelay
+	var err error
+	for i := 1; ; i++ {
+		err = fn()
+		if err == nil || i >= attempts || !retryable(err) {
+			return err
+		}
+		fmt.Printf("Attempt %d of %d failed, retrying in %v: %v\n", i, attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// retryable 报告 err 是否值得重试。取消和超时不重试；服务器忽略 Range 时重试也一样，
+// 由调用方改为单个请求下载
+func retryable(err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) &&
+		!errors.Is(err, errRangeIgnored)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// task 一个下载任务
+type task struct {
+	URL     string            `json:"url"`
+	Output  string            `json:"output"` // 以 / 结尾时为目录，文件名取自响应头或 URL
+	Headers map[string]string `json:"headers,omitempty"`
+	SHA256  string            `json:"sha256,omitempty"` // 可选，下载完成后校验
+
+	// 可选，覆盖命令行指定的分片参数，用于需要单独调整的服务器
+	ChunkSize   int64 `json:"chunk_size,omitempty"`
+	Concurrency int   `json:"concurrency,omitempty"`
+}
+
+// validate 检查 JSON 任务的必填字段
+func (t task) validate() error {
+	if t.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	if t.Output == "" {
+		return fmt.Errorf("missing output")
+	}
+	if t.SHA256 != "" {
+		if b, err := hex.DecodeString(t.SHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid sha256 %q", t.SHA256)
+		}
+	}
+	if t.ChunkSize != 0 && t.ChunkSize < minChunkSize {
+		return fmt.Errorf("chunk_size must be at least %d bytes", minChunkSize)
+	}
+	if t.Concurrency < 0 {
+		return fmt.Errorf("invalid concurrency %d", t.Concurrency)
+	}
+	return nil
+}
+
+// options 返回任务使用的分片参数，没有指定的字段使用 defaults
+func (t task) options(defaults downloadOptions) downloadOptions {
+	opts := defaults
+	if t.ChunkSize != 0 {
+		opts.chunkSize = t.ChunkSize
+	}
+	if t.Concurrency != 0 {
+		opts.concurrency = t.Concurrency
+	}
+	return opts
+}
+
+// readTaskFile 读取一个任务文件，按扩展名选择格式：.json 为任务数组，.jsonl 每行一个任务，
+// 其他文件是旧格式，每行一个文件名，由 legacy 转换为任务。
+// 无效的条目打印后跳过，不影响同一文件中的其他任务
+func readTaskFile(path string, legacy func(name string) task, emit func(task)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		var tasks []task
+		if err := json.NewDecoder(f).Decode(&tasks); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		for i, t := range tasks {
+			if err := t.validate(); err != nil {
+				fmt.Printf("Skipping task %d in %s: %v\n", i, path, err)
+				continue
+			}
+			emit(t)
+		}
+		return nil
+
+	case ".jsonl":
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var t task
+			if err := json.Unmarshal([]byte(text), &t); err != nil {
+				fmt.Printf("Skipping line %d in %s: %v\n", line, path, err)
+				continue
+			}
+			if err := t.validate(); err != nil {
+				fmt.Printf("Skipping line %d in %s: %v\n", line, path, err)
+				continue
+			}
+			emit(t)
+		}
+		return scanner.Err()
+
+	default:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if name := strings.TrimSpace(scanner.Text()); name != "" {
+				emit(legacy(name))
+			}
+		}
+		return scanner.Err()
+	}
+}
+
+// fileCheck 下载结果的校验条件，length 为 -1 时不校验长度，sha256 为空时不校验摘要
+type fileCheck struct {
+	length int64
+	sha256 string
+}
+
+// digestWriter 统计写入的字节数并计算 sha256
+type digestWriter struct {
+	hash hash.Hash
+	n    int64
+}
+
+func newDigestWriter() *digestWriter {
+	return &digestWriter{hash: sha256.New()}
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.n += int64(len(p))
+	return d.hash.Write(p)
+}
+
+// verify 比较写入 d 的内容是否符合校验条件
+func (c fileCheck) verify(d *digestWriter) error {
+	if c.length >= 0 && d.n != c.length {
+		return fmt.Errorf("size mismatch: want %d bytes, got %d", c.length, d.n)
+	}
+	if c.sha256 == "" {
+		return nil
+	}
+	if sum := hex.EncodeToString(d.hash.Sum(nil)); !strings.EqualFold(sum, c.sha256) {
+		return fmt.Errorf("checksum mismatch: want %s, got %s", c.sha256, sum)
+	}
+	return nil
+}
+
+// verifyFile 校验下载完成的文件，不一致时删除文件。没有期望的 sha256 时只比较长度，不读取文件
+func verifyFile(path string, c fileCheck) error {
+	d := newDigestWriter()
+	if c.sha256 == "" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		d.n = fi.Size()
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(d, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+	if err := c.verify(d); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// limiter 所有下载共享的带宽限制，各区间和单个请求的下载都从中取令牌，为 nil 时不限速
+var limiter *rate.Limiter
+
+// maxThrottleBurst 单次读取最多取的令牌数（字节），限制突发流量
+const maxThrottleBurst = 64 * 1024
+
+// newLimiter 返回每秒最多 bytesPerSec 字节的限速器，bytesPerSec 为 0 时返回 nil
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := maxThrottleBurst
+	if bytesPerSec < int64(burst) {
+		burst = int(bytesPerSec)
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// throttledReader 每次读取后按读到的字节数等待令牌
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// WaitN 不能超过 burst，一次只读这么多
+	if burst := t.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttle 没有配置 limiter 时原样返回 r，ctx 取消时等待中的读取立即返回
+func throttle(ctx context.Context, r io.Reader) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiter: limiter}
+}
@@ -3,18 +3,38 @@ package main
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
+	"jiaoben-/email/mailcharset"
+	"jiaoben-/email/maillog"
+	"jiaoben-/email/mailpart"
 	"net"
 	"time"
 
 	"github.com/emersion/go-imap"
 	id "github.com/emersion/go-imap-id"
 	"github.com/emersion/go-imap/client"
-	_ "github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
 	"github.com/golang-module/carbon"
 )
 
+// logger 包内诊断日志，可通过 SetLogger 替换
+var logger maillog.Logger = maillog.Default()
+
+// maxPartSize 单个正文的大小上限（字节），超过的正文会被丢弃
+var maxPartSize = mailpart.MaxSize()
+
+func init() {
+	// 邮件头和正文统一使用共享的字符集注册表
+	imap.CharsetReader = mailcharset.Reader
+}
+
+// SetLogger 替换包内使用的日志实现，传入 nil 时丢弃所有日志
+func SetLogger(l maillog.Logger) {
+	if l == nil {
+		l = maillog.Discard
+	}
+	logger = l
+}
+
 func main() {
 
 	err, result := emailListByUid1("imap.xx.com:993", "@xx.com", "1")
@@ -28,7 +48,7 @@ func main() {
 func emailListByUid1(Eserver, UserName, Password string) (err error, result []string) {
 	c, err := loginEmail(Eserver, UserName, Password)
 	if err != nil {
-		fmt.Println(err)
+		logger.Errorf("login failed: %v", err)
 		return
 	}
 	idClient := id.NewClient(c)
@@ -50,11 +70,11 @@ func emailListByUid1(Eserver, UserName, Password string) (err error, result []st
 		if box.Name != "INBOX" {
 			continue
 		}
-		fmt.Println("切换目录:", box.Name)
+		logger.Infof("切换目录: %s", box.Name)
 		mbox, err := c.Select(box.Name, false)
 		// 选择收件箱
 		if err != nil {
-			fmt.Println("select inbox err: ", err)
+			logger.Errorf("select inbox err: %v", err)
 			continue
 		}
 		if mbox.Messages == 0 {
@@ -68,13 +88,14 @@ func emailListByUid1(Eserver, UserName, Password string) (err error, result []st
 		format := time.Now().Format("2006-01-02 15:04:05")
 		inLocation, _ := time.ParseInLocation("2006-01-02 15:04:05", format, location)
 		criteria.Since = inLocation.Add(-1 * time.Minute * 15)
-		fmt.Println(criteria.Since.Unix())
+		logger.Debugf("search since: %d", criteria.Since.Unix())
 		// 按条件查询邮件
 		ids, err := c.UidSearch(criteria)
-		fmt.Println(len(ids))
 		if err != nil {
+			logger.Errorf("uid search err: %v", err)
 			continue
 		}
+		logger.Debugf("found %d messages", len(ids))
 		if len(ids) == 0 {
 			continue
 		}
@@ -92,7 +113,7 @@ func emailListByUid1(Eserver, UserName, Password string) (err error, result []st
 			r := msg.GetBody(sect)
 			mr, err := mail.CreateReader(r)
 			if err != nil {
-				fmt.Println(err)
+				logger.Errorf("create mail reader err: %v", err)
 				continue
 			}
 			/*header := mr.Header
@@ -100,7 +121,7 @@ func emailListByUid1(Eserver, UserName, Password string) (err error, result []st
 			_, fileName, results := parseEmail1(mr)
 			result = append(result, results...)
 			for k, _ := range fileName {
-				fmt.Println("收取到附件:", k)
+				logger.Infof("收取到附件: %s", k)
 			}
 		}
 	}
@@ -113,14 +134,16 @@ func parseEmail1(mr *mail.Reader) (body []byte, fileMap map[string][]byte, resul
 		if err == io.EOF {
 			break
 		} else if err != nil {
+			logger.Errorf("read part err: %v", err)
 			break
 		}
 		if p != nil {
 			switch p.Header.(type) {
 			case *mail.InlineHeader:
-				body, err = ioutil.ReadAll(p.Body)
+				body, err = mailpart.ReadAll(p.Body, maxPartSize)
 				if err != nil {
-					fmt.Println("read body err:", err.Error())
+					logger.Errorf("read body err: %v", err)
+					continue
 				}
 				//fmt.Println(string(body))
 				//fmt.Println("---------------------------------------------------------")
@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"io"
+	"jiaoben-/email/mailcharset"
+	"jiaoben-/email/maillog"
+	"jiaoben-/email/mailpart"
 	"log"
 	"os"
 	"strconv"
@@ -11,42 +14,63 @@ import (
 	"github.com/emersion/go-imap"
 	id "github.com/emersion/go-imap-id"
 	"github.com/emersion/go-imap/client"
-	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-message/mail"
 	"github.com/pkg/errors"
-	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 func init() {
-	// 注册GBK字符集
-	charset.RegisterEncoding("GBK", simplifiedchinese.GBK)
-	charset.RegisterEncoding("GB18030", simplifiedchinese.GB18030)
-	charset.RegisterEncoding("HZ-GB2312", simplifiedchinese.HZGB2312)
+	// 邮件头和正文统一使用共享的字符集注册表
+	imap.CharsetReader = mailcharset.Reader
 }
 
 type IMAPClient struct {
-	server   string
-	username string
-	password string
-	client   *client.Client
+	server      string
+	username    string
+	password    string
+	client      *client.Client
+	logger      maillog.Logger
+	maxPartSize int64 // 单个正文或附件的大小上限（字节）
+
+	// dial 建立到服务器的连接，默认使用 TLS
+	dial func(addr string) (*client.Client, error)
 }
 
 func NewIMAPClient(server, username, password string) *IMAPClient {
 	return &IMAPClient{
-		server:   server,
-		username: username,
-		password: password,
+		server:      server,
+		username:    username,
+		password:    password,
+		logger:      maillog.Default(),
+		maxPartSize: mailpart.MaxSize(),
+		dial: func(addr string) (*client.Client, error) {
+			return client.DialTLS(addr, nil)
+		},
+	}
+}
+
+// SetMaxPartSize 设置单个正文或附件的大小上限（字节），超过的分段会被丢弃
+func (c *IMAPClient) SetMaxPartSize(max int64) {
+	c.maxPartSize = max
+}
+
+// SetLogger 替换客户端使用的日志实现，传入 nil 时丢弃所有日志
+func (c *IMAPClient) SetLogger(l maillog.Logger) {
+	if l == nil {
+		l = maillog.Discard
 	}
+	c.logger = l
 }
 
 func (c *IMAPClient) Connect() error {
-	cl, err := client.DialTLS(c.server, nil)
+	cl, err := c.dial(c.server)
 	if err != nil {
 		return err
 	}
 
 	err = cl.Login(c.username, c.password)
 	if err != nil {
+		cl.Logout()
 		return err
 	}
 
@@ -103,6 +127,7 @@ func (c *IMAPClient) GetMessages(numMessages uint32) ([]*imap.Message, error) {
 	return msgs, nil
 }
 
+// SetSeen 将 UID 为 uid 的邮件标记为已读，需要先选中邮箱
 func (client *IMAPClient) SetSeen(uid uint32) error {
 	seqSet := new(imap.SeqSet)
 	seqSet.AddNum(uid)
@@ -111,7 +136,7 @@ func (client *IMAPClient) SetSeen(uid uint32) error {
 
 	go func() {
 		// 设置邮件为 SeenFlag（已读）
-		err := client.client.Store(seqSet, imap.AddFlags, []interface{}{imap.SeenFlag}, nil)
+		err := client.client.UidStore(seqSet, imap.AddFlags, []interface{}{imap.SeenFlag}, nil)
 		if err != nil {
 			done <- errors.Wrap(err, "Store failed")
 			return
@@ -123,6 +148,10 @@ func (client *IMAPClient) SetSeen(uid uint32) error {
 	return <-done
 }
 
+// SetDelete 删除当前邮箱中序号为 pos 的邮件。
+// 序号是邮件在邮箱中的位置，其他邮件被删除后会变化，与 UID 不同。
+//
+// Deprecated: 使用 DeleteByUID，按 UID 删除不会因序号变化删错邮件
 func (client *IMAPClient) SetDelete(pos int) error {
 	seenSet, err := imap.ParseSeqSet(strconv.Itoa(pos))
 	if err != nil {
@@ -152,6 +181,35 @@ func (client *IMAPClient) SetDelete(pos int) error {
 	return <-done
 }
 
+// DeleteByUID 删除当前邮箱中 UID 为 uid 的邮件，需要先选中邮箱。
+// UID 在邮箱中固定不变，序号（SetDelete 使用的位置）会随其他邮件的删除而变化。
+// 服务器支持 UIDPLUS 时只清除这一封邮件；否则使用 EXPUNGE，
+// 其他已带 \Deleted 标记的邮件也会被一并清除
+func (client *IMAPClient) DeleteByUID(uid uint32) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	if err := client.client.UidStore(seqSet, imap.AddFlags, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return errors.Wrap(err, "UidStore failed")
+	}
+
+	uidPlus, err := client.client.Support("UIDPLUS")
+	if err != nil {
+		return errors.Wrap(err, "Capability failed")
+	}
+	if !uidPlus {
+		return errors.Wrap(client.client.Expunge(nil), "Expunge failed")
+	}
+
+	// UID EXPUNGE <uid>（RFC 4315）
+	cmd := &commands.Uid{Cmd: &imap.Command{Name: "EXPUNGE", Arguments: []interface{}{seqSet}}}
+	status, err := client.client.Execute(cmd, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	return errors.Wrap(err, "UidExpunge failed")
+}
+
 func (c *IMAPClient) ParseMessages(messages []*imap.Message, body chan string, filePaths chan string) {
 	defer close(body)
 	defer close(filePaths)
@@ -163,7 +221,7 @@ func (c *IMAPClient) ParseMessages(messages []*imap.Message, body chan string, f
 
 	for _, msg := range messages {
 		if msg.Body == nil {
-			log.Println("Body is nil")
+			c.logger.Warnf("Body is nil")
 			continue
 		}
 
@@ -181,14 +239,14 @@ func (c *IMAPClient) ParseMessages(messages []*imap.Message, body chan string, f
 			section := imap.BodySectionName{}
 			r := msg.GetBody(&section)
 			if r == nil {
-				log.Println("Server didn't return message body")
+				c.logger.Warnf("Server didn't return message body")
 				return
 			}
 
 			// 解析邮件内容
 			mr, err := mail.CreateReader(r)
 			if err != nil {
-				log.Printf("Error creating mail reader: %v\n", err)
+				c.logger.Errorf("Error creating mail reader: %v", err)
 				return
 			}
 
@@ -199,27 +257,27 @@ func (c *IMAPClient) ParseMessages(messages []*imap.Message, body chan string, f
 					break
 				}
 				if err != nil {
-					log.Printf("Error reading message part: %v\n", err)
-					continue
+					c.logger.Errorf("Error reading message part: %v", err)
+					break
 				}
 
 				switch h := p.Header.(type) {
 				case *mail.InlineHeader:
-					b, err := io.ReadAll(p.Body)
+					b, err := mailpart.ReadAll(p.Body, c.maxPartSize)
 					if err != nil {
-						log.Printf("Error reading inline part: %v\n", err)
+						c.logger.Errorf("Error reading inline part: %v", err)
 						continue
 					}
-					log.Printf("Got text: %s\n", b)
+					c.logger.Debugf("Got text: %s", b)
 					body <- string(b)
 
 				case *mail.AttachmentHeader:
 					filename, err := h.Filename()
 					if err != nil {
-						log.Printf("Error getting attachment filename: %v\n", err)
+						c.logger.Errorf("Error getting attachment filename: %v", err)
 						continue
 					}
-					log.Printf("Got attachment: %s\n", filename)
+					c.logger.Infof("Got attachment: %s", filename)
 
 					// 生成本地文件路径
 					localPath := "./attachments/" + filename // 示例存放在当前目录下的 attachments 文件夹中
@@ -227,15 +285,16 @@ func (c *IMAPClient) ParseMessages(messages []*imap.Message, body chan string, f
 					// 创建本地文件
 					file, err := os.Create(localPath)
 					if err != nil {
-						log.Printf("Error creating file: %v\n", err)
+						c.logger.Errorf("Error creating file: %v", err)
 						continue
 					}
 
-					// 将附件内容写入文件
-					_, err = io.Copy(file, p.Body)
+					// 将附件内容写入文件，超过大小上限时删除已写入的部分
+					_, err = mailpart.Copy(file, p.Body, c.maxPartSize)
 					if err != nil {
-						log.Printf("Error writing attachment to file: %v\n", err)
+						c.logger.Errorf("Error writing attachment to file: %v", err)
 						file.Close()
+						os.Remove(localPath)
 						continue
 					}
 					file.Close()
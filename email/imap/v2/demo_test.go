@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"jiaoben-/email/maillog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestServer 启动一个内存 IMAP 服务器，返回地址和收件箱
+func newTestServer(t *testing.T) (string, backend.Mailbox) {
+	be := memory.New()
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	user, err := be.Login(nil, "username", "password")
+	assert.NoError(t, err)
+	inbox, err := user.GetMailbox("INBOX")
+	assert.NoError(t, err)
+	return l.Addr().String(), inbox
+}
+
+// newTestClient 创建连接测试服务器的客户端
+func newTestClient(addr string) *IMAPClient {
+	c := NewIMAPClient(addr, "username", "password")
+	c.SetLogger(maillog.Discard)
+	c.dial = func(addr string) (*client.Client, error) {
+		return client.Dial(addr)
+	}
+	return c
+}
+
+// deliver 向邮箱投递一封新邮件
+func deliver(t *testing.T, mbox backend.Mailbox, subject string) {
+	body := fmt.Sprintf("From: sender@example.org\r\nSubject: %s\r\nDate: Wed, 11 May 2016 14:31:59 +0000\r\n\r\nhello", subject)
+	assert.NoError(t, mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(body)))
+}
+
+// TestPollInbox 测试两轮检查中到达的新邮件各处理一次，且连接断开后自动重连
+func TestPollInbox(t *testing.T) {
+	addr, inbox := newTestServer(t)
+	c := newTestClient(addr)
+	deliver(t, inbox, "first")
+
+	// 先建立连接再断开，PollInbox 需要自动重连
+	assert.NoError(t, c.Connect())
+	c.client.Terminate()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var handled []string
+	err := c.PollInbox(ctx, 20*time.Millisecond, func(summaries []Summary) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, summary := range summaries {
+			handled = append(handled, summary.Subject)
+		}
+		switch len(handled) {
+		case 1:
+			// 第一轮处理完成后投递第二封
+			deliver(t, inbox, "second")
+		case 2:
+			cancel()
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// 再检查一轮，确认已处理的邮件不会重复交给 handler
+	assert.NoError(t, c.pollOnce(func(summaries []Summary) error {
+		t.Errorf("unexpected messages: %v", summaries)
+		return nil
+	}))
+
+	assert.Equal(t, []string{"first", "second"}, handled)
+}
+
+// charsetMessage Big5 和 GB18030 正文各一段的邮件，与 pop3 测试使用相同内容
+const charsetMessage = "Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=big5\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"pKSk5bZspfO0+rjV\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=GB18030\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"1tDOxNPKvP6y4srUouM=\r\n" +
+	"--b1--\r\n"
+
+// TestParseMessagesCharset 测试 Big5 和 GB18030 正文解码为 UTF-8
+func TestParseMessagesCharset(t *testing.T) {
+	c := NewIMAPClient("", "", "")
+	c.SetLogger(maillog.Discard)
+
+	section := &imap.BodySectionName{}
+	msg := &imap.Message{Body: map[*imap.BodySectionName]imap.Literal{
+		section: bytes.NewBufferString(charsetMessage),
+	}}
+
+	body := make(chan string, 2)
+	filePaths := make(chan string, 1)
+	c.ParseMessages([]*imap.Message{msg}, body, filePaths)
+
+	var texts []string
+	for text := range body {
+		texts = append(texts, text)
+	}
+	assert.Equal(t, []string{"中文郵件測試", "中文邮件测试€"}, texts)
+}
+
+// TestDeleteByUID 测试按 UID 删除，前面的邮件被删除导致序号与 UID 不一致后仍删除正确的邮件
+func TestDeleteByUID(t *testing.T) {
+	addr, inbox := newTestServer(t)
+	c := newTestClient(addr)
+	for _, subject := range []string{"first", "second", "third"} {
+		deliver(t, inbox, subject)
+	}
+	assert.NoError(t, c.Connect())
+	defer c.client.Logout()
+
+	summaries, err := c.fetchSummaries("INBOX", imap.NewSearchCriteria())
+	assert.NoError(t, err)
+	uids := make(map[string]uint32)
+	for _, summary := range summaries {
+		uids[summary.Subject] = summary.UID
+	}
+
+	assert.NoError(t, c.DeleteByUID(uids["first"]))
+	// 此时 third 的序号比 UID 小，按序号删除会删错或越界
+	assert.NoError(t, c.DeleteByUID(uids["third"]))
+
+	summaries, err = c.fetchSummaries("INBOX", imap.NewSearchCriteria())
+	assert.NoError(t, err)
+	var subjects []string
+	for _, summary := range summaries {
+		subjects = append(subjects, summary.Subject)
+	}
+	assert.NotContains(t, subjects, "first")
+	assert.NotContains(t, subjects, "third")
+	assert.Contains(t, subjects, "second")
+	assert.Len(t, subjects, len(uids)-2)
+}
+
+// TestDateRangeCriteria 测试时间范围按整天扩大后映射为 SINCE/BEFORE 搜索条件
+func TestDateRangeCriteria(t *testing.T) {
+	cst := time.FixedZone("CST", 8*3600)
+	since := time.Date(2024, 3, 5, 1, 30, 0, 0, cst) // UTC 3 月 4 日 17:30
+	before := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	criteria := dateRangeCriteria(since, before)
+	assert.Equal(t, time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), criteria.Since)
+	assert.Equal(t, time.Date(2024, 3, 12, 0, 0, 0, 0, time.UTC), criteria.Before)
+	assert.Equal(t, `A1 UID SEARCH SINCE "3-Mar-2024" BEFORE "12-Mar-2024"`, uidSearchCommand(t, criteria))
+
+	criteria = dateRangeCriteria(since, time.Time{})
+	assert.Equal(t, `A1 UID SEARCH SINCE "3-Mar-2024"`, uidSearchCommand(t, criteria))
+	assert.True(t, dateRangeCriteria(time.Time{}, time.Time{}).Since.IsZero())
+}
+
+// uidSearchCommand 返回按 criteria 发出的 UID SEARCH 命令行
+func uidSearchCommand(t *testing.T, criteria *imap.SearchCriteria) string {
+	cmd := (&commands.Uid{Cmd: &commands.Search{Criteria: criteria}}).Command()
+	cmd.Tag = "A1"
+	var buf bytes.Buffer
+	w := imap.NewWriter(&buf)
+	assert.NoError(t, cmd.WriteTo(w))
+	assert.NoError(t, w.Flush())
+	return strings.TrimSpace(buf.String())
+}
+
+// TestFetchRange 测试按收到时间精确过滤，同一天内早于 since 或不早于 before 的邮件被排除
+func TestFetchRange(t *testing.T) {
+	addr, inbox := newTestServer(t)
+	c := newTestClient(addr)
+	day := func(d, h int) time.Time { return time.Date(2024, 3, d, h, 0, 0, 0, time.UTC) }
+	for _, received := range []time.Time{day(1, 12), day(4, 8), day(4, 20), day(6, 12), day(9, 23), day(10, 1)} {
+		body := fmt.Sprintf("From: sender@example.org\r\nSubject: %s\r\n\r\nhello", received.Format(time.RFC3339))
+		assert.NoError(t, inbox.CreateMessage(nil, received, bytes.NewBufferString(body)))
+	}
+	assert.NoError(t, c.Connect())
+	defer c.client.Logout()
+
+	subjects := func(summaries []Summary) []string {
+		var s []string
+		for _, summary := range summaries {
+			s = append(s, summary.Subject)
+		}
+		return s
+	}
+
+	summaries, err := c.FetchRange("INBOX", day(4, 12), day(10, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2024-03-04T20:00:00Z", "2024-03-06T12:00:00Z", "2024-03-09T23:00:00Z"}, subjects(summaries))
+	for _, summary := range summaries {
+		assert.False(t, summary.Received.IsZero())
+	}
+
+	summaries, err = c.FetchRange("INBOX", day(4, 12), day(10, 0).Add(90*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2024-03-04T20:00:00Z", "2024-03-06T12:00:00Z", "2024-03-09T23:00:00Z", "2024-03-10T01:00:00Z"}, subjects(summaries))
+
+	_, err = c.FetchRange("INBOX", day(10, 0), day(4, 0))
+	assert.Error(t, err)
+}
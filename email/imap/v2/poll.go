@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Summary 邮件摘要信息
+type Summary struct {
+	UID      uint32
+	Subject  string
+	From     string
+	Date     time.Time
+	Received time.Time // 服务器收到邮件的时间（INTERNALDATE）
+}
+
+// newSummary 从带信封的邮件构造摘要
+func newSummary(msg *imap.Message) Summary {
+	summary := Summary{UID: msg.Uid, Received: msg.InternalDate}
+	if msg.Envelope != nil {
+		summary.Subject = msg.Envelope.Subject
+		summary.Date = msg.Envelope.Date
+		var from []string
+		for _, addr := range msg.Envelope.From {
+			from = append(from, addr.Address())
+		}
+		summary.From = strings.Join(from, ", ")
+	}
+	return summary
+}
+
+// fetchSummaries 在 mailbox 中按 criteria 搜索邮件并返回按 UID 排序的摘要，不会改变邮件的已读状态
+func (c *IMAPClient) fetchSummaries(mailbox string, criteria *imap.SearchCriteria) ([]Summary, error) {
+	if _, err := c.client.Select(mailbox, false); err != nil {
+		return nil, fmt.Errorf("select %s: %w", mailbox, err)
+	}
+
+	uids, err := c.client.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("uid search: %w", err)
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	messages := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.client.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate}, messages)
+	}()
+
+	var summaries []Summary
+	for msg := range messages {
+		summaries = append(summaries, newSummary(msg))
+	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("uid fetch: %w", err)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].UID < summaries[j].UID })
+	return summaries, nil
+}
+
+// PollInbox 每隔 interval 检查一次收件箱中的未读邮件并交给 handler 处理，
+// handler 成功返回后这些邮件会被标记为已读，失败时下一轮会再次交给 handler。
+// 连接断开后在下一轮自动重连，ctx 取消时返回 ctx.Err()
+func (c *IMAPClient) PollInbox(ctx context.Context, interval time.Duration, handler func([]Summary) error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.pollOnce(handler); err != nil {
+			c.logger.Warnf("poll inbox failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollOnce 执行一轮检查，连接不可用时先重连
+func (c *IMAPClient) pollOnce(handler func([]Summary) error) error {
+	if c.client == nil || c.client.State() == imap.LogoutState {
+		c.logger.Infof("connecting to %s", c.server)
+		if err := c.Connect(); err != nil {
+			return fmt.Errorf("connect: %w", err)
+		}
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	summaries, err := c.fetchSummaries("INBOX", criteria)
+	if err != nil {
+		c.dropConnection()
+		return err
+	}
+	if len(summaries) == 0 {
+		return nil
+	}
+
+	if err := handler(summaries); err != nil {
+		return fmt.Errorf("handler: %w", err)
+	}
+
+	seqset := new(imap.SeqSet)
+	for _, summary := range summaries {
+		seqset.AddNum(summary.UID)
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.client.UidStore(seqset, item, []interface{}{imap.SeenFlag}, nil); err != nil {
+		c.dropConnection()
+		return fmt.Errorf("mark seen: %w", err)
+	}
+	return nil
+}
+
+// dropConnection 关闭当前连接，下一轮检查时重新连接
+func (c *IMAPClient) dropConnection() {
+	if c.client != nil {
+		c.client.Terminate()
+		c.client = nil
+	}
+}
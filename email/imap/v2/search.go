@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// FetchSince 返回 mailbox 中收到时间不早于 since 的邮件摘要，按 UID 排序
+func (c *IMAPClient) FetchSince(mailbox string, since time.Time) ([]Summary, error) {
+	return c.FetchRange(mailbox, since, time.Time{})
+}
+
+// FetchRange 返回 mailbox 中收到时间在 [since, before) 内的邮件摘要，按 UID 排序，
+// 零值表示该端不限制。IMAP 的 SINCE/BEFORE 只比较日期，因此服务器上按扩大到整天的范围搜索，
+// 再按邮件的 INTERNALDATE 精确过滤
+func (c *IMAPClient) FetchRange(mailbox string, since, before time.Time) ([]Summary, error) {
+	if !since.IsZero() && !before.IsZero() && !since.Before(before) {
+		return nil, fmt.Errorf("invalid range: since %s is not before %s", since, before)
+	}
+
+	summaries, err := c.fetchSummaries(mailbox, dateRangeCriteria(since, before))
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []Summary
+	for _, summary := range summaries {
+		if !since.IsZero() && summary.Received.Before(since) {
+			continue
+		}
+		if !before.IsZero() && !summary.Received.Before(before) {
+			continue
+		}
+		matched = append(matched, summary)
+	}
+	return matched, nil
+}
+
+// dateRangeCriteria 构造覆盖 [since, before) 的搜索条件。服务器按自己的时区比较日期，
+// 与 UTC 的日期最多相差一天，所以两端各多留一天，保证不会漏掉邮件
+func dateRangeCriteria(since, before time.Time) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+	if !since.IsZero() {
+		// SINCE d 包含 d 当天
+		criteria.Since = utcDate(since).AddDate(0, 0, -1)
+	}
+	if !before.IsZero() {
+		// BEFORE d 不包含 d 当天，before 所在的那一天也要包含在内
+		criteria.Before = utcDate(before).AddDate(0, 0, 2)
+	}
+	return criteria
+}
+
+// utcDate 返回 t 在 UTC 下当天的零点
+func utcDate(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,96 @@
+package mailcharset
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+)
+
+// ErrUnknownCharset 字符集既不在注册表中也无法由 go-message 识别
+var ErrUnknownCharset = errors.New("unknown charset")
+
+var (
+	mu sync.RWMutex
+	// encodings 注册的字符集，名称统一为小写
+	encodings = map[string]encoding.Encoding{
+		"gbk":        simplifiedchinese.GBK,
+		"gb2312":     simplifiedchinese.GBK, // 很多邮件把 GBK 内容标记为 GB2312
+		"gb18030":    simplifiedchinese.GB18030,
+		"hz-gb2312":  simplifiedchinese.HZGB2312,
+		"big5":       traditionalchinese.Big5,
+		"iso-8859-1": charmap.ISO8859_1,
+	}
+)
+
+func init() {
+	// go-message/charset 的 init 先于本包执行，这里覆盖为优先查注册表的实现
+	message.CharsetReader = Reader
+}
+
+// Register 注册或替换一个字符集，名称不区分大小写
+func Register(name string, enc encoding.Encoding) {
+	mu.Lock()
+	defer mu.Unlock()
+	encodings[strings.ToLower(name)] = enc
+}
+
+// lookup 查找注册的字符集
+func lookup(name string) (encoding.Encoding, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	enc, ok := encodings[strings.ToLower(strings.TrimSpace(name))]
+	return enc, ok
+}
+
+// isUTF8 空字符集和 UTF-8/ASCII 不需要转换
+func isUTF8(name string) bool {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+// Reader 返回把 name 编码的 input 转换为 UTF-8 的 Reader，
+// 签名与 message.CharsetReader 和 imap.CharsetReader 一致。
+// 注册表中没有的字符集交给 go-message 识别
+func Reader(name string, input io.Reader) (io.Reader, error) {
+	if isUTF8(name) {
+		return input, nil
+	}
+	if enc, ok := lookup(name); ok {
+		return enc.NewDecoder().Reader(input), nil
+	}
+	r, err := charset.Reader(name, input)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownCharset, err)
+	}
+	return r, nil
+}
+
+// Decode 把 name 编码的 input 转换为 UTF-8 字符串
+func Decode(name string, input []byte) (string, error) {
+	if isUTF8(name) {
+		return string(input), nil
+	}
+	if enc, ok := lookup(name); ok {
+		decoded, _, err := transform.Bytes(enc.NewDecoder(), input)
+		return string(decoded), err
+	}
+	r, err := Reader(name, strings.NewReader(string(input)))
+	if err != nil {
+		return "", err
+	}
+	decoded, err := io.ReadAll(r)
+	return string(decoded), err
+}
@@ -0,0 +1,85 @@
+package maillog
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Level 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel 解析日志级别名称，无法识别时返回 LevelInfo
+func ParseLevel(s string) Level {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	}
+	return LevelInfo
+}
+
+// Logger 邮件客户端使用的日志接口，调用方可以注入自己的实现
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// StdLogger 基于标准库 log 的 Logger 实现
+type StdLogger struct {
+	logger *log.Logger
+	level  Level
+}
+
+// New 创建一个输出到 w 的 StdLogger，低于 level 的日志会被丢弃
+func New(w io.Writer, level Level) *StdLogger {
+	return &StdLogger{logger: log.New(w, "", log.LstdFlags), level: level}
+}
+
+// Default 返回输出到 stderr 的 Info 级别日志，级别可通过 MAIL_LOG_LEVEL 环境变量调整
+func Default() *StdLogger {
+	return New(os.Stderr, ParseLevel(os.Getenv("MAIL_LOG_LEVEL")))
+}
+
+func (l *StdLogger) logf(level Level, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	l.logger.Printf("[%s] %s", level, fmt.Sprintf(format, args...))
+}
+
+func (l *StdLogger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+func (l *StdLogger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args...) }
+func (l *StdLogger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args...) }
+func (l *StdLogger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+
+// Discard 丢弃所有日志
+var Discard Logger = New(io.Discard, LevelError+1)
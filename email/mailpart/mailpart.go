@@ -0,0 +1,54 @@
+package mailpart
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// DefaultMaxSize 单个正文或附件的默认大小上限
+const DefaultMaxSize = 25 * 1024 * 1024 // 25MB
+
+// ErrPartTooLarge 正文或附件超过大小上限
+var ErrPartTooLarge = errors.New("mail part exceeds size limit")
+
+// MaxSize 返回单个分段的大小上限，可通过 MAIL_MAX_PART_SIZE 环境变量（字节）调整
+func MaxSize() int64 {
+	if value, err := strconv.ParseInt(os.Getenv("MAIL_MAX_PART_SIZE"), 10, 64); err == nil && value > 0 {
+		return value
+	}
+	return DefaultMaxSize
+}
+
+// ReadAll 读取 r 的全部内容，超过 max 字节时返回 ErrPartTooLarge，最多只缓冲 max+1 字节。
+// max <= 0 表示不限制
+func ReadAll(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrPartTooLarge, max)
+	}
+	return data, nil
+}
+
+// Copy 将 src 流式写入 dst，超过 max 字节时停止并返回 ErrPartTooLarge，max <= 0 表示不限制
+func Copy(dst io.Writer, src io.Reader, max int64) (int64, error) {
+	if max <= 0 {
+		return io.Copy(dst, src)
+	}
+	written, err := io.Copy(dst, io.LimitReader(src, max+1))
+	if err != nil {
+		return written, err
+	}
+	if written > max {
+		return written, fmt.Errorf("%w: more than %d bytes", ErrPartTooLarge, max)
+	}
+	return written, nil
+}
@@ -2,24 +2,47 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"jiaoben-/email/mailcharset"
+	"jiaoben-/email/maillog"
+	"jiaoben-/email/mailpart"
 	"log"
 	"mime"
 	"mime/multipart"
 	"net/mail"
 	"strings"
+	"sync"
 
+	"github.com/emersion/go-message"
 	"github.com/knadh/go-pop3"
-	"golang.org/x/text/encoding/charmap"
-	"golang.org/x/text/encoding/simplifiedchinese"
-	"golang.org/x/text/encoding/traditionalchinese"
-	"golang.org/x/text/transform"
+)
+
+// pop3Conn MailClient 使用的 POP3 连接操作，*pop3.Conn 实现了该接口
+type pop3Conn interface {
+	Stat() (int, int, error)
+	List(msgID int) ([]pop3.MessageID, error)
+	Top(msgID int, numLines int) (*message.Entity, error)
+	Retr(msgID int) (*message.Entity, error)
+	Quit() error
+}
+
+const (
+	defaultMaxMessages = 100 // 一次最多处理的邮件数
+	defaultWorkers     = 4   // 并发获取邮件的连接数
 )
 
 type MailClient struct {
-	client *pop3.Client
-	conn   *pop3.Conn
+	client      *pop3.Client
+	conn        pop3Conn
+	logger      maillog.Logger
+	maxPartSize int64
+	maxMessages int
+	workers     int
+
+	// dial 建立一个新的已认证连接，用于并发获取邮件
+	dial func() (pop3Conn, error)
 }
 
 func NewMailClient(server, username, password string) (*MailClient, error) {
@@ -30,17 +53,57 @@ func NewMailClient(server, username, password string) (*MailClient, error) {
 	}
 
 	client := pop3.New(opt)
-	conn, err := client.NewConn()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create connection: %v", err)
+	dial := func() (pop3Conn, error) {
+		conn, err := client.NewConn()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create connection: %v", err)
+		}
+
+		err = conn.Auth(username, password)
+		if err != nil {
+			conn.Quit()
+			return nil, fmt.Errorf("failed to authenticate: %v", err)
+		}
+		return conn, nil
 	}
 
-	err = conn.Auth(username, password)
+	conn, err := dial()
 	if err != nil {
-		return nil, fmt.Errorf("failed to authenticate: %v", err)
+		return nil, err
 	}
 
-	return &MailClient{client: client, conn: conn}, nil
+	return &MailClient{
+		client:      client,
+		conn:        conn,
+		logger:      maillog.Default(),
+		maxPartSize: mailpart.MaxSize(),
+		maxMessages: defaultMaxMessages,
+		workers:     defaultWorkers,
+		dial:        dial,
+	}, nil
+}
+
+// SetMaxMessages 设置 ListHeaders 一次最多返回的邮件数，小于等于 0 时不限制
+func (mc *MailClient) SetMaxMessages(max int) {
+	mc.maxMessages = max
+}
+
+// SetWorkers 设置 RetrieveMessages 使用的连接数，小于 1 时按 1 处理
+func (mc *MailClient) SetWorkers(n int) {
+	mc.workers = n
+}
+
+// SetMaxPartSize 设置单个正文或附件的大小上限（字节），超过时解析返回错误
+func (mc *MailClient) SetMaxPartSize(max int64) {
+	mc.maxPartSize = max
+}
+
+// SetLogger 替换客户端使用的日志实现，传入 nil 时丢弃所有日志
+func (mc *MailClient) SetLogger(l maillog.Logger) {
+	if l == nil {
+		l = maillog.Discard
+	}
+	mc.logger = l
 }
 
 func (mc *MailClient) Stat() (int, error) {
@@ -51,16 +114,50 @@ func (mc *MailClient) Stat() (int, error) {
 	return stat, nil
 }
 
+// ListMessages 返回最多 count 封邮件的编号和大小，count 小于等于 0 时返回全部
 func (mc *MailClient) ListMessages(count int) ([]pop3.MessageID, error) {
-	msgs, err := mc.conn.List(count)
+	msgs, err := mc.conn.List(0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get LIST: %v", err)
 	}
+	if count > 0 && len(msgs) > count {
+		msgs = msgs[:count]
+	}
 	return msgs, nil
 }
 
+// MessageHeader 通过 TOP 获取的邮件头，可以在获取完整邮件前先做过滤
+type MessageHeader struct {
+	ID     int
+	Size   int
+	Header mail.Header
+}
+
+// ListHeaders 按邮件编号顺序获取最多 maxMessages 封邮件的邮件头，只传输邮件头不传输正文
+func (mc *MailClient) ListHeaders() ([]MessageHeader, error) {
+	msgs, err := mc.ListMessages(mc.maxMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make([]MessageHeader, 0, len(msgs))
+	for _, msg := range msgs {
+		e, err := mc.conn.Top(msg.ID, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get TOP %d: %v", msg.ID, err)
+		}
+		headers = append(headers, MessageHeader{ID: msg.ID, Size: msg.Size, Header: mail.Header(e.Header.Map())})
+	}
+	return headers, nil
+}
+
 func (mc *MailClient) RetrieveMessage(msgID int) (*mail.Message, error) {
-	f, err := mc.conn.Retr(msgID)
+	return retrieve(mc.conn, msgID)
+}
+
+// retrieve 通过 conn 获取一封完整邮件
+func retrieve(conn pop3Conn, msgID int) (*mail.Message, error) {
+	f, err := conn.Retr(msgID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve message %d: %v", msgID, err)
 	}
@@ -75,6 +172,112 @@ func (mc *MailClient) RetrieveMessage(msgID int) (*mail.Message, error) {
 	}, nil
 }
 
+// RetrieveMessages 并发获取多封完整邮件，返回的切片与 ids 一一对应，获取失败的位置为 nil，
+// 所有失败合并为一个错误返回。POP3 不能在同一个连接上并发执行命令，因此每个 worker
+// 使用独立的连接：第一个 worker 使用当前连接，其余的通过 dial 新建。服务器限制同时登录时
+// 新建连接会失败，此时退化为较少的 worker，最少只用当前连接串行获取
+func (mc *MailClient) RetrieveMessages(ids []int) ([]*mail.Message, error) {
+	workers := mc.workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(ids) {
+		workers = len(ids)
+	}
+
+	conns := []pop3Conn{mc.conn}
+	for len(conns) < workers && mc.dial != nil {
+		conn, err := mc.dial()
+		if err != nil {
+			mc.logger.Warnf("failed to open extra connection, using %d: %v", len(conns), err)
+			break
+		}
+		conns = append(conns, conn)
+	}
+
+	messages := make([]*mail.Message, len(ids))
+	errs := make([]error, len(ids))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(conn pop3Conn, extra bool) {
+			defer wg.Done()
+			if extra {
+				defer conn.Quit()
+			}
+			for idx := range jobs {
+				messages[idx], errs[idx] = retrieve(conn, ids[idx])
+			}
+		}(conn, i > 0)
+	}
+	for idx := range ids {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	return messages, errors.Join(errs...)
+}
+
+// BatchRetrieve 新建 connections 个已认证连接并发获取邮件，返回以邮件编号为键的结果，
+// 不使用也不影响当前连接。每个 worker 独占一个连接，连接上的 RETR 依次执行；
+// 某个 worker 建立连接或认证失败时只记录日志，其余 worker 继续分担剩余的邮件。
+// 获取失败或因没有可用连接而未获取的邮件不在结果中，所有失败合并为一个错误返回
+func (mc *MailClient) BatchRetrieve(ids []int, connections int) (map[int]*mail.Message, error) {
+	if mc.dial == nil {
+		return nil, errors.New("batch retrieve requires a dialer")
+	}
+	if connections < 1 {
+		connections = 1
+	}
+	if connections > len(ids) {
+		connections = len(ids)
+	}
+
+	jobs := make(chan int, len(ids))
+	for _, id := range ids {
+		jobs <- id
+	}
+	close(jobs)
+
+	var (
+		mu       sync.Mutex
+		messages = make(map[int]*mail.Message, len(ids))
+		errs     []error
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			conn, err := mc.dial()
+			if err != nil {
+				mc.logger.Warnf("batch worker %d failed to connect: %v", worker, err)
+				return
+			}
+			defer conn.Quit()
+			for id := range jobs {
+				msg, err := retrieve(conn, id)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					messages[id] = msg
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 所有 worker 都连接失败时剩余的邮件没有被处理
+	for id := range jobs {
+		errs = append(errs, fmt.Errorf("message %d not retrieved: no connection available", id))
+	}
+	return messages, errors.Join(errs...)
+}
+
 func (mc *MailClient) Quit() error {
 	return mc.conn.Quit()
 }
@@ -85,40 +288,23 @@ func decodeBase64(encoded string) ([]byte, error) {
 	return io.ReadAll(decoder)
 }
 
-// decodeCharset decodes a string with the given charset
+// decodeCharset decodes a string with the given charset.
+// Unknown charsets are returned undecoded, as before.
 func decodeCharset(charset string, input []byte) (string, error) {
-	var decoded string
-	var err error
-
-	switch strings.ToLower(charset) {
-	case "gbk":
-		decoder := simplifiedchinese.GBK.NewDecoder()
-		decoded, _, err = transform.String(decoder, string(input))
-	case "gb18030":
-		decoder := simplifiedchinese.GB18030.NewDecoder()
-		decoded, _, err = transform.String(decoder, string(input))
-	case "hz-gb2312":
-		decoder := simplifiedchinese.HZGB2312.NewDecoder()
-		decoded, _, err = transform.String(decoder, string(input))
-	case "big5":
-		decoder := traditionalchinese.Big5.NewDecoder()
-		decoded, _, err = transform.String(decoder, string(input))
-	case "iso-8859-1":
-		decoder := charmap.ISO8859_1.NewDecoder()
-		decoded, _, err = transform.String(decoder, string(input))
-	default:
-		decoded = string(input)
+	decoded, err := mailcharset.Decode(charset, input)
+	if errors.Is(err, mailcharset.ErrUnknownCharset) {
+		return string(input), nil
 	}
-
 	return decoded, err
 }
 
 // 具体可以打印正文
 // 存在问题，不适配google，163 邮箱。
-func (mc *MailClient) ParseMessage(msg *mail.Message) {
+// 解析失败时返回错误而不是退出进程
+func (mc *MailClient) ParseMessage(msg *mail.Message) error {
 	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to parse content type: %v", err)
 	}
 
 	if strings.HasPrefix(mediaType, "multipart/") {
@@ -129,12 +315,12 @@ func (mc *MailClient) ParseMessage(msg *mail.Message) {
 				break
 			}
 			if err != nil {
-				log.Fatal(err)
+				return fmt.Errorf("failed to read message part: %v", err)
 			}
 
-			slurp, err := io.ReadAll(p)
+			slurp, err := mailpart.ReadAll(p, mc.maxPartSize)
 			if err != nil {
-				log.Fatal(err)
+				return fmt.Errorf("failed to read part body: %w", err)
 			}
 
 			// 根据 Content-Transfer-Encoding 头信息解码内容
@@ -143,7 +329,7 @@ func (mc *MailClient) ParseMessage(msg *mail.Message) {
 			if strings.ToLower(encoding) == "base64" {
 				decoded, err = decodeBase64(string(slurp))
 				if err != nil {
-					log.Fatalf("Failed to decode base64 content: %v", err)
+					return fmt.Errorf("failed to decode base64 content: %v", err)
 				}
 			} else {
 				decoded = slurp
@@ -155,15 +341,19 @@ func (mc *MailClient) ParseMessage(msg *mail.Message) {
 			charset := params["charset"]
 			decodedStr, err := decodeCharset(charset, decoded)
 			if err != nil {
-				log.Fatalf("Failed to decode charset: %v", err)
+				return fmt.Errorf("failed to decode charset: %v", err)
 			}
 
-			fmt.Printf("Part %q: %q\n", p.Header, decodedStr)
+			mc.logger.Infof("Part %q: %q", p.Header, decodedStr)
 		}
 	} else {
-		content, _ := io.ReadAll(msg.Body)
-		fmt.Printf("Single part message: %s\n", content)
+		content, err := mailpart.ReadAll(msg.Body, mc.maxPartSize)
+		if err != nil {
+			return fmt.Errorf("failed to read message body: %w", err)
+		}
+		mc.logger.Infof("Single part message: %s", content)
 	}
+	return nil
 }
 
 func main() {
@@ -183,17 +373,27 @@ func main() {
 	}
 	fmt.Printf("Number of messages: %d\n", stat)
 
-	msgs, err := mc.ListMessages(2)
+	headers, err := mc.ListHeaders()
 	if err != nil {
 		log.Fatalf("Failed to list messages: %v", err)
 	}
 
-	for _, msg := range msgs {
-		fmt.Printf("Message ID: %d, Size: %d bytes\n", msg.ID, msg.Size)
-		mailMsg, err := mc.RetrieveMessage(msg.ID)
-		if err != nil {
-			log.Fatalf("Failed to retrieve message %d: %v", msg.ID, err)
+	var ids []int
+	for _, h := range headers {
+		fmt.Printf("Message ID: %d, Size: %d bytes, Subject: %s\n", h.ID, h.Size, h.Header.Get("Subject"))
+		ids = append(ids, h.ID)
+	}
+
+	msgs, err := mc.RetrieveMessages(ids)
+	if err != nil {
+		mc.logger.Errorf("Failed to retrieve some messages: %v", err)
+	}
+	for i, mailMsg := range msgs {
+		if mailMsg == nil {
+			continue
+		}
+		if err := mc.ParseMessage(mailMsg); err != nil {
+			mc.logger.Errorf("Failed to parse message %d: %v", ids[i], err)
 		}
-		mc.ParseMessage(mailMsg)
 	}
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"jiaoben-/email/maillog"
+	"jiaoben-/email/mailpart"
+	"net/mail"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/knadh/go-pop3"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestMessage 构造一封测试邮件
+func newTestMessage(t *testing.T, raw string) *mail.Message {
+	msg, err := mail.ReadMessage(strings.NewReader(strings.ReplaceAll(raw, "\n", "\r\n")))
+	assert.NoError(t, err)
+	return msg
+}
+
+// TestParseMessageMalformedPart 测试损坏的分段返回错误而不是退出进程
+func TestParseMessageMalformedPart(t *testing.T) {
+	mc := &MailClient{logger: maillog.Discard}
+	msg := newTestMessage(t, `Content-Type: multipart/mixed; boundary="b1"
+
+--b1
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: base64
+
+!!!not-base64!!!
+--b1--
+`)
+
+	err := mc.ParseMessage(msg)
+	assert.Error(t, err)
+}
+
+// TestParseMessageBadContentType 测试无法解析的 Content-Type
+func TestParseMessageBadContentType(t *testing.T) {
+	mc := &MailClient{logger: maillog.Discard}
+	msg := newTestMessage(t, `Content-Type: ;;;
+
+body
+`)
+
+	err := mc.ParseMessage(msg)
+	assert.Error(t, err)
+}
+
+// TestParseMessageOversizedPart 测试超过大小上限的分段被拒绝
+func TestParseMessageOversizedPart(t *testing.T) {
+	mc := &MailClient{logger: maillog.Discard, maxPartSize: 16}
+	msg := newTestMessage(t, `Content-Type: multipart/mixed; boundary="b1"
+
+--b1
+Content-Type: text/plain; charset=utf-8
+
+`+strings.Repeat("x", 1024)+`
+--b1--
+`)
+
+	err := mc.ParseMessage(msg)
+	assert.ErrorIs(t, err, mailpart.ErrPartTooLarge)
+}
+
+// partLogger 记录 ParseMessage 输出的各分段解码结果
+type partLogger struct {
+	maillog.Logger
+	parts []string
+}
+
+func (l *partLogger) Infof(format string, args ...interface{}) {
+	if strings.HasPrefix(format, "Part ") {
+		l.parts = append(l.parts, args[1].(string))
+	}
+}
+
+// TestParseMessageCharset 测试 Big5 和 GB18030 正文解码为 UTF-8，与 IMAP 客户端的结果一致
+func TestParseMessageCharset(t *testing.T) {
+	logger := &partLogger{Logger: maillog.Discard}
+	mc := &MailClient{logger: logger}
+	msg := newTestMessage(t, `Content-Type: multipart/mixed; boundary="b1"
+
+--b1
+Content-Type: text/plain; charset=big5
+Content-Transfer-Encoding: base64
+
+pKSk5bZspfO0+rjV
+--b1
+Content-Type: text/plain; charset=GB18030
+Content-Transfer-Encoding: base64
+
+1tDOxNPKvP6y4srUouM=
+--b1--
+`)
+
+	assert.NoError(t, mc.ParseMessage(msg))
+	assert.Equal(t, []string{"中文郵件測試", "中文邮件测试€"}, logger.parts)
+}
+
+// fakeMailbox 多个连接共享的内存邮箱
+type fakeMailbox struct {
+	messages []string
+	dials    int32
+}
+
+// fakeConn 内存 POP3 连接，同一连接上出现并发命令时记录错误
+type fakeConn struct {
+	box  *fakeMailbox
+	busy int32
+	mu   sync.Mutex
+	errs []error
+}
+
+func (c *fakeConn) enter() func() {
+	if !atomic.CompareAndSwapInt32(&c.busy, 0, 1) {
+		c.mu.Lock()
+		c.errs = append(c.errs, errors.New("concurrent command on one connection"))
+		c.mu.Unlock()
+	}
+	return func() { atomic.StoreInt32(&c.busy, 0) }
+}
+
+func (c *fakeConn) Stat() (int, int, error) {
+	return len(c.box.messages), 0, nil
+}
+
+func (c *fakeConn) List(msgID int) ([]pop3.MessageID, error) {
+	defer c.enter()()
+	var ids []pop3.MessageID
+	for i, raw := range c.box.messages {
+		ids = append(ids, pop3.MessageID{ID: i + 1, Size: len(raw)})
+	}
+	return ids, nil
+}
+
+func (c *fakeConn) Top(msgID int, numLines int) (*message.Entity, error) {
+	return c.Retr(msgID)
+}
+
+func (c *fakeConn) Retr(msgID int) (*message.Entity, error) {
+	defer c.enter()()
+	if msgID < 1 || msgID > len(c.box.messages) {
+		return nil, fmt.Errorf("no such message %d", msgID)
+	}
+	return message.Read(strings.NewReader(c.box.messages[msgID-1]))
+}
+
+func (c *fakeConn) Quit() error {
+	return nil
+}
+
+// TestRetrieveMessagesCapAndOrder 测试邮件数上限和结果顺序，且每个连接上的命令不会并发
+func TestRetrieveMessagesCapAndOrder(t *testing.T) {
+	box := &fakeMailbox{}
+	for i := 1; i <= 10; i++ {
+		box.messages = append(box.messages, fmt.Sprintf("Subject: message %d\r\n\r\nbody %d\r\n", i, i))
+	}
+	conns := []*fakeConn{{box: box}}
+	mc := &MailClient{
+		conn:        conns[0],
+		logger:      maillog.Discard,
+		maxMessages: 5,
+		workers:     3,
+		dial: func() (pop3Conn, error) {
+			// 服务器只允许两个并发会话
+			if atomic.AddInt32(&box.dials, 1) > 1 {
+				return nil, errors.New("[IN-USE] mailbox locked")
+			}
+			conn := &fakeConn{box: box}
+			conns = append(conns, conn)
+			return conn, nil
+		},
+	}
+
+	headers, err := mc.ListHeaders()
+	assert.NoError(t, err)
+	var ids []int
+	for i, h := range headers {
+		assert.Equal(t, i+1, h.ID)
+		assert.Equal(t, fmt.Sprintf("message %d", i+1), h.Header.Get("Subject"))
+		ids = append(ids, h.ID)
+	}
+	assert.Len(t, ids, 5)
+
+	// 倒序请求，结果与请求顺序一致
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	msgs, err := mc.RetrieveMessages(ids)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 5)
+	for i, msg := range msgs {
+		assert.Equal(t, fmt.Sprintf("message %d", ids[i]), msg.Header.Get("Subject"))
+	}
+
+	assert.Len(t, conns, 2)
+	for _, conn := range conns {
+		assert.Empty(t, conn.errs)
+	}
+}
+
+// TestRetrieveMessagesPartialFailure 测试部分邮件获取失败时其余结果仍然返回
+func TestRetrieveMessagesPartialFailure(t *testing.T) {
+	box := &fakeMailbox{messages: []string{"Subject: one\r\n\r\n1\r\n"}}
+	mc := &MailClient{conn: &fakeConn{box: box}, logger: maillog.Discard, workers: 1}
+
+	msgs, err := mc.RetrieveMessages([]int{1, 2})
+	assert.Error(t, err)
+	assert.NotNil(t, msgs[0])
+	assert.Nil(t, msgs[1])
+}
+
+// TestBatchRetrieve 测试按配置的连接数并发获取全部邮件，连接失败的 worker 不影响结果
+func TestBatchRetrieve(t *testing.T) {
+	box := &fakeMailbox{}
+	for i := 1; i <= 20; i++ {
+		box.messages = append(box.messages, fmt.Sprintf("Subject: message %d\r\n\r\nbody %d\r\n", i, i))
+	}
+	var mu sync.Mutex
+	var conns []*fakeConn
+	mc := &MailClient{
+		logger: maillog.Discard,
+		dial: func() (pop3Conn, error) {
+			atomic.AddInt32(&box.dials, 1)
+			conn := &fakeConn{box: box}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			return conn, nil
+		},
+	}
+
+	ids := []int{20, 3, 7, 1, 15, 9, 11, 2, 18, 5}
+	msgs, err := mc.BatchRetrieve(ids, 3)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, len(ids))
+	for _, id := range ids {
+		if assert.Contains(t, msgs, id) {
+			assert.Equal(t, fmt.Sprintf("message %d", id), msgs[id].Header.Get("Subject"))
+		}
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&box.dials))
+	for _, conn := range conns {
+		assert.Empty(t, conn.errs)
+	}
+
+	// 一个 worker 认证失败，其余 worker 仍然取完所有邮件
+	var attempts int32
+	mc.dial = func() (pop3Conn, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return nil, errors.New("-ERR authentication failed")
+		}
+		return &fakeConn{box: box}, nil
+	}
+	msgs, err = mc.BatchRetrieve(ids, 3)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, len(ids))
+
+	// 所有 worker 都连接失败时返回错误
+	mc.dial = func() (pop3Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	msgs, err = mc.BatchRetrieve([]int{1, 2}, 2)
+	assert.Error(t, err)
+	assert.Empty(t, msgs)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator 校验登录凭据，签名与 server.Auth 一致，可以直接传给 ServerOpts
+type Authenticator interface {
+	CheckPasswd(user, pass string) (bool, error)
+}
+
+// StaticAuth 使用内存中的用户名到密码的映射，密码可以是明文或 bcrypt 哈希
+type StaticAuth map[string]string
+
+func (a StaticAuth) CheckPasswd(user, pass string) (bool, error) {
+	hash, ok := a[user]
+	if !ok {
+		return false, nil
+	}
+	return checkHash(hash, pass)
+}
+
+// HtpasswdAuth 从 htpasswd 格式的文件读取凭据，每行一个 user:hash，
+// 支持 bcrypt（$2a$、$2b$、$2y$）和 {SHA}，# 开头的行为注释
+type HtpasswdAuth struct {
+	users StaticAuth
+}
+
+// NewHtpasswdAuth 读取 htpasswd 文件
+func NewHtpasswdAuth(path string) (*HtpasswdAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(StaticAuth)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("%s:%d: invalid entry", path, lineNum)
+		}
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for user %s", path, lineNum, user)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &HtpasswdAuth{users: users}, nil
+}
+
+func (a *HtpasswdAuth) CheckPasswd(user, pass string) (bool, error) {
+	return a.users.CheckPasswd(user, pass)
+}
+
+// isBcrypt 判断是否为 bcrypt 哈希
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// checkHash 按哈希格式校验密码，无法识别的格式按明文比较
+func checkHash(hash, pass string) (bool, error) {
+	switch {
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1, nil
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(pass)) == 1, nil
+	}
+}
+
+// newAuthenticator 根据环境变量选择认证后端：
+// FTP_HTPASSWD 指定 htpasswd 文件，否则使用 FTP_USER 和 FTP_PASSWORD
+func newAuthenticator() (Authenticator, error) {
+	if path := os.Getenv("FTP_HTPASSWD"); path != "" {
+		return NewHtpasswdAuth(path)
+	}
+	user, pass := os.Getenv("FTP_USER"), os.Getenv("FTP_PASSWORD")
+	if user == "" || pass == "" {
+		return nil, fmt.Errorf("set FTP_HTPASSWD or FTP_USER and FTP_PASSWORD")
+	}
+	return StaticAuth{user: pass}, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd 写入测试用的 htpasswd 文件
+func writeHtpasswd(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// TestHtpasswdAuth 测试 htpasswd 文件中 bcrypt 和 {SHA} 凭据的校验
+func TestHtpasswdAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	path := writeHtpasswd(t, "# users\n"+
+		"alice:"+string(hash)+"\n"+
+		"\n"+
+		"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+
+	auth, err := NewHtpasswdAuth(path)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "password", true},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		ok, err := auth.CheckPasswd(tt.user, tt.pass)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, ok, "%s/%s", tt.user, tt.pass)
+	}
+}
+
+// TestHtpasswdAuthInvalidFile 测试格式错误或不支持的哈希会在加载时报错
+func TestHtpasswdAuthInvalidFile(t *testing.T) {
+	_, err := NewHtpasswdAuth(writeHtpasswd(t, "alice\n"))
+	assert.Error(t, err)
+
+	_, err = NewHtpasswdAuth(writeHtpasswd(t, "alice:$apr1$abc$def\n"))
+	assert.Error(t, err)
+
+	_, err = NewHtpasswdAuth(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// errTransferStalled 传输在空闲超时内没有任何进展
+var errTransferStalled = errors.New("transfer stalled: no progress within idle timeout")
+
+// readTimeout 上传时数据连接的空闲超时，writeTimeout 下载时的空闲超时，0 表示不限制。
+// 可通过 FTP_READ_TIMEOUT、FTP_WRITE_TIMEOUT 环境变量（如 30s）调整
+var (
+	readTimeout  = getEnvDuration("FTP_READ_TIMEOUT", 5*time.Minute)
+	writeTimeout = getEnvDuration("FTP_WRITE_TIMEOUT", 5*time.Minute)
+)
+
+// stallGuard 在超过 timeout 没有进展时调用 abort 中止传输
+type stallGuard struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+func newStallGuard(timeout time.Duration, abort func()) *stallGuard {
+	g := &stallGuard{timeout: timeout}
+	if timeout > 0 {
+		g.timer = time.AfterFunc(timeout, func() {
+			g.stalled.Store(true)
+			abort()
+		})
+	}
+	return g
+}
+
+// progress 记录一次进展，重新开始计时
+func (g *stallGuard) progress() {
+	if g.timer != nil && !g.stalled.Load() {
+		g.timer.Reset(g.timeout)
+	}
+}
+
+func (g *stallGuard) stop() {
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+}
+
+// wrap 超时中止后把底层返回的错误替换为 errTransferStalled
+func (g *stallGuard) wrap(err error) error {
+	if err != nil && g.stalled.Load() {
+		return errTransferStalled
+	}
+	return err
+}
+
+// abortConn 中止阻塞在 conn 上的读写：支持截止时间的连接把截止时间设为过去，
+// 否则直接关闭
+func abortConn(conn interface{}) {
+	past := time.Unix(1, 0)
+	switch c := conn.(type) {
+	case interface{ SetDeadline(time.Time) error }:
+		c.SetDeadline(past)
+	case io.Closer:
+		c.Close()
+	}
+}
+
+// idleReader 读取数据连接，超过空闲超时没有读到数据时中止
+type idleReader struct {
+	r     io.Reader
+	guard *stallGuard
+}
+
+func newIdleReader(r io.Reader, timeout time.Duration) *idleReader {
+	return &idleReader{r: r, guard: newStallGuard(timeout, func() { abortConn(r) })}
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.guard.progress()
+	}
+	return n, ir.guard.wrap(err)
+}
+
+// idleWriter 写入数据连接，单次写入超过空闲超时没有完成时中止
+type idleWriter struct {
+	w     io.Writer
+	guard *stallGuard
+}
+
+func newIdleWriter(w io.Writer, timeout time.Duration) *idleWriter {
+	return &idleWriter{w: w, guard: newStallGuard(timeout, func() { abortConn(w) })}
+}
+
+func (iw *idleWriter) Write(p []byte) (int, error) {
+	n, err := iw.w.Write(p)
+	if n > 0 {
+		iw.guard.progress()
+	}
+	return n, iw.guard.wrap(err)
+}
+
+// idleFile GetFile 返回的文件。服务器用 io.Copy 把文件发送到数据连接时会调用 WriteTo，
+// 借此拿到数据连接并加上写入的空闲超时
+type idleFile struct {
+	file    *os.File
+	timeout time.Duration
+}
+
+func (f *idleFile) Read(p []byte) (int, error) {
+	return f.file.Read(p)
+}
+
+func (f *idleFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *idleFile) WriteTo(w io.Writer) (int64, error) {
+	iw := newIdleWriter(w, f.timeout)
+	defer iw.guard.stop()
+	n, err := io.Copy(iw, struct{ io.Reader }{f.file})
+	return n, iw.guard.wrap(err)
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+        "fmt"
         "io"
         "log"
         "os"
-        "path/filepath"
 
         "github.com/goftp/server"
 )
@@ -25,6 +25,7 @@ func (fi MyFileInfo) Group() string {
 // MyDriver 实现了 server.Driver 接口
 type MyDriver struct {
         rootPath string
+        symlinks string // 符号链接的处理方式，为空时按 symlinksFollow 处理
 }
 
 func (d *MyDriver) Init(conn *server.Conn) {
@@ -32,7 +33,10 @@ func (d *MyDriver) Init(conn *server.Conn) {
 }
 
 func (d *MyDriver) Stat(path string) (server.FileInfo, error) {
-        fullPath := filepath.Join(d.rootPath, path)
+        fullPath, err := d.realPath(path, true)
+        if err != nil {
+                return nil, err
+        }
         info, err := os.Stat(fullPath)
         if err != nil {
                 return nil, err
@@ -41,7 +45,10 @@ func (d *MyDriver) Stat(path string) (server.FileInfo, error) {
 }
 
 func (d *MyDriver) ListDir(path string, callback func(server.FileInfo) error) error {
-        fullPath := filepath.Join(d.rootPath, path)
+        fullPath, err := d.realPath(path, true)
+        if err != nil {
+                return err
+        }
         entries, err := os.ReadDir(fullPath)
         if err != nil {
                 return err
@@ -59,48 +66,81 @@ func (d *MyDriver) ListDir(path string, callback func(server.FileInfo) error) er
 }
 
 func (d *MyDriver) DeleteDir(path string) error {
-        fullPath := filepath.Join(d.rootPath, path)
+        fullPath, err := d.realPath(path, false)
+        if err != nil {
+                return err
+        }
         return os.Remove(fullPath)
 }
 
 func (d *MyDriver) DeleteFile(path string) error {
-        fullPath := filepath.Join(d.rootPath, path)
+        fullPath, err := d.realPath(path, false)
+        if err != nil {
+                return err
+        }
         return os.Remove(fullPath)
 }
 
 func (d *MyDriver) Rename(fromPath string, toPath string) error {
-        fullFromPath := filepath.Join(d.rootPath, fromPath)
-        fullToPath := filepath.Join(d.rootPath, toPath)
+        fullFromPath, err := d.realPath(fromPath, false)
+        if err != nil {
+                return err
+        }
+        fullToPath, err := d.realPath(toPath, false)
+        if err != nil {
+                return err
+        }
         return os.Rename(fullFromPath, fullToPath)
 }
 
 func (d *MyDriver) MakeDir(path string) error {
-        fullPath := filepath.Join(d.rootPath, path)
+        fullPath, err := d.realPath(path, true)
+        if err != nil {
+                return err
+        }
         return os.Mkdir(fullPath, os.ModePerm)
 }
 
+// GetFile 打开文件并定位到 REST 指定的偏移量，返回从偏移量开始实际会发送的字节数。
+// 偏移量超过文件末尾时返回错误，而不是发送一个空文件
 func (d *MyDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
-        fullPath := filepath.Join(d.rootPath, path)
+        fullPath, err := d.realPath(path, true)
+        if err != nil {
+                return 0, nil, err
+        }
         file, err := os.Open(fullPath)
         if err != nil {
                 return 0, nil, err
         }
         stat, err := file.Stat()
         if err != nil {
+                file.Close()
                 return 0, nil, err
         }
+        if offset < 0 || offset > stat.Size() {
+                file.Close()
+                return 0, nil, fmt.Errorf("offset %d is beyond end of file (size %d)", offset, stat.Size())
+        }
         if offset > 0 {
                 if _, err := file.Seek(offset, io.SeekStart); err != nil {
+                        file.Close()
                         return 0, nil, err
                 }
         }
-        return stat.Size(), file, nil
+        return stat.Size() - offset, &idleFile{file: file, timeout: writeTimeout}, nil
 }
 
+// syncFile 将文件内容刷到磁盘，便于测试替换
+var syncFile = (*os.File).Sync
+
+// PutFile 写入上传的文件，返回前 fsync，保证客户端收到成功响应时数据已经落盘。
+// goftp 不会把 REST 的偏移量传给驱动，续传时无法校验偏移量与已有文件的大小一致，只能直接追加
 func (d *MyDriver) PutFile(destPath string, data io.Reader, appendData bool) (int64, error) {
-        fullPath := filepath.Join(d.rootPath, destPath)
+        fullPath, err := d.realPath(destPath, true)
+        if err != nil {
+                return 0, err
+        }
         var file *os.File
-        var err error
         if appendData {
                 file, err = os.OpenFile(fullPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.ModePerm)
         } else {
@@ -110,12 +150,25 @@ func (d *MyDriver) PutFile(destPath string, data io.Reader, appendData bool) (in
                 return 0, err
         }
         defer file.Close()
-        written, err := io.Copy(file, data)
-        return written, err
+
+        // 客户端超过空闲超时没有发送数据时中止上传
+        reader := newIdleReader(data, readTimeout)
+        defer reader.guard.stop()
+        written, err := io.Copy(file, reader)
+        if err != nil {
+                return written, err
+        }
+        if err := syncFile(file); err != nil {
+                return written, err
+        }
+        return written, file.Close()
 }
 
 func (d *MyDriver) ChangeDir(path string) error {
-        fullPath := filepath.Join(d.rootPath, path)
+        fullPath, err := d.realPath(path, true)
+        if err != nil {
+                return err
+        }
         info, err := os.Stat(fullPath)
         if err != nil {
                 return err
@@ -128,17 +181,23 @@ func (d *MyDriver) ChangeDir(path string) error {
 
 type MyDriverFactory struct {
         rootPath string
+        symlinks string
 }
 
 func (f *MyDriverFactory) NewDriver() (server.Driver, error) {
-        return &MyDriver{rootPath: f.rootPath}, nil
+        return &MyDriver{rootPath: f.rootPath, symlinks: f.symlinks}, nil
 }
 
 func main() {
-        factory := &MyDriverFactory{rootPath: ""} // 监听哪个路径
-        auth := &server.SimpleAuth{ 
-                Name:     "cg",                    // 用户名
-                Password: "6666",                  // 密码
+        // FTP_SYMLINKS=reject 时拒绝经过符号链接的路径，默认跟随但限制在根目录内
+        symlinks := os.Getenv("FTP_SYMLINKS")
+        if symlinks != "" && symlinks != symlinksFollow && symlinks != symlinksReject {
+                log.Fatalf("FTP_SYMLINKS must be %q or %q", symlinksFollow, symlinksReject)
+        }
+        factory := &MyDriverFactory{rootPath: "", symlinks: symlinks} // 监听哪个路径
+        auth, err := newAuthenticator()
+        if err != nil {
+                log.Fatal("Error loading credentials:", err)
         }
 
         opts := &server.ServerOpts{
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goftp/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// spySync 记录 fsync 时文件的完整内容，测试结束后恢复
+func spySync(t *testing.T) *[]string {
+	synced := &[]string{}
+	old := syncFile
+	syncFile = func(f *os.File) error {
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			return err
+		}
+		*synced = append(*synced, string(data))
+		return old(f)
+	}
+	t.Cleanup(func() { syncFile = old })
+	return synced
+}
+
+// TestPutFileSync 测试 PutFile 返回前已经写完并 fsync
+func TestPutFileSync(t *testing.T) {
+	synced := spySync(t)
+	d := &MyDriver{rootPath: t.TempDir()}
+
+	n, err := d.PutFile("upload.txt", strings.NewReader("hello"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	n, err = d.PutFile("upload.txt", strings.NewReader(" world"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), n)
+
+	assert.Equal(t, []string{"hello", "hello world"}, *synced)
+	data, err := os.ReadFile(filepath.Join(d.rootPath, "upload.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+}
+
+// TestGetFileOffset 测试 REST 之后的 RETR 报告剩余长度并从偏移量开始发送，越过文件末尾时报错
+func TestGetFileOffset(t *testing.T) {
+	d := &MyDriver{rootPath: t.TempDir()}
+	assert.NoError(t, os.WriteFile(filepath.Join(d.rootPath, "data.bin"), []byte("0123456789"), 0644))
+
+	size, rc, err := d.GetFile("data.bin", 4)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), size)
+	assert.Equal(t, "456789", string(data))
+
+	// 偏移量等于文件大小时没有剩余内容
+	size, rc, err = d.GetFile("data.bin", 10)
+	assert.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, int64(0), size)
+
+	_, _, err = d.GetFile("data.bin", 11)
+	assert.Error(t, err)
+}
+
+// stallConn 模拟发送完 data 后不再发送或接收数据的客户端连接，关闭后读写返回错误
+type stallConn struct {
+	data   *strings.Reader
+	closed chan struct{}
+}
+
+func newStallConn(data string) *stallConn {
+	return &stallConn{data: strings.NewReader(data), closed: make(chan struct{})}
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	if c.data.Len() > 0 {
+		return c.data.Read(p)
+	}
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (c *stallConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// TestTransferStalled 测试客户端停止收发数据后上传和下载在空闲超时后中止
+func TestTransferStalled(t *testing.T) {
+	oldRead, oldWrite := readTimeout, writeTimeout
+	readTimeout, writeTimeout = 50*time.Millisecond, 50*time.Millisecond
+	defer func() { readTimeout, writeTimeout = oldRead, oldWrite }()
+
+	d := &MyDriver{rootPath: t.TempDir()}
+	start := time.Now()
+	_, err := d.PutFile("upload.bin", newStallConn("partial"), false)
+	assert.ErrorIs(t, err, errTransferStalled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(d.rootPath, "data.bin"), []byte("0123456789"), 0644))
+	_, rc, err := d.GetFile("data.bin", 0)
+	assert.NoError(t, err)
+	defer rc.Close()
+	start = time.Now()
+	_, err = io.Copy(newStallConn(""), rc)
+	assert.ErrorIs(t, err, errTransferStalled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// TestSymlinkConfinement 测试指向根目录外的符号链接被拒绝，根目录内的链接可以跟随，
+// 拒绝模式下任何经过符号链接的路径都被拒绝
+func TestSymlinkConfinement(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644))
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "sub"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "sub", "public.txt"), []byte("public"), 0644))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt")))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "created.txt"), filepath.Join(root, "dangling.txt")))
+	assert.NoError(t, os.Symlink("sub", filepath.Join(root, "inner")))
+
+	d := &MyDriver{rootPath: root}
+	for _, path := range []string{"/escape/secret.txt", "/secret.txt", "escape/../escape/secret.txt"} {
+		_, _, err := d.GetFile(path, 0)
+		assert.ErrorIs(t, err, os.ErrPermission, path)
+	}
+	_, err := d.Stat("/escape")
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.ErrorIs(t, d.ListDir("/escape", func(server.FileInfo) error { return nil }), os.ErrPermission)
+	assert.ErrorIs(t, d.ChangeDir("/escape"), os.ErrPermission)
+
+	// 通过链接写入根目录外，包括指向不存在文件的链接
+	_, err = d.PutFile("/escape/new.txt", strings.NewReader("x"), false)
+	assert.ErrorIs(t, err, os.ErrPermission)
+	_, err = d.PutFile("/dangling.txt", strings.NewReader("x"), false)
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.NoFileExists(t, filepath.Join(outside, "new.txt"))
+	assert.NoFileExists(t, filepath.Join(outside, "created.txt"))
+
+	// .. 只能回到根目录
+	_, err = d.Stat("/../../" + filepath.Base(outside))
+	assert.True(t, os.IsNotExist(err))
+
+	// 根目录内的链接正常跟随
+	_, rc, err := d.GetFile("/inner/public.txt", 0)
+	if assert.NoError(t, err) {
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		assert.Equal(t, "public", string(data))
+	}
+
+	// 删除链接本身，不影响链接指向的文件
+	assert.NoError(t, d.DeleteFile("/secret.txt"))
+	assert.FileExists(t, filepath.Join(outside, "secret.txt"))
+
+	d = &MyDriver{rootPath: root, symlinks: symlinksReject}
+	_, _, err = d.GetFile("/inner/public.txt", 0)
+	assert.ErrorIs(t, err, errSymlinkRejected)
+	_, rc, err = d.GetFile("/sub/public.txt", 0)
+	if assert.NoError(t, err) {
+		rc.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 符号链接的处理方式
+const (
+	symlinksFollow = "follow" // 跟随符号链接，但解析后的真实路径必须仍在根目录内
+	symlinksReject = "reject" // 路径中出现任何符号链接都拒绝访问
+)
+
+var (
+	// errOutsideRoot 解析后的真实路径不在根目录内
+	errOutsideRoot = fmt.Errorf("path escapes root: %w", os.ErrPermission)
+	// errSymlinkRejected 拒绝符号链接时路径经过了符号链接
+	errSymlinkRejected = fmt.Errorf("symlinks are not allowed: %w", os.ErrPermission)
+)
+
+// realPath 把客户端路径解析为根目录下的真实路径。先按字面清理掉 ..，再用 EvalSymlinks
+// 解析路径中的符号链接，确认真实路径仍在根目录内。followLast 为 false 时不解析最后一段，
+// 用于删除和重命名，操作的是链接本身而不是它指向的文件
+func (d *MyDriver) realPath(path string, followLast bool) (string, error) {
+	root, err := filepath.Abs(d.rootPath)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	lexical := filepath.Join(realRoot, filepath.Clean(string(filepath.Separator)+path))
+	if lexical == realRoot {
+		return realRoot, nil
+	}
+	dir, base := filepath.Dir(lexical), filepath.Base(lexical)
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(realDir, base)
+
+	if followLast {
+		if info, err := os.Lstat(resolved); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			// 指向不存在目标的链接无法确认位置，创建文件时会写到链接指向的地方
+			target, err := filepath.EvalSymlinks(resolved)
+			if err != nil {
+				return "", errOutsideRoot
+			}
+			resolved = target
+		}
+	}
+
+	if !withinRoot(realRoot, resolved) {
+		return "", errOutsideRoot
+	}
+	if d.symlinks == symlinksReject && resolved != lexical {
+		return "", errSymlinkRejected
+	}
+	return resolved, nil
+}
+
+// withinRoot 判断 path 是否是 root 或在 root 之下
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
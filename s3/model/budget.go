@@ -0,0 +1,64 @@
+package model
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// SetMemoryBudget caps the memory used by part buffers of concurrent
+// uploads. Every part in flight holds one buffer in memory, so the
+// concurrency of UploadFiles, of multipart part uploads and of the
+// simple-upload path is lowered to budget/partSize (at least 1) whenever that
+// is below the configured value. UploadFiles splits the budget between the
+// files it uploads at once. A budget of 0 or less removes the cap.
+func (client *S3Client) SetMemoryBudget(budget int64) {
+	client.memoryBudget = budget
+}
+
+// effectiveConcurrency returns concurrency lowered to what the memory budget
+// allows for buffers of partSize bytes
+func (client *S3Client) effectiveConcurrency(concurrency int, partSize int64) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if client.memoryBudget <= 0 || partSize <= 0 {
+		return concurrency
+	}
+	allowed := client.memoryBudget / partSize
+	if allowed < 1 {
+		allowed = 1
+	}
+	if int64(concurrency) > allowed {
+		concurrency = int(allowed)
+	}
+	return concurrency
+}
+
+// limitUploader applies the memory budget to the simple-upload path
+func (client *S3Client) limitUploader(u *s3manager.Uploader) {
+	u.Concurrency = client.effectiveConcurrency(u.Concurrency, u.PartSize)
+}
+
+// partBuffers recycles part buffers between uploads so that uploading many
+// files does not allocate a fresh partSize buffer for each of them
+var partBuffers sync.Pool
+
+// partBufferAllocs counts buffers that could not be taken from partBuffers
+var partBufferAllocs int64
+
+// getPartBuffer returns a buffer of exactly size bytes, reusing a pooled one
+// when it is large enough
+func getPartBuffer(size int64) []byte {
+	if buf, ok := partBuffers.Get().(*[]byte); ok && int64(cap(*buf)) >= size {
+		return (*buf)[:size]
+	}
+	atomic.AddInt64(&partBufferAllocs, 1)
+	return make([]byte, size)
+}
+
+// putPartBuffer returns a buffer obtained from getPartBuffer to the pool
+func putPartBuffer(buf []byte) {
+	partBuffers.Put(&buf)
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Checksum algorithms returned by ObjectChecksum
+const (
+	// ChecksumSHA256 is the hex SHA-256 of the object content, from x-amz-checksum-sha256
+	ChecksumSHA256 = "sha256"
+	// ChecksumMD5 is the hex MD5 of the object content, from a single-part ETag
+	ChecksumMD5 = "md5"
+	// ChecksumCompositeETag is an ETag that is not a content MD5: either a
+	// multipart composite ("<md5 of part md5s>-<parts>") or the ETag of a
+	// KMS-encrypted object. It can only be compared against an ETag computed
+	// the same way, not against a digest of the content.
+	ChecksumCompositeETag = "etag-composite"
+)
+
+// multipartETag matches the composite ETag S3 assigns to multipart uploads
+var multipartETag = regexp.MustCompile(`^[0-9a-fA-F]{32}-\d+$`)
+
+// ObjectChecksum returns a checksum of the object that callers can verify a
+// local copy against. It prefers x-amz-checksum-sha256 when the object has
+// one, else interprets the ETag: a plain MD5 for single-part uploads, or a
+// composite value for multipart and KMS-encrypted objects.
+func (client *S3Client) ObjectChecksum(key string) (algo string, value string, err error) {
+	return client.ObjectChecksumWithContext(context.Background(), key)
+}
+
+// ObjectChecksumWithContext is ObjectChecksum with a context that can cancel
+// the request or bound it with a deadline
+func (client *S3Client) ObjectChecksumWithContext(ctx context.Context, key string) (algo string, value string, err error) {
+	resp, err := client.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(client.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get file info: %w", err)
+	}
+	return interpretChecksum(resp)
+}
+
+// interpretChecksum picks the most useful checksum from a HEAD response
+func interpretChecksum(resp *s3.HeadObjectOutput) (algo string, value string, err error) {
+	if sum := aws.StringValue(resp.ChecksumSHA256); sum != "" {
+		// the checksum of a multipart object is a checksum of part checksums
+		// and carries a "-<parts>" suffix, which is not a content digest
+		if b64, _, composite := strings.Cut(sum, "-"); !composite {
+			raw, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid sha256 checksum %q: %v", sum, err)
+			}
+			return ChecksumSHA256, hex.EncodeToString(raw), nil
+		}
+	}
+
+	etag := strings.Trim(aws.StringValue(resp.ETag), `"`)
+	if etag == "" {
+		return "", "", fmt.Errorf("object has no ETag")
+	}
+	if multipartETag.MatchString(etag) || aws.StringValue(resp.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms {
+		return ChecksumCompositeETag, etag, nil
+	}
+	return ChecksumMD5, strings.ToLower(etag), nil
+}
@@ -3,60 +3,157 @@ package model
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+)
+
+const (
+	// uploaderConcurrency is the number of parts the simple-upload path sends in parallel
+	uploaderConcurrency = s3manager.DefaultUploadConcurrency
+	// uploaderPartSize is the part size the simple-upload path uses for large bodies
+	uploaderPartSize = s3manager.MinUploadPartSize
+	// uploadAttempts is how many times a transient upload failure is attempted
+	uploadAttempts = 3
+	// minPartSize is the smallest size S3 accepts for any part but the last
+	minPartSize = 5 * 1024 * 1024
+	// maxUploadParts is the largest number of parts a multipart upload may have
+	maxUploadParts = 10000
 )
 
 // S3Client encapsulates the S3 client and its operations
 type S3Client struct {
-	svc    *s3.S3
-	bucket string
+	svc             s3iface.S3API
+	uploader        s3manageriface.UploaderAPI
+	bucket          string
+	httpClient      *http.Client
+	normalizeKey    KeyNormalizer
+	overwrite       OverwritePolicy
+	memoryBudget    int64
+	resumeThreshold int64
+	partConcurrency int
 }
 
-// NewS3Client creates a new S3Client instance
-func NewS3Client(accessKeyID, secretAccessKey, region, endpoint, bucket string) (*S3Client, error) {
+// NewS3Client creates a new S3Client instance. The client owns its HTTP
+// connection pool, so create it once and reuse it for every operation rather
+// than creating one per call; call Close when it is no longer needed.
+// Without options it uses path-style addressing, TLS verification and static
+// credentials without a session token.
+func NewS3Client(accessKeyID, secretAccessKey, region, endpoint, bucket string, opts ...ClientOption) (*S3Client, error) {
+	var options clientOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	httpClient := options.httpClient
+	if httpClient == nil {
+		httpClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	}
+
 	sess, err := session.NewSession(&aws.Config{
 		Region:           aws.String(region),
-		Credentials:      credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
+		Credentials:      credentials.NewStaticCredentials(accessKeyID, secretAccessKey, options.sessionToken),
 		Endpoint:         aws.String(endpoint),
 		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(options.disableSSL),
+		HTTPClient:       httpClient,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %v", err)
 	}
 
+	svc := s3.New(sess)
 	return &S3Client{
-		svc:    s3.New(sess),
-		bucket: bucket,
+		svc:        svc,
+		uploader:   newUploader(svc),
+		bucket:     bucket,
+		httpClient: httpClient,
 	}, nil
 }
 
-// UploadFile chooses between simple upload or multipart upload based on file size
+// Close releases the idle connections held by the client's HTTP transport.
+// It is safe to call more than once.
+func (client *S3Client) Close() error {
+	if client.httpClient != nil {
+		client.httpClient.CloseIdleConnections()
+	}
+	return nil
+}
+
+// newUploader creates an uploader with explicit concurrency and part size
+func newUploader(svc s3iface.S3API) *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.Concurrency = uploaderConcurrency
+		u.PartSize = uploaderPartSize
+	})
+}
+
+// UploadFile chooses between simple upload or multipart upload based on file size.
+// Files above the resume threshold use ResumableUploadFile. A partSize of 0, below the 5MB minimum, or too small to fit the file in
+// 10,000 parts is replaced by the smallest safe part size.
 func (client *S3Client) UploadFile(filePath string, partSize int64) error {
+	return client.UploadFileWithContext(context.Background(), filePath, partSize)
+}
+
+// UploadFileWithContext is UploadFile with a context that can cancel the
+// upload or bound it with a deadline
+func (client *S3Client) UploadFileWithContext(ctx context.Context, filePath string, partSize int64) error {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to get file info: %v", err)
 	}
 
+	if effective := effectivePartSize(fileInfo.Size(), partSize); effective != partSize {
+		fmt.Printf("adjusted part size from %d to %d for %s\n", partSize, effective, filePath)
+		partSize = effective
+	}
+
 	if fileInfo.Size() > partSize {
-		return client.MultipartUploadFile(filePath, partSize)
+		if client.resumable(fileInfo.Size()) {
+			return client.ResumableUploadFileWithContext(ctx, filePath, partSize)
+		}
+		return client.MultipartUploadFileWithContext(ctx, filePath, partSize)
+	}
+	return client.SimpleUploadFileWithContext(ctx, filePath)
+}
+
+// effectivePartSize returns a part size that keeps a file of fileSize bytes
+// within maxUploadParts parts and no part below minPartSize
+func effectivePartSize(fileSize, partSize int64) int64 {
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if fileSize > partSize*maxUploadParts {
+		partSize = (fileSize + maxUploadParts - 1) / maxUploadParts
 	}
-	return client.SimpleUploadFile(filePath)
+	return partSize
 }
 
 // SimpleUploadFile uploads a file to S3 using simple upload
 func (client *S3Client) SimpleUploadFile(filePath string) error {
-	key := filepath.Base(filePath)
+	return client.SimpleUploadFileWithContext(context.Background(), filePath)
+}
+
+// SimpleUploadFileWithContext is SimpleUploadFile with a context that can
+// cancel the upload or bound it with a deadline
+func (client *S3Client) SimpleUploadFileWithContext(ctx context.Context, filePath string) error {
+	key := client.objectKey(filePath)
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -64,12 +161,17 @@ func (client *S3Client) SimpleUploadFile(filePath string) error {
 	}
 	defer file.Close()
 
-	uploader := s3manager.NewUploaderWithClient(client.svc)
-
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(client.bucket),
-		Key:    aws.String(key),
-		Body:   file,
+	// 每次重试前回到文件开头，保证重试上传的是完整内容
+	err = retry(ctx, uploadAttempts, func() error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind file: %v", err)
+		}
+		_, err := client.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String(client.bucket),
+			Key:    aws.String(key),
+			Body:   file,
+		}, client.limitUploader)
+		return err
 	})
 	if err != nil {
 		return fmt.Errorf("upload failed: %v", err)
@@ -81,7 +183,13 @@ func (client *S3Client) SimpleUploadFile(filePath string) error {
 
 // MultipartUploadFile uploads a file to S3 using multipart upload
 func (client *S3Client) MultipartUploadFile(filePath string, partSize int64) error {
-	key := filepath.Base(filePath)
+	return client.MultipartUploadFileWithContext(context.Background(), filePath, partSize)
+}
+
+// MultipartUploadFileWithContext is MultipartUploadFile with a context that
+// can cancel the upload; a cancelled upload is aborted
+func (client *S3Client) MultipartUploadFileWithContext(ctx context.Context, filePath string, partSize int64) error {
+	key := client.objectKey(filePath)
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -89,18 +197,18 @@ func (client *S3Client) MultipartUploadFile(filePath string, partSize int64) err
 	}
 	defer file.Close()
 
-	uploadID, err := client.InitMultipartUpload(key)
+	uploadID, err := client.initMultipartUpload(ctx, key)
 	if err != nil {
 		return err
 	}
 
-	completedParts, err := client.UploadParts(file, key, uploadID, partSize)
+	completedParts, err := client.uploadPartsFrom(ctx, file, key, uploadID, partSize, 1, nil)
 	if err != nil {
 		client.AbortMultipartUpload(&key, uploadID)
 		return err
 	}
 
-	err = client.CompleteMultipartUpload(key, uploadID, completedParts)
+	err = client.completeMultipartUpload(ctx, key, uploadID, completedParts)
 	if err != nil {
 		return err
 	}
@@ -109,59 +217,292 @@ func (client *S3Client) MultipartUploadFile(filePath string, partSize int64) err
 	return nil
 }
 
+// UploadReader streams data from r to key using a multipart upload, so the
+// content never has to exist as a local file. The upload is aborted on failure.
+func (client *S3Client) UploadReader(key string, r io.Reader, partSize int64) error {
+	return client.UploadReaderWithContext(context.Background(), key, r, partSize)
+}
+
+// UploadReaderWithContext is UploadReader with a context that can cancel the
+// upload; a cancelled upload is aborted
+func (client *S3Client) UploadReaderWithContext(ctx context.Context, key string, r io.Reader, partSize int64) error {
+	uploadID, err := client.initMultipartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	completedParts, err := client.uploadPartsFrom(ctx, r, key, uploadID, partSize, 1, nil)
+	if err != nil {
+		client.AbortMultipartUpload(&key, uploadID)
+		return err
+	}
+
+	err = client.completeMultipartUpload(ctx, key, uploadID, completedParts)
+	if err != nil {
+		client.AbortMultipartUpload(&key, uploadID)
+		return err
+	}
+
+	fmt.Println("stream uploaded successfully (multipart):", key)
+	return nil
+}
+
+// AppendToObject appends the data read from r to the object at key. S3 has no
+// native append, so the existing object is copied server-side as part 1 of a
+// new multipart upload, the new data follows as further parts, and completing
+// the upload replaces the object. Objects smaller than the 5MB minimum part
+// size are downloaded and re-uploaded together with the new data instead.
+// A missing object is simply created from r.
+func (client *S3Client) AppendToObject(key string, r io.Reader) error {
+	return client.AppendToObjectWithContext(context.Background(), key, r)
+}
+
+// AppendToObjectWithContext is AppendToObject with a context that can cancel
+// the append; a cancelled append is aborted and leaves the object unchanged
+func (client *S3Client) AppendToObjectWithContext(ctx context.Context, key string, r io.Reader) error {
+	head, err := client.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(client.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return client.UploadReaderWithContext(ctx, key, r, minPartSize)
+		}
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	size := aws.Int64Value(head.ContentLength)
+
+	var body io.Reader = r
+	if size < minPartSize {
+		// 现有对象太小，不能作为单独的分片复制
+		resp, err := client.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(client.bucket),
+			Key:     aws.String(key),
+			IfMatch: head.ETag,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read existing object: %w", err)
+		}
+		defer resp.Body.Close()
+		body = io.MultiReader(resp.Body, r)
+	}
+
+	uploadID, err := client.initMultipartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	var completedParts []*s3.CompletedPart
+	firstPart := int64(1)
+	if size >= minPartSize {
+		copyResp, err := client.svc.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:            aws.String(client.bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(url.PathEscape(client.bucket + "/" + key)),
+			CopySourceIfMatch: head.ETag,
+			PartNumber:        aws.Int64(1),
+			UploadId:          uploadID,
+		})
+		if err != nil {
+			client.AbortMultipartUpload(&key, uploadID)
+			return fmt.Errorf("failed to copy existing object: %w", err)
+		}
+		completedParts = append(completedParts, &s3.CompletedPart{
+			ETag:       copyResp.CopyPartResult.ETag,
+			PartNumber: aws.Int64(1),
+		})
+		firstPart = 2
+	}
+
+	parts, err := client.uploadPartsFrom(ctx, body, key, uploadID, minPartSize, firstPart, nil)
+	if err != nil {
+		client.AbortMultipartUpload(&key, uploadID)
+		return err
+	}
+	completedParts = append(completedParts, parts...)
+	if len(completedParts) == 0 {
+		// 现有对象和追加内容都为空，无需改动
+		client.AbortMultipartUpload(&key, uploadID)
+		return nil
+	}
+
+	err = client.completeMultipartUpload(ctx, key, uploadID, completedParts)
+	if err != nil {
+		client.AbortMultipartUpload(&key, uploadID)
+		return err
+	}
+
+	fmt.Println("appended to object successfully:", key)
+	return nil
+}
+
+// isNotFound reports whether err is a 404 from S3
+func isNotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "NotFound" || aerr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return false
+}
+
 // InitMultipartUpload initializes a multipart upload
 func (client *S3Client) InitMultipartUpload(key string) (*string, error) {
-	createResp, err := client.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+	return client.initMultipartUpload(context.Background(), key)
+}
+
+func (client *S3Client) initMultipartUpload(ctx context.Context, key string) (*string, error) {
+	createResp, err := client.svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
 		Bucket: aws.String(client.bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to initiate multipart upload: %v", err)
+		return nil, fmt.Errorf("failed to initiate multipart upload: %w", err)
 	}
 	return createResp.UploadId, nil
 }
 
 // UploadParts uploads parts of a file in a multipart upload
-func (client *S3Client) UploadParts(file *os.File, key string, uploadID *string, partSize int64) ([]*s3.CompletedPart, error) {
-	var completedParts []*s3.CompletedPart
-	buffer := make([]byte, partSize)
-	partNumber := int64(1)
+func (client *S3Client) UploadParts(file io.Reader, key string, uploadID *string, partSize int64) ([]*s3.CompletedPart, error) {
+	return client.uploadPartsFrom(context.Background(), file, key, uploadID, partSize, 1, nil)
+}
 
-	for {
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to read file: %v", err)
+// SetPartConcurrency sets how many parts of a multipart upload are read and
+// uploaded at once. Every part in flight holds its own partSize buffer, so the
+// memory budget can lower it further. 0 or 1 uploads parts one at a time.
+func (client *S3Client) SetPartConcurrency(n int) {
+	client.partConcurrency = n
+}
+
+// uploadPartsFrom uploads parts read from r, numbering them from firstPart.
+// Parts are read in order and uploaded by up to partConcurrency workers, each
+// with its own buffer; the first failure stops further parts from starting.
+// Parts listed in existing whose content still matches are kept instead of
+// uploaded again. Each part gets 30 seconds on top of any deadline already
+// set on ctx. The returned parts are sorted by part number.
+func (client *S3Client) uploadPartsFrom(ctx context.Context, r io.Reader, key string, uploadID *string, partSize int64, firstPart int64, existing map[int64]*s3.Part) ([]*s3.CompletedPart, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// free 中的缓冲区数量即并发上限，nil 表示尚未分配
+	workers := client.effectiveConcurrency(client.partConcurrency, partSize)
+	free := make(chan []byte, workers)
+	for i := 0; i < workers; i++ {
+		free <- nil
+	}
+
+	var (
+		mu             sync.Mutex
+		wg             sync.WaitGroup
+		completedParts []*s3.CompletedPart
+		firstErr       error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	for partNumber := firstPart; ; partNumber++ {
+		var buffer []byte
+		select {
+		case buffer = <-free:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			if buffer != nil {
+				free <- buffer
+			}
+			break
+		}
+		if buffer == nil {
+			buffer = getPartBuffer(partSize)
+		}
+
+		n, err := io.ReadFull(r, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			free <- buffer
+			fail(fmt.Errorf("failed to read file: %v", err))
+			break
 		}
 		if n == 0 {
+			free <- buffer
 			break
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+		wg.Add(1)
+		go func(partNumber int64, buffer []byte, n int) {
+			defer wg.Done()
+			defer func() { free <- buffer }()
+			part, err := client.uploadPart(ctx, buffer[:n], key, uploadID, partNumber, existing[partNumber])
+			if err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			completedParts = append(completedParts, part)
+			mu.Unlock()
+		}(partNumber, buffer, n)
+	}
+	wg.Wait()
 
-		uploadResp, err := client.UploadPartWithRetry(ctx, buffer[:n], key, uploadID, partNumber, 3)
-		if err != nil {
-			return nil, err
+	for len(free) > 0 {
+		if buffer := <-free; buffer != nil {
+			putPartBuffer(buffer)
 		}
-
-		completedParts = append(completedParts, &s3.CompletedPart{
-			ETag:       uploadResp.ETag,
-			PartNumber: aws.Int64(partNumber),
-		})
-		partNumber++
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
+	sort.Slice(completedParts, func(i, j int) bool {
+		return aws.Int64Value(completedParts[i].PartNumber) < aws.Int64Value(completedParts[j].PartNumber)
+	})
 	return completedParts, nil
 }
 
-// CompleteMultipartUpload completes a multipart upload
+// uploadPart uploads chunk as part partNumber, or keeps existing when it
+// already holds exactly chunk
+func (client *S3Client) uploadPart(ctx context.Context, chunk []byte, key string, uploadID *string, partNumber int64, existing *s3.Part) (*s3.CompletedPart, error) {
+	if existing != nil && partMatches(existing, chunk) {
+		return &s3.CompletedPart{ETag: existing.ETag, PartNumber: aws.Int64(partNumber)}, nil
+	}
+
+	partCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	uploadResp, err := client.UploadPartWithRetry(partCtx, chunk, key, uploadID, partNumber, uploadAttempts)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.CompletedPart{ETag: uploadResp.ETag, PartNumber: aws.Int64(partNumber)}, nil
+}
+
+// CompleteMultipartUpload completes a multipart upload. The parts may be
+// given in any order; they are sent sorted by part number, and the upload is
+// rejected before reaching S3 if the numbers have gaps or duplicates.
 func (client *S3Client) CompleteMultipartUpload(key string, uploadID *string, completedParts []*s3.CompletedPart) error {
-	_, err := client.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+	return client.completeMultipartUpload(context.Background(), key, uploadID, completedParts)
+}
+
+func (client *S3Client) completeMultipartUpload(ctx context.Context, key string, uploadID *string, completedParts []*s3.CompletedPart) error {
+	parts, err := sortCompletedParts(completedParts)
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %v", err)
+	}
+
+	_, err = client.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
 		Bucket:   aws.String(client.bucket),
 		Key:      aws.String(key),
 		UploadId: uploadID,
 		MultipartUpload: &s3.CompletedMultipartUpload{
-			Parts: completedParts,
+			Parts: parts,
 		},
 	})
 	if err != nil {
@@ -170,12 +511,37 @@ func (client *S3Client) CompleteMultipartUpload(key string, uploadID *string, co
 	return nil
 }
 
+// sortCompletedParts returns a copy of parts sorted by part number, checking
+// that the numbers run from 1 without gaps or duplicates
+func sortCompletedParts(parts []*s3.CompletedPart) ([]*s3.CompletedPart, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no parts to complete")
+	}
+
+	sorted := make([]*s3.CompletedPart, len(parts))
+	copy(sorted, parts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return aws.Int64Value(sorted[i].PartNumber) < aws.Int64Value(sorted[j].PartNumber)
+	})
+
+	for i, part := range sorted {
+		want := int64(i + 1)
+		switch got := aws.Int64Value(part.PartNumber); {
+		case got < want:
+			return nil, fmt.Errorf("duplicate part number %d", got)
+		case got > want:
+			return nil, fmt.Errorf("missing part number %d", want)
+		}
+	}
+	return sorted, nil
+}
+
 // UploadPartWithRetry uploads a single part with retry logic
 func (client *S3Client) UploadPartWithRetry(ctx context.Context, buffer []byte, key string, uploadID *string, partNumber int64, retries int) (*s3.UploadPartOutput, error) {
 	var uploadResp *s3.UploadPartOutput
-	var err error
 
-	for i := 0; i < retries; i++ {
+	err := retry(ctx, retries, func() error {
+		var err error
 		uploadResp, err = client.svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
 			Bucket:     aws.String(client.bucket),
 			Key:        aws.String(key),
@@ -183,13 +549,12 @@ func (client *S3Client) UploadPartWithRetry(ctx context.Context, buffer []byte,
 			UploadId:   uploadID,
 			Body:       bytes.NewReader(buffer),
 		})
-		if err == nil {
-			return uploadResp, nil
-		}
-		fmt.Println("failed to upload part, retrying:", err)
-		time.Sleep(2 * time.Second)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload part %d: %v", partNumber, err)
 	}
-	return nil, err
+	return uploadResp, nil
 }
 
 // AbortMultipartUpload aborts a multipart upload
@@ -204,35 +569,218 @@ func (client *S3Client) AbortMultipartUpload(key, uploadID *string) {
 	}
 }
 
-// DownloadFile downloads a file from S3 to the local filesystem
+// OverwritePolicy decides what DownloadFile does when the destination exists
+type OverwritePolicy int
+
+const (
+	// Overwrite replaces an existing destination (the default)
+	Overwrite OverwritePolicy = iota
+	// Skip leaves an existing destination untouched and returns ErrSkipped
+	Skip
+	// ErrorIfExists fails with ErrDestinationExists
+	ErrorIfExists
+)
+
+var (
+	// ErrSkipped is returned by DownloadFile under Skip when the destination exists
+	ErrSkipped = errors.New("destination exists, download skipped")
+	// ErrDestinationExists is returned by DownloadFile under ErrorIfExists
+	ErrDestinationExists = errors.New("destination already exists")
+)
+
+// SetOverwritePolicy sets what DownloadFile does with an existing destination
+func (client *S3Client) SetOverwritePolicy(policy OverwritePolicy) {
+	client.overwrite = policy
+}
+
+// DownloadFile downloads a file from S3 to the local filesystem. The object
+// is written to filePath + ".part" and renamed into place only once complete,
+// so an interrupted download never looks like a finished one. A leftover
+// .part file is resumed if the object's ETag is unchanged. An existing
+// filePath is handled according to the client's OverwritePolicy.
 func (client *S3Client) DownloadFile(key, filePath string) error {
-	file, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+	return client.DownloadFileWithContext(context.Background(), key, filePath)
+}
+
+// DownloadFileWithContext is DownloadFile with a context that can cancel the
+// download; a cancelled download keeps its .part file for resuming
+func (client *S3Client) DownloadFileWithContext(ctx context.Context, key, filePath string) error {
+	if _, err := os.Stat(filePath); err == nil {
+		switch client.overwrite {
+		case Skip:
+			return ErrSkipped
+		case ErrorIfExists:
+			return fmt.Errorf("%s: %w", filePath, ErrDestinationExists)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat destination: %v", err)
 	}
-	defer file.Close()
 
-	resp, err := client.svc.GetObject(&s3.GetObjectInput{
+	partPath := filePath + ".part"
+	etagPath := partPath + ".etag"
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(client.bucket),
 		Key:    aws.String(key),
-	})
+	}
+
+	// 只有记录了 ETag 的 .part 文件才能续传，且对象必须没有变化
+	var offset int64
+	if etag, err := os.ReadFile(etagPath); err == nil {
+		if info, err := os.Stat(partPath); err == nil && info.Size() > 0 {
+			offset = info.Size()
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+			input.IfMatch = aws.String(string(etag))
+		}
+	}
+
+	resp, err := client.svc.GetObjectWithContext(ctx, input)
+	if err != nil && offset > 0 && ctx.Err() == nil {
+		// 对象已变化或无法续传，从头下载
+		offset = 0
+		input.Range, input.IfMatch = nil, nil
+		resp, err = client.svc.GetObjectWithContext(ctx, input)
+	}
 	if err != nil {
-		return fmt.Errorf("download failed: %v", err)
+		return fmt.Errorf("download failed: %w", err)
 	}
 	defer resp.Body.Close()
 
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flag = os.O_WRONLY | os.O_APPEND
+	} else if err := os.WriteFile(etagPath, []byte(aws.StringValue(resp.ETag)), 0644); err != nil {
+		return fmt.Errorf("failed to record ETag: %v", err)
+	}
+	file, err := os.OpenFile(partPath, flag, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+
 	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return fmt.Errorf("failed to read file content: %v", err)
 	}
+	if err := os.Rename(partPath, filePath); err != nil {
+		return fmt.Errorf("failed to rename file: %v", err)
+	}
+	os.Remove(etagPath)
 
 	fmt.Println("file downloaded successfully:", filePath)
 	return nil
 }
 
+// DownloadIfChanged downloads the object to filePath only if its ETag differs
+// from etag, sending it as If-None-Match. When the object is unchanged it
+// returns changed=false and leaves filePath untouched; otherwise the file is
+// replaced atomically and the object's current ETag is returned. An empty
+// etag always downloads.
+func (client *S3Client) DownloadIfChanged(key, filePath, etag string) (changed bool, newETag string, err error) {
+	return client.DownloadIfChangedWithContext(context.Background(), key, filePath, etag)
+}
+
+// DownloadIfChangedWithContext is DownloadIfChanged with a context that can
+// cancel the download; filePath is left untouched when it is cancelled
+func (client *S3Client) DownloadIfChangedWithContext(ctx context.Context, key, filePath, etag string) (changed bool, newETag string, err error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(client.bucket),
+		Key:    aws.String(key),
+	}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+
+	resp, err := client.svc.GetObjectWithContext(ctx, input)
+	if err != nil {
+		if isNotModified(err) {
+			return false, etag, nil
+		}
+		return false, "", fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return false, "", fmt.Errorf("failed to create file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read file content: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return false, "", fmt.Errorf("failed to replace file: %v", err)
+	}
+
+	return true, aws.StringValue(resp.ETag), nil
+}
+
+// isNotModified reports whether a conditional GET was rejected because the
+// object still matches the given ETag
+func isNotModified(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusNotModified, http.StatusPreconditionFailed:
+			return true
+		}
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "NotModified" || aerr.Code() == "PreconditionFailed"
+	}
+	return false
+}
+
+// ObjectInfo describes an object as returned by a bucket listing
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+}
+
+// ListObjects lists objects whose keys start with prefix, with the metadata
+// the listing already carries. A limit of 0 returns every match.
+func (client *S3Client) ListObjects(prefix string, limit int64) ([]ObjectInfo, error) {
+	return client.ListObjectsWithContext(context.Background(), prefix, limit)
+}
+
+// ListObjectsWithContext is ListObjects with a context that can cancel the listing
+func (client *S3Client) ListObjectsWithContext(ctx context.Context, prefix string, limit int64) ([]ObjectInfo, error) {
+	return client.listObjects(ctx, prefix, limit, nil)
+}
+
 // ListFiles lists files in the S3 bucket with optional filtering and pagination
 func (client *S3Client) ListFiles(filter string, lmit int64) ([]string, error) {
+	return client.ListFilesWithContext(context.Background(), filter, lmit)
+}
+
+// ListFilesWithContext is ListFiles with a context that can cancel the listing
+func (client *S3Client) ListFilesWithContext(ctx context.Context, filter string, lmit int64) ([]string, error) {
+	objects, err := client.listObjects(ctx, "", lmit, func(key string) bool {
+		return filter == "" || strings.Contains(key, filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	var fileList []string
+	for _, object := range objects {
+		fileList = append(fileList, object.Key)
+	}
+	return fileList, nil
+}
+
+// listObjects pages through the objects under prefix, keeping those match
+// accepts (all of them when match is nil) until limit are found
+func (client *S3Client) listObjects(ctx context.Context, prefix string, limit int64, match func(key string) bool) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
 	var continuationToken *string
 
 	for {
@@ -240,18 +788,29 @@ func (client *S3Client) ListFiles(filter string, lmit int64) ([]string, error) {
 			Bucket:            aws.String(client.bucket),
 			ContinuationToken: continuationToken,
 		}
+		if prefix != "" {
+			input.Prefix = aws.String(prefix)
+		}
 
-		resp, err := client.svc.ListObjectsV2(input)
+		resp, err := client.svc.ListObjectsV2WithContext(ctx, input)
 		if err != nil {
-			return nil, fmt.Errorf("failed to list files: %v", err)
+			return nil, fmt.Errorf("failed to list files: %w", err)
 		}
 
 		for _, item := range resp.Contents {
-			if filter == "" || strings.Contains(*item.Key, filter) {
-				fileList = append(fileList, *item.Key)
-				if len(fileList) >= int(lmit) && lmit != 0 {
-					return fileList, nil
-				}
+			key := aws.StringValue(item.Key)
+			if match != nil && !match(key) {
+				continue
+			}
+			objects = append(objects, ObjectInfo{
+				Key:          key,
+				Size:         aws.Int64Value(item.Size),
+				LastModified: aws.TimeValue(item.LastModified),
+				ETag:         aws.StringValue(item.ETag),
+				StorageClass: aws.StringValue(item.StorageClass),
+			})
+			if limit != 0 && int64(len(objects)) >= limit {
+				return objects, nil
 			}
 		}
 
@@ -262,12 +821,17 @@ func (client *S3Client) ListFiles(filter string, lmit int64) ([]string, error) {
 		continuationToken = resp.NextContinuationToken
 	}
 
-	return fileList, nil
+	return objects, nil
 }
 
 // DeleteFile deletes a file from the S3 bucket
 func (client *S3Client) DeleteFile(key string) error {
-	_, err := client.svc.DeleteObject(&s3.DeleteObjectInput{
+	return client.DeleteFileWithContext(context.Background(), key)
+}
+
+// DeleteFileWithContext is DeleteFile with a context for cancellation and deadlines
+func (client *S3Client) DeleteFileWithContext(ctx context.Context, key string) error {
+	_, err := client.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(client.bucket),
 		Key:    aws.String(key),
 	})
@@ -281,12 +845,17 @@ func (client *S3Client) DeleteFile(key string) error {
 
 // GetFileInfo retrieves information about a file in the S3 bucket
 func (client *S3Client) GetFileInfo(key string) (*s3.HeadObjectOutput, error) {
-	resp, err := client.svc.HeadObject(&s3.HeadObjectInput{
+	return client.GetFileInfoWithContext(context.Background(), key)
+}
+
+// GetFileInfoWithContext is GetFileInfo with a context for cancellation and deadlines
+func (client *S3Client) GetFileInfoWithContext(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	resp, err := client.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(client.bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get file info: %v", err)
+		return nil, fmt.Errorf("failed to get file info: %w", err)
 	}
 	return resp, nil
 }
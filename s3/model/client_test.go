@@ -0,0 +1,942 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 内存中的 S3 实现，只支持测试用到的接口
+type fakeS3 struct {
+	s3iface.S3API
+	mu      sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string // 分段上传对象的组合 ETag
+	ranges  []string          // GetObject 收到的 Range
+	uploads map[string]map[int64][]byte
+	keys    map[string]string // 分段上传 ID 对应的对象键
+	nextID  int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, etags: map[string]string{}, uploads: map[string]map[int64][]byte{}, keys: map[string]string{}}
+}
+
+func etagOf(data []byte) *string {
+	return aws.String(fmt.Sprintf("\"%x\"", md5.Sum(data)))
+}
+
+func notFound() error {
+	return awserr.NewRequestFailure(awserr.New("NotFound", "not found", nil), 404, "req")
+}
+
+func (f *fakeS3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[aws.StringValue(in.Key)]
+	if !ok {
+		return nil, notFound()
+	}
+	etag := etagOf(data)
+	if composite, ok := f.etags[aws.StringValue(in.Key)]; ok {
+		etag = aws.String(composite)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data))), ETag: etag}, nil
+}
+
+func (f *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[aws.StringValue(in.Key)]
+	if !ok {
+		return nil, notFound()
+	}
+	if in.IfNoneMatch != nil && aws.StringValue(in.IfNoneMatch) == aws.StringValue(etagOf(data)) {
+		return nil, awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), 304, "req")
+	}
+	if in.IfMatch != nil && aws.StringValue(in.IfMatch) != aws.StringValue(etagOf(data)) {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "Precondition Failed", nil), 412, "req")
+	}
+	f.ranges = append(f.ranges, aws.StringValue(in.Range))
+	if in.Range != nil {
+		var start int
+		fmt.Sscanf(aws.StringValue(in.Range), "bytes=%d-", &start)
+		data = data[start:]
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		ETag:          etagOf(data),
+	}, nil
+}
+
+func (f *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[aws.StringValue(in.Key)] = data
+	delete(f.etags, aws.StringValue(in.Key))
+	return &s3.PutObjectOutput{ETag: etagOf(data)}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(in *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = map[int64][]byte{}
+	f.keys[id] = aws.StringValue(in.Key)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) ListMultipartUploads(in *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.ListMultipartUploadsOutput{IsTruncated: aws.Bool(false)}
+	for id := range f.uploads {
+		key := f.keys[id]
+		if !strings.HasPrefix(key, aws.StringValue(in.Prefix)) {
+			continue
+		}
+		var n int64
+		fmt.Sscanf(id, "upload-%d", &n)
+		out.Uploads = append(out.Uploads, &s3.MultipartUpload{Key: aws.String(key), UploadId: aws.String(id), Initiated: aws.Time(time.Unix(n, 0))})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) ListParts(in *s3.ListPartsInput) (*s3.ListPartsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.StringValue(in.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	out := &s3.ListPartsOutput{IsTruncated: aws.Bool(false)}
+	for number, data := range parts {
+		out.Parts = append(out.Parts, &s3.Part{PartNumber: aws.Int64(number), ETag: etagOf(data), Size: aws.Int64(int64(len(data)))})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.StringValue(in.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	parts[aws.Int64Value(in.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: etagOf(data)}, nil
+}
+
+func (f *fakeS3) UploadPartCopy(in *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	source := strings.TrimPrefix(strings.ReplaceAll(aws.StringValue(in.CopySource), "%2F", "/"), "test/")
+	data, ok := f.objects[source]
+	if !ok {
+		return nil, notFound()
+	}
+	parts, ok := f.uploads[aws.StringValue(in.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	parts[aws.Int64Value(in.PartNumber)] = append([]byte(nil), data...)
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: etagOf(data)}}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(in *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.StringValue(in.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+	completed := in.MultipartUpload.Parts
+	if !sort.SliceIsSorted(completed, func(i, j int) bool {
+		return aws.Int64Value(completed[i].PartNumber) < aws.Int64Value(completed[j].PartNumber)
+	}) {
+		return nil, awserr.New("InvalidPartOrder", "parts not in ascending order", nil)
+	}
+	var content []byte
+	for i, part := range completed {
+		data, ok := parts[aws.Int64Value(part.PartNumber)]
+		if !ok {
+			return nil, awserr.New("InvalidPart", "missing part", nil)
+		}
+		if i < len(completed)-1 && len(data) < minPartSize {
+			return nil, awserr.New("EntityTooSmall", "part too small", nil)
+		}
+		content = append(content, data...)
+	}
+	etag := fmt.Sprintf("\"%x-%d\"", md5.Sum(content), len(completed))
+	f.objects[aws.StringValue(in.Key)] = content
+	f.etags[aws.StringValue(in.Key)] = etag
+	delete(f.uploads, aws.StringValue(in.UploadId))
+	delete(f.keys, aws.StringValue(in.UploadId))
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(etag)}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(in *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, aws.StringValue(in.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.HeadObject(in)
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, in *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.GetObject(in)
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.CreateMultipartUpload(in)
+}
+
+func (f *fakeS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.CompleteMultipartUpload(in)
+}
+
+func (f *fakeS3) ListMultipartUploadsWithContext(ctx aws.Context, in *s3.ListMultipartUploadsInput, opts ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.ListMultipartUploads(in)
+}
+
+func (f *fakeS3) ListPartsWithContext(ctx aws.Context, in *s3.ListPartsInput, opts ...request.Option) (*s3.ListPartsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.ListParts(in)
+}
+
+func (f *fakeS3) UploadPartCopyWithContext(ctx aws.Context, in *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.UploadPartCopy(in)
+}
+
+// ListObjectsV2WithContext 按键排序分页返回对象，每页最多 2 个，以便覆盖翻页
+func (f *fakeS3) ListObjectsV2WithContext(ctx aws.Context, in *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(in.Prefix)) && key > aws.StringValue(in.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(keys) > 2)}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		out.NextContinuationToken = aws.String(keys[1])
+	}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(f.objects[key]))),
+			LastModified: aws.Time(time.Unix(1700000000, 0)),
+			ETag:         etagOf(f.objects[key]),
+			StorageClass: aws.String(s3.ObjectStorageClassStandard),
+		})
+	}
+	return out, nil
+}
+
+// stubUploader 前 failures 次调用返回临时错误，之后记录上传内容
+type stubUploader struct {
+	failures    int
+	calls       int
+	key         string
+	body        []byte
+	concurrency int // 应用 opts 后的并发数
+}
+
+func (u *stubUploader) Upload(input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	u.calls++
+	cfg := &s3manager.Uploader{Concurrency: uploaderConcurrency, PartSize: uploaderPartSize}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	u.concurrency = cfg.Concurrency
+	if u.calls <= u.failures {
+		// 模拟上传中途失败，Body 已被读走一部分
+		io.CopyN(io.Discard, input.Body, 4)
+		return nil, awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "req")
+	}
+	body, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	u.key = aws.StringValue(input.Key)
+	u.body = body
+	return &s3manager.UploadOutput{}, nil
+}
+
+func (u *stubUploader) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return u.Upload(input, opts...)
+}
+
+// TestSimpleUploadFileRetry 测试临时失败后重试并上传完整内容
+func TestSimpleUploadFileRetry(t *testing.T) {
+	oldDelay := retryDelay
+	retryDelay = 0
+	t.Cleanup(func() { retryDelay = oldDelay })
+	uploader := &stubUploader{failures: 1}
+	client := &S3Client{uploader: uploader, bucket: "test"}
+
+	content := []byte("This is a test file content")
+	filePath := filepath.Join(t.TempDir(), "retry.txt")
+	assert.NoError(t, os.WriteFile(filePath, content, 0644))
+
+	err := client.SimpleUploadFile(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, uploader.calls)
+	assert.Equal(t, "retry.txt", uploader.key)
+	assert.Equal(t, content, uploader.body)
+}
+
+// TestAppendToObject 测试追加到已有对象后内容为两者拼接
+func TestAppendToObject(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), minPartSize+10)
+	cases := map[string][]byte{
+		"small.log": []byte("existing line\n"),
+		"large.log": large,
+	}
+	for key, existing := range cases {
+		fake := newFakeS3()
+		fake.objects[key] = existing
+		client := &S3Client{svc: fake, bucket: "test"}
+
+		err := client.AppendToObject(key, strings.NewReader("appended line\n"))
+		assert.NoError(t, err, key)
+		assert.Equal(t, append(append([]byte(nil), existing...), "appended line\n"...), fake.objects[key], key)
+		assert.Empty(t, fake.uploads, key)
+	}
+}
+
+// TestAppendToMissingObject 测试追加到不存在的对象时直接创建
+func TestAppendToMissingObject(t *testing.T) {
+	fake := newFakeS3()
+	client := &S3Client{svc: fake, bucket: "test"}
+
+	err := client.AppendToObject("new.log", strings.NewReader("first line\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first line\n"), fake.objects["new.log"])
+}
+
+// TestClose 测试 Close 可以重复调用
+func TestClose(t *testing.T) {
+	client, err := NewS3Client("key", "secret", "us-east-1", "http://127.0.0.1:9000", "test")
+	assert.NoError(t, err)
+	assert.NoError(t, client.Close())
+	assert.NoError(t, client.Close())
+
+	// 未通过 NewS3Client 创建的客户端同样可以关闭
+	assert.NoError(t, (&S3Client{}).Close())
+}
+
+// TestClientOptions 测试会话令牌、HTTP 客户端和 DisableSSL 选项传给 AWS 配置，未设置时保持默认行为
+func TestClientOptions(t *testing.T) {
+	httpClient := &http.Client{}
+	client, err := NewS3Client("key", "secret", "us-east-1", "127.0.0.1:9000", "test",
+		WithSessionToken("token"), WithHTTPClient(httpClient), WithDisableSSL())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	cfg := client.svc.(*s3.S3).Config
+	creds, err := cfg.Credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "key", creds.AccessKeyID)
+	assert.Equal(t, "token", creds.SessionToken)
+	assert.True(t, aws.BoolValue(cfg.DisableSSL))
+	assert.Same(t, httpClient, cfg.HTTPClient)
+	assert.Same(t, httpClient, client.httpClient)
+
+	client, err = NewS3Client("key", "secret", "us-east-1", "http://127.0.0.1:9000", "test")
+	assert.NoError(t, err)
+	defer client.Close()
+	cfg = client.svc.(*s3.S3).Config
+	creds, err = cfg.Credentials.Get()
+	assert.NoError(t, err)
+	assert.Empty(t, creds.SessionToken)
+	assert.False(t, aws.BoolValue(cfg.DisableSSL))
+	assert.True(t, aws.BoolValue(cfg.S3ForcePathStyle))
+
+	// 跳过证书校验时使用独立的传输层，不修改默认传输层
+	client, err = NewS3Client("key", "secret", "us-east-1", "https://127.0.0.1:9000", "test", WithInsecureSkipVerify())
+	assert.NoError(t, err)
+	defer client.Close()
+	transport := client.httpClient.Transport.(*http.Transport)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+	assert.NotSame(t, http.DefaultTransport, client.httpClient.Transport)
+	// Clone 会为默认传输层配置 HTTP/2，TLSClientConfig 可能不为空，但不能跳过校验
+	if tlsConfig := http.DefaultTransport.(*http.Transport).TLSClientConfig; tlsConfig != nil {
+		assert.False(t, tlsConfig.InsecureSkipVerify)
+	}
+}
+
+// TestEffectivePartSize 测试分片大小自动调整
+func TestEffectivePartSize(t *testing.T) {
+	const size = 200 * 1024 * 1024 * 1024 // 200GB
+	for _, requested := range []int64{0, 1024, minPartSize} {
+		partSize := effectivePartSize(size, requested)
+		parts := (size + partSize - 1) / partSize
+		assert.LessOrEqual(t, parts, int64(maxUploadParts), requested)
+		assert.GreaterOrEqual(t, partSize, int64(minPartSize), requested)
+	}
+
+	// 合理的分片大小保持不变
+	assert.Equal(t, int64(64*1024*1024), effectivePartSize(size, 64*1024*1024))
+	// 小文件使用最小分片大小
+	assert.Equal(t, int64(minPartSize), effectivePartSize(1024, 0))
+}
+
+// completedPart 构造测试用的已完成分片
+func completedPart(partNumber int64, etag *string) *s3.CompletedPart {
+	return &s3.CompletedPart{ETag: etag, PartNumber: aws.Int64(partNumber)}
+}
+
+// TestCompleteMultipartUploadOrder 测试乱序的分片在完成上传前按编号排序
+func TestCompleteMultipartUploadOrder(t *testing.T) {
+	fake := newFakeS3()
+	client := &S3Client{svc: fake, bucket: "test"}
+
+	uploadID, err := client.InitMultipartUpload("out-of-order")
+	assert.NoError(t, err)
+	bodies := [][]byte{
+		bytes.Repeat([]byte("1"), minPartSize),
+		bytes.Repeat([]byte("2"), minPartSize),
+		[]byte("3"),
+	}
+	var parts []*s3.CompletedPart
+	for i, body := range bodies {
+		resp, err := client.UploadPartWithRetry(context.Background(), body, "out-of-order", uploadID, int64(i+1), 1)
+		assert.NoError(t, err)
+		parts = append(parts, completedPart(int64(i+1), resp.ETag))
+	}
+
+	shuffled := []*s3.CompletedPart{parts[2], parts[0], parts[1]}
+	err = client.CompleteMultipartUpload("out-of-order", uploadID, shuffled)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Join(bodies, nil), fake.objects["out-of-order"])
+
+	// 调用方传入的切片保持不变
+	assert.Equal(t, int64(3), aws.Int64Value(shuffled[0].PartNumber))
+}
+
+// TestSortCompletedPartsInvalid 测试分片编号有空缺或重复时拒绝完成上传
+func TestSortCompletedPartsInvalid(t *testing.T) {
+	cases := map[string][]*s3.CompletedPart{
+		"empty":      nil,
+		"gap":        {completedPart(1, nil), completedPart(3, nil)},
+		"duplicate":  {completedPart(2, nil), completedPart(1, nil), completedPart(1, nil)},
+		"not from 1": {completedPart(2, nil), completedPart(3, nil)},
+	}
+	for name, parts := range cases {
+		_, err := sortCompletedParts(parts)
+		assert.Error(t, err, name)
+	}
+
+	sorted, err := sortCompletedParts([]*s3.CompletedPart{completedPart(2, nil), completedPart(1, nil)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), aws.Int64Value(sorted[0].PartNumber))
+	assert.Equal(t, int64(2), aws.Int64Value(sorted[1].PartNumber))
+}
+
+// TestDownloadIfChanged 测试 ETag 一致时不下载，不一致时下载并返回新的 ETag
+func TestDownloadIfChanged(t *testing.T) {
+	fake := newFakeS3()
+	fake.objects["sync.txt"] = []byte("v1")
+	client := &S3Client{svc: fake, bucket: "test"}
+	filePath := filepath.Join(t.TempDir(), "sync.txt")
+
+	// 本地没有 ETag 时总是下载
+	changed, etag, err := client.DownloadIfChanged("sync.txt", filePath, "")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, aws.StringValue(etagOf([]byte("v1"))), etag)
+
+	// ETag 一致时不重写本地文件
+	assert.NoError(t, os.WriteFile(filePath, []byte("local edit"), 0644))
+	changed, sameETag, err := client.DownloadIfChanged("sync.txt", filePath, etag)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, etag, sameETag)
+	data, _ := os.ReadFile(filePath)
+	assert.Equal(t, "local edit", string(data))
+
+	// 对象变化后重新下载
+	fake.objects["sync.txt"] = []byte("v2")
+	changed, newETag, err := client.DownloadIfChanged("sync.txt", filePath, etag)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NotEqual(t, etag, newETag)
+	data, _ = os.ReadFile(filePath)
+	assert.Equal(t, "v2", string(data))
+}
+
+// TestPlanKeysCollision 测试大小写不敏感的规范化下不同文件映射到同一个键时报错
+func TestPlanKeysCollision(t *testing.T) {
+	dir := t.TempDir()
+	upper := filepath.Join(dir, "File.TXT")
+	lower := filepath.Join(dir, "sub", "file.txt")
+
+	client := &S3Client{}
+	keys, err := client.PlanKeys([]string{upper, lower})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"File.TXT": upper, "file.txt": lower}, keys)
+
+	client.SetKeyNormalizer(LowercaseKeys)
+	_, err = client.PlanKeys([]string{upper, lower})
+	assert.ErrorContains(t, err, "file.txt")
+
+	// 同一个文件重复出现不算冲突
+	_, err = client.PlanKeys([]string{lower, lower})
+	assert.NoError(t, err)
+
+	client.SetKeyNormalizer(ReplaceKeys(strings.NewReplacer(" ", "_")))
+	assert.Equal(t, "a_b.txt", client.objectKey(filepath.Join(dir, "a b.txt")))
+}
+
+// TestUploadFilesCollision 测试冲突时不上传任何文件
+func TestUploadFilesCollision(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"File.TXT", "file.txt"} {
+		sub := filepath.Join(dir, name+".d")
+		assert.NoError(t, os.MkdirAll(sub, 0755))
+		path := filepath.Join(sub, name)
+		assert.NoError(t, os.WriteFile(path, []byte(name), 0644))
+		paths = append(paths, path)
+	}
+
+	uploader := &stubUploader{}
+	client := &S3Client{svc: newFakeS3(), uploader: uploader, bucket: "test"}
+	client.SetKeyNormalizer(LowercaseKeys)
+
+	err := client.UploadFiles(paths, 0)
+	assert.Error(t, err)
+	assert.Equal(t, 0, uploader.calls)
+}
+
+// TestObjectChecksum 测试单段对象的 ETag 解释为 MD5，分段对象的 ETag 标记为组合值
+func TestObjectChecksum(t *testing.T) {
+	fake := newFakeS3()
+	client := &S3Client{svc: fake, bucket: "test"}
+
+	content := []byte("single part")
+	_, err := fake.PutObject(&s3.PutObjectInput{Key: aws.String("single.txt"), Body: bytes.NewReader(content)})
+	assert.NoError(t, err)
+	algo, value, err := client.ObjectChecksum("single.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, ChecksumMD5, algo)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(content)), value)
+
+	upload, err := fake.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Key: aws.String("multi.bin")})
+	assert.NoError(t, err)
+	var parts []*s3.CompletedPart
+	for i, data := range [][]byte{bytes.Repeat([]byte("a"), minPartSize), []byte("tail")} {
+		out, err := fake.UploadPartWithContext(context.Background(), &s3.UploadPartInput{
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int64(int64(i + 1)),
+			Body:       bytes.NewReader(data),
+		})
+		assert.NoError(t, err)
+		parts = append(parts, completedPart(int64(i+1), out.ETag))
+	}
+	_, err = fake.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Key:             aws.String("multi.bin"),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	assert.NoError(t, err)
+	algo, value, err = client.ObjectChecksum("multi.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, ChecksumCompositeETag, algo)
+	assert.True(t, strings.HasSuffix(value, "-2"))
+
+	// 有 x-amz-checksum-sha256 时优先使用，并转换为十六进制
+	sum := sha256.Sum256(content)
+	algo, value, err = interpretChecksum(&s3.HeadObjectOutput{
+		ETag:           aws.String(`"abc"`),
+		ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ChecksumSHA256, algo)
+	assert.Equal(t, fmt.Sprintf("%x", sum), value)
+}
+
+// TestDownloadFileOverwritePolicy 测试目标文件已存在时各覆盖策略的行为
+func TestDownloadFileOverwritePolicy(t *testing.T) {
+	fake := newFakeS3()
+	fake.objects["obj.txt"] = []byte("remote")
+	client := &S3Client{svc: fake, bucket: "test"}
+
+	for _, tc := range []struct {
+		policy OverwritePolicy
+		err    error
+		want   string
+	}{
+		{Overwrite, nil, "remote"},
+		{Skip, ErrSkipped, "local"},
+		{ErrorIfExists, ErrDestinationExists, "local"},
+	} {
+		filePath := filepath.Join(t.TempDir(), "obj.txt")
+		assert.NoError(t, os.WriteFile(filePath, []byte("local"), 0644))
+
+		client.SetOverwritePolicy(tc.policy)
+		err := client.DownloadFile("obj.txt", filePath)
+		if tc.err == nil {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, tc.err)
+		}
+		data, _ := os.ReadFile(filePath)
+		assert.Equal(t, tc.want, string(data))
+		_, err = os.Stat(filePath + ".part")
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+// TestDownloadFileResume 测试未完成的 .part 文件在对象未变化时续传，变化后从头下载
+func TestDownloadFileResume(t *testing.T) {
+	fake := newFakeS3()
+	fake.objects["obj.txt"] = []byte("0123456789")
+	client := &S3Client{svc: fake, bucket: "test", overwrite: Skip}
+
+	// 中断的下载不会被当作已完成的文件跳过
+	filePath := filepath.Join(t.TempDir(), "obj.txt")
+	assert.NoError(t, os.WriteFile(filePath+".part", []byte("01234"), 0644))
+	assert.NoError(t, os.WriteFile(filePath+".part.etag", []byte(aws.StringValue(etagOf(fake.objects["obj.txt"]))), 0644))
+	assert.NoError(t, client.DownloadFile("obj.txt", filePath))
+	data, _ := os.ReadFile(filePath)
+	assert.Equal(t, "0123456789", string(data))
+	assert.Equal(t, []string{"bytes=5-"}, fake.ranges)
+	_, err := os.Stat(filePath + ".part.etag")
+	assert.True(t, os.IsNotExist(err))
+
+	// 记录的 ETag 与对象不一致时丢弃 .part 重新下载
+	fake.ranges = nil
+	filePath = filepath.Join(t.TempDir(), "obj.txt")
+	assert.NoError(t, os.WriteFile(filePath+".part", []byte("stale"), 0644))
+	assert.NoError(t, os.WriteFile(filePath+".part.etag", []byte(`"old"`), 0644))
+	assert.NoError(t, client.DownloadFile("obj.txt", filePath))
+	data, _ = os.ReadFile(filePath)
+	assert.Equal(t, "0123456789", string(data))
+	assert.Equal(t, []string{""}, fake.ranges)
+}
+
+// slowS3 上传分段时稍作停顿，记录同时进行的分段上传数的峰值
+type slowS3 struct {
+	*fakeS3
+	inflight int32
+	peak     int32
+}
+
+func (f *slowS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	n := atomic.AddInt32(&f.inflight, 1)
+	defer atomic.AddInt32(&f.inflight, -1)
+	for {
+		peak := atomic.LoadInt32(&f.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&f.peak, peak, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return f.fakeS3.UploadPartWithContext(ctx, in, opts...)
+}
+
+// TestMemoryBudget 测试内存预算限制并发上传数，且分段缓冲区在上传之间复用
+func TestMemoryBudget(t *testing.T) {
+	client := &S3Client{}
+	assert.Equal(t, 4, client.effectiveConcurrency(4, minPartSize))
+	client.SetMemoryBudget(2*minPartSize + 1)
+	assert.Equal(t, 2, client.effectiveConcurrency(4, minPartSize))
+	assert.Equal(t, 1, client.effectiveConcurrency(4, 100*minPartSize))
+	assert.Equal(t, 1, client.effectiveConcurrency(1, 1))
+
+	dir := t.TempDir()
+	var paths []string
+	content := bytes.Repeat([]byte("x"), minPartSize+1)
+	for i := 0; i < 6; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%d.bin", i))
+		assert.NoError(t, os.WriteFile(path, content, 0644))
+		paths = append(paths, path)
+	}
+
+	svc := &slowS3{fakeS3: newFakeS3()}
+	uploader := &stubUploader{}
+	client = &S3Client{svc: svc, uploader: uploader, bucket: "test"}
+	client.SetMemoryBudget(2*minPartSize + 1)
+
+	allocs := atomic.LoadInt64(&partBufferAllocs)
+	assert.NoError(t, client.UploadFiles(paths, minPartSize))
+	assert.Equal(t, int32(2), svc.peak)
+	for _, path := range paths {
+		assert.Equal(t, content, svc.objects[filepath.Base(path)])
+	}
+	// 6 个文件最多同时占用 2 个缓冲区，其余上传复用已归还的缓冲区
+	assert.Less(t, atomic.LoadInt64(&partBufferAllocs)-allocs, int64(len(paths)))
+
+	// 简单上传路径的并发数同样受预算限制
+	small := filepath.Join(dir, "small.txt")
+	assert.NoError(t, os.WriteFile(small, []byte("small"), 0644))
+	assert.NoError(t, client.SimpleUploadFile(small))
+	assert.Equal(t, 2, uploader.concurrency)
+}
+
+// interruptedS3 上传到 failPart 时失败，模拟中断的上传，记录上传过的分段号
+type interruptedS3 struct {
+	*fakeS3
+	failPart int64
+	uploaded []int64
+}
+
+func (f *interruptedS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if aws.Int64Value(in.PartNumber) == f.failPart {
+		return nil, awserr.New("RequestCanceled", "connection lost", nil)
+	}
+	f.uploaded = append(f.uploaded, aws.Int64Value(in.PartNumber))
+	return f.fakeS3.UploadPartWithContext(ctx, in, opts...)
+}
+
+// TestResumableUploadFile 测试大文件上传中断后重新运行只上传缺失的分段
+func TestResumableUploadFile(t *testing.T) {
+	content := make([]byte, 3*minPartSize+10)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	path := filepath.Join(t.TempDir(), "large.bin")
+	assert.NoError(t, os.WriteFile(path, content, 0644))
+
+	svc := &interruptedS3{fakeS3: newFakeS3(), failPart: 3}
+	client := &S3Client{svc: svc, bucket: "test"}
+	client.SetResumeThreshold(minPartSize)
+
+	// 第一次上传在第 3 个分段中断，已上传的分段保留在服务器上
+	assert.Error(t, client.UploadFile(path, minPartSize))
+	assert.Equal(t, []int64{1, 2}, svc.uploaded)
+	assert.Len(t, svc.uploads, 1)
+	assert.NotContains(t, svc.objects, "large.bin")
+
+	// 重新运行只上传缺失的分段
+	svc.failPart = 0
+	svc.uploaded = nil
+	assert.NoError(t, client.UploadFile(path, minPartSize))
+	assert.Equal(t, []int64{3, 4}, svc.uploaded)
+	assert.Equal(t, content, svc.objects["large.bin"])
+	assert.Empty(t, svc.uploads)
+
+	// 本地文件变化后，内容不一致的分段重新上传
+	svc.failPart = 2
+	svc.uploaded = nil
+	assert.Error(t, client.UploadFile(path, minPartSize))
+	content[0]++
+	assert.NoError(t, os.WriteFile(path, content, 0644))
+	svc.failPart = 0
+	svc.uploaded = nil
+	assert.NoError(t, client.UploadFile(path, minPartSize))
+	assert.Equal(t, []int64{1, 2, 3, 4}, svc.uploaded)
+	assert.Equal(t, content, svc.objects["large.bin"])
+}
+
+// TestResumeThreshold 测试只有超过阈值的文件使用可续传的上传
+func TestResumeThreshold(t *testing.T) {
+	client := &S3Client{}
+	assert.False(t, client.resumable(defaultResumeThreshold))
+	assert.True(t, client.resumable(defaultResumeThreshold+1))
+	client.SetResumeThreshold(-1)
+	assert.False(t, client.resumable(defaultResumeThreshold+1))
+}
+
+// TestContextCanceled 测试取消的 context 使上传和下载失败，且不留下对象或文件
+func TestContextCanceled(t *testing.T) {
+	fake := newFakeS3()
+	fake.objects["obj.txt"] = []byte("0123456789")
+	client := &S3Client{svc: fake, bucket: "test"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	filePath := filepath.Join(t.TempDir(), "obj.txt")
+	err := client.DownloadFileWithContext(ctx, "obj.txt", filePath)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, statErr := os.Stat(filePath)
+	assert.True(t, os.IsNotExist(statErr))
+
+	err = client.UploadReaderWithContext(ctx, "new.txt", strings.NewReader("hello"), minPartSize)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, ok := fake.objects["new.txt"]
+	assert.False(t, ok)
+
+	_, err = client.GetFileInfoWithContext(ctx, "obj.txt")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, _, err = client.ObjectChecksumWithContext(ctx, "obj.txt")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, _, err = client.DownloadIfChangedWithContext(ctx, "obj.txt", filePath, "")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, statErr = os.Stat(filePath)
+	assert.True(t, os.IsNotExist(statErr))
+
+	err = client.AppendToObjectWithContext(ctx, "obj.txt", strings.NewReader("more"))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []byte("0123456789"), fake.objects["obj.txt"])
+
+	// 大文件走可续传上传，取消时不创建对象
+	client.SetResumeThreshold(1)
+	largePath := filepath.Join(t.TempDir(), "large.bin")
+	assert.NoError(t, os.WriteFile(largePath, make([]byte, minPartSize+1), 0644))
+	err = client.UploadFilesWithContext(ctx, []string{largePath}, minPartSize)
+	assert.ErrorIs(t, err, context.Canceled)
+	err = client.UploadFileWithContext(ctx, largePath, minPartSize)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, ok = fake.objects["large.bin"]
+	assert.False(t, ok)
+}
+
+// TestRetryContext 测试重试等待期间 ctx 取消时立即返回，不再等待退避时间
+func TestRetryContext(t *testing.T) {
+	oldDelay := retryDelay
+	retryDelay = time.Hour
+	t.Cleanup(func() { retryDelay = oldDelay })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	err := retry(ctx, 3, func() error {
+		calls++
+		cancel()
+		return awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "req")
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, calls)
+}
+
+// TestPartConcurrency 测试分段并行上传，并发数受内存预算限制，完成时分段按序号排列
+func TestPartConcurrency(t *testing.T) {
+	content := make([]byte, 6*minPartSize+10)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	svc := &slowS3{fakeS3: newFakeS3()}
+	client := &S3Client{svc: svc, bucket: "test"}
+	client.SetPartConcurrency(3)
+	assert.NoError(t, client.UploadReader("large.bin", bytes.NewReader(content), minPartSize))
+	assert.Equal(t, int32(3), svc.peak)
+	assert.Equal(t, content, svc.objects["large.bin"])
+
+	svc = &slowS3{fakeS3: newFakeS3()}
+	client = &S3Client{svc: svc, bucket: "test"}
+	client.SetPartConcurrency(3)
+	client.SetMemoryBudget(2 * minPartSize)
+	uploadID, err := client.InitMultipartUpload("large.bin")
+	assert.NoError(t, err)
+	parts, err := client.UploadParts(bytes.NewReader(content), "large.bin", uploadID, minPartSize)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), svc.peak)
+	assert.Len(t, parts, 7)
+	for i, part := range parts {
+		assert.Equal(t, int64(i+1), aws.Int64Value(part.PartNumber))
+	}
+}
+
+// TestPresign 测试预签名的下载和上传地址指向对象并带有过期时间
+func TestPresign(t *testing.T) {
+	client, err := NewS3Client("key", "secret", "us-east-1", "http://127.0.0.1:9000", "test")
+	assert.NoError(t, err)
+
+	getURL, err := client.PresignGet("dir/obj.txt", 15*time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(getURL, "http://127.0.0.1:9000/test/dir/obj.txt?"))
+	assert.Contains(t, getURL, "X-Amz-Expires=900")
+	assert.Contains(t, getURL, "X-Amz-Signature=")
+
+	putURL, err := client.PresignPut("dir/obj.txt", time.Hour)
+	assert.NoError(t, err)
+	assert.Contains(t, putURL, "X-Amz-Expires=3600")
+	assert.NotEqual(t, getURL, putURL)
+
+	_, err = client.PresignGet("obj.txt", 0)
+	assert.Error(t, err)
+	_, err = client.PresignGet("obj.txt", 8*24*time.Hour)
+	assert.Error(t, err)
+}
+
+// TestListObjects 测试按前缀列出对象及其元数据，ListFiles 仍按子串过滤
+func TestListObjects(t *testing.T) {
+	fake := newFakeS3()
+	fake.objects["logs/a.txt"] = []byte("a")
+	fake.objects["logs/b.txt"] = []byte("bb")
+	fake.objects["logs/c.txt"] = []byte("ccc")
+	fake.objects["data/logs.txt"] = []byte("dddd")
+	client := &S3Client{svc: fake, bucket: "test"}
+
+	objects, err := client.ListObjects("logs/", 0)
+	assert.NoError(t, err)
+	assert.Len(t, objects, 3)
+	assert.Equal(t, ObjectInfo{
+		Key:          "logs/c.txt",
+		Size:         3,
+		LastModified: time.Unix(1700000000, 0),
+		ETag:         aws.StringValue(etagOf([]byte("ccc"))),
+		StorageClass: s3.ObjectStorageClassStandard,
+	}, objects[2])
+
+	objects, err = client.ListObjects("logs/", 2)
+	assert.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	files, err := client.ListFiles("logs", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data/logs.txt", "logs/a.txt", "logs/b.txt", "logs/c.txt"}, files)
+}
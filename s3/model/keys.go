@@ -0,0 +1,95 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"jiaoben-/util/pool"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// KeyNormalizer maps the base name of a local file to its object key
+type KeyNormalizer func(name string) string
+
+// LowercaseKeys folds keys to lower case, for sources on case-insensitive
+// filesystems where File.TXT and file.txt name the same thing
+func LowercaseKeys(name string) string {
+	return strings.ToLower(name)
+}
+
+// ReplaceKeys returns a normalizer that applies r to every key
+func ReplaceKeys(r *strings.Replacer) KeyNormalizer {
+	return r.Replace
+}
+
+// SetKeyNormalizer sets how local file names are turned into object keys by
+// the file upload methods. nil keeps the base name unchanged.
+func (client *S3Client) SetKeyNormalizer(fn KeyNormalizer) {
+	client.normalizeKey = fn
+}
+
+// objectKey returns the object key for a local file
+func (client *S3Client) objectKey(filePath string) string {
+	key := filepath.Base(filePath)
+	if client.normalizeKey != nil {
+		key = client.normalizeKey(key)
+	}
+	return key
+}
+
+// PlanKeys computes the object key of every file and returns them keyed by
+// object key. It fails if two distinct files map to the same key, which would
+// otherwise make the later upload silently overwrite the earlier one.
+func (client *S3Client) PlanKeys(filePaths []string) (map[string]string, error) {
+	keys := make(map[string]string, len(filePaths))
+	for _, filePath := range filePaths {
+		key := client.objectKey(filePath)
+		if other, ok := keys[key]; ok && filepath.Clean(other) != filepath.Clean(filePath) {
+			return nil, fmt.Errorf("key collision: %s and %s both map to %q", other, filePath, key)
+		}
+		keys[key] = filePath
+	}
+	return keys, nil
+}
+
+// uploadConcurrency is how many files UploadFiles uploads at once
+const uploadConcurrency = 4
+
+// UploadFiles uploads every file with UploadFile after checking that no two
+// of them map to the same object key. Nothing is uploaded on a collision.
+// Files are uploaded concurrently, fewer at a time when the memory budget
+// cannot hold a part buffer for each; the first failure stops further uploads
+// from starting and is returned.
+func (client *S3Client) UploadFiles(filePaths []string, partSize int64) error {
+	return client.UploadFilesWithContext(context.Background(), filePaths, partSize)
+}
+
+// UploadFilesWithContext is UploadFiles with a context that cancels the
+// uploads in progress and keeps the remaining files from starting
+func (client *S3Client) UploadFilesWithContext(ctx context.Context, filePaths []string, partSize int64) error {
+	keys, err := client.PlanKeys(filePaths)
+	if err != nil {
+		return err
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	concurrency := client.effectiveConcurrency(uploadConcurrency, effectivePartSize(0, partSize))
+	// 同时上传的文件平分内存预算，各自的分段并发数据此再降低
+	perFile := *client
+	if client.memoryBudget > 0 {
+		perFile.memoryBudget = client.memoryBudget / int64(concurrency)
+	}
+	tasks := make([]func() error, len(sorted))
+	for i, key := range sorted {
+		filePath := keys[key]
+		tasks[i] = func() error {
+			return perFile.UploadFileWithContext(ctx, filePath, partSize)
+		}
+	}
+	return pool.RunSlice(ctx, concurrency, tasks)
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// clientOptions holds the settings NewS3Client accepts beyond the required
+// arguments
+type clientOptions struct {
+	sessionToken string
+	disableSSL   bool
+	httpClient   *http.Client
+}
+
+// ClientOption customizes a client created by NewS3Client
+type ClientOption func(*clientOptions)
+
+// WithSessionToken adds a session token to the static credentials, as issued
+// by STS alongside temporary access keys.
+func WithSessionToken(token string) ClientOption {
+	return func(o *clientOptions) {
+		o.sessionToken = token
+	}
+}
+
+// WithDisableSSL talks plain HTTP to endpoints given without a scheme, for
+// MinIO deployments that do not terminate TLS.
+func WithDisableSSL() ClientOption {
+	return func(o *clientOptions) {
+		o.disableSSL = true
+	}
+}
+
+// WithHTTPClient makes the client send requests through httpClient instead
+// of its own. Close still closes the idle connections of httpClient.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(o *clientOptions) {
+		o.httpClient = httpClient
+	}
+}
+
+// WithInsecureSkipVerify accepts any TLS certificate the endpoint presents,
+// for MinIO behind a self-signed certificate. Do not use it against endpoints
+// reached over untrusted networks.
+func WithInsecureSkipVerify() ClientOption {
+	return func(o *clientOptions) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		o.httpClient = &http.Client{Transport: transport}
+	}
+}
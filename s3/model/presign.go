@@ -0,0 +1,46 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxPresignExpiry is the longest lifetime S3 accepts for a SigV4 presigned URL
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// PresignGet returns a URL that downloads the object with a plain HTTP GET
+// until expiry has passed, without the caller holding any credentials.
+func (client *S3Client) PresignGet(key string, expiry time.Duration) (string, error) {
+	req, _ := client.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(client.bucket),
+		Key:    aws.String(key),
+	})
+	return presign(req, expiry)
+}
+
+// PresignPut returns a URL that uploads the request body to the object with
+// a plain HTTP PUT until expiry has passed. The upload is a single PUT, so it
+// is limited to 5GB.
+func (client *S3Client) PresignPut(key string, expiry time.Duration) (string, error) {
+	req, _ := client.svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(client.bucket),
+		Key:    aws.String(key),
+	})
+	return presign(req, expiry)
+}
+
+// presign signs req for expiry, which must be positive and at most 7 days
+func presign(req *request.Request, expiry time.Duration) (string, error) {
+	if expiry <= 0 || expiry > maxPresignExpiry {
+		return "", fmt.Errorf("invalid presign expiry %v: must be between 0 and %v", expiry, maxPresignExpiry)
+	}
+	url, err := req.Presign(expiry)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign request: %v", err)
+	}
+	return url, nil
+}
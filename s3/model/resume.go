@@ -0,0 +1,142 @@
+package model
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// defaultResumeThreshold is the file size above which UploadFile uses
+// ResumableUploadFile unless SetResumeThreshold says otherwise
+const defaultResumeThreshold = 100 * 1024 * 1024
+
+// SetResumeThreshold sets the file size above which UploadFile uploads with
+// ResumableUploadFile. 0 restores the 100MB default; a negative value always
+// uses the non-resumable multipart path.
+func (client *S3Client) SetResumeThreshold(threshold int64) {
+	client.resumeThreshold = threshold
+}
+
+// resumable reports whether a file of size bytes should use the resumable path
+func (client *S3Client) resumable(size int64) bool {
+	threshold := client.resumeThreshold
+	if threshold == 0 {
+		threshold = defaultResumeThreshold
+	}
+	return threshold > 0 && size > threshold
+}
+
+// ResumableUploadFile uploads a file with a multipart upload that survives
+// interruption. A failed upload is left in place instead of being aborted;
+// running it again for the same key finds the pending upload, keeps every
+// part whose size and MD5 still match the local file, and uploads only the
+// rest. Each part is retried on transient errors, and parts are uploaded
+// as concurrently as SetPartConcurrency allows.
+func (client *S3Client) ResumableUploadFile(filePath string, partSize int64) error {
+	return client.ResumableUploadFileWithContext(context.Background(), filePath, partSize)
+}
+
+// ResumableUploadFileWithContext is ResumableUploadFile with a context that
+// can cancel the upload; like any other failure, a cancelled upload is kept
+// so that it can be resumed
+func (client *S3Client) ResumableUploadFileWithContext(ctx context.Context, filePath string, partSize int64) error {
+	key := client.objectKey(filePath)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %v", err)
+	}
+	partSize = effectivePartSize(info.Size(), partSize)
+
+	uploadID, existing, err := client.findUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+	if uploadID == nil {
+		if uploadID, err = client.initMultipartUpload(ctx, key); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("resuming upload of %s: %d parts already uploaded\n", filePath, len(existing))
+	}
+
+	completedParts, err := client.uploadPartsFrom(ctx, file, key, uploadID, partSize, 1, existing)
+	if err != nil {
+		return fmt.Errorf("%w (upload %s kept, run again to resume)", err, aws.StringValue(uploadID))
+	}
+
+	if err := client.completeMultipartUpload(ctx, key, uploadID, completedParts); err != nil {
+		return err
+	}
+
+	fmt.Println("file uploaded successfully (resumable):", filePath)
+	return nil
+}
+
+// partMatches reports whether an uploaded part holds exactly chunk. Parts
+// uploaded without server-side encryption use the MD5 of their content as ETag.
+func partMatches(part *s3.Part, chunk []byte) bool {
+	if aws.Int64Value(part.Size) != int64(len(chunk)) {
+		return false
+	}
+	sum := md5.Sum(chunk)
+	return strings.Trim(aws.StringValue(part.ETag), `"`) == hex.EncodeToString(sum[:])
+}
+
+// findUpload returns the most recently initiated pending multipart upload for
+// key and its uploaded parts keyed by part number, or a nil ID if there is none
+func (client *S3Client) findUpload(ctx context.Context, key string) (*string, map[int64]*s3.Part, error) {
+	var latest *s3.MultipartUpload
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(client.bucket), Prefix: aws.String(key)}
+	for {
+		resp, err := client.svc.ListMultipartUploadsWithContext(ctx, input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+		for _, upload := range resp.Uploads {
+			if aws.StringValue(upload.Key) != key {
+				continue
+			}
+			if latest == nil || aws.TimeValue(upload.Initiated).After(aws.TimeValue(latest.Initiated)) {
+				latest = upload
+			}
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		input.KeyMarker = resp.NextKeyMarker
+		input.UploadIdMarker = resp.NextUploadIdMarker
+	}
+	if latest == nil {
+		return nil, nil, nil
+	}
+
+	parts := make(map[int64]*s3.Part)
+	partsInput := &s3.ListPartsInput{Bucket: aws.String(client.bucket), Key: aws.String(key), UploadId: latest.UploadId}
+	for {
+		resp, err := client.svc.ListPartsWithContext(ctx, partsInput)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		}
+		for _, part := range resp.Parts {
+			parts[aws.Int64Value(part.PartNumber)] = part
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		partsInput.PartNumberMarker = resp.NextPartNumberMarker
+	}
+	return latest.UploadId, parts, nil
+}
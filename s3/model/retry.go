@@ -0,0 +1,54 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// retryDelay is the base delay between attempts; it doubles after each failure
+var retryDelay = 2 * time.Second
+
+// retry calls fn until it succeeds, returns a non-transient error, or the
+// attempts are exhausted. The last error is returned. Waiting between
+// attempts stops early with ctx's error when ctx is done.
+func retry(ctx context.Context, attempts int, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		if i < attempts-1 {
+			fmt.Println("transient error, retrying:", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryDelay << uint(i)):
+			}
+		}
+	}
+	return err
+}
+
+// isTransient reports whether err is worth retrying: throttling, retryable
+// SDK errors, 5xx responses and network timeouts.
+func isTransient(err error) bool {
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return false
+}
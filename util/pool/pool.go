@@ -0,0 +1,65 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Run 用最多 concurrency 个协程执行 tasks 中的任务，直到 tasks 被关闭。
+// 任一任务出错或 ctx 被取消后不再开始新的任务（已开始的任务继续完成），
+// 剩余的任务会被取出并丢弃，发送方不会因此阻塞，但仍需负责关闭 tasks。
+// 返回第一个任务错误；没有任务出错但因 ctx 取消跳过了任务时返回 ctx.Err()
+func Run(ctx context.Context, concurrency int, tasks <-chan func() error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		once     sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+		skipped  atomic.Bool
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				if ctx.Err() != nil {
+					skipped.Store(true)
+					continue
+				}
+				if err := task(); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if skipped.Load() {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// RunSlice 用 Run 执行一组已知的任务
+func RunSlice(ctx context.Context, concurrency int, tasks []func() error) error {
+	ch := make(chan func() error)
+	go func() {
+		defer close(ch)
+		for _, task := range tasks {
+			ch <- task
+		}
+	}()
+	return Run(ctx, concurrency, ch)
+}
@@ -0,0 +1,91 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRunBoundsConcurrency 测试同时运行的任务数不超过 concurrency，且所有任务都被执行
+func TestRunBoundsConcurrency(t *testing.T) {
+	var running, peak, ran int32
+	tasks := make([]func() error, 20)
+	for i := range tasks {
+		tasks[i] = func() error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}
+	}
+
+	assert.NoError(t, RunSlice(context.Background(), 3, tasks))
+	assert.Equal(t, int32(20), ran)
+	assert.LessOrEqual(t, peak, int32(3))
+	assert.Greater(t, peak, int32(1))
+}
+
+// TestRunFirstError 测试返回第一个错误，之后的任务不再执行，发送方也不会阻塞
+func TestRunFirstError(t *testing.T) {
+	errFirst := errors.New("first")
+	var ran int32
+	tasks := make(chan func() error)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		defer close(tasks)
+		for i := 0; i < 10; i++ {
+			i := i
+			tasks <- func() error {
+				atomic.AddInt32(&ran, 1)
+				switch i {
+				case 1:
+					return errFirst
+				case 2:
+					return errors.New("second")
+				}
+				return nil
+			}
+		}
+	}()
+
+	err := Run(context.Background(), 1, tasks)
+	assert.ErrorIs(t, err, errFirst)
+	assert.Equal(t, int32(2), ran)
+	<-sent
+}
+
+// TestRunCancel 测试 ctx 取消后不再开始新的任务并返回取消原因
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ran int32
+	tasks := make([]func() error, 10)
+	for i := range tasks {
+		tasks[i] = func() error {
+			if atomic.AddInt32(&ran, 1) == 3 {
+				cancel()
+			}
+			return nil
+		}
+	}
+
+	err := RunSlice(ctx, 1, tasks)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(3), ran)
+
+	// 所有任务都完成后不报告错误
+	assert.NoError(t, RunSlice(context.Background(), 2, tasks[:1]))
+}